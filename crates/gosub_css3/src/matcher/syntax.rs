@@ -907,6 +907,65 @@ mod tests {
         assert!(!defs.is_empty());
     }
 
+    /// Grammars in the generated definitions that are known not to be value definition
+    /// syntax, with the reason they are skipped.
+    const UNCOMPILABLE_GRAMMARS: [(&str, &str); 3] = [
+        // MDN marks a footnote with a dagger: `'+'?† n`
+        ("<an+b>", "'+'?†"),
+        // An open-ended list written as a literal `...`
+        ("<event-trigger-event>", "| ..."),
+        // The @font-feature-values "descriptors" are nested blocks: `@swash { <declaration-list> }`
+        ("@font-feature-values", "{ <declaration-list> }"),
+    ];
+
+    #[test]
+    fn test_compile_all_generated_grammars() {
+        // Every grammar tools/generate_definitions emits (properties, value types and
+        // at-rule descriptors) must compile here; a failure is a malformed merge or an
+        // upstream data error that the generator let through.
+        let json: serde_json::Value =
+            serde_json::from_str(include_str!("../../resources/definitions/definitions.json")).unwrap();
+
+        let mut grammars: Vec<(String, String)> = Vec::new();
+        for key in ["properties", "values"] {
+            for entry in json[key].as_array().unwrap() {
+                grammars.push((
+                    entry["name"].as_str().unwrap().to_string(),
+                    entry["syntax"].as_str().unwrap().to_string(),
+                ));
+            }
+        }
+        for at_rule in json["atrules"].as_array().unwrap() {
+            let at_rule_name = at_rule["name"].as_str().unwrap();
+            for descriptor in at_rule["descriptors"].as_array().unwrap() {
+                grammars.push((
+                    format!("{at_rule_name} {}", descriptor["name"].as_str().unwrap()),
+                    descriptor["syntax"].as_str().unwrap().to_string(),
+                ));
+            }
+        }
+
+        let failures: Vec<String> = grammars
+            .iter()
+            .filter(|(name, syntax)| {
+                !UNCOMPILABLE_GRAMMARS
+                    .iter()
+                    .any(|(known, marker)| name.starts_with(known) && syntax.contains(marker))
+            })
+            .filter_map(|(name, syntax)| match CssSyntax::new(syntax).compile() {
+                Ok(_) => None,
+                Err(e) => Some(format!("{name}: {syntax:?}: {e:?}")),
+            })
+            .collect();
+
+        assert!(
+            failures.is_empty(),
+            "{} generated grammars do not compile:\n{}",
+            failures.len(),
+            failures.join("\n")
+        );
+    }
+
     #[test]
     fn test_generic() {
         let parts = CssSyntax::new("ease-in").compile();
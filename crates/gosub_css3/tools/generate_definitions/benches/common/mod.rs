@@ -0,0 +1,60 @@
+//! The synthetic spec set the decode benchmarks run over.
+
+use generate_definitions::generator::Options;
+use generate_definitions::webref::WebRefLocation;
+use serde_json::json;
+use std::fs;
+use std::path::Path;
+
+/// Writes a local checkout of `spec_files` synthetic spec extracts with
+/// `properties` properties each under `root`, and returns the options for an
+/// offline run over it from webref alone. The checkout is read from disk on
+/// every run, so every run after the first reads from a warm page cache.
+pub fn synthetic_checkout(root: &Path, spec_files: usize, properties: usize) -> Options {
+    let extracts = root.join("webref/ed/css");
+    fs::create_dir_all(&extracts).unwrap();
+    for spec in 0..spec_files {
+        let properties: Vec<_> = (0..properties)
+            .map(|i| {
+                json!({
+                    "name": format!("synthetic-{spec}-{i}"),
+                    "value": "[ <length-percentage> | auto ]{1,4} | <synthetic-{spec}-value>",
+                    "initial": "auto",
+                    "inherited": "no",
+                    "appliesTo": "all elements",
+                    "computedValue": "as specified",
+                    "animationType": "by computed value type"
+                })
+            })
+            .collect();
+        let extract = json!({
+            "spec": {
+                "title": format!("Synthetic {spec}"),
+                "url": format!("https://example.org/synthetic-{spec}/")
+            },
+            "properties": properties,
+            "values": [{
+                "name": format!("<synthetic-{spec}-value>"),
+                "type": "type",
+                "value": "none | <integer> | <string>"
+            }]
+        });
+        // A name ending in a digit would be skipped as a versioned snapshot.
+        let name = format!("css-synthetic-{spec}-draft.json");
+        fs::write(extracts.join(name), extract.to_string()).unwrap();
+    }
+
+    Options {
+        offline: true,
+        dry_run: true,
+        mdn: false,
+        decode_cache: false,
+        webref: WebRefLocation {
+            checkout: Some(root.join("webref")),
+            ..Options::default().webref
+        },
+        cache_dir: root.join("cache"),
+        overrides: None,
+        ..Default::default()
+    }
+}
@@ -0,0 +1,34 @@
+mod common;
+
+use criterion::{criterion_group, criterion_main, BenchmarkId, Criterion};
+use generate_definitions::generator::{generate, Options};
+use std::thread;
+
+/// Synthetic spec files in the checkout, and properties in each, so decoding
+/// them dominates the run the way it does for the real spec set.
+const SPEC_FILES: usize = 200;
+const PROPERTIES_PER_SPEC: usize = 150;
+
+fn criterion_benchmark(c: &mut Criterion) {
+    let root = tempfile::tempdir().unwrap();
+    let options = common::synthetic_checkout(root.path(), SPEC_FILES, PROPERTIES_PER_SPEC);
+
+    // One worker decodes every file in turn, as the serialized decode did;
+    // the default is one worker per CPU.
+    let cpus = thread::available_parallelism().map_or(1, |n| n.get());
+    let mut group = c.benchmark_group("Decode");
+    group.sample_size(20);
+    for threads in [1, cpus] {
+        let options = Options {
+            threads: Some(threads),
+            ..options.clone()
+        };
+        group.bench_with_input(BenchmarkId::new("threads", threads), &options, |b, options| {
+            b.iter(|| generate(options).unwrap());
+        });
+    }
+    group.finish();
+}
+
+criterion_group!(benches, criterion_benchmark);
+criterion_main!(benches);
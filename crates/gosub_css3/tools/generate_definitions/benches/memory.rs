@@ -0,0 +1,57 @@
+//! Peak resident memory of a run by number of decode workers. The peak only
+//! ever grows within a process, so every setting is measured in a child
+//! process of its own. Linux only, where the peak can be read.
+
+mod common;
+
+use generate_definitions::generator::{generate, Options};
+use generate_definitions::timing::peak_resident_bytes;
+use std::env;
+use std::process::Command;
+use std::thread;
+
+/// Large enough that the decoded spec set dwarfs everything else a run holds.
+const SPEC_FILES: usize = 200;
+const PROPERTIES_PER_SPEC: usize = 1000;
+
+/// Set in a child process to the number of workers it runs with.
+const THREADS_VAR: &str = "GENERATE_DEFINITIONS_BENCH_THREADS";
+
+fn main() {
+    if let Ok(threads) = env::var(THREADS_VAR) {
+        run(threads.parse().unwrap());
+        return;
+    }
+
+    // With as many workers as spec files, the bounded channels hold every
+    // decoded file before the merge, as the all-at-once decode did.
+    let cpus = thread::available_parallelism().map_or(1, |n| n.get());
+    for threads in [1, cpus, SPEC_FILES] {
+        let output = Command::new(env::current_exe().unwrap())
+            .env(THREADS_VAR, threads.to_string())
+            .output()
+            .unwrap();
+        assert!(output.status.success(), "{}", String::from_utf8_lossy(&output.stderr));
+        print!("threads/{threads}: {}", String::from_utf8_lossy(&output.stdout));
+    }
+}
+
+fn run(threads: usize) {
+    let root = tempfile::tempdir().unwrap();
+    let options = common::synthetic_checkout(root.path(), SPEC_FILES, PROPERTIES_PER_SPEC);
+    // Writing the checkout is not part of the run; start from its peak.
+    let before = peak_resident_bytes().unwrap_or_default();
+    generate(&Options {
+        threads: Some(threads),
+        ..options
+    })
+    .unwrap();
+    match peak_resident_bytes() {
+        Some(peak) => println!(
+            "peak resident {:.1} MiB, {:.1} MiB over the setup",
+            peak as f64 / 1048576.0,
+            peak.saturating_sub(before) as f64 / 1048576.0
+        ),
+        None => println!("peak resident set unavailable"),
+    }
+}
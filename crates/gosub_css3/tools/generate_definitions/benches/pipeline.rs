@@ -0,0 +1,71 @@
+use criterion::{criterion_group, criterion_main, Criterion};
+use generate_definitions::generator::{generate, Options};
+use generate_definitions::webref::WebRefLocation;
+use serde_json::json;
+use std::fs;
+use std::path::Path;
+
+/// Synthetic properties added to the fixtures, so the passes that look
+/// names up run over data the size of a real run.
+const SYNTHETIC_PROPERTIES: usize = 2000;
+
+fn criterion_benchmark(c: &mut Criterion) {
+    let golden = Path::new(concat!(env!("CARGO_MANIFEST_DIR"), "/testdata/golden"));
+    let root = tempfile::tempdir().unwrap();
+
+    // A checkout of the fixture extracts plus one large synthetic spec.
+    let extracts = root.path().join("webref/ed/css");
+    fs::create_dir_all(&extracts).unwrap();
+    for entry in fs::read_dir(golden.join("webref")).unwrap() {
+        let path = entry.unwrap().path();
+        fs::copy(&path, extracts.join(path.file_name().unwrap())).unwrap();
+    }
+    let properties: Vec<_> = (0..SYNTHETIC_PROPERTIES)
+        .map(|i| {
+            json!({
+                "name": format!("synthetic-{i}"),
+                "value": "<length-percentage> | auto",
+                "initial": "auto",
+                "inherited": "no"
+            })
+        })
+        .collect();
+    let synthetic = json!({
+        "spec": {"title": "Synthetic", "url": "https://example.org/synthetic/"},
+        "properties": properties
+    });
+    fs::write(extracts.join("css-synthetic.json"), synthetic.to_string()).unwrap();
+
+    // Offline, MDN's files can only come from the cache.
+    let cache_dir = root.path().join("cache");
+    fs::create_dir_all(cache_dir.join("mdn")).unwrap();
+    for name in ["properties.json", "syntaxes.json"] {
+        fs::copy(golden.join("mdn").join(name), cache_dir.join("mdn").join(name)).unwrap();
+    }
+
+    // A dry run leaves the cache as it is, so every iteration does the same
+    // work.
+    let options = Options {
+        offline: true,
+        dry_run: true,
+        validate_initial: true,
+        decode_cache: false,
+        webref: WebRefLocation {
+            checkout: Some(root.path().join("webref")),
+            ..Options::default().webref
+        },
+        cache_dir,
+        overrides: None,
+        ..Default::default()
+    };
+
+    let mut group = c.benchmark_group("Pipeline");
+    group.sample_size(20);
+    group.bench_function("generate", |b| {
+        b.iter(|| generate(&options).unwrap());
+    });
+    group.finish();
+}
+
+criterion_group!(benches, criterion_benchmark);
+criterion_main!(benches);
@@ -0,0 +1,448 @@
+//! Legacy property aliases (`word-wrap` → `overflow-wrap`), as declared by
+//! webref's `legacyAliasOf`, and the `resolve-alias` debugging subcommand.
+
+use crate::types::{add_source, Data, PropAlias, ReverseAlias};
+use crate::webref::{canonical_name, WebRefProperty};
+use anyhow::{bail, Result};
+use log::{info, warn};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write;
+
+/// What becomes of a legacy alias whose property is not collected
+/// (`font-stretch` without `font-width`). It is never exported as an alias
+/// of a missing property.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum MissingTarget {
+    /// Add the property, copied from the alias, when the alias has a syntax
+    #[default]
+    Synthesize,
+    /// Keep the alias as a property of its own, without an alias entry
+    Standalone,
+    /// Drop the alias property too
+    Drop,
+}
+
+/// Maps an alias name to the property it stands for.
+#[derive(Debug, Default, Clone)]
+pub struct PropertyAliasTable {
+    aliases: BTreeMap<String, String>,
+}
+
+impl PropertyAliasTable {
+    pub fn from_webref(properties: &[WebRefProperty]) -> Self {
+        PropertyAliasTable {
+            aliases: properties
+                .iter()
+                .filter(|p| !p.legacy_alias_of.is_empty())
+                .map(|p| (p.name.clone(), p.legacy_alias_of.clone()))
+                .collect(),
+        }
+    }
+
+    /// Returns the property `name` is a direct alias of. `name` is looked up
+    /// in canonical form, like the names in the table.
+    pub fn get_alias(&self, name: &str) -> Option<&str> {
+        self.aliases.get(canonical_name(name).as_ref()).map(String::as_str)
+    }
+
+    /// Follows aliases from `name` until reaching a name that is not an alias
+    /// itself. The chain starts with `name` and ends with the resolved name.
+    pub fn chain(&self, name: &str) -> Result<Vec<String>> {
+        let mut chain = vec![canonical_name(name).into_owned()];
+        while let Some(target) = self.get_alias(chain[chain.len() - 1].as_str()) {
+            if chain.iter().any(|n| n == target) {
+                bail!("alias cycle: {} -> {target}", chain.join(" -> "));
+            }
+            chain.push(target.to_string());
+        }
+        Ok(chain)
+    }
+
+    /// The alias cycles in the table, such as `a -> b -> a` or a name that is
+    /// an alias of itself. None of their aliases resolve. Each cycle is listed
+    /// once, starting from its smallest name; aliases that only lead into a
+    /// cycle are not part of it.
+    pub fn cycles(&self) -> Vec<Vec<String>> {
+        let mut cycles = BTreeSet::new();
+        for name in self.aliases.keys() {
+            let mut chain = vec![name.as_str()];
+            while let Some(target) = self.get_alias(chain[chain.len() - 1]) {
+                if let Some(start) = chain.iter().position(|n| *n == target) {
+                    let mut cycle: Vec<String> = chain[start..].iter().map(|n| n.to_string()).collect();
+                    if let Some(smallest) = cycle.iter().enumerate().min_by_key(|(_, n)| *n).map(|(i, _)| i) {
+                        cycle.rotate_left(smallest);
+                    }
+                    cycles.insert(cycle);
+                    break;
+                }
+                chain.push(target);
+            }
+        }
+        cycles.into_iter().collect()
+    }
+
+    /// The other direction: every property aliases resolve to, with the
+    /// aliases (through chains too) that resolve to it, sorted. Aliases in a
+    /// cycle are left out.
+    pub fn reverse_aliases(&self) -> BTreeMap<String, Vec<String>> {
+        let mut reverse: BTreeMap<String, Vec<String>> = BTreeMap::new();
+        for name in self.aliases.keys() {
+            if let Some(target) = self.chain(name).ok().and_then(|mut chain| chain.pop()) {
+                reverse.entry(target).or_default().push(name.clone());
+            }
+        }
+        reverse
+    }
+}
+
+/// Resolves every alias in `table` to its final property, skipping (with a
+/// warning) aliases whose target is not a collected property.
+pub fn prop_aliases(table: &PropertyAliasTable, data: &Data) -> Vec<PropAlias> {
+    let index = data.index();
+    let mut aliases = Vec::new();
+    for name in table.aliases.keys() {
+        let target = match table.chain(name) {
+            Ok(mut chain) => chain.pop().unwrap_or_default(),
+            Err(e) => {
+                warn!("Skipping alias {name}: {e}");
+                continue;
+            }
+        };
+        if index.property(&target).is_none() {
+            warn!("Skipping alias {name}: {target} is not a collected property");
+            continue;
+        }
+        aliases.push(PropAlias {
+            name: name.clone(),
+            property: target,
+        });
+    }
+    aliases
+}
+
+/// The reverse aliases of the collected properties, for serializing a
+/// property under its legacy spellings. Unresolvable aliases are left out,
+/// like in `prop_aliases`.
+pub fn reverse_aliases(table: &PropertyAliasTable, data: &Data) -> Vec<ReverseAlias> {
+    let index = data.index();
+    table
+        .reverse_aliases()
+        .into_iter()
+        .filter(|(property, _)| index.property(property).is_some())
+        .map(|(property, aliases)| ReverseAlias { property, aliases })
+        .collect()
+}
+
+/// Lets an alias and the property it resolves to share a grammar: when one
+/// of the two has an empty syntax, it borrows the other's, along with its
+/// sources. A property only collected under its alias (`-webkit-appearance`
+/// without `appearance`) is handled by `missing`. When both have a syntax
+/// and they differ, both are kept, with a warning. Returns how many syntaxes
+/// were borrowed.
+pub fn share_syntaxes(table: &PropertyAliasTable, data: &mut Data, missing: MissingTarget) -> usize {
+    // Every collected alias and its target, by position in `properties`.
+    let pairs: Vec<(&String, String, usize, Option<usize>)> = {
+        let index = data.index();
+        table
+            .aliases
+            .keys()
+            .filter_map(|name| {
+                let target = table.chain(name).ok().and_then(|mut chain| chain.pop())?;
+                let alias = index.property_position(name)?;
+                let standard = index.property_position(&target);
+                Some((name, target, alias, standard))
+            })
+            .collect()
+    };
+
+    let mut shared = 0;
+    let mut dropped = Vec::new();
+    // Targets added below, so another alias of the same target finds them.
+    let mut added: BTreeMap<String, usize> = BTreeMap::new();
+    for (name, target, alias, standard) in pairs {
+        let Some(standard) = standard.or_else(|| added.get(&target).copied()) else {
+            match missing {
+                MissingTarget::Synthesize if !data.properties[alias].syntax.is_empty() => {
+                    info!("{target} is only collected as its alias {name}; adding it with the alias's syntax");
+                    let mut property = data.properties[alias].clone();
+                    property.name = target.clone();
+                    property.mdn_url.clear();
+                    added.insert(target, data.properties.len());
+                    data.properties.push(property);
+                    shared += 1;
+                }
+                MissingTarget::Drop => {
+                    warn!("Dropping property {name}: it is an alias of {target}, which is not collected");
+                    dropped.push(name.clone());
+                }
+                // Left out of the exported aliases, with a warning.
+                MissingTarget::Synthesize | MissingTarget::Standalone => {}
+            }
+            continue;
+        };
+
+        let (from, to) = match (
+            data.properties[alias].syntax.is_empty(),
+            data.properties[standard].syntax.is_empty(),
+        ) {
+            (false, true) => (alias, standard),
+            (true, false) => (standard, alias),
+            (false, false) => {
+                let (a, s) = (&data.properties[alias].syntax, &data.properties[standard].syntax);
+                if !a.split_whitespace().eq(s.split_whitespace()) {
+                    warn!("Alias {name} has syntax `{a}`, but {target} has `{s}`");
+                }
+                continue;
+            }
+            (true, true) => continue,
+        };
+        let donor = data.properties[from].clone();
+        let property = &mut data.properties[to];
+        info!("{} has no syntax; borrowing {}'s", property.name, donor.name);
+        property.syntax = donor.syntax;
+        for source in &donor.sources {
+            add_source(&mut property.sources, source);
+        }
+        shared += 1;
+    }
+    data.properties.retain(|p| !dropped.contains(&p.name));
+    shared
+}
+
+/// Describes how `name` resolves: its alias chain and the resolved property's
+/// syntax. Fails when `name` is not an alias or the target is not a collected
+/// property.
+pub fn resolve(table: &PropertyAliasTable, data: &Data, name: &str) -> Result<String> {
+    let chain = table.chain(name)?;
+    if chain.len() == 1 {
+        bail!("{name} is not an alias");
+    }
+
+    let target = &chain[chain.len() - 1];
+    let Some(property) = data.index().property(target) else {
+        bail!(
+            "{} resolves to {target}, which is not a collected property",
+            chain.join(" -> ")
+        );
+    };
+
+    let mut out = String::new();
+    writeln!(out, "{}", chain.join(" -> "))?;
+    writeln!(out, "syntax: {}", property.syntax)?;
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{Property, Source};
+
+    fn alias(name: &str, of: &str) -> WebRefProperty {
+        WebRefProperty {
+            name: name.to_string(),
+            legacy_alias_of: of.to_string(),
+            ..Default::default()
+        }
+    }
+
+    fn data_with(name: &str, syntax: &str) -> Data {
+        Data {
+            properties: vec![Property {
+                name: name.to_string(),
+                syntax: syntax.to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn resolves_through_the_chain() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("-webkit-word-wrap", "word-wrap"),
+            alias("word-wrap", "overflow-wrap"),
+            WebRefProperty {
+                name: "overflow-wrap".to_string(),
+                ..Default::default()
+            },
+        ]);
+        let data = data_with("overflow-wrap", "normal | break-word | anywhere");
+
+        assert_eq!(table.get_alias("word-wrap"), Some("overflow-wrap"));
+        assert_eq!(table.get_alias("overflow-wrap"), None);
+        assert_eq!(
+            resolve(&table, &data, "-webkit-word-wrap").unwrap(),
+            "-webkit-word-wrap -> word-wrap -> overflow-wrap\nsyntax: normal | break-word | anywhere\n"
+        );
+    }
+
+    #[test]
+    fn reports_missing_alias_target_and_cycles() {
+        let table = PropertyAliasTable::from_webref(&[alias("a", "b"), alias("b", "a"), alias("c", "gone")]);
+        let data = data_with("d", "auto");
+
+        assert!(resolve(&table, &data, "d").is_err());
+        assert!(resolve(&table, &data, "c").is_err());
+        assert!(resolve(&table, &data, "a").is_err());
+    }
+
+    #[test]
+    fn cycles_are_found_once_each() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("b", "a"),
+            alias("a", "b"),
+            alias("c", "a"),
+            alias("self", "self"),
+            alias("word-wrap", "overflow-wrap"),
+        ]);
+
+        assert_eq!(
+            table.cycles(),
+            [vec!["a".to_string(), "b".to_string()], vec!["self".to_string()]]
+        );
+        assert!(PropertyAliasTable::from_webref(&[alias("word-wrap", "overflow-wrap")])
+            .cycles()
+            .is_empty());
+    }
+
+    #[test]
+    fn exports_resolved_aliases_only() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("-webkit-word-wrap", "word-wrap"),
+            alias("word-wrap", "overflow-wrap"),
+            alias("stale", "gone"),
+        ]);
+        let data = data_with("overflow-wrap", "normal | break-word | anywhere");
+
+        let resolved = |name: &str| PropAlias {
+            name: name.to_string(),
+            property: "overflow-wrap".to_string(),
+        };
+        assert_eq!(
+            prop_aliases(&table, &data),
+            [resolved("-webkit-word-wrap"), resolved("word-wrap")]
+        );
+    }
+
+    #[test]
+    fn an_empty_syntax_is_borrowed_across_the_alias() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("-webkit-appearance", "appearance"),
+            alias("-webkit-mask", "mask"),
+            alias("-webkit-box-flex", "box-flex"),
+            alias("-webkit-transform", "transform"),
+        ]);
+        let with_source = |name: &str, syntax: &str, shortname: &str| {
+            let mut property = data_with(name, syntax).properties.remove(0);
+            property.sources.push(Source {
+                shortname: shortname.to_string(),
+                ..Default::default()
+            });
+            property
+        };
+        let mut data = Data {
+            properties: vec![
+                // The alias has the grammar
+                with_source("-webkit-appearance", "none | auto | <compat-auto>", "css-ui-4"),
+                with_source("appearance", "", "mdn-properties"),
+                // The standard property has it
+                with_source("-webkit-mask", "", "mdn-properties"),
+                with_source("mask", "<mask-layer>#", "css-masking-1"),
+                // Only the alias is collected
+                with_source("-webkit-box-flex", "<number>", "mdn-properties"),
+                // Both have one; they are left as they are
+                with_source("-webkit-transform", "none | <transform-list>", "mdn-properties"),
+                with_source("transform", "none | <transform-list> | auto", "css-transforms-1"),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(share_syntaxes(&table, &mut data, MissingTarget::Synthesize), 3);
+
+        let property = |name: &str| {
+            let p = data.properties.iter().find(|p| p.name == name).unwrap();
+            let sources: Vec<&str> = p.sources.iter().map(|s| s.shortname.as_str()).collect();
+            (p.syntax.as_str(), sources)
+        };
+        assert_eq!(
+            property("appearance"),
+            ("none | auto | <compat-auto>", vec!["mdn-properties", "css-ui-4"])
+        );
+        assert_eq!(
+            property("-webkit-mask"),
+            ("<mask-layer>#", vec!["mdn-properties", "css-masking-1"])
+        );
+        assert_eq!(property("box-flex"), ("<number>", vec!["mdn-properties"]));
+        assert_eq!(property("-webkit-transform").0, "none | <transform-list>");
+        assert_eq!(property("transform").0, "none | <transform-list> | auto");
+    }
+
+    #[test]
+    fn an_alias_of_a_missing_property_is_synthesized_kept_or_dropped() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("font-stretch", "font-width"),
+            alias("-webkit-transform", "transform"),
+        ]);
+        let collected = || Data {
+            properties: [
+                data_with("font-stretch", "<font-width-css3>"),
+                data_with("-webkit-transform", "none | <transform-list>"),
+                data_with("transform", "none | <transform-list>"),
+            ]
+            .into_iter()
+            .flat_map(|d| d.properties)
+            .collect(),
+            ..Default::default()
+        };
+        let run = |missing| {
+            let mut data = collected();
+            share_syntaxes(&table, &mut data, missing);
+            let mut names: Vec<String> = data.properties.iter().map(|p| p.name.clone()).collect();
+            names.sort();
+            let aliases: Vec<String> = prop_aliases(&table, &data).into_iter().map(|a| a.name).collect();
+            (names, aliases)
+        };
+
+        // The alias of a present property is exported whatever the choice.
+        let (names, aliases) = run(MissingTarget::Synthesize);
+        assert_eq!(names, ["-webkit-transform", "font-stretch", "font-width", "transform"]);
+        assert_eq!(aliases, ["-webkit-transform", "font-stretch"]);
+
+        let (names, aliases) = run(MissingTarget::Standalone);
+        assert_eq!(names, ["-webkit-transform", "font-stretch", "transform"]);
+        assert_eq!(aliases, ["-webkit-transform"]);
+
+        let (names, aliases) = run(MissingTarget::Drop);
+        assert_eq!(names, ["-webkit-transform", "transform"]);
+        assert_eq!(aliases, ["-webkit-transform"]);
+    }
+
+    #[test]
+    fn reverse_aliases_list_the_legacy_spellings_of_a_property() {
+        let table = PropertyAliasTable::from_webref(&[
+            alias("-webkit-transform", "transform"),
+            alias("-webkit-word-wrap", "word-wrap"),
+            alias("word-wrap", "overflow-wrap"),
+            alias("a", "b"),
+            alias("b", "a"),
+        ]);
+
+        assert_eq!(
+            table.reverse_aliases(),
+            BTreeMap::from([
+                (
+                    "overflow-wrap".to_string(),
+                    vec!["-webkit-word-wrap".to_string(), "word-wrap".to_string()]
+                ),
+                ("transform".to_string(), vec!["-webkit-transform".to_string()]),
+            ])
+        );
+        assert_eq!(
+            reverse_aliases(&table, &data_with("transform", "none | <transform-list>")),
+            [ReverseAlias {
+                property: "transform".to_string(),
+                aliases: vec!["-webkit-transform".to_string()],
+            }]
+        );
+    }
+}
@@ -0,0 +1,234 @@
+//! `--webref-archive`: a webref snapshot vendored as a tar (optionally
+//! gzipped) or zip archive, such as the ones GitHub serves for a ref. The
+//! spec extracts and the spec index are unpacked into a directory that is
+//! then read like a local checkout, so no network or full checkout is needed.
+
+use crate::spec_index;
+use anyhow::{bail, Context, Result};
+use flate2::read::GzDecoder;
+use log::info;
+use std::fs::{self, File};
+use std::io::{BufReader, Read, Seek};
+use std::path::Path;
+use zip::ZipArchive;
+
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+const ZIP_MAGIC: [u8; 4] = *b"PK\x03\x04";
+
+/// Unpacks the extracts in `locations` (and the spec index next to them) from
+/// `archive` into `dest`, replacing whatever `dest` held. The archive may
+/// wrap everything in one top-level directory, as GitHub's do
+/// (`webref-<ref>/ed/css/...`). Returns how many files were unpacked.
+pub fn unpack(archive: &Path, dest: &Path, locations: &[String]) -> Result<usize> {
+    let index_path = spec_index::index_path(locations);
+    let wanted = |path: &str| relative_path(path, locations, &index_path).map(str::to_string);
+    let entries = read_entries(archive, wanted).with_context(|| format!("reading archive {}", archive.display()))?;
+    if entries.is_empty() {
+        bail!("archive {} has no {} extracts", archive.display(), locations.join(", "));
+    }
+
+    if dest.exists() {
+        fs::remove_dir_all(dest).with_context(|| format!("clearing {}", dest.display()))?;
+    }
+    for (path, content) in &entries {
+        let path = dest.join(path);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("creating {}", parent.display()))?;
+        }
+        fs::write(&path, content).with_context(|| format!("writing {}", path.display()))?;
+    }
+    info!("Unpacked {} file(s) from {}", entries.len(), archive.display());
+    Ok(entries.len())
+}
+
+/// The path of an archive entry relative to the repository root, when it is
+/// a JSON file directly inside one of `locations` or the spec index. Entries
+/// may sit under one top-level directory.
+fn relative_path<'p>(path: &'p str, locations: &[String], index_path: &str) -> Option<&'p str> {
+    let path = path.trim_start_matches("./");
+    let unwrapped = path.split_once('/').map(|(_, rest)| rest);
+    [Some(path), unwrapped].into_iter().flatten().find(|candidate| {
+        *candidate == index_path
+            || candidate
+                .rsplit_once('/')
+                .is_some_and(|(dir, name)| name.ends_with(".json") && locations.iter().any(|location| location == dir))
+    })
+}
+
+/// The `wanted` entries of a tar, gzipped tar, or zip archive, by the path
+/// `wanted` maps them to.
+fn read_entries(archive: &Path, wanted: impl Fn(&str) -> Option<String>) -> Result<Vec<(String, Vec<u8>)>> {
+    let mut magic = [0; 4];
+    let read = File::open(archive)?.read(&mut magic)?;
+    let file = BufReader::new(File::open(archive)?);
+    if magic[..read].starts_with(&GZIP_MAGIC) {
+        tar_entries(GzDecoder::new(file), wanted)
+    } else if magic[..read] == ZIP_MAGIC {
+        zip_entries(file, wanted)
+    } else {
+        tar_entries(file, wanted)
+    }
+}
+
+/// The regular files of a tar stream. Long names in pax or GNU headers are
+/// resolved by the `tar` crate.
+fn tar_entries(reader: impl Read, wanted: impl Fn(&str) -> Option<String>) -> Result<Vec<(String, Vec<u8>)>> {
+    let mut entries = Vec::new();
+    for entry in tar::Archive::new(reader).entries()? {
+        let mut entry = entry?;
+        if !entry.header().entry_type().is_file() {
+            continue;
+        }
+        let Some(path) = wanted(&entry.path()?.to_string_lossy()) else {
+            continue;
+        };
+        let mut content = Vec::new();
+        entry
+            .read_to_end(&mut content)
+            .with_context(|| format!("reading {path}"))?;
+        entries.push((path, content));
+    }
+    Ok(entries)
+}
+
+/// The files of a zip archive.
+fn zip_entries(reader: impl Read + Seek, wanted: impl Fn(&str) -> Option<String>) -> Result<Vec<(String, Vec<u8>)>> {
+    let mut archive = ZipArchive::new(reader)?;
+    let mut entries = Vec::new();
+    for i in 0..archive.len() {
+        let mut file = archive.by_index(i)?;
+        if !file.is_file() {
+            continue;
+        }
+        let Some(path) = wanted(file.name()) else {
+            continue;
+        };
+        let mut content = Vec::new();
+        file.read_to_end(&mut content)
+            .with_context(|| format!("reading {path}"))?;
+        entries.push((path, content));
+    }
+    Ok(entries)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flate2::write::GzEncoder;
+    use flate2::Compression;
+    use std::io::{Cursor, Write};
+    use tar::{Builder, EntryType, Header};
+    use zip::write::SimpleFileOptions;
+    use zip::ZipWriter;
+
+    fn tar(entries: &[(&str, EntryType, &[u8])]) -> Vec<u8> {
+        let mut builder = Builder::new(Vec::new());
+        for (name, kind, content) in entries {
+            let mut header = Header::new_gnu();
+            header.set_entry_type(*kind);
+            header.set_size(content.len() as u64);
+            header.set_mode(0o644);
+            builder.append_data(&mut header, name, *content).unwrap();
+        }
+        builder.into_inner().unwrap()
+    }
+
+    fn unpacked(dest: &Path) -> Vec<(String, String)> {
+        let mut files = Vec::new();
+        for dir in ["ed", "ed/css"] {
+            for entry in fs::read_dir(dest.join(dir)).unwrap() {
+                let path = entry.unwrap().path();
+                if path.is_file() {
+                    let relative = path.strip_prefix(dest).unwrap().to_string_lossy().into_owned();
+                    files.push((relative, fs::read_to_string(&path).unwrap()));
+                }
+            }
+        }
+        files.sort();
+        files
+    }
+
+    #[test]
+    fn extracts_are_unpacked_from_a_gzipped_tar() {
+        let long_name = format!("webref-abc/ed/css/css-{}.json", "x".repeat(100));
+        let archive = tar(&[
+            // GitHub's archives start with the commit as a global header.
+            (
+                "pax_global_header",
+                EntryType::XGlobalHeader,
+                b"52 comment=0123456789abcdef0123456789abcdef01234567\n",
+            ),
+            ("webref-abc/", EntryType::Directory, b""),
+            (
+                "webref-abc/ed/css/css-a.json",
+                EntryType::Regular,
+                br#"{"properties": []}"#,
+            ),
+            ("webref-abc/ed/css/archive/css-old.json", EntryType::Regular, b"{}"),
+            ("webref-abc/ed/idl/dom.idl", EntryType::Regular, b"interface Node {};"),
+            ("webref-abc/ed/index.json", EntryType::Regular, br#"{"results": []}"#),
+            // Longer than a ustar name, so written with a GNU long-name entry.
+            (&long_name, EntryType::Regular, br#"{"values": []}"#),
+        ]);
+        let mut gz = GzEncoder::new(Vec::new(), Compression::default());
+        gz.write_all(&archive).unwrap();
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("webref-abc.tar.gz");
+        fs::write(&path, gz.finish().unwrap()).unwrap();
+        let dest = dir.path().join("unpacked");
+        fs::create_dir_all(dest.join("stale")).unwrap();
+
+        assert_eq!(unpack(&path, &dest, &["ed/css".to_string()]).unwrap(), 3);
+        assert_eq!(
+            unpacked(&dest),
+            [
+                ("ed/css/css-a.json".to_string(), r#"{"properties": []}"#.to_string()),
+                (
+                    format!("ed/css/css-{}.json", "x".repeat(100)),
+                    r#"{"values": []}"#.to_string()
+                ),
+                ("ed/index.json".to_string(), r#"{"results": []}"#.to_string()),
+            ]
+        );
+        assert!(!dest.join("stale").exists());
+    }
+
+    fn zip(entries: &[(&str, &[u8])]) -> Vec<u8> {
+        let mut writer = ZipWriter::new(Cursor::new(Vec::new()));
+        for (name, content) in entries {
+            writer.start_file(*name, SimpleFileOptions::default()).unwrap();
+            writer.write_all(content).unwrap();
+        }
+        writer.finish().unwrap().into_inner()
+    }
+
+    #[test]
+    fn extracts_are_unpacked_from_a_zip() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("webref.zip");
+        fs::write(
+            &path,
+            zip(&[
+                ("webref-abc/ed/css/css-a.json", br#"{"properties": []}"#),
+                ("webref-abc/ed/idl/dom.idl", b"interface Node {};"),
+            ]),
+        )
+        .unwrap();
+        let dest = dir.path().join("unpacked");
+
+        assert_eq!(unpack(&path, &dest, &["ed/css".to_string()]).unwrap(), 1);
+        assert_eq!(
+            fs::read_to_string(dest.join("ed/css/css-a.json")).unwrap(),
+            r#"{"properties": []}"#
+        );
+    }
+
+    #[test]
+    fn an_archive_without_extracts_is_an_error() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("other.tar");
+        fs::write(&path, tar(&[("README.md", EntryType::Regular, b"hello")])).unwrap();
+        assert!(unpack(&path, &dir.path().join("unpacked"), &["ed/css".to_string()]).is_err());
+    }
+}
@@ -0,0 +1,197 @@
+//! The changes between two `definitions.json` files, for the `diff`
+//! subcommand: a readable summary of what a webref or MDN update changed, to
+//! attach to the PR that bumps them instead of a diff of the whole document.
+
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::fs;
+use std::path::Path;
+
+/// The parts of a `definitions.json` document the changelog compares.
+#[derive(Debug, Default, Deserialize)]
+pub struct Definitions {
+    #[serde(default)]
+    properties: Vec<Entry>,
+    #[serde(default)]
+    values: Vec<Entry>,
+    #[serde(default)]
+    atrules: Vec<Entry>,
+    #[serde(default)]
+    selectors: Vec<Entry>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Entry {
+    name: String,
+    #[serde(default)]
+    syntax: String,
+}
+
+impl Definitions {
+    pub fn load(path: &Path) -> Result<Self> {
+        let body = fs::read(path).with_context(|| format!("reading {}", path.display()))?;
+        serde_json::from_slice(&body).with_context(|| format!("parsing {}", path.display()))
+    }
+}
+
+/// A grammar that differs between the two files.
+#[derive(Debug, PartialEq)]
+pub struct SyntaxChange {
+    pub name: String,
+    pub old: String,
+    pub new: String,
+}
+
+/// The changes to one kind of definition, each list sorted by name.
+#[derive(Debug, Default, PartialEq)]
+pub struct Section {
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    /// Only filled for kinds whose syntax is compared
+    pub changed: Vec<SyntaxChange>,
+}
+
+impl Section {
+    fn compare(old: &[Entry], new: &[Entry], syntaxes: bool) -> Self {
+        let old: BTreeMap<&str, &str> = old.iter().map(|e| (e.name.as_str(), e.syntax.as_str())).collect();
+        let new: BTreeMap<&str, &str> = new.iter().map(|e| (e.name.as_str(), e.syntax.as_str())).collect();
+
+        let mut section = Section {
+            added: new
+                .keys()
+                .filter(|name| !old.contains_key(*name))
+                .map(|name| name.to_string())
+                .collect(),
+            removed: old
+                .keys()
+                .filter(|name| !new.contains_key(*name))
+                .map(|name| name.to_string())
+                .collect(),
+            changed: Vec::new(),
+        };
+        if syntaxes {
+            for (name, old_syntax) in &old {
+                if let Some(new_syntax) = new.get(name).filter(|s| *s != old_syntax) {
+                    section.changed.push(SyntaxChange {
+                        name: name.to_string(),
+                        old: old_syntax.to_string(),
+                        new: new_syntax.to_string(),
+                    });
+                }
+            }
+        }
+        section
+    }
+
+    fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.changed.is_empty()
+    }
+}
+
+/// The changes between two generation runs. Properties and values are
+/// compared by syntax as well; at-rules and selectors only by name.
+#[derive(Debug, Default, PartialEq)]
+pub struct Changelog {
+    pub properties: Section,
+    pub values: Section,
+    pub atrules: Section,
+    pub selectors: Section,
+}
+
+impl Changelog {
+    pub fn compare(old: &Definitions, new: &Definitions) -> Self {
+        Changelog {
+            properties: Section::compare(&old.properties, &new.properties, true),
+            values: Section::compare(&old.values, &new.values, true),
+            atrules: Section::compare(&old.atrules, &new.atrules, false),
+            selectors: Section::compare(&old.selectors, &new.selectors, false),
+        }
+    }
+
+    /// The changes as plain text, under a heading per kind that changed:
+    /// `+` added, `-` removed, `~` a changed syntax followed by both versions.
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        let sections = [
+            ("Properties", &self.properties),
+            ("Values", &self.values),
+            ("At-rules", &self.atrules),
+            ("Selectors", &self.selectors),
+        ];
+        for (heading, section) in sections {
+            if section.is_empty() {
+                continue;
+            }
+            let _ = writeln!(
+                out,
+                "{heading} ({} added, {} removed, {} changed):",
+                section.added.len(),
+                section.removed.len(),
+                section.changed.len()
+            );
+            for name in &section.added {
+                let _ = writeln!(out, "  + {name}");
+            }
+            for name in &section.removed {
+                let _ = writeln!(out, "  - {name}");
+            }
+            for change in &section.changed {
+                let _ = writeln!(out, "  ~ {}", change.name);
+                let _ = writeln!(out, "      before: {}", change.old);
+                let _ = writeln!(out, "      after:  {}", change.new);
+            }
+        }
+        if out.is_empty() {
+            out.push_str("No changes\n");
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn definitions(json: &str) -> Definitions {
+        serde_json::from_str(json).unwrap()
+    }
+
+    #[test]
+    fn changes_are_grouped_by_kind_and_sorted() {
+        let old = definitions(
+            r#"{"schemaVersion": 4,
+                "properties": [{"name": "zoom", "syntax": "<number>"}, {"name": "margin", "syntax": "<length>{1,4}"}],
+                "values": [{"name": "<length>", "syntax": "<number>px"}],
+                "atrules": [{"name": "@page", "descriptors": []}],
+                "selectors": [{"name": ":hover"}]}"#,
+        );
+        let new = definitions(
+            r#"{"schemaVersion": 4,
+                "properties": [{"name": "margin", "syntax": "<length-percentage>{1,4}"},
+                               {"name": "anchor-name", "syntax": "none | <dashed-ident>#"}],
+                "values": [{"name": "<length>", "syntax": "<number>px"}],
+                "atrules": [{"name": "@page", "descriptors": []}, {"name": "@container", "descriptors": []}],
+                "selectors": [{"name": ":hover"}, {"name": ":has()", "arguments": "<relative-selector-list>"}]}"#,
+        );
+
+        let changelog = Changelog::compare(&old, &new);
+        assert!(changelog.values.is_empty());
+        assert_eq!(
+            changelog.render(),
+            "Properties (1 added, 1 removed, 1 changed):\n\
+             \x20 + anchor-name\n\
+             \x20 - zoom\n\
+             \x20 ~ margin\n\
+             \x20     before: <length>{1,4}\n\
+             \x20     after:  <length-percentage>{1,4}\n\
+             At-rules (1 added, 0 removed, 0 changed):\n\
+             \x20 + @container\n\
+             Selectors (1 added, 0 removed, 0 changed):\n\
+             \x20 + :has()\n"
+        );
+
+        assert_eq!(Changelog::compare(&new, &new).render(), "No changes\n");
+    }
+}
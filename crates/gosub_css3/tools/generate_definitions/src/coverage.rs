@@ -0,0 +1,69 @@
+//! Property coverage gaps between the two sources, for the `coverage`
+//! subcommand. A webref-only property gets no MDN metadata (`computed`,
+//! `initial`, ...) and is not exported as a property at all; an MDN-only
+//! property gets no spec grammar and falls back to MDN's syntax.
+
+use serde::Serialize;
+use std::collections::BTreeSet;
+use std::fmt::Write;
+
+/// Property names present in only one of the sources, sorted.
+#[derive(Debug, Default, PartialEq, Serialize)]
+pub struct Coverage {
+    pub webref_only: Vec<String>,
+    pub mdn_only: Vec<String>,
+}
+
+impl Coverage {
+    /// Compares the webref and MDN property names. Legacy aliases should be
+    /// left out of `webref`: they are exported as `propAliases` instead.
+    pub fn compare<'a>(webref: impl IntoIterator<Item = &'a str>, mdn: impl IntoIterator<Item = &'a str>) -> Self {
+        let webref: BTreeSet<&str> = webref.into_iter().collect();
+        let mdn: BTreeSet<&str> = mdn.into_iter().collect();
+        Coverage {
+            webref_only: webref.difference(&mdn).map(|s| s.to_string()).collect(),
+            mdn_only: mdn.difference(&webref).map(|s| s.to_string()).collect(),
+        }
+    }
+
+    /// Both lists as plain text, one name per line under a counted heading.
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        for (heading, names) in [("webref-only", &self.webref_only), ("MDN-only", &self.mdn_only)] {
+            let _ = writeln!(out, "{heading} ({}):", names.len());
+            for name in names {
+                let _ = writeln!(out, "  {name}");
+            }
+        }
+        out
+    }
+
+    /// Both lists as a pretty-printed JSON report.
+    pub fn to_json(&self) -> serde_json::Result<String> {
+        serde_json::to_string_pretty(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn lists_names_missing_from_either_source() {
+        let coverage = Coverage::compare(
+            ["margin", "box-shadow-blur", "anchor-name"],
+            ["margin", "-webkit-box-reflect", "zoom"],
+        );
+
+        assert_eq!(coverage.webref_only, ["anchor-name", "box-shadow-blur"]);
+        assert_eq!(coverage.mdn_only, ["-webkit-box-reflect", "zoom"]);
+        assert_eq!(
+            coverage.render(),
+            "webref-only (2):\n  anchor-name\n  box-shadow-blur\nMDN-only (2):\n  -webkit-box-reflect\n  zoom\n"
+        );
+
+        let report: serde_json::Value = serde_json::from_str(&coverage.to_json().unwrap()).unwrap();
+        assert_eq!(report["webref_only"][1], "box-shadow-blur");
+        assert_eq!(report["mdn_only"][0], "-webkit-box-reflect");
+    }
+}
@@ -0,0 +1,123 @@
+//! The `dependents` subcommand: for each value type, the properties whose
+//! grammar references it, directly or through other values and properties.
+//! It shows how far a change to a value's grammar reaches. The references are
+//! found the same way `--properties-filter` and `--prune-values` find them.
+
+use crate::filter;
+use crate::types::Data;
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write;
+
+/// The properties depending on each value, by value name. Every value is
+/// listed, those no property reaches with an empty list.
+#[derive(Debug, Default, PartialEq, Serialize)]
+#[serde(transparent)]
+pub struct Dependents {
+    pub by_value: BTreeMap<String, BTreeSet<String>>,
+}
+
+impl Dependents {
+    pub fn compute(data: &Data) -> Result<Self> {
+        let index = data.index();
+        let mut by_value: BTreeMap<String, BTreeSet<String>> =
+            data.values.iter().map(|v| (v.name.clone(), BTreeSet::new())).collect();
+        for property in &data.properties {
+            let reached = filter::reachable(&index, vec![property.syntax.clone()])?;
+            for value in reached.values {
+                by_value.entry(value).or_default().insert(property.name.clone());
+            }
+        }
+        Ok(Dependents { by_value })
+    }
+
+    /// Keeps only `value`; None when there is no such value.
+    pub fn only(mut self, value: &str) -> Option<Self> {
+        let (name, properties) = self.by_value.remove_entry(value)?;
+        Some(Dependents {
+            by_value: BTreeMap::from([(name, properties)]),
+        })
+    }
+
+    /// Each value with a count of its dependents, one property per line
+    /// under it.
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        for (value, properties) in &self.by_value {
+            let _ = writeln!(out, "{value} ({}):", properties.len());
+            for property in properties {
+                let _ = writeln!(out, "  {property}");
+            }
+        }
+        out
+    }
+
+    /// The dependents of every value as a pretty-printed JSON object.
+    pub fn to_json(&self) -> serde_json::Result<String> {
+        serde_json::to_string_pretty(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{Property, Value, ValueKind};
+
+    fn property(name: &str, syntax: &str) -> Property {
+        Property {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            ..Default::default()
+        }
+    }
+
+    fn value(name: &str, syntax: &str) -> Value {
+        Value {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            kind: ValueKind::Type,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn properties_are_listed_under_every_value_they_reach() {
+        let data = Data {
+            properties: vec![
+                property("color", "<color>"),
+                property("border-color", "<color>{1,4}"),
+                // Through another value
+                property("box-shadow", "<shadow>#"),
+                // Through another property
+                property("border-top", "<line-width> || <'border-top-color'>"),
+                property("border-top-color", "<'border-color'>"),
+                property("width", "auto | <length>"),
+            ],
+            values: vec![
+                value("<color>", "<rgb()> | currentcolor"),
+                value("<rgb()>", "rgb( <number>{3} )"),
+                value("<shadow>", "inset? && <length>{2,4} && <color>?"),
+                value("<line-width>", "<length> | thin"),
+                value("<unused>", "a | b"),
+            ],
+            ..Default::default()
+        };
+
+        let dependents = Dependents::compute(&data).unwrap();
+        let names = |value: &str| -> Vec<&str> { dependents.by_value[value].iter().map(String::as_str).collect() };
+        assert_eq!(
+            names("<color>"),
+            ["border-color", "border-top", "border-top-color", "box-shadow", "color"]
+        );
+        assert_eq!(names("<rgb()>"), names("<color>"));
+        assert_eq!(names("<line-width>"), ["border-top"]);
+        assert!(names("<unused>").is_empty());
+
+        let only = Dependents::compute(&data).unwrap().only("<line-width>").unwrap();
+        assert_eq!(only.render(), "<line-width> (1):\n  border-top\n");
+        let report: serde_json::Value = serde_json::from_str(&only.to_json().unwrap()).unwrap();
+        assert_eq!(report, serde_json::json!({"<line-width>": ["border-top"]}));
+        assert!(Dependents::compute(&data).unwrap().only("<missing>").is_none());
+    }
+}
@@ -0,0 +1,113 @@
+//! Typed errors for the failures a caller may want to tell apart: a download,
+//! the local cache, or a source file that does not decode. The leaf functions
+//! raise them inside `anyhow::Error`, so context added further up the stack is
+//! kept; `Error::find` gets them back out.
+
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, thiserror::Error)]
+pub enum Error {
+    /// Fetching a URL failed, or its response was unusable
+    #[error("downloading {url}")]
+    Download {
+        url: String,
+        #[source]
+        source: anyhow::Error,
+    },
+    /// Reading or writing a file in the local cache failed
+    #[error("cache file {}", path.display())]
+    Cache {
+        path: PathBuf,
+        #[source]
+        source: anyhow::Error,
+    },
+    /// A downloaded or cached source file is not the expected JSON
+    #[error("decoding {file}")]
+    Decode {
+        file: String,
+        #[source]
+        source: anyhow::Error,
+    },
+}
+
+impl Error {
+    /// The typed error behind `err`, if it has one.
+    pub fn find(err: &anyhow::Error) -> Option<&Error> {
+        err.chain().find_map(|e| e.downcast_ref::<Error>())
+    }
+
+    /// The process exit code for this error. 1 is left for any other failure
+    /// and 2 for command-line usage errors.
+    pub fn exit_code(&self) -> u8 {
+        match self {
+            Error::Download { .. } => 3,
+            Error::Cache { .. } => 4,
+            Error::Decode { .. } => 5,
+        }
+    }
+}
+
+/// Wraps the error of a `Result` in one of the typed errors, like
+/// `anyhow::Context` does with a message.
+pub trait ErrorContext<T> {
+    fn download_context(self, url: &str) -> anyhow::Result<T>;
+    fn cache_context(self, path: &Path) -> anyhow::Result<T>;
+    fn decode_context(self, file: &str) -> anyhow::Result<T>;
+}
+
+impl<T, E: Into<anyhow::Error>> ErrorContext<T> for Result<T, E> {
+    fn download_context(self, url: &str) -> anyhow::Result<T> {
+        self.map_err(|e| {
+            Error::Download {
+                url: url.to_string(),
+                source: e.into(),
+            }
+            .into()
+        })
+    }
+
+    fn cache_context(self, path: &Path) -> anyhow::Result<T> {
+        self.map_err(|e| {
+            Error::Cache {
+                path: path.to_path_buf(),
+                source: e.into(),
+            }
+            .into()
+        })
+    }
+
+    fn decode_context(self, file: &str) -> anyhow::Result<T> {
+        self.map_err(|e| {
+            Error::Decode {
+                file: file.to_string(),
+                source: e.into(),
+            }
+            .into()
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::Context;
+
+    #[test]
+    fn typed_errors_are_found_under_added_context() {
+        let result: anyhow::Result<()> = Err(anyhow::anyhow!("connection reset"));
+        let err = result
+            .download_context("https://example.org/css-a.json")
+            .context("fetching css-a.json")
+            .unwrap_err();
+
+        let typed = Error::find(&err).unwrap();
+        assert!(matches!(typed, Error::Download { url, .. } if url == "https://example.org/css-a.json"));
+        assert_eq!(typed.exit_code(), 3);
+        assert_eq!(
+            format!("{err:#}"),
+            "fetching css-a.json: downloading https://example.org/css-a.json: connection reset"
+        );
+
+        assert!(Error::find(&anyhow::anyhow!("something else")).is_none());
+    }
+}
@@ -0,0 +1,75 @@
+//! `--explain <property>`: how one property's definition was put together.
+//! Collection records each step that touched the property (every spec that
+//! declared it, `newValues` merges, the MDN data, patches, and overrides) in
+//! a [`Trace`], which is printed with the final result. Without the flag no
+//! trace exists, and recording a step is a single `None` check.
+
+use crate::types::Data;
+use std::fmt::Write;
+
+/// The steps that touched one property, in the order they happened.
+#[derive(Debug, Clone, Default)]
+pub struct Trace {
+    property: String,
+    steps: Vec<String>,
+}
+
+impl Trace {
+    pub fn new(property: &str) -> Self {
+        Trace {
+            property: property.to_string(),
+            steps: Vec::new(),
+        }
+    }
+
+    /// The name of the property being explained
+    pub fn property(&self) -> &str {
+        &self.property
+    }
+
+    /// The steps as plain text, numbered, followed by the exported property.
+    pub fn render(&self, data: &Data) -> String {
+        let mut out = format!("Property {}\n", self.property);
+        if self.steps.is_empty() {
+            out.push_str("  No source defines it\n");
+        }
+        for (i, step) in self.steps.iter().enumerate() {
+            let _ = writeln!(out, "  {}. {step}", i + 1);
+        }
+        match data.properties.iter().find(|p| p.name == self.property) {
+            Some(property) => {
+                let json = serde_json::to_string_pretty(property).unwrap_or_default();
+                let _ = writeln!(out, "Result:\n{json}");
+            }
+            None => out.push_str("Result: not exported as a property\n"),
+        }
+        out
+    }
+}
+
+/// Records a step when `trace` follows the property `name`. The step is only
+/// formatted then.
+pub fn record(trace: &mut Option<Trace>, name: &str, step: impl FnOnce() -> String) {
+    if let Some(trace) = trace.as_mut().filter(|t| t.property == name) {
+        trace.steps.push(step());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn only_the_explained_property_is_recorded() {
+        let mut trace = Some(Trace::new("margin"));
+        record(&mut trace, "margin", || "css-box: defines it".to_string());
+        record(&mut trace, "padding", || unreachable!());
+        let mut off = None;
+        record(&mut off, "margin", || unreachable!());
+
+        assert_eq!(
+            trace.unwrap().render(&Data::default()),
+            "Property margin\n  1. css-box: defines it\nResult: not exported as a property\n"
+        );
+    }
+}
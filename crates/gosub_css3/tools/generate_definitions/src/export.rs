@@ -0,0 +1,684 @@
+//! Renders the generated data into its output files and writes them.
+
+use crate::manifest::{Manifest, MANIFEST_FILE};
+use crate::rust_export;
+use crate::schema;
+use crate::types::{AtRule, Data, PropAlias, Property, ReverseAlias, Selector, Source, Value, SCHEMA_VERSION};
+use anyhow::{Context, Result};
+use log::{info, warn};
+use schemars::JsonSchema;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+/// Default output directory, relative to where the tool runs
+pub const RESOURCE_PATH: &str = ".output/definitions";
+const MULTI_FILE_PREFIX: &str = "definitions_";
+/// With `--minify`: the compact copy of `definitions.json`
+pub const MINIFIED_FILE: &str = "definitions.min.json";
+/// Every name mapped to its syntax (see [`syntax_index`])
+pub const SYNTAX_INDEX_FILE: &str = "syntax-index.json";
+/// With `--split-by spec`: the file of the entries no spec is credited for
+const UNATTRIBUTED: &str = "unattributed";
+
+/// The `definitions.json` document: the data plus its schema version.
+#[derive(Serialize, JsonSchema)]
+pub struct Document<'a> {
+    #[serde(rename = "schemaVersion")]
+    #[schemars(extend("const" = SCHEMA_VERSION))]
+    schema_version: u32,
+    #[serde(flatten)]
+    data: &'a Data,
+}
+
+impl<'a> Document<'a> {
+    fn new(data: &'a Data) -> Self {
+        Document {
+            schema_version: SCHEMA_VERSION,
+            data,
+        }
+    }
+}
+
+/// One rendered output file.
+pub struct OutputFile {
+    pub path: PathBuf,
+    pub content: Vec<u8>,
+}
+
+/// How the per-category files are written. The combined `definitions.json`
+/// is always a pretty-printed document.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum OutputFormat {
+    /// A pretty-printed JSON array per file (`.json`)
+    #[default]
+    Json,
+    /// One compact JSON object per line (`.ndjson`), for streaming consumers
+    Ndjson,
+}
+
+impl OutputFormat {
+    fn extension(self) -> &'static str {
+        match self {
+            OutputFormat::Json => "json",
+            OutputFormat::Ndjson => "ndjson",
+        }
+    }
+
+    fn render<T: Serialize>(self, items: &[T]) -> Result<Vec<u8>> {
+        match self {
+            OutputFormat::Json => to_json(&items),
+            OutputFormat::Ndjson => to_ndjson(items),
+        }
+    }
+}
+
+/// How the definitions are split across files besides `definitions.json`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum SplitBy {
+    /// One file per kind of entry (`definitions_properties.json`, ...)
+    #[default]
+    Kind,
+    /// One file per spec (`definitions_css-flexbox-1.json`) holding the
+    /// entries it contributed, plus `definitions_index.json` listing them
+    Spec,
+}
+
+/// Which files `render_outputs` renders, and how.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct ExportOptions {
+    /// The format of the per-category files
+    pub format: OutputFormat,
+    /// How the definitions are split across files
+    pub split_by: SplitBy,
+    /// Also render a compact copy of `definitions.json`
+    pub minify: bool,
+    /// Also render the Rust tables
+    pub emit_rust: bool,
+    /// Also render the JSON Schema of `definitions.json`
+    pub emit_schema: bool,
+}
+
+/// A `--split-by spec` file: the entries credited to one spec, or with
+/// [`UNATTRIBUTED`] the entries credited to none.
+#[derive(Default, Serialize)]
+struct SpecDocument<'a> {
+    #[serde(rename = "schemaVersion")]
+    schema_version: u32,
+    properties: Vec<&'a Property>,
+    values: Vec<&'a Value>,
+    atrules: Vec<&'a AtRule>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    selectors: Vec<&'a Selector>,
+    #[serde(rename = "propAliases", skip_serializing_if = "Vec::is_empty")]
+    prop_aliases: Vec<&'a PropAlias>,
+    #[serde(rename = "reverseAliases", skip_serializing_if = "Vec::is_empty")]
+    reverse_aliases: Vec<&'a ReverseAlias>,
+}
+
+/// `definitions_index.json`: which file holds each spec's entries.
+#[derive(Serialize)]
+struct SpecIndex {
+    specs: BTreeMap<String, String>,
+    unattributed: String,
+}
+
+/// Splits `data` by spec, keyed by shortname. An entry merged from several
+/// specs is in each of their documents. Selectors and aliases carry no
+/// sources and, like any other entry without one, go to [`UNATTRIBUTED`].
+fn split_by_spec(data: &Data) -> BTreeMap<&str, SpecDocument<'_>> {
+    fn names(sources: &[Source]) -> Vec<&str> {
+        if sources.is_empty() {
+            vec![UNATTRIBUTED]
+        } else {
+            sources.iter().map(|s| s.shortname.as_str()).collect()
+        }
+    }
+
+    fn document<'d, 'a>(
+        documents: &'d mut BTreeMap<&'a str, SpecDocument<'a>>,
+        name: &'a str,
+    ) -> &'d mut SpecDocument<'a> {
+        documents.entry(name).or_insert_with(|| SpecDocument {
+            schema_version: SCHEMA_VERSION,
+            ..Default::default()
+        })
+    }
+
+    let mut documents = BTreeMap::new();
+    for property in &data.properties {
+        for name in names(&property.sources) {
+            document(&mut documents, name).properties.push(property);
+        }
+    }
+    for value in &data.values {
+        for name in names(&value.sources) {
+            document(&mut documents, name).values.push(value);
+        }
+    }
+    for at_rule in &data.atrules {
+        for name in names(&at_rule.sources) {
+            document(&mut documents, name).atrules.push(at_rule);
+        }
+    }
+    let unattributed = document(&mut documents, UNATTRIBUTED);
+    unattributed.selectors.extend(&data.selectors);
+    unattributed.prop_aliases.extend(&data.prop_aliases);
+    unattributed.reverse_aliases.extend(&data.reverse_aliases);
+    documents
+}
+
+/// A shortname as a file name part: anything but ASCII letters, digits, `-`,
+/// and `_` becomes `-`.
+fn file_part(shortname: &str) -> String {
+    shortname
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '-' || c == '_' {
+                c
+            } else {
+                '-'
+            }
+        })
+        .collect()
+}
+
+/// Renders every output file under `dir`: the combined `definitions.json`,
+/// the split files (per category in `format`, or per spec), the syntax
+/// index, and the run's `manifest`; with `minify`, a compact copy of
+/// `definitions.json`; with `emit_rust`, the Rust tables; and with
+/// `emit_schema`, the JSON Schema of `definitions.json`.
+pub fn render_outputs(
+    data: &Data,
+    manifest: &Manifest,
+    dir: &Path,
+    options: &ExportOptions,
+) -> Result<Vec<OutputFile>> {
+    let mut files = match options.split_by {
+        SplitBy::Kind => by_kind(data, options.format, dir)?,
+        SplitBy::Spec => by_spec(data, dir)?,
+    };
+    files.extend([
+        OutputFile {
+            path: dir.join("definitions.json"),
+            content: definitions_json(data)?,
+        },
+        OutputFile {
+            path: dir.join(SYNTAX_INDEX_FILE),
+            content: to_json(&syntax_index(data))?,
+        },
+        OutputFile {
+            path: dir.join(MANIFEST_FILE),
+            content: to_json(manifest)?,
+        },
+    ]);
+
+    if options.minify {
+        files.push(OutputFile {
+            path: dir.join(MINIFIED_FILE),
+            content: serde_json::to_vec(&Document::new(data))?,
+        });
+    }
+
+    if options.emit_rust {
+        files.push(OutputFile {
+            path: dir.join("definitions.rs"),
+            content: rust_export::render(data)?.into_bytes(),
+        });
+    }
+
+    if options.emit_schema {
+        files.push(OutputFile {
+            path: dir.join("definitions.schema.json"),
+            content: to_json(&schema::definitions_schema())?,
+        });
+    }
+
+    Ok(files)
+}
+
+/// The per-category files, in `format`.
+fn by_kind(data: &Data, format: OutputFormat, dir: &Path) -> Result<Vec<OutputFile>> {
+    let path = |category: &str| dir.join(format!("{MULTI_FILE_PREFIX}{category}.{}", format.extension()));
+    Ok(vec![
+        OutputFile {
+            path: path("properties"),
+            content: format.render(&data.properties)?,
+        },
+        OutputFile {
+            path: path("values"),
+            content: format.render(&data.values)?,
+        },
+        OutputFile {
+            path: path("at-rules"),
+            content: format.render(&data.atrules)?,
+        },
+        OutputFile {
+            path: path("selectors"),
+            content: format.render(&data.selectors)?,
+        },
+        OutputFile {
+            path: path("prop-aliases"),
+            content: format.render(&data.prop_aliases)?,
+        },
+        OutputFile {
+            path: path("reverse-aliases"),
+            content: format.render(&data.reverse_aliases)?,
+        },
+    ])
+}
+
+/// The per-spec documents and the index listing them. Always JSON.
+fn by_spec(data: &Data, dir: &Path) -> Result<Vec<OutputFile>> {
+    let file_name = |part: &str| format!("{MULTI_FILE_PREFIX}{part}.json");
+    let mut files = Vec::new();
+    let mut index = SpecIndex {
+        specs: BTreeMap::new(),
+        unattributed: String::new(),
+    };
+    for (shortname, document) in split_by_spec(data) {
+        let name = file_name(&file_part(shortname));
+        files.push(OutputFile {
+            path: dir.join(&name),
+            content: to_json(&document)?,
+        });
+        if shortname == UNATTRIBUTED {
+            index.unattributed = name;
+        } else {
+            index.specs.insert(shortname.to_string(), name);
+        }
+    }
+    files.push(OutputFile {
+        path: dir.join(file_name("index")),
+        content: to_json(&index)?,
+    });
+    Ok(files)
+}
+
+/// How much smaller the minified `definitions.json` is, for the run report.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct MinifiedSize {
+    pub pretty_bytes: usize,
+    pub minified_bytes: usize,
+}
+
+impl MinifiedSize {
+    /// The sizes of `definitions.json` and its minified copy among `files`,
+    /// or None when either was not rendered.
+    pub fn of(files: &[OutputFile]) -> Option<Self> {
+        let size = |name: &str| {
+            files
+                .iter()
+                .find(|f| f.path.file_name().is_some_and(|n| n == name))
+                .map(|f| f.content.len())
+        };
+        Some(MinifiedSize {
+            pretty_bytes: size("definitions.json")?,
+            minified_bytes: size(MINIFIED_FILE)?,
+        })
+    }
+
+    /// One-line human readable summary, for the log.
+    pub fn summary(&self) -> String {
+        let saved = self.pretty_bytes.saturating_sub(self.minified_bytes);
+        let percent = if self.pretty_bytes == 0 {
+            0.0
+        } else {
+            saved as f64 * 100.0 / self.pretty_bytes as f64
+        };
+        format!(
+            "{MINIFIED_FILE} is {} bytes, {saved} ({percent:.0}%) smaller than definitions.json",
+            self.minified_bytes
+        )
+    }
+}
+
+/// Writes the files to disk. With `dry_run` nothing is written; each file is
+/// reported as new, changed, or unchanged against what is on disk instead.
+/// With `only_changed`, a file whose content is already on disk is left
+/// alone, so its mtime only moves when it changes.
+pub fn write_outputs(files: &[OutputFile], dry_run: bool, only_changed: bool) -> Result<()> {
+    for file in files {
+        let state = || match fs::read(&file.path) {
+            Ok(existing) if existing == file.content => "unchanged",
+            Ok(_) => "changed",
+            Err(_) => "new",
+        };
+        if dry_run {
+            info!("Would write {} ({})", file.path.display(), state());
+            continue;
+        }
+        if only_changed && state() == "unchanged" {
+            info!("{} is unchanged, not rewriting it", file.path.display());
+            continue;
+        }
+
+        if let Some(parent) = file.path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(&file.path, &file.content).with_context(|| format!("writing {}", file.path.display()))?;
+    }
+
+    Ok(())
+}
+
+/// Writes the same document as `definitions.json` to stdout. Progress
+/// logging goes to stderr, so stdout carries only the JSON.
+pub fn write_stdout(data: &Data) -> Result<()> {
+    let mut stdout = std::io::stdout().lock();
+    stdout.write_all(&definitions_json(data)?)?;
+    stdout.flush()?;
+    Ok(())
+}
+
+/// Every property, value, and at-rule name mapped to its syntax, for
+/// consumers that only look grammars up by name. The names tell the kinds
+/// apart: properties are bare (`color`), value types and functions keep
+/// their `<color>` and `rgb()` form, and at-rules their `@`, mapped to
+/// their prelude. A keyword value named like a property is left out, with a
+/// warning; the property keeps the name.
+pub fn syntax_index(data: &Data) -> BTreeMap<&str, &str> {
+    let mut index = BTreeMap::new();
+    for property in &data.properties {
+        index.insert(property.name.as_str(), property.syntax.as_str());
+    }
+    for value in &data.values {
+        match index.get(value.name.as_str()) {
+            Some(syntax) if *syntax != value.syntax => {
+                warn!(
+                    "Syntax index: value {} is named like a property, keeping the property's",
+                    value.name
+                );
+            }
+            Some(_) => {}
+            None => {
+                index.insert(value.name.as_str(), value.syntax.as_str());
+            }
+        }
+    }
+    for at_rule in &data.atrules {
+        index.insert(at_rule.name.as_str(), at_rule.prelude.as_str());
+    }
+    index
+}
+
+/// The combined `definitions.json` document.
+pub fn definitions_json(data: &Data) -> Result<Vec<u8>> {
+    to_json(&Document::new(data))
+}
+
+/// Two-space indented JSON with a trailing newline, the on-disk format.
+fn to_json<T: Serialize>(data: &T) -> Result<Vec<u8>> {
+    let mut out = serde_json::to_vec_pretty(data)?;
+    out.push(b'\n');
+    Ok(out)
+}
+
+/// One compact JSON value per line, each line terminated by a newline.
+fn to_ndjson<T: Serialize>(items: &[T]) -> Result<Vec<u8>> {
+    let mut out = Vec::new();
+    for item in items {
+        serde_json::to_writer(&mut out, item)?;
+        out.push(b'\n');
+    }
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::ValueKind;
+
+    #[test]
+    fn combined_document_starts_with_schema_version() {
+        let json = String::from_utf8(to_json(&Document::new(&Data::default())).unwrap()).unwrap();
+        assert!(json.starts_with(&format!(
+            "{{\n  \"schemaVersion\": {SCHEMA_VERSION},\n  \"properties\": [],"
+        )));
+        assert!(json.contains("\"propAliases\": []"));
+    }
+
+    #[test]
+    fn ndjson_writes_one_entry_per_line_in_order() {
+        let data = Data {
+            prop_aliases: ["-webkit-box-flex", "word-wrap"]
+                .iter()
+                .map(|name| PropAlias {
+                    name: name.to_string(),
+                    property: "x".to_string(),
+                })
+                .collect(),
+            ..Default::default()
+        };
+
+        let files = render_outputs(
+            &data,
+            &Manifest::default(),
+            Path::new(RESOURCE_PATH),
+            &ExportOptions {
+                format: OutputFormat::Ndjson,
+                ..Default::default()
+            },
+        )
+        .unwrap();
+        let aliases = files
+            .iter()
+            .find(|f| f.path.ends_with("definitions_prop-aliases.ndjson"))
+            .unwrap();
+        assert_eq!(
+            String::from_utf8(aliases.content.clone()).unwrap(),
+            "{\"name\":\"-webkit-box-flex\",\"property\":\"x\"}\n{\"name\":\"word-wrap\",\"property\":\"x\"}\n"
+        );
+
+        let properties = files
+            .iter()
+            .find(|f| f.path.ends_with("definitions_properties.ndjson"))
+            .unwrap();
+        assert!(properties.content.is_empty());
+        assert!(files.iter().any(|f| f.path.ends_with("definitions.json")));
+    }
+
+    #[test]
+    fn split_by_spec_writes_each_spec_its_own_entries() {
+        let source = |shortname: &str| Source {
+            shortname: shortname.to_string(),
+            ..Default::default()
+        };
+        let value = |name: &str, sources: Vec<Source>| Value {
+            name: name.to_string(),
+            kind: ValueKind::Type,
+            sources,
+            ..Default::default()
+        };
+        let data = Data {
+            values: vec![
+                value("<flex>", vec![source("css-flexbox-1")]),
+                value("<length>", vec![source("css-values-4"), source("css-flexbox-1")]),
+                value("<mdn-only>", Vec::new()),
+            ],
+            prop_aliases: vec![PropAlias {
+                name: "word-wrap".to_string(),
+                property: "overflow-wrap".to_string(),
+            }],
+            ..Default::default()
+        };
+
+        let files = render_outputs(
+            &data,
+            &Manifest::default(),
+            Path::new(RESOURCE_PATH),
+            &ExportOptions {
+                split_by: SplitBy::Spec,
+                ..Default::default()
+            },
+        )
+        .unwrap();
+        let document = |name: &str| -> serde_json::Value {
+            let file = files.iter().find(|f| f.path.ends_with(name)).unwrap();
+            serde_json::from_slice(&file.content).unwrap()
+        };
+        let names = |document: &serde_json::Value, kind: &str| -> Vec<String> {
+            let entries = document[kind].as_array().unwrap();
+            entries
+                .iter()
+                .map(|e| e["name"].as_str().unwrap().to_string())
+                .collect()
+        };
+
+        assert_eq!(
+            names(&document("definitions_css-flexbox-1.json"), "values"),
+            ["<flex>", "<length>"]
+        );
+        assert_eq!(
+            names(&document("definitions_css-values-4.json"), "values"),
+            ["<length>"]
+        );
+        let unattributed = document("definitions_unattributed.json");
+        assert_eq!(names(&unattributed, "values"), ["<mdn-only>"]);
+        assert_eq!(names(&unattributed, "propAliases"), ["word-wrap"]);
+        assert_eq!(
+            document("definitions_index.json"),
+            serde_json::json!({
+                "specs": {
+                    "css-flexbox-1": "definitions_css-flexbox-1.json",
+                    "css-values-4": "definitions_css-values-4.json"
+                },
+                "unattributed": "definitions_unattributed.json"
+            })
+        );
+        assert!(!files.iter().any(|f| f.path.ends_with("definitions_values.json")));
+        assert!(files.iter().any(|f| f.path.ends_with("definitions.json")));
+    }
+
+    #[test]
+    fn minified_definitions_match_the_pretty_ones() {
+        let data = Data {
+            prop_aliases: vec![PropAlias {
+                name: "word-wrap".to_string(),
+                property: "overflow-wrap".to_string(),
+            }],
+            ..Default::default()
+        };
+        let dir = Path::new("out");
+        let manifest = Manifest::new(&data, None);
+        let render = || {
+            render_outputs(
+                &data,
+                &manifest,
+                dir,
+                &ExportOptions {
+                    minify: true,
+                    ..Default::default()
+                },
+            )
+        };
+        let files = render().unwrap();
+
+        let content = |name: &str| &files.iter().find(|f| f.path == dir.join(name)).unwrap().content;
+        let minified = content(MINIFIED_FILE);
+        assert!(!minified.contains(&b'\n'));
+        let parse = |bytes: &[u8]| serde_json::from_slice::<serde_json::Value>(bytes).unwrap();
+        assert_eq!(parse(minified), parse(content("definitions.json")));
+        // Rendering again gives the same bytes.
+        assert_eq!(
+            &render()
+                .unwrap()
+                .iter()
+                .find(|f| f.path == dir.join(MINIFIED_FILE))
+                .unwrap()
+                .content,
+            minified
+        );
+
+        let size = MinifiedSize::of(&files).unwrap();
+        assert_eq!(size.minified_bytes, minified.len());
+        assert!(size.minified_bytes < size.pretty_bytes);
+    }
+
+    #[test]
+    fn syntax_index_maps_every_name_to_its_syntax() {
+        let property = |name: &str, syntax: &str| Property {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            ..Default::default()
+        };
+        let data = Data {
+            properties: vec![property("color", "<color>"), property("inherit", "auto")],
+            values: [
+                ("<color>", "<color-base> | currentColor", ValueKind::Type),
+                ("rgb()", "rgb( <number>#{3} )", ValueKind::Function),
+                ("inherit", "inherit", ValueKind::Keyword),
+            ]
+            .into_iter()
+            .map(|(name, syntax, kind)| Value {
+                name: name.to_string(),
+                syntax: syntax.to_string(),
+                kind,
+                ..Default::default()
+            })
+            .collect(),
+            atrules: vec![AtRule {
+                name: "@media".to_string(),
+                prelude: "<media-query-list>".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+
+        let json = String::from_utf8(to_json(&syntax_index(&data)).unwrap()).unwrap();
+        assert_eq!(
+            json,
+            r#"{
+  "<color>": "<color-base> | currentColor",
+  "@media": "<media-query-list>",
+  "color": "<color>",
+  "inherit": "auto",
+  "rgb()": "rgb( <number>#{3} )"
+}
+"#
+        );
+    }
+
+    #[test]
+    fn dry_run_writes_nothing() {
+        let dir = tempfile::tempdir().unwrap();
+        let files = [OutputFile {
+            path: dir.path().join("out/definitions.json"),
+            content: b"{}\n".to_vec(),
+        }];
+
+        write_outputs(&files, true, false).unwrap();
+        assert!(!files[0].path.exists());
+
+        write_outputs(&files, false, false).unwrap();
+        assert_eq!(fs::read(&files[0].path).unwrap(), b"{}\n");
+    }
+
+    #[test]
+    fn only_changed_files_are_rewritten() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("definitions.json");
+        let output = |content: &[u8]| OutputFile {
+            path: path.clone(),
+            content: content.to_vec(),
+        };
+        fs::write(&path, b"{}\n").unwrap();
+        let epoch = std::time::SystemTime::UNIX_EPOCH;
+        fs::File::options()
+            .write(true)
+            .open(&path)
+            .unwrap()
+            .set_modified(epoch)
+            .unwrap();
+        let modified = || fs::metadata(&path).unwrap().modified().unwrap();
+
+        write_outputs(&[output(b"{}\n")], false, true).unwrap();
+        assert_eq!(modified(), epoch);
+
+        write_outputs(&[output(b"[]\n")], false, true).unwrap();
+        assert_eq!(fs::read(&path).unwrap(), b"[]\n");
+        assert_ne!(modified(), epoch);
+    }
+}
@@ -0,0 +1,79 @@
+//! The single entry point for HTTP and cache writes. In `--offline` mode
+//! every request is refused, so data must come from the local cache; in
+//! `--dry-run` mode the cache is never written. Every request asks for a
+//! gzip-compressed response, which the client decompresses before the body is
+//! read, so the cache and the SHA checks only ever see the plain JSON.
+
+use crate::error::ErrorContext;
+use anyhow::{anyhow, Result};
+use log::info;
+use reqwest::blocking::{Client, RequestBuilder};
+use std::fs;
+use std::path::Path;
+use std::thread;
+use std::time::Duration;
+
+/// How long to wait before trying a failed download again.
+const RETRY_DELAY: Duration = Duration::from_millis(500);
+
+pub struct Fetcher {
+    client: Client,
+    offline: bool,
+    dry_run: bool,
+}
+
+impl Fetcher {
+    pub fn new(offline: bool, dry_run: bool) -> Result<Self> {
+        let client = Client::builder().user_agent("gosub-generate-definitions").build()?;
+        Ok(Fetcher {
+            client,
+            offline,
+            dry_run,
+        })
+    }
+
+    pub fn offline(&self) -> bool {
+        self.offline
+    }
+
+    pub fn dry_run(&self) -> bool {
+        self.dry_run
+    }
+
+    /// Stores `content` in the cache at `path`, creating parent directories.
+    /// It is written to `<path>.part` first and renamed into place, so an
+    /// interrupted run never leaves a truncated cache file behind. Skipped in
+    /// dry-run mode.
+    pub fn write_cache(&self, path: &Path, content: &[u8]) -> Result<()> {
+        if self.dry_run {
+            info!("Would update cache file {}", path.display());
+            return Ok(());
+        }
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).cache_context(path)?;
+        }
+        let mut part = path.as_os_str().to_owned();
+        part.push(".part");
+        fs::write(&part, content).cache_context(path)?;
+        fs::rename(&part, path).cache_context(path)
+    }
+
+    /// Starts a GET request, or fails when running offline.
+    pub fn get(&self, url: &str) -> Result<RequestBuilder> {
+        if self.offline {
+            return Err(anyhow!("refusing to fetch in offline mode")).download_context(url);
+        }
+        Ok(self.client.get(url))
+    }
+}
+
+/// Runs `attempt`, and once more after a short pause when it fails: a
+/// dropped connection or a 5xx from GitHub is often gone a moment later.
+/// `what` names the attempt in the log (`Reading ed/css/css-a.json`).
+pub fn retry_once<T>(what: &str, attempt: impl Fn() -> Result<T>) -> Result<T> {
+    attempt().or_else(|e| {
+        info!("{what} failed ({e:#}), retrying once");
+        thread::sleep(RETRY_DELAY);
+        attempt()
+    })
+}
@@ -0,0 +1,306 @@
+//! `--properties-filter`: scopes the exported data to a subset of properties
+//! (and at-rules) plus every value type and property their grammars
+//! transitively reference, so the output still resolves on its own.
+
+use crate::global_keywords;
+use crate::lookup::Index;
+use crate::types::Data;
+use anyhow::Result;
+use regex::Regex;
+use std::collections::BTreeSet;
+
+/// A comma-separated list of exact names or `*`/`?` globs.
+#[derive(Debug, Default)]
+pub struct NameFilter {
+    patterns: Vec<String>,
+}
+
+impl NameFilter {
+    pub fn parse(list: &str) -> Self {
+        NameFilter {
+            patterns: list
+                .split(',')
+                .map(str::trim)
+                .filter(|p| !p.is_empty())
+                .map(str::to_string)
+                .collect(),
+        }
+    }
+
+    pub fn matches(&self, name: &str) -> bool {
+        self.patterns.iter().any(|p| glob_match(p, name))
+    }
+}
+
+/// Matches `name` against a pattern where `*` is any run of characters and
+/// `?` any single character.
+fn glob_match(pattern: &str, name: &str) -> bool {
+    let p: Vec<char> = pattern.chars().collect();
+    let n: Vec<char> = name.chars().collect();
+
+    let (mut pi, mut ni) = (0, 0);
+    let mut backtrack: Option<(usize, usize)> = None;
+    while ni < n.len() {
+        if pi < p.len() && (p[pi] == '?' || p[pi] == n[ni]) {
+            pi += 1;
+            ni += 1;
+        } else if pi < p.len() && p[pi] == '*' {
+            backtrack = Some((pi, ni));
+            pi += 1;
+        } else if let Some((star, matched)) = backtrack {
+            pi = star + 1;
+            ni = matched + 1;
+            backtrack = Some((star, matched + 1));
+        } else {
+            return false;
+        }
+    }
+    p[pi..].iter().all(|c| *c == '*')
+}
+
+/// What a grammar refers to: value definitions (by their output name) and
+/// properties (through `<'name'>`).
+#[derive(Debug, Default, PartialEq)]
+pub struct References {
+    pub values: BTreeSet<String>,
+    pub properties: BTreeSet<String>,
+}
+
+/// Extracts the references from a grammar.
+pub struct ReferenceScanner {
+    /// `<name>`, `<'property'>`, `<name()>` and ranged `<length [0,∞]>`;
+    /// names may contain `+` (`<an+b>`).
+    reference: Regex,
+    /// A bare function token (`fit-content(`), which refers to `name()`.
+    function: Regex,
+}
+
+impl ReferenceScanner {
+    pub fn new() -> Result<Self> {
+        Ok(ReferenceScanner {
+            reference: Regex::new(r"<('?)([a-zA-Z0-9+-]+(?:\(\))?)'?(?:\s*\[[^\]]*\])?>")?,
+            function: Regex::new(r"(^|[^<a-zA-Z0-9-])([a-zA-Z-]+)\(")?,
+        })
+    }
+
+    pub fn references(&self, syntax: &str) -> References {
+        let mut refs = References::default();
+
+        for cap in self.reference.captures_iter(syntax) {
+            let name = &cap[2];
+            if &cap[1] == "'" {
+                refs.properties.insert(name.to_string());
+                // Sub-properties backfilled as value types use the <name> form.
+                refs.values.insert(format!("<{name}>"));
+                continue;
+            }
+            refs.values.insert(format!("<{name}>"));
+            if name.ends_with("()") {
+                refs.values.insert(name.to_string());
+            }
+        }
+
+        for cap in self.function.captures_iter(syntax) {
+            refs.values.insert(format!("{}()", &cap[2]));
+            refs.values.insert(format!("<{}()>", &cap[2]));
+        }
+
+        refs
+    }
+}
+
+/// Restricts `data` to the properties and at-rules `filter` matches plus
+/// everything they transitively reference, and the aliases (both directions)
+/// of the kept properties. Selectors and the CSS-wide keyword values are
+/// left untouched.
+/// Returns the number of properties that matched the filter directly.
+pub fn apply(data: &mut Data, filter: &NameFilter) -> Result<usize> {
+    let mut keep_properties: BTreeSet<String> = BTreeSet::new();
+    let mut pending: Vec<String> = Vec::new();
+
+    for property in &data.properties {
+        if filter.matches(&property.name) {
+            keep_properties.insert(property.name.clone());
+            pending.push(property.syntax.clone());
+        }
+    }
+    let matched = keep_properties.len();
+
+    for at_rule in &data.atrules {
+        if filter.matches(&at_rule.name) {
+            pending.extend(at_rule.descriptors.iter().map(|d| d.syntax.clone()));
+        }
+    }
+
+    let reached = reachable(&data.index(), pending)?;
+    keep_properties.extend(reached.properties);
+
+    data.properties.retain(|p| keep_properties.contains(&p.name));
+    data.values
+        .retain(|v| reached.values.contains(&v.name) || global_keywords::is_global(&v.name));
+    data.atrules.retain(|a| filter.matches(&a.name));
+    data.prop_aliases.retain(|a| keep_properties.contains(&a.property));
+    data.reverse_aliases.retain(|a| keep_properties.contains(&a.property));
+
+    Ok(matched)
+}
+
+/// `--prune-values`: drops the value types no property, at-rule, or selector
+/// grammar references, directly or through other value types. The CSS-wide
+/// keywords are kept, since no grammar names them. Returns the number of
+/// values dropped.
+pub fn prune_values(data: &mut Data) -> Result<usize> {
+    let mut pending: Vec<String> = data.properties.iter().map(|p| p.syntax.clone()).collect();
+    for at_rule in &data.atrules {
+        pending.extend(at_rule.descriptors.iter().map(|d| d.syntax.clone()));
+        for value in at_rule.values.iter().flatten() {
+            pending.push(value.value.clone());
+            pending.extend(value.values.iter().flatten().map(|v| v.value.clone()));
+        }
+    }
+    pending.extend(data.selectors.iter().map(|s| s.arguments.clone()));
+
+    let reached = reachable(&data.index(), pending)?;
+    let before = data.values.len();
+    data.values
+        .retain(|v| reached.values.contains(&v.name) || global_keywords::is_global(&v.name));
+
+    Ok(before - data.values.len())
+}
+
+/// Follows the references of the `pending` grammars through the syntaxes of
+/// the values and properties they name, and returns every value and property
+/// reached that the indexed data defines.
+pub(crate) fn reachable(index: &Index, mut pending: Vec<String>) -> Result<References> {
+    let scanner = ReferenceScanner::new()?;
+
+    let mut reached = References::default();
+    while let Some(syntax) = pending.pop() {
+        let refs = scanner.references(&syntax);
+        for name in refs.values {
+            if let Some(value) = index.value(&name) {
+                if reached.values.insert(name) {
+                    pending.push(value.syntax.clone());
+                }
+            }
+        }
+        for name in refs.properties {
+            if let Some(property) = index.property(&name) {
+                if reached.properties.insert(name) {
+                    pending.push(property.syntax.clone());
+                }
+            }
+        }
+    }
+
+    Ok(reached)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{Property, Selector, Value, ValueKind};
+
+    fn property(name: &str, syntax: &str) -> Property {
+        Property {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            ..Default::default()
+        }
+    }
+
+    fn value(name: &str, syntax: &str) -> Value {
+        Value {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            kind: ValueKind::Type,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn glob_patterns() {
+        assert!(glob_match("margin", "margin"));
+        assert!(!glob_match("margin", "margin-top"));
+        assert!(glob_match("margin-*", "margin-top"));
+        assert!(glob_match("*-top", "margin-top"));
+        assert!(glob_match("m?rgin*", "margin-inline"));
+        assert!(!glob_match("padding-*", "margin-top"));
+    }
+
+    #[test]
+    fn filter_list_trims_and_skips_empty_entries() {
+        let filter = NameFilter::parse(" color , ,border-* ");
+        assert!(filter.matches("color"));
+        assert!(filter.matches("border-top"));
+        assert!(!filter.matches("background"));
+    }
+
+    #[test]
+    fn references_cover_all_reference_forms() {
+        let refs = ReferenceScanner::new()
+            .unwrap()
+            .references("<length [0,∞]> | <'box-shadow-blur'> | <rect()> | fit-content( <percentage> ) | <an+b>");
+        assert!(refs.values.contains("<length>"));
+        assert!(refs.values.contains("<percentage>"));
+        assert!(refs.values.contains("<box-shadow-blur>"));
+        assert!(refs.values.contains("rect()"));
+        assert!(refs.values.contains("fit-content()"));
+        assert!(refs.values.contains("<an+b>"));
+        assert!(refs.properties.contains("box-shadow-blur"));
+    }
+
+    #[test]
+    fn apply_keeps_transitive_references_only() {
+        let mut data = Data {
+            properties: vec![
+                property("margin", "<'margin-top'>{1,4}"),
+                property("margin-top", "<length-percentage> | auto"),
+                property("color", "<color>"),
+            ],
+            values: vec![
+                value("<length-percentage>", "<length> | <percentage>"),
+                value("<length>", "<number>px"),
+                value("<color>", "<named-color>"),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(apply(&mut data, &NameFilter::parse("margin")).unwrap(), 1);
+
+        let properties: Vec<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
+        let values: Vec<&str> = data.values.iter().map(|v| v.name.as_str()).collect();
+        assert_eq!(properties, ["margin", "margin-top"]);
+        assert_eq!(values, ["<length-percentage>", "<length>"]);
+    }
+
+    #[test]
+    fn prune_values_keeps_values_reachable_through_other_values() {
+        let mut data = Data {
+            properties: vec![property("margin-top", "<length-percentage> | auto")],
+            values: vec![
+                value("<length-percentage>", "<length> | <percentage>"),
+                value("<length>", "<number>px"),
+                value("<percentage>", "<number>%"),
+                value("<number>", "<number-token>"),
+                value("<color>", "<named-color> | <hex-color>"),
+                value("<named-color>", "red | blue"),
+                value("<an+b>", "odd | even | <integer>"),
+            ],
+            selectors: vec![Selector {
+                name: ":nth-child()".to_string(),
+                kind: None,
+                arguments: "<an+b>".to_string(),
+            }],
+            ..Default::default()
+        };
+
+        assert_eq!(prune_values(&mut data).unwrap(), 2);
+
+        let values: Vec<&str> = data.values.iter().map(|v| v.name.as_str()).collect();
+        assert_eq!(
+            values,
+            ["<length-percentage>", "<length>", "<percentage>", "<number>", "<an+b>"]
+        );
+    }
+}
@@ -0,0 +1,1105 @@
+//! The generation pipeline: downloads (or reads from cache) the webref and
+//! MDN data, merges it into a single sorted `Data`, and applies the patches,
+//! overrides, and checks. Writing the output is left to the caller; see
+//! `export`.
+
+use crate::alias::{self, MissingTarget, PropertyAliasTable};
+use crate::archive;
+use crate::coverage::Coverage;
+use crate::explain::{self, Trace};
+use crate::fetch::Fetcher;
+use crate::initial_check;
+use crate::mdn::{self, MdnItem};
+use crate::media_features;
+use crate::obsolete::OBSOLETE_PATH;
+use crate::overrides::OVERRIDES_PATH;
+use crate::postprocess::{
+    self, AliasSyntaxes, ApplyOverrides, Arrange, GlobalKeywords, MediaFeatures, ObsoleteProperties, PostProcessor,
+    PropertyRegistration, PruneValues, ShorthandInitials,
+};
+use crate::prelude;
+use crate::spec_index::Maturity;
+use crate::syntax_check;
+use crate::timing::Timings;
+use crate::types::{AtRule, AtRuleDescriptor, Data, Property, StringMaybeArray, Value, ValueKind};
+use crate::webref::{self, ConflictStrategy, WebRefData, WebRefLocation, WebRefSettings};
+use anyhow::{bail, Context, Result};
+use cow_utils::CowUtils;
+use log::{error, info, warn};
+use regex::Regex;
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+/// What to generate from, and how strictly. The defaults match the CLI's.
+#[derive(Debug, Clone)]
+pub struct Options {
+    /// Never touch the network; build entirely from the local cache
+    pub offline: bool,
+    /// Don't download stale spec files or write the cache
+    pub dry_run: bool,
+    /// Fail when any spec file failed, a legacy alias conflicts or loops, or
+    /// any initial value is invalid
+    pub strict: bool,
+    /// Check every property's initial value against its own syntax
+    pub validate_initial: bool,
+    /// Where the spec extracts are listed from
+    pub webref: WebRefLocation,
+    /// A webref snapshot archive to read instead of `webref`'s repository
+    pub webref_archive: Option<PathBuf>,
+    /// Where downloads and decoded extracts are cached
+    pub cache_dir: PathBuf,
+    /// How long a cached webref listing is reused without revalidating
+    pub spec_index_ttl: Duration,
+    /// Download cached spec files older than this again, even when their SHA
+    /// matches the listing
+    pub max_age: Option<Duration>,
+    /// Only collect specs at least this mature
+    pub maturity: Maturity,
+    /// How differing syntaxes for the same entry are merged
+    pub conflict_strategy: ConflictStrategy,
+    /// Reuse the parsed extracts of spec files whose SHA the last run decoded
+    pub decode_cache: bool,
+    /// Number of spec decode workers; None for one per CPU
+    pub threads: Option<usize>,
+    /// Only collect this many spec files, for a quick partial run
+    pub limit_specs: Option<usize>,
+    /// Trace how this property is collected
+    pub explain: Option<String>,
+    /// Add the properties listed in `resources/obsolete.json`
+    pub include_obsolete: bool,
+    /// What becomes of a legacy alias whose property is not collected
+    pub missing_alias_target: MissingTarget,
+    /// Fetch MDN's data. Without it the property set, grammars, and initial
+    /// values all come from webref, and `computed` is left empty.
+    pub mdn: bool,
+    /// The overrides file, if any; it has to exist
+    pub overrides: Option<PathBuf>,
+    /// Export each property's MDN reference page
+    pub with_docs: bool,
+    /// Drop the value types no grammar references (the last post-processor)
+    pub prune_values: bool,
+    /// Post-processors (see `postprocess::NAMES`) to skip
+    pub disabled_processors: Vec<String>,
+    /// Adds, reorders, or drops post-processors once the built-in ones are
+    /// listed
+    pub arrange_processors: Option<Arrange>,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Options {
+            offline: false,
+            dry_run: false,
+            strict: false,
+            validate_initial: false,
+            webref: WebRefLocation {
+                repo: webref::REPO.to_string(),
+                branch: webref::BRANCH.to_string(),
+                locations: vec![webref::LOCATION.to_string()],
+                checkout: None,
+                api_url: webref::API_URL.to_string(),
+                raw_url: webref::RAW_URL.to_string(),
+            },
+            webref_archive: None,
+            cache_dir: PathBuf::from(webref::CACHE_DIR),
+            spec_index_ttl: Duration::from_secs(24 * 60 * 60),
+            max_age: None,
+            maturity: Maturity::Ed,
+            conflict_strategy: ConflictStrategy::Union,
+            decode_cache: true,
+            threads: None,
+            limit_specs: None,
+            explain: None,
+            include_obsolete: false,
+            missing_alias_target: MissingTarget::Synthesize,
+            mdn: true,
+            overrides: Some(PathBuf::from(OVERRIDES_PATH)),
+            with_docs: false,
+            prune_values: false,
+            disabled_processors: Vec::new(),
+            arrange_processors: None,
+        }
+    }
+}
+
+/// The result of a generation run.
+#[derive(Debug)]
+pub struct Generated {
+    /// The merged, sorted definitions
+    pub data: Data,
+    /// webref's legacy property aliases, for resolving alias chains
+    pub aliases: PropertyAliasTable,
+    /// Properties only one of webref and MDN defines
+    pub coverage: Coverage,
+    /// How long each phase took
+    pub timings: Timings,
+    /// How the `explain` property was collected, when one was asked for
+    pub trace: Option<Trace>,
+    /// The webref commit the extracts were listed at, when it is known
+    pub webref_commit: Option<String>,
+}
+
+/// Removes a value-definition-syntax comma multiplier (`#`, optionally bounded
+/// as `#{min,max}`) from the very end of a grammar, turning a comma-separated
+/// list grammar into its single-value form.
+fn strip_trailing_comma_multiplier(re: &Regex, syntax: &str) -> String {
+    re.replace_all(syntax.trim_end_matches(' '), "").into_owned()
+}
+
+/// The key a value name is deduplicated by: CSS names are ASCII
+/// case-insensitive, so `<translateX()>` and `<translatex()>` are one value.
+fn value_key(name: &str) -> String {
+    name.cow_to_ascii_lowercase().into_owned()
+}
+
+/// Overrides for upstream PROPERTY grammars where both sources are wrong or
+/// incomplete for real-world CSS.
+const PROPERTY_SYNTAX_PATCHES: [(&str, &str); 2] = [
+    // webref only carries the modern space-separated basic-shape <rect()>, but
+    // the dominant real-world clip syntax is the legacy comma-separated CSS2
+    // rect() (MDN's <shape>). Accept both.
+    ("clip", "<shape> | <rect()> | auto"),
+    // webref types background-clip as <visual-box># which misses `text` (and
+    // `border-area`) from css-backgrounds-4; gradient text via
+    // `background-clip: text` is widely deployed. MDN's <bg-clip> carries the
+    // full alternation.
+    ("background-clip", "<bg-clip>#"),
+];
+
+/// Value types that grammars reference but neither source defines: webref
+/// lists them with an EMPTY syntax (which the generator skips) and MDN
+/// references them from <shape> without defining them. Definitions per
+/// CSS2.1 §11.1.2.
+const MISSING_VALUE_PATCHES: [(&str, &str); 4] = [
+    ("<top>", "<length> | auto"),
+    ("<right>", "<length> | auto"),
+    ("<bottom>", "<length> | auto"),
+    ("<left>", "<length> | auto"),
+];
+
+/// Pins value definitions that multiple specs define differently, so the
+/// choice is explicit instead of an artifact of the conflict strategy (by
+/// default, the union of the specs' alternatives).
+const VALUE_SYNTAX_PATCHES: [(&str, &str); 1] = [
+    // Defined by css-masking-1 (legacy `rect( <top>, <right>, <bottom>,
+    // <left> )`, only for `clip`) and css-shapes-1 (the modern basic-shape
+    // used by clip-path etc.). Pin the modern form; `clip` reaches the legacy
+    // form through <shape> instead.
+    (
+        "rect()",
+        "rect( [ <length-percentage> | auto ]{4} [ round <'border-radius'> ]? )",
+    ),
+];
+
+/// Adds the css-sizing-4 bare `fit-content` keyword alongside the functional
+/// form in PROPERTY grammars (width, height, min/max-*, ...). webref still
+/// carries only `fit-content(<length-percentage>)` while MDN lists both; since
+/// webref grammar is preferred, the keyword would otherwise be lost. Value
+/// definitions are left alone: a bare fit-content is not valid in e.g. grid
+/// track sizing.
+fn add_bare_fit_content(syntax: &str) -> String {
+    match syntax.find("fit-content(") {
+        Some(pos) if !syntax.contains("fit-content |") => {
+            format!("{}fit-content | {}", &syntax[..pos], &syntax[pos..])
+        }
+        _ => syntax.to_string(),
+    }
+}
+
+/// Spellings specs and MDN use for an initial value that does not apply,
+/// compared case-insensitively.
+const NOT_APPLICABLE: &[&str] = &["n/a", "n.a.", "not applicable"];
+
+/// Trims an initial value, and empties it when it only says that there is
+/// none. The one normalization for both property and descriptor initials.
+fn normalize_initial(initial: &str) -> String {
+    let initial = initial.trim();
+    if NOT_APPLICABLE.iter().any(|na| initial.eq_ignore_ascii_case(na)) {
+        return String::new();
+    }
+    initial.to_string()
+}
+
+/// [`normalize_initial`] over a property's initial: the string, or every array
+/// entry (dropping the ones that end up empty).
+fn normalize_initials(initial: &StringMaybeArray) -> StringMaybeArray {
+    let mut initial = initial.normalized();
+    initial.string = normalize_initial(&initial.string);
+    initial.array.retain(|entry| !normalize_initial(entry).is_empty());
+    initial
+}
+
+/// Runs the pipeline and returns the assembled definitions.
+pub fn generate(options: &Options) -> Result<Generated> {
+    let mut timings = Timings::default();
+
+    let fetcher = Fetcher::new(options.offline, options.dry_run)?;
+
+    // An archive is unpacked into the cache and then read as a checkout. A
+    // dry run leaves the cache alone and unpacks into a temporary directory,
+    // removed when `scratch` drops.
+    let mut location = options.webref.clone();
+    let mut scratch = None;
+    if let Some(archive) = &options.webref_archive {
+        let dir = if options.dry_run {
+            let tmp = tempfile::tempdir().context("creating a directory to unpack the archive into")?;
+            scratch.insert(tmp).path().to_path_buf()
+        } else {
+            options.cache_dir.join("archive")
+        };
+        timings.time("download", || archive::unpack(archive, &dir, &location.locations))?;
+        location.checkout = Some(dir);
+    }
+
+    let webref_data = webref::get_webref_data(
+        &fetcher,
+        &location,
+        &options.cache_dir,
+        &WebRefSettings {
+            listing_ttl: options.spec_index_ttl,
+            max_age: options.max_age,
+            maturity: options.maturity,
+            conflict_strategy: options.conflict_strategy,
+            decode_cache: options.decode_cache,
+            threads: options.threads,
+            limit: options.limit_specs,
+            explain: options.explain.clone(),
+        },
+        &mut timings,
+    )?;
+    if !webref_data.failed_files.is_empty() {
+        if options.strict {
+            bail!("spec files failed: {}", webref_data.failed_files.join(", "));
+        }
+        warn!(
+            "{} spec file(s) skipped: {}",
+            webref_data.failed_files.len(),
+            webref_data.failed_files.join(", ")
+        );
+    }
+    if !webref_data.alias_conflicts.is_empty() {
+        if options.strict {
+            bail!("conflicting legacy aliases: {}", webref_data.alias_conflicts.join("; "));
+        }
+        for conflict in &webref_data.alias_conflicts {
+            warn!("Conflicting legacy alias: {conflict}");
+        }
+    }
+    if !webref_data.syntax_conflicts.is_empty() {
+        for conflict in &webref_data.syntax_conflicts {
+            error!("Conflicting syntax: {conflict}");
+        }
+        bail!(
+            "{} conflicting syntax definition(s)",
+            webref_data.syntax_conflicts.len()
+        );
+    }
+    if !options.mdn {
+        info!("Skipping MDN; building from webref alone");
+        return merge(options, &webref_data, None, BTreeMap::new(), timings);
+    }
+    let mdn_data = timings.time("mdn", || mdn::get_mdn_data(&fetcher, &options.cache_dir))?;
+    let mdn_syntaxes = timings.time("mdn", || mdn::get_mdn_syntaxes(&fetcher, &options.cache_dir))?;
+
+    merge(options, &webref_data, Some(&mdn_data), mdn_syntaxes, timings)
+}
+
+/// A property's `inherited`: the spec's when its property table says `yes` or
+/// `no`, else MDN's, else false. A disagreement is logged, and the spec wins.
+fn merge_inherited(name: &str, webref: &str, mdn: Option<bool>) -> bool {
+    let spec = match webref {
+        "yes" => Some(true),
+        "no" => Some(false),
+        _ => None,
+    };
+    if let (Some(spec), Some(mdn)) = (spec, mdn) {
+        if spec != mdn {
+            warn!("{name}: webref gives inherited `{webref}` but MDN gives {mdn}; using webref's");
+        }
+    }
+    spec.or(mdn).unwrap_or_default()
+}
+
+/// Applies the property syntax patches and the grammar normalizations to the
+/// grammar a property was collected with.
+fn finish_syntax(name: &str, mut syntax: String, comma_list_idiom: &Regex, trace: &mut Option<Trace>) -> String {
+    if let Some((_, patched)) = PROPERTY_SYNTAX_PATCHES.iter().find(|(n, _)| *n == name) {
+        syntax = (*patched).to_string();
+        explain::record(trace, name, || format!("patched: syntax pinned to `{syntax}`"));
+    }
+
+    let normalized = comma_list_idiom.replace_all(&syntax, "[ ${1} , ]* ").into_owned();
+    let normalized = add_bare_fit_content(&normalized);
+    if normalized != syntax {
+        explain::record(trace, name, || format!("normalized: syntax is now `{normalized}`"));
+    }
+    normalized
+}
+
+/// The post-processors of a run: the built-in ones in the order of
+/// `postprocess::NAMES`, as rearranged by `arrange_processors`. The obsolete
+/// list is only added with `include_obsolete`, and pruning with
+/// `prune_values`.
+fn postprocessors(
+    options: &Options,
+    webref_by_name: &BTreeMap<&str, &webref::WebRefProperty>,
+    aliases: &PropertyAliasTable,
+    declared_features: BTreeMap<String, String>,
+) -> Vec<Box<dyn PostProcessor>> {
+    let mut processors: Vec<Box<dyn PostProcessor>> = Vec::new();
+    if options.include_obsolete {
+        processors.push(Box::new(ObsoleteProperties {
+            path: PathBuf::from(OBSOLETE_PATH),
+            webref_names: webref_by_name.keys().map(|n| n.to_string()).collect(),
+        }));
+    }
+    // Before the overrides, which keep the last word.
+    processors.push(Box::new(GlobalKeywords));
+    processors.push(Box::new(AliasSyntaxes {
+        aliases: aliases.clone(),
+        missing: options.missing_alias_target,
+    }));
+    if let Some(path) = &options.overrides {
+        processors.push(Box::new(ApplyOverrides { path: path.clone() }));
+    }
+    // After the overrides, so corrected longhand initials are composed.
+    processors.push(Box::new(ShorthandInitials));
+    // After the overrides, so a corrected @property or @media descriptor is
+    // picked up.
+    processors.push(Box::new(PropertyRegistration));
+    processors.push(Box::new(MediaFeatures {
+        declared: declared_features,
+    }));
+    // Last, after every processor that adds values.
+    if options.prune_values {
+        processors.push(Box::new(PruneValues));
+    }
+    if let Some(arrange) = &options.arrange_processors {
+        arrange.apply(&mut processors);
+    }
+    processors
+}
+
+/// Merges the downloaded sources into the sorted definitions and runs the
+/// overrides and checks over them. Needs no network or cache. Without
+/// `mdn_data` (`--no-mdn`) webref's properties are exported as they are.
+fn merge(
+    options: &Options,
+    webref_data: &WebRefData,
+    mdn_data: Option<&BTreeMap<String, MdnItem>>,
+    mdn_syntaxes: BTreeMap<String, String>,
+    mut timings: Timings,
+) -> Result<Generated> {
+    // A value-definition-syntax comma multiplier at the very end of a grammar.
+    let trailing_comma_multiplier = Regex::new(r"#(\{[0-9]+(,[0-9]*)?\})?\s*$")?;
+
+    // The "optional comma-list, then a mandatory comma, then a final term"
+    // shorthand that MDN and webref both use to flatten a repeated layer group
+    // onto one line (e.g. `background = <bg-layer>#? , <final-bg-layer>`).
+    // It is rewritten into the spec's actual grammar, where the separating
+    // comma lives inside the repeat: `[ <X> , ]* <Y>`. The linearized form
+    // makes the comma mandatory, so a single final term (`background: red`)
+    // fails to match; keeping the comma inside the repeat matches both one
+    // and many layers.
+    let comma_list_idiom = Regex::new(r"(<[^>]+>)#\? , ")?;
+
+    let merge_start = Instant::now();
+
+    let mut data = Data::default();
+    let mut trace = webref_data.trace.clone();
+
+    info!(
+        "Webref data: {} properties, {} values, {} at-rules, {} selectors",
+        webref_data.properties.len(),
+        webref_data.values.len(),
+        webref_data.at_rules.len(),
+        webref_data.selectors.len(),
+    );
+
+    // Index webref properties by name so we can source authoritative grammar
+    // (syntax) from the W3C specs. webref is standards-scoped and does not
+    // cover vendor-prefixed or legacy properties.
+    let webref_by_name: BTreeMap<&str, &webref::WebRefProperty> =
+        webref_data.properties.iter().map(|p| (p.name.as_str(), p)).collect();
+
+    // Legacy aliases are exported as propAliases, so MDN not listing them is
+    // no gap.
+    let webref_properties = webref_data.properties.iter().filter(|p| p.legacy_alias_of.is_empty());
+    let coverage = match mdn_data {
+        Some(mdn_data) => Coverage::compare(
+            webref_properties.clone().map(|p| p.name.as_str()),
+            mdn_data.keys().map(String::as_str),
+        ),
+        None => Coverage::default(),
+    };
+
+    // Without MDN, webref's properties are the set, each with its own grammar
+    // and initial value. webref has no computed values.
+    if mdn_data.is_none() {
+        for webref_prop in webref_properties {
+            let name = &webref_prop.name;
+            if webref_prop.syntax.is_empty() {
+                warn!("Skipping {name}: webref has only newValues for it");
+                continue;
+            }
+            explain::record(&mut trace, name, || {
+                format!(
+                    "webref only (--no-mdn): initial `{}`, inherited `{}`",
+                    webref_prop.initial, webref_prop.inherited
+                )
+            });
+            let syntax = finish_syntax(name, webref_prop.syntax.clone(), &comma_list_idiom, &mut trace);
+            data.properties.push(Property {
+                name: name.clone(),
+                syntax,
+                computed: Vec::new(),
+                initial: StringMaybeArray {
+                    string: normalize_initial(&webref_prop.initial),
+                    ..Default::default()
+                },
+                initial_derived: false,
+                inherited: merge_inherited(name, &webref_prop.inherited, None),
+                // What MDN's own entries default to when they omit the field.
+                animation_type: mdn::default_animation_type(),
+                percentages: mdn::default_percentages(),
+                longhands: Vec::new(),
+                obsolete: false,
+                mdn_url: String::new(),
+                sources: webref_prop.sources.clone(),
+            });
+        }
+    }
+
+    // MDN is the authoritative property SET: it tracks the full shipping
+    // surface including vendor-prefixed and legacy properties that webref
+    // omits. For each property we prefer webref's spec grammar for the syntax,
+    // falling back to MDN's syntax when webref has no entry for it.
+    for (name, mdn_prop) in mdn_data.into_iter().flatten() {
+        let mut syntax = mdn_prop.syntax.clone();
+        let mut sources = vec![mdn::properties_source()];
+        let mut from = "MDN (webref has none)";
+        let webref_prop = webref_by_name.get(name.as_str());
+        if let Some(webref_prop) = webref_prop {
+            if !webref_prop.syntax.is_empty() {
+                syntax = webref_prop.syntax.clone();
+                sources = webref_prop.sources.clone();
+                from = "webref";
+            }
+        }
+        explain::record(&mut trace, name, || {
+            format!(
+                "MDN: syntax from {from}; initial `{}`, inherited {:?}, computed `{}`, animation type `{}`",
+                mdn_prop.initial.to_list().join(", "),
+                mdn_prop.inherited,
+                mdn_prop.computed.to_list().join(", "),
+                mdn_prop.animation_type.to_list().join(", ")
+            )
+        });
+
+        let syntax = finish_syntax(name, syntax, &comma_list_idiom, &mut trace);
+
+        data.properties.push(Property {
+            name: name.clone(),
+            syntax,
+            computed: mdn_prop.computed.to_list(),
+            initial: normalize_initials(&mdn_prop.initial),
+            initial_derived: false,
+            inherited: merge_inherited(
+                name,
+                webref_prop.map_or("", |p| p.inherited.as_str()),
+                mdn_prop.inherited,
+            ),
+            animation_type: mdn_prop.animation_type.clone(),
+            percentages: mdn_prop.percentages.clone(),
+            longhands: mdn_prop.longhands(),
+            obsolete: false,
+            mdn_url: if options.with_docs {
+                mdn_prop.mdn_url.clone()
+            } else {
+                String::new()
+            },
+            sources,
+        });
+    }
+
+    // Every longhand a shorthand expands to should itself be a collected
+    // property; a miss means the shorthand cannot be expanded by the engine.
+    let collected: BTreeSet<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
+    for prop in &data.properties {
+        for longhand in &prop.longhands {
+            if !collected.contains(longhand.as_str()) {
+                warn!("Shorthand {} lists unknown longhand {longhand}", prop.name);
+            }
+        }
+    }
+
+    for value in &webref_data.values {
+        data.values.push(Value {
+            name: value.name.clone(),
+            syntax: value.syntax.clone(),
+            kind: ValueKind::classify(&value.value_type, &value.name),
+            children: value.children.clone(),
+            sources: value.sources.clone(),
+        });
+    }
+
+    // Value definitions are named "<name>" in the output; track them by that
+    // form, case-insensitively, so MDN's `<translateX()>` matches however a
+    // spec spells it.
+    let mut defined_values: BTreeSet<String> = data.values.iter().map(|v| value_key(&v.name)).collect();
+
+    // Backfill 1: MDN's syntaxes.json is a value-type dictionary webref does
+    // not fully cover (e.g. outline-radius, single-animation-*). Add every
+    // entry webref did not already define, so grammar references to them
+    // resolve.
+    for (name, syntax) in mdn_syntaxes {
+        let key = format!("<{name}>");
+        if syntax.is_empty() || defined_values.contains(&value_key(&key)) {
+            continue;
+        }
+        defined_values.insert(value_key(&key));
+        data.values.push(Value {
+            name: key,
+            syntax,
+            kind: ValueKind::Type,
+            children: Vec::new(),
+            sources: vec![mdn::syntaxes_source()],
+        });
+    }
+
+    // Backfill 2: webref decomposes some shorthands into sub-properties it
+    // then references as value types (e.g. box-shadow -> <spread-shadow>,
+    // which uses <'box-shadow-blur'>). Those sub-properties live in webref but
+    // not in MDN's property set, so they are absent from data.properties. Emit
+    // any webref property that some grammar references but that is otherwise
+    // undefined, as a value-type definition sourced from its webref grammar.
+    let mdn_prop_set: BTreeSet<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
+
+    let mut corpus = String::new();
+    for prop in &data.properties {
+        corpus.push_str(&prop.syntax);
+        corpus.push('\n');
+    }
+    for value in &data.values {
+        corpus.push_str(&value.syntax);
+        corpus.push('\n');
+    }
+
+    for wp in &webref_data.properties {
+        let key = format!("<{}>", wp.name);
+        if wp.syntax.is_empty() || mdn_prop_set.contains(wp.name.as_str()) || defined_values.contains(&value_key(&key))
+        {
+            continue;
+        }
+        // Only capture it when a grammar actually references it as a value
+        // type, either as <name> or as the property-reference form <'name'>.
+        if corpus.contains(&key) || corpus.contains(&format!("<'{}'>", wp.name)) {
+            // A standalone property may be comma-separated (a trailing `#`),
+            // but when it is embedded as a value type in another grammar it
+            // stands for a single value (e.g. one shadow's <box-shadow-color>
+            // inside <spread-shadow>). Keeping the `#` makes that inner list
+            // greedily consume the separator comma of the outer list. Drop the
+            // trailing comma multiplier.
+            data.values.push(Value {
+                name: key.clone(),
+                syntax: strip_trailing_comma_multiplier(&trailing_comma_multiplier, &wp.syntax),
+                kind: ValueKind::Type,
+                children: Vec::new(),
+                sources: wp.sources.clone(),
+            });
+            explain::record(&mut trace, &wp.name, || {
+                format!("not in MDN, but referenced by a grammar: exported as the value {key}")
+            });
+            defined_values.insert(value_key(&key));
+        }
+    }
+
+    // Backfill 3: value types no source defines (see MISSING_VALUE_PATCHES).
+    for (name, syntax) in MISSING_VALUE_PATCHES {
+        if defined_values.contains(&value_key(name)) {
+            continue;
+        }
+        data.values.push(Value {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            kind: ValueKind::classify("", name),
+            children: Vec::new(),
+            sources: Vec::new(),
+        });
+        defined_values.insert(value_key(name));
+    }
+
+    // Pin value definitions that specs duplicate with conflicting grammars.
+    for value in &mut data.values {
+        if let Some((_, patched)) = VALUE_SYNTAX_PATCHES.iter().find(|(n, _)| *n == value.name) {
+            value.syntax = (*patched).to_string();
+        }
+    }
+
+    for at_rule in &webref_data.at_rules {
+        let mut descriptors = Vec::with_capacity(at_rule.descriptors.len());
+
+        for descriptor in &at_rule.descriptors {
+            descriptors.push(AtRuleDescriptor {
+                name: descriptor.name.clone(),
+                syntax: descriptor.syntax.clone(),
+                initial: normalize_initial(&descriptor.initial),
+                sources: descriptor.sources.clone(),
+            });
+        }
+
+        data.atrules.push(AtRule {
+            name: at_rule.name.clone(),
+            prelude: prelude::extract(&at_rule.name, &at_rule.syntax),
+            forms: prelude::forms(&at_rule.name, &at_rule.syntax),
+            descriptors,
+            values: at_rule.values.clone(),
+            registration: None,
+            media_features: None,
+            sources: at_rule.sources.clone(),
+        });
+    }
+
+    data.selectors = webref_data.selectors.clone();
+
+    let declared_features: BTreeMap<String, String> = webref_data
+        .at_rules
+        .iter()
+        .filter(|a| a.name == media_features::AT_RULE)
+        .flat_map(|a| &a.descriptors)
+        .filter(|d| !d.descriptor_type.is_empty())
+        .map(|d| (d.name.clone(), d.descriptor_type.clone()))
+        .collect();
+    let alias_table = PropertyAliasTable::from_webref(&webref_data.properties);
+    let cycles: Vec<String> = alias_table
+        .cycles()
+        .iter()
+        .map(|cycle| format!("{} -> {}", cycle.join(" -> "), cycle[0]))
+        .collect();
+    if !cycles.is_empty() {
+        if options.strict {
+            bail!("legacy alias cycles: {}", cycles.join("; "));
+        }
+        for cycle in &cycles {
+            error!("Legacy alias cycle, none of its aliases resolve: {cycle}");
+        }
+    }
+    postprocess::run(
+        &postprocessors(options, &webref_by_name, &alias_table, declared_features),
+        &options.disabled_processors,
+        &mut data,
+        &mut trace,
+    )?;
+
+    let malformed = syntax_check::report_malformed(&data);
+    if malformed > 0 {
+        warn!("{malformed} malformed syntax definition(s) found");
+    }
+
+    if options.validate_initial || options.strict {
+        let invalid = initial_check::report_invalid_initials(&data.index());
+        if invalid > 0 {
+            if options.strict {
+                bail!("{invalid} initial value(s) do not match their property syntax");
+            }
+            warn!("{invalid} initial value(s) do not match their property syntax");
+        }
+    }
+
+    info!(
+        "Collected data: {} properties, {} values, {} at-rules, {} selectors",
+        data.properties.len(),
+        data.values.len(),
+        data.atrules.len(),
+        data.selectors.len(),
+    );
+
+    // Sort elements, so that the output is deterministic and we have less
+    // issues with version control
+    data.properties.sort_by(|a, b| a.name.cmp(&b.name));
+    data.values.sort_by(|a, b| a.name.cmp(&b.name));
+    data.atrules.sort_by(|a, b| a.name.cmp(&b.name));
+    // webref does not emit at-rule descriptors/values in a stable order, so
+    // sort the nested collections too; otherwise every regeneration produces
+    // spurious churn.
+    for at_rule in &mut data.atrules {
+        at_rule.descriptors.sort_by(|a, b| a.name.cmp(&b.name));
+        if let Some(values) = &mut at_rule.values {
+            // Merging specs can leave duplicate names (e.g. @media has two
+            // "all" entries); tie-break on value and nested-list size so the
+            // order does not depend on which spec file was processed first.
+            values.sort_by(|a, b| {
+                a.name
+                    .cmp(&b.name)
+                    .then_with(|| a.value.cmp(&b.value))
+                    .then_with(|| a.values.as_ref().map(Vec::len).cmp(&b.values.as_ref().map(Vec::len)))
+            });
+            for value in values {
+                if let Some(entries) = &mut value.values {
+                    entries.sort_by(|a, b| a.name.cmp(&b.name).then_with(|| a.value.cmp(&b.value)));
+                }
+            }
+        }
+    }
+    data.selectors.sort_by(|a, b| a.name.cmp(&b.name));
+
+    data.prop_aliases = alias::prop_aliases(&alias_table, &data);
+    // Already in name order from the table; sorted here so the export does
+    // not depend on that.
+    data.prop_aliases.sort_by(|a, b| a.name.cmp(&b.name));
+    data.reverse_aliases = alias::reverse_aliases(&alias_table, &data);
+    timings.record("merge", merge_start.elapsed());
+
+    Ok(Generated {
+        data,
+        aliases: alias_table,
+        coverage,
+        timings,
+        trace,
+        webref_commit: webref_data.commit.clone(),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::export::{self, ExportOptions};
+    use crate::manifest::{Manifest, MANIFEST_FILE};
+    use std::fs;
+    use std::path::Path;
+
+    /// Fixture spec extracts (`webref/`), MDN files (`mdn/`), and the
+    /// expected merge result (`expected.json`).
+    const GOLDEN_DIR: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/testdata/golden");
+
+    #[test]
+    fn processors_can_be_arranged() {
+        let names = |options: &Options| -> Vec<&'static str> {
+            postprocessors(
+                options,
+                &BTreeMap::new(),
+                &PropertyAliasTable::default(),
+                BTreeMap::new(),
+            )
+            .iter()
+            .map(|p| p.name())
+            .collect()
+        };
+        let options = Options {
+            overrides: None,
+            prune_values: true,
+            ..Default::default()
+        };
+        assert_eq!(
+            names(&options),
+            [
+                "global-keywords",
+                "alias-syntaxes",
+                "shorthand-initials",
+                "registration",
+                "media-features",
+                "prune-values"
+            ]
+        );
+
+        // Pruning moved up front, and the alias syntaxes left to the caller.
+        let options = Options {
+            arrange_processors: Some(Arrange::new(|processors| {
+                processors.retain(|p| p.name() != "alias-syntaxes");
+                let prune = processors.pop().unwrap();
+                processors.insert(0, prune);
+            })),
+            ..options
+        };
+        assert_eq!(
+            names(&options),
+            [
+                "prune-values",
+                "global-keywords",
+                "shorthand-initials",
+                "registration",
+                "media-features"
+            ]
+        );
+    }
+
+    #[test]
+    fn bare_fit_content_is_added_once() {
+        assert_eq!(
+            add_bare_fit_content("auto | fit-content( <length-percentage> )"),
+            "auto | fit-content | fit-content( <length-percentage> )"
+        );
+        assert_eq!(
+            add_bare_fit_content("fit-content | fit-content( <length-percentage> )"),
+            "fit-content | fit-content( <length-percentage> )"
+        );
+        assert_eq!(add_bare_fit_content("auto"), "auto");
+    }
+
+    #[test]
+    fn not_applicable_initials_are_emptied() {
+        for initial in ["n/a", "N/A", " n/a ", "N/A\n", "Not applicable", "n.a.", "", "  "] {
+            assert_eq!(normalize_initial(initial), "", "{initial:?}");
+        }
+        // Values that merely start like a placeholder are kept.
+        for initial in ["normal", "none", "nAAn", "auto", "no-repeat"] {
+            assert_eq!(normalize_initial(initial), initial);
+        }
+        assert_eq!(normalize_initial("  0s "), "0s");
+
+        let array = StringMaybeArray {
+            array: vec!["margin-top".to_string(), "N/A".to_string()],
+            is_array: true,
+            ..Default::default()
+        };
+        assert_eq!(normalize_initials(&array).array, ["margin-top"]);
+    }
+
+    #[test]
+    fn inherited_comes_from_webref_then_mdn() {
+        // webref only
+        assert!(merge_inherited("color", "yes", None));
+        assert!(!merge_inherited("margin", "no", None));
+        // MDN only: webref omits the field or gives prose
+        assert!(merge_inherited("font-size", "", Some(true)));
+        assert!(merge_inherited("font", "see individual properties", Some(true)));
+        // In conflict, webref wins
+        assert!(!merge_inherited("quotes", "no", Some(true)));
+        // Neither
+        assert!(!merge_inherited("zoom", "", None));
+    }
+
+    #[test]
+    fn trailing_comma_multiplier_is_stripped() {
+        let re = Regex::new(r"#(\{[0-9]+(,[0-9]*)?\})?\s*$").unwrap();
+        assert_eq!(strip_trailing_comma_multiplier(&re, "<shadow>#"), "<shadow>");
+        assert_eq!(strip_trailing_comma_multiplier(&re, "<color>#{1,4} "), "<color>");
+        assert_eq!(strip_trailing_comma_multiplier(&re, "[ <a>#, <b> ]"), "[ <a>#, <b> ]");
+    }
+
+    #[test]
+    fn without_mdn_webref_properties_are_exported_as_they_are() {
+        let extract = br#"{
+            "spec": {"title": "CSS Box Model", "url": "https://drafts.csswg.org/css-box-4/"},
+            "properties": [
+                {"name": "margin-top", "value": "<length-percentage> | auto", "initial": "0", "inherited": "no"},
+                {"name": "word-wrap", "value": "normal | break-word", "legacyAliasOf": "overflow-wrap"},
+                {"name": "overflow-wrap", "value": "normal | break-word", "initial": "normal", "inherited": "yes"}
+            ]
+        }"#;
+        let webref_data = webref::decode_files(&[("css-box.json".to_string(), extract.to_vec())]);
+        let options = Options {
+            mdn: false,
+            overrides: None,
+            ..Default::default()
+        };
+        let generated = merge(&options, &webref_data, None, BTreeMap::new(), Timings::default()).unwrap();
+
+        assert_eq!(generated.coverage, Coverage::default());
+        let properties: Vec<(&str, &str, bool, usize)> = generated
+            .data
+            .properties
+            .iter()
+            .map(|p| {
+                (
+                    p.name.as_str(),
+                    p.initial.string.as_str(),
+                    p.inherited,
+                    p.computed.len(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            properties,
+            [("margin-top", "0", false, 0), ("overflow-wrap", "normal", true, 0)]
+        );
+        let margin_top = &generated.data.properties[0];
+        assert_eq!(margin_top.animation_type.string, "notAnimatable");
+        assert_eq!(margin_top.percentages.string, "no");
+    }
+
+    #[test]
+    fn mdn_urls_are_only_exported_with_docs() {
+        let webref_data = webref::decode_files(&[(
+            "css-box.json".to_string(),
+            br#"{"properties": [{"name": "margin-top", "value": "<length-percentage> | auto"}]}"#.to_vec(),
+        )]);
+        let mdn_data: BTreeMap<String, MdnItem> = serde_json::from_str(
+            r#"{
+                "margin-top": {"syntax": "<length-percentage> | auto", "initial": "0",
+                               "mdn_url": "https://developer.mozilla.org/docs/Web/CSS/margin-top"},
+                "zoom": {"syntax": "normal | <number>", "initial": "normal"}
+            }"#,
+        )
+        .unwrap();
+        let mdn_urls = |with_docs| {
+            let options = Options {
+                with_docs,
+                overrides: None,
+                ..Default::default()
+            };
+            let generated = merge(
+                &options,
+                &webref_data,
+                Some(&mdn_data),
+                BTreeMap::new(),
+                Timings::default(),
+            )
+            .unwrap();
+            let urls: Vec<(String, String)> = generated
+                .data
+                .properties
+                .into_iter()
+                .map(|p| (p.name, p.mdn_url))
+                .collect();
+            urls
+        };
+
+        assert!(mdn_urls(false).iter().all(|(_, url)| url.is_empty()));
+        assert_eq!(
+            mdn_urls(true),
+            [
+                (
+                    "margin-top".to_string(),
+                    "https://developer.mozilla.org/docs/Web/CSS/margin-top".to_string()
+                ),
+                ("zoom".to_string(), String::new()),
+            ]
+        );
+    }
+
+    /// Runs the merge over the fixtures and compares the result with
+    /// `expected.json`. After an intended change, regenerate it with
+    /// `UPDATE_GOLDEN=1 cargo test -p generate_definitions` and review the diff.
+    #[test]
+    fn fixture_specs_merge_to_the_golden_data() {
+        let dir = Path::new(GOLDEN_DIR);
+
+        // Listing order, as GitHub returns it.
+        let mut files: Vec<(String, Vec<u8>)> = fs::read_dir(dir.join("webref"))
+            .unwrap()
+            .map(|entry| {
+                let path = entry.unwrap().path();
+                let name = path.file_name().unwrap().to_string_lossy().into_owned();
+                (name, fs::read(&path).unwrap())
+            })
+            .collect();
+        files.sort();
+        let webref_data = webref::decode_files(&files);
+        let mdn_data = mdn::parse_properties(&fs::read(dir.join("mdn/properties.json")).unwrap()).unwrap();
+        let mdn_syntaxes = mdn::parse_syntaxes(&fs::read(dir.join("mdn/syntaxes.json")).unwrap()).unwrap();
+
+        // Overrides record their file path as a source, so the golden data
+        // runs without any (they have tests of their own).
+        let options = Options {
+            overrides: None,
+            ..Default::default()
+        };
+        let generated = merge(
+            &options,
+            &webref_data,
+            Some(&mdn_data),
+            mdn_syntaxes,
+            Timings::default(),
+        )
+        .unwrap();
+        assert_eq!(
+            generated.coverage.webref_only,
+            ["box-shadow-color", "box-shadow-offset", "white-space-collapse"]
+        );
+        assert_eq!(generated.coverage.mdn_only, ["-webkit-line-clamp", "clip"]);
+
+        let actual = serde_json::to_string_pretty(&generated.data).unwrap() + "\n";
+        let golden = dir.join("expected.json");
+        if std::env::var_os("UPDATE_GOLDEN").is_some() {
+            fs::write(&golden, &actual).unwrap();
+            return;
+        }
+        let expected = fs::read_to_string(&golden).unwrap_or_default();
+        assert!(
+            actual == expected,
+            "merged data differs from {}; if the change is intended, rerun with UPDATE_GOLDEN=1",
+            golden.display()
+        );
+    }
+
+    #[test]
+    fn a_full_generation_runs_in_the_given_cache_and_output_dirs() {
+        let golden = Path::new(GOLDEN_DIR);
+        let root = tempfile::tempdir().unwrap();
+
+        let extracts = root.path().join("webref/ed/css");
+        fs::create_dir_all(&extracts).unwrap();
+        for entry in fs::read_dir(golden.join("webref")).unwrap() {
+            let path = entry.unwrap().path();
+            fs::copy(&path, extracts.join(path.file_name().unwrap())).unwrap();
+        }
+        // Offline, MDN's files can only come from this cache.
+        let cache_dir = root.path().join("cache");
+        fs::create_dir_all(cache_dir.join("mdn")).unwrap();
+        for name in ["properties.json", "syntaxes.json"] {
+            fs::copy(golden.join("mdn").join(name), cache_dir.join("mdn").join(name)).unwrap();
+        }
+
+        let options = Options {
+            offline: true,
+            webref: WebRefLocation {
+                checkout: Some(root.path().join("webref")),
+                ..Options::default().webref
+            },
+            cache_dir,
+            overrides: None,
+            ..Default::default()
+        };
+        let generated = generate(&options).unwrap();
+
+        let output_dir = root.path().join("out");
+        let manifest = Manifest::new(&generated.data, None);
+        let files = export::render_outputs(&generated.data, &manifest, &output_dir, &ExportOptions::default()).unwrap();
+        export::write_outputs(&files, false, false).unwrap();
+
+        // The same merge as the golden data, read from the checkout and cache.
+        let read = |path: PathBuf| -> serde_json::Value { serde_json::from_slice(&fs::read(path).unwrap()).unwrap() };
+        let written = read(output_dir.join("definitions.json"));
+        let expected = read(golden.join("expected.json"));
+        for kind in ["properties", "values", "atrules"] {
+            assert_eq!(written[kind], expected[kind], "{kind}");
+        }
+        assert!(output_dir.join(MANIFEST_FILE).exists());
+        assert!(output_dir.join("definitions_properties.json").exists());
+    }
+
+    #[test]
+    fn a_dry_run_unpacks_an_archive_outside_the_cache() {
+        let golden = Path::new(GOLDEN_DIR);
+        let root = tempfile::tempdir().unwrap();
+
+        let mut builder = tar::Builder::new(Vec::new());
+        for entry in fs::read_dir(golden.join("webref")).unwrap() {
+            let path = entry.unwrap().path();
+            let name = Path::new("webref-main/ed/css").join(path.file_name().unwrap());
+            builder.append_path_with_name(&path, name).unwrap();
+        }
+        let archive = root.path().join("webref.tar");
+        fs::write(&archive, builder.into_inner().unwrap()).unwrap();
+
+        let cache_dir = root.path().join("cache");
+        fs::create_dir_all(cache_dir.join("mdn")).unwrap();
+        for name in ["properties.json", "syntaxes.json"] {
+            fs::copy(golden.join("mdn").join(name), cache_dir.join("mdn").join(name)).unwrap();
+        }
+
+        let options = Options {
+            offline: true,
+            dry_run: true,
+            webref_archive: Some(archive),
+            cache_dir: cache_dir.clone(),
+            overrides: None,
+            ..Default::default()
+        };
+        let generated = generate(&options).unwrap();
+        assert!(!generated.data.properties.is_empty());
+        assert!(!cache_dir.join("archive").exists());
+    }
+}
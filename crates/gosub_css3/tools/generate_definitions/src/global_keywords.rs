@@ -0,0 +1,106 @@
+//! The CSS-wide keywords (`initial`, `inherit`, ...) are valid in every
+//! property, so no grammar names them and a spec extract may well leave them
+//! out. The engine relies on them being there, so each is exported as a
+//! keyword value whatever the sources gave.
+
+use crate::types::{add_source, Data, Source, Value, ValueKind};
+use log::warn;
+
+/// The CSS-wide keywords, in the order css-cascade lists them.
+pub const KEYWORDS: [&str; 5] = ["initial", "inherit", "unset", "revert", "revert-layer"];
+
+/// Provenance recorded on the keyword values.
+fn source() -> Source {
+    Source {
+        shortname: "css-cascade-5".to_string(),
+        title: "CSS Cascading and Inheritance Level 5".to_string(),
+        url: "https://drafts.csswg.org/css-cascade-5/#defaulting-keywords".to_string(),
+    }
+}
+
+/// Whether `name` is one of the CSS-wide keywords.
+pub fn is_global(name: &str) -> bool {
+    KEYWORDS.contains(&name)
+}
+
+/// Adds the CSS-wide keywords missing from `data`. One the sources define
+/// with another syntax is warned about and given its canonical definition.
+/// Returns how many were added.
+pub fn ensure(data: &mut Data) -> usize {
+    let mut added = 0;
+    for keyword in KEYWORDS {
+        match data.values.iter_mut().find(|v| v.name == keyword) {
+            Some(value) => {
+                if value.syntax != keyword || value.kind != ValueKind::Keyword {
+                    warn!(
+                        "CSS-wide keyword {keyword} is defined as {:?} `{}`, using the keyword itself",
+                        value.kind, value.syntax
+                    );
+                    value.syntax = keyword.to_string();
+                    value.kind = ValueKind::Keyword;
+                    value.children.clear();
+                }
+                add_source(&mut value.sources, &source());
+            }
+            None => {
+                data.values.push(Value {
+                    name: keyword.to_string(),
+                    syntax: keyword.to_string(),
+                    kind: ValueKind::Keyword,
+                    children: Vec::new(),
+                    sources: vec![source()],
+                });
+                added += 1;
+            }
+        }
+    }
+    added
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn value(name: &str, syntax: &str, kind: ValueKind) -> Value {
+        Value {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            kind,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn missing_keywords_are_added_and_conflicting_ones_corrected() {
+        let mut data = Data {
+            values: vec![
+                value("inherit", "inherit", ValueKind::Keyword),
+                value("revert", "revert | revert-layer", ValueKind::Type),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(ensure(&mut data), 3);
+
+        let mut values: Vec<(&str, &str, ValueKind, usize)> = data
+            .values
+            .iter()
+            .map(|v| (v.name.as_str(), v.syntax.as_str(), v.kind, v.sources.len()))
+            .collect();
+        values.sort_by_key(|v| v.0);
+        assert_eq!(
+            values,
+            [
+                ("inherit", "inherit", ValueKind::Keyword, 1),
+                ("initial", "initial", ValueKind::Keyword, 1),
+                ("revert", "revert", ValueKind::Keyword, 1),
+                ("revert-layer", "revert-layer", ValueKind::Keyword, 1),
+                ("unset", "unset", ValueKind::Keyword, 1),
+            ]
+        );
+
+        // Running again changes nothing.
+        assert_eq!(ensure(&mut data), 0);
+        assert_eq!(data.values.len(), 5);
+    }
+}
@@ -0,0 +1,564 @@
+//! `--validate-initial`: checks that each property's initial value is itself
+//! accepted by the property's grammar (`auto` for a syntax containing `auto`,
+//! `0% 0%` for `<bg-position>#`, ...). This catches bad MDN or webref data and
+//! bad overrides.
+//!
+//! The matcher here is deliberately small: it walks the grammars parsed by
+//! `syntax_check`, resolves `<type>` and `<'property'>` references through
+//! the collected data (parsing each referenced grammar once), and classifies
+//! primitive tokens (lengths, numbers, identifiers, ...). Anything it cannot
+//! decide (an undefined type, a `{ }` block grammar, deep recursion) makes the
+//! check inconclusive rather than a failure, so every reported mismatch is a
+//! real one.
+
+use crate::lookup::Index;
+use crate::syntax_check::{parse_grammar, Node};
+use anyhow::{bail, Result};
+use log::{debug, warn};
+use std::cell::RefCell;
+use std::collections::{BTreeMap, BTreeSet};
+use std::rc::Rc;
+
+/// How deep `<type>` references are followed before giving up.
+const MAX_DEPTH: usize = 24;
+
+/// A component value of a CSS value (the initial value being checked).
+#[derive(Debug, Clone, PartialEq)]
+enum ValueToken {
+    Ident(String),
+    Number { value: f64, unit: String, text: String },
+    Hash,
+    String,
+    Function(String, Vec<ValueToken>),
+    Delim(char),
+}
+
+fn tokenize_value(value: &str) -> Result<Vec<ValueToken>> {
+    let chars: Vec<char> = value.chars().collect();
+    let mut i = 0;
+    let tokens = tokenize_values(&chars, &mut i, false)?;
+    Ok(tokens)
+}
+
+fn is_ident_char(c: char) -> bool {
+    c.is_alphanumeric() || c == '-' || c == '_' || !c.is_ascii()
+}
+
+fn tokenize_values(chars: &[char], i: &mut usize, in_function: bool) -> Result<Vec<ValueToken>> {
+    let mut tokens = Vec::new();
+
+    while *i < chars.len() {
+        let c = chars[*i];
+        let next = chars.get(*i + 1).copied();
+        let starts_number = |c: char| c.is_ascii_digit() || c == '.';
+        match c {
+            _ if c.is_whitespace() => *i += 1,
+            ')' if in_function => {
+                *i += 1;
+                return Ok(tokens);
+            }
+            '"' | '\'' => match chars[*i + 1..].iter().position(|&q| q == c) {
+                Some(end) => {
+                    *i += end + 2;
+                    tokens.push(ValueToken::String);
+                }
+                None => bail!("unterminated string"),
+            },
+            '#' => {
+                *i += 1;
+                while *i < chars.len() && is_ident_char(chars[*i]) {
+                    *i += 1;
+                }
+                tokens.push(ValueToken::Hash);
+            }
+            _ if starts_number(c) || (matches!(c, '+' | '-') && next.is_some_and(starts_number)) => {
+                let start = *i;
+                *i += 1;
+                while *i < chars.len() && starts_number(chars[*i]) {
+                    *i += 1;
+                }
+                let number: String = chars[start..*i].iter().collect();
+                let unit_start = *i;
+                if chars.get(*i) == Some(&'%') {
+                    *i += 1;
+                } else {
+                    while *i < chars.len() && is_ident_char(chars[*i]) {
+                        *i += 1;
+                    }
+                }
+                tokens.push(ValueToken::Number {
+                    value: number.parse()?,
+                    unit: chars[unit_start..*i].iter().collect(),
+                    text: chars[start..*i].iter().collect(),
+                });
+            }
+            _ if is_ident_char(c) => {
+                let start = *i;
+                while *i < chars.len() && is_ident_char(chars[*i]) {
+                    *i += 1;
+                }
+                let name: String = chars[start..*i].iter().collect();
+                if chars.get(*i) == Some(&'(') {
+                    *i += 1;
+                    let arguments = tokenize_values(chars, i, true)?;
+                    tokens.push(ValueToken::Function(name, arguments));
+                } else {
+                    tokens.push(ValueToken::Ident(name));
+                }
+            }
+            _ => {
+                tokens.push(ValueToken::Delim(c));
+                *i += 1;
+            }
+        }
+    }
+
+    if in_function {
+        bail!("unterminated function");
+    }
+    Ok(tokens)
+}
+
+const LENGTH_UNITS: &[&str] = &[
+    "px", "cm", "mm", "q", "in", "pt", "pc", "em", "rem", "ex", "rex", "cap", "rcap", "ch", "rch", "ic", "ric", "lh",
+    "rlh", "vw", "vh", "vi", "vb", "vmin", "vmax", "svw", "svh", "lvw", "lvh", "dvw", "dvh", "cqw", "cqh", "cqi",
+    "cqb", "cqmin", "cqmax",
+];
+
+/// Matches the primitive types that have no grammar of their own against the
+/// token at the current position (None at the end of the value). Returns
+/// None for any other type name.
+fn match_primitive(name: &str, token: Option<&ValueToken>) -> Option<bool> {
+    let number = match token {
+        Some(ValueToken::Number { value, unit, text }) => Some((*value, unit.as_str(), text.as_str())),
+        _ => None,
+    };
+    let has_unit =
+        |units: &[&str]| number.is_some_and(|(_, unit, _)| units.iter().any(|u| u.eq_ignore_ascii_case(unit)));
+    let is_zero = number.is_some_and(|(value, unit, _)| value == 0.0 && unit.is_empty());
+
+    Some(match name {
+        "length" => has_unit(LENGTH_UNITS) || is_zero,
+        "percentage" => has_unit(&["%"]),
+        "number" => has_unit(&[""]),
+        "integer" => number.is_some_and(|(_, unit, text)| unit.is_empty() && !text.contains('.')),
+        "angle" => has_unit(&["deg", "grad", "rad", "turn"]) || is_zero,
+        "time" => has_unit(&["s", "ms"]),
+        "frequency" => has_unit(&["hz", "khz"]),
+        "resolution" => has_unit(&["dpi", "dpcm", "dppx", "x"]),
+        "flex" => has_unit(&["fr"]),
+        "ident" | "custom-ident" => matches!(token, Some(ValueToken::Ident(_))),
+        "dashed-ident" => matches!(token, Some(ValueToken::Ident(ident)) if ident.starts_with("--")),
+        "string" => matches!(token, Some(ValueToken::String)),
+        "hex-color" => matches!(token, Some(ValueToken::Hash)),
+        _ => return None,
+    })
+}
+
+/// The token positions a node can end at when matched from some start.
+#[derive(Debug, Default)]
+struct Ends {
+    ends: BTreeSet<usize>,
+    /// Some branch could not be decided (unknown type, unsupported grammar)
+    unknown: bool,
+}
+
+impl Ends {
+    fn unknown() -> Self {
+        Ends {
+            ends: BTreeSet::new(),
+            unknown: true,
+        }
+    }
+
+    fn merge(&mut self, other: Ends) {
+        self.ends.extend(other.ends);
+        self.unknown |= other.unknown;
+    }
+}
+
+/// The outcome of checking one value against one grammar.
+#[derive(Debug, PartialEq)]
+pub(crate) enum Check {
+    Valid,
+    Invalid,
+    Inconclusive,
+}
+
+pub(crate) struct Matcher<'a> {
+    /// Where referenced value types and properties are looked up
+    index: &'a Index<'a>,
+    /// Every grammar parsed so far, by its syntax; None when it does not parse
+    parsed: RefCell<BTreeMap<&'a str, Option<Rc<Node>>>>,
+}
+
+impl<'a> Matcher<'a> {
+    pub(crate) fn new(index: &'a Index<'a>) -> Self {
+        Matcher {
+            index,
+            parsed: RefCell::new(BTreeMap::new()),
+        }
+    }
+
+    /// The grammar of `syntax`, parsed on first use.
+    fn grammar(&self, syntax: &'a str) -> Option<Rc<Node>> {
+        self.parsed
+            .borrow_mut()
+            .entry(syntax)
+            .or_insert_with(|| parse_grammar(syntax).ok().map(Rc::new))
+            .clone()
+    }
+
+    /// Checks `value` against `syntax`; an empty syntax can't be checked.
+    pub(crate) fn check(&self, syntax: &'a str, value: &str) -> Check {
+        let Some(grammar) = self.grammar(syntax).filter(|_| !syntax.trim().is_empty()) else {
+            return Check::Inconclusive;
+        };
+        let Ok(tokens) = tokenize_value(value) else {
+            return Check::Invalid;
+        };
+        let ends = self.match_node(&grammar, &tokens, 0, 0);
+        if ends.ends.contains(&tokens.len()) {
+            Check::Valid
+        } else if ends.unknown {
+            Check::Inconclusive
+        } else {
+            Check::Invalid
+        }
+    }
+
+    /// Matches the grammar `syntax` (looked up by reference) at `start`.
+    fn match_reference(&self, syntax: Option<&'a str>, tokens: &[ValueToken], start: usize, depth: usize) -> Ends {
+        match syntax.filter(|s| !s.is_empty()).and_then(|s| self.grammar(s)) {
+            Some(grammar) if depth < MAX_DEPTH => self.match_node(&grammar, tokens, start, depth + 1),
+            _ => Ends::unknown(),
+        }
+    }
+
+    fn match_node(&self, node: &Node, tokens: &[ValueToken], start: usize, depth: usize) -> Ends {
+        let mut result = Ends::default();
+        let token = tokens.get(start);
+
+        match node {
+            Node::Keyword(keyword) => {
+                let matches = match token {
+                    Some(ValueToken::Ident(ident)) => ident.eq_ignore_ascii_case(keyword),
+                    Some(ValueToken::Number { text, .. }) => text == keyword,
+                    _ => false,
+                };
+                if matches {
+                    result.ends.insert(start + 1);
+                }
+            }
+            Node::Literal(literal) => {
+                if matches!(token, Some(ValueToken::Delim(c)) if literal.chars().eq([*c])) {
+                    result.ends.insert(start + 1);
+                }
+            }
+            Node::Type(name) => match match_primitive(name, token) {
+                Some(true) => {
+                    result.ends.insert(start + 1);
+                }
+                Some(false) => {}
+                None => {
+                    let syntax = self.index.value(&format!("<{name}>")).map(|v| v.syntax.as_str());
+                    result = self.match_reference(syntax, tokens, start, depth);
+                }
+            },
+            Node::Property(name) => {
+                let syntax = self.index.property(name).map(|p| p.syntax.as_str());
+                result = self.match_reference(syntax, tokens, start, depth);
+            }
+            Node::Block(_) => result = Ends::unknown(),
+            Node::Function(name, inner) => {
+                if let Some(ValueToken::Function(function, arguments)) = token {
+                    if function.eq_ignore_ascii_case(name) {
+                        let ends = self.match_node(inner, arguments, 0, depth);
+                        if ends.ends.contains(&arguments.len()) {
+                            result.ends.insert(start + 1);
+                        }
+                        result.unknown = ends.unknown;
+                    }
+                }
+            }
+            Node::Seq(nodes) => {
+                result.ends.insert(start);
+                for node in nodes {
+                    let mut next = Ends::default();
+                    for &position in &result.ends {
+                        next.merge(self.match_node(node, tokens, position, depth));
+                    }
+                    next.unknown |= result.unknown;
+                    result = next;
+                    if result.ends.is_empty() {
+                        break;
+                    }
+                }
+            }
+            Node::OneOf(nodes) => {
+                for node in nodes {
+                    result.merge(self.match_node(node, tokens, start, depth));
+                }
+            }
+            Node::AllOf(nodes) => self.match_unordered(
+                nodes,
+                &mut vec![false; nodes.len()],
+                true,
+                tokens,
+                start,
+                depth,
+                &mut result,
+            ),
+            Node::AnyOf(nodes) => self.match_unordered(
+                nodes,
+                &mut vec![false; nodes.len()],
+                false,
+                tokens,
+                start,
+                depth,
+                &mut result,
+            ),
+            Node::Repeat { node, min, max, comma } => {
+                if *min == 0 {
+                    result.ends.insert(start);
+                }
+                let mut current = BTreeSet::from([start]);
+                let limit = max.unwrap_or(tokens.len() + 1);
+                for count in 1..=limit {
+                    let mut next = Ends::default();
+                    for &position in &current {
+                        let position = match tokens.get(position) {
+                            Some(ValueToken::Delim(',')) if *comma && count > 1 => position + 1,
+                            _ if *comma && count > 1 => continue,
+                            _ => position,
+                        };
+                        next.merge(self.match_node(node, tokens, position, depth));
+                    }
+                    result.unknown |= next.unknown;
+                    if next.ends.is_empty() {
+                        break;
+                    }
+                    if count >= *min {
+                        result.ends.extend(&next.ends);
+                    }
+                    current = next.ends;
+                }
+            }
+        }
+
+        result
+    }
+
+    /// `&&` (`all`) and `||`: tries every not yet `used` node at `start`,
+    /// recording where a complete combination can end.
+    #[allow(clippy::too_many_arguments)]
+    fn match_unordered(
+        &self,
+        nodes: &[Node],
+        used: &mut Vec<bool>,
+        all: bool,
+        tokens: &[ValueToken],
+        start: usize,
+        depth: usize,
+        result: &mut Ends,
+    ) {
+        let used_count = used.iter().filter(|u| **u).count();
+        if (all && used_count == nodes.len()) || (!all && used_count > 0) {
+            result.ends.insert(start);
+        }
+        for i in 0..nodes.len() {
+            if used[i] {
+                continue;
+            }
+            let ends = self.match_node(&nodes[i], tokens, start, depth);
+            result.unknown |= ends.unknown;
+            used[i] = true;
+            for end in ends.ends {
+                self.match_unordered(nodes, used, all, tokens, end, depth, result);
+            }
+            used[i] = false;
+        }
+    }
+}
+
+/// MDN describes some initial values in prose, through a localization key
+/// (`dependsOnUserAgent`, `seeProse`, ...) rather than a CSS value.
+pub(crate) fn is_descriptive(initial: &str) -> bool {
+    initial.starts_with(|c: char| c.is_ascii_lowercase())
+        && initial.chars().all(|c| c.is_ascii_alphanumeric())
+        && initial.chars().any(|c| c.is_ascii_uppercase())
+}
+
+/// Checks every property's initial value against its syntax and logs the
+/// mismatches. An array initial (a shorthand's) must list known properties;
+/// those longhands are checked on their own. Returns how many mismatches were
+/// found.
+pub fn report_invalid_initials(index: &Index) -> usize {
+    let matcher = Matcher::new(index);
+    let mut invalid = 0;
+
+    for property in index.data().properties.iter().filter(|p| !p.syntax.is_empty()) {
+        if property.initial.is_array() {
+            for longhand in &property.initial.array {
+                if index.property(longhand).is_none() {
+                    warn!(
+                        "Initial value of property {} names unknown property {longhand}",
+                        property.name
+                    );
+                    invalid += 1;
+                }
+            }
+            continue;
+        }
+
+        let initial = property.initial.string.as_str();
+        if initial.is_empty() {
+            continue;
+        }
+        match matcher.check(&property.syntax, initial) {
+            Check::Valid => {}
+            Check::Inconclusive => debug!("Cannot check initial value of property {}: {initial}", property.name),
+            Check::Invalid if is_descriptive(initial) => {
+                debug!("Initial value of property {} is descriptive: {initial}", property.name)
+            }
+            Check::Invalid => {
+                warn!(
+                    "Initial value of property {} does not match its syntax\nInitial: {initial}\nSyntax: {}",
+                    property.name, property.syntax
+                );
+                invalid += 1;
+            }
+        }
+    }
+
+    invalid
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{Data, Property, StringMaybeArray, Value, ValueKind};
+
+    fn property(name: &str, syntax: &str, initial: StringMaybeArray) -> Property {
+        Property {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            initial,
+            ..Default::default()
+        }
+    }
+
+    fn value(name: &str, syntax: &str) -> Value {
+        Value {
+            name: name.to_string(),
+            syntax: syntax.to_string(),
+            kind: ValueKind::Type,
+            ..Default::default()
+        }
+    }
+
+    fn data() -> Data {
+        Data {
+            values: vec![
+                value("<length-percentage>", "[ <length> | <percentage> ]"),
+                value("<line-width>", "<length [0,∞]> | thin | medium | thick"),
+                value(
+                    "<bg-position>",
+                    "[ left | center | right | top | bottom | <length-percentage> ] | \
+                     [ left | center | right | <length-percentage> ] [ top | center | bottom | <length-percentage> ]",
+                ),
+            ],
+            properties: vec![property("border-top-width", "<line-width>", Default::default())],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn accepts_initials_matching_their_grammar() {
+        let data = data();
+        let index = data.index();
+        let matcher = Matcher::new(&index);
+        for (syntax, initial) in [
+            ("auto | <length>", "auto"),
+            ("<line-width>", "medium"),
+            ("<line-width>", "0"),
+            ("<bg-position>#", "0% 0%"),
+            ("<bg-position>#", "left top, 50% 10px"),
+            ("none | [ weight || style || small-caps ]", "weight style small-caps "),
+            ("<'border-top-width'>{1,4}", "medium thin"),
+            ("normal | [ <number> <integer>? ]", "1.5 2"),
+            (
+                "snapInterval( <percentage>, <percentage> ) | none",
+                "snapInterval(0%, 100%)",
+            ),
+            ("<length>{2} && inset?", "inset 1px 2px"),
+            ("auto | <custom-ident>", "currentColor"),
+        ] {
+            assert_eq!(matcher.check(syntax, initial), Check::Valid, "{initial} for {syntax}");
+        }
+    }
+
+    #[test]
+    fn rejects_initials_outside_their_grammar() {
+        let data = data();
+        let index = data.index();
+        let matcher = Matcher::new(&index);
+        for (syntax, initial) in [
+            ("none | <length>", "auto"),
+            ("<line-width>", "5%"),
+            ("<bg-position>#", "0% 0%,"),
+            ("[ weight || style ]", "weight weight"),
+            ("<length>{2}", "1px"),
+            ("<integer>", "1.5"),
+            ("snapInterval( <percentage>, <percentage> )", "snapInterval(0px, 100%)"),
+        ] {
+            assert_eq!(matcher.check(syntax, initial), Check::Invalid, "{initial} for {syntax}");
+        }
+    }
+
+    #[test]
+    fn undecidable_grammars_are_inconclusive() {
+        let data = data();
+        let index = data.index();
+        let matcher = Matcher::new(&index);
+        assert_eq!(matcher.check("<color>", "black"), Check::Inconclusive);
+        assert_eq!(matcher.check("<color> | none", "auto"), Check::Inconclusive);
+        assert_eq!(matcher.check("<x># { <declaration-list> }", "a"), Check::Inconclusive);
+        assert_eq!(matcher.check("<color> | none", "none"), Check::Valid);
+    }
+
+    #[test]
+    fn reports_only_real_mismatches() {
+        let mut data = data();
+        data.properties.extend([
+            property(
+                "quotes",
+                "auto | none",
+                StringMaybeArray {
+                    string: "dependsOnUserAgent".to_string(),
+                    ..Default::default()
+                },
+            ),
+            property(
+                "border-width",
+                "<line-width>{1,4}",
+                StringMaybeArray {
+                    array: vec!["border-top-width".to_string(), "border-nope-width".to_string()],
+                    is_array: true,
+                    ..Default::default()
+                },
+            ),
+            property(
+                "outline-width",
+                "<line-width>",
+                StringMaybeArray {
+                    string: "auto".to_string(),
+                    ..Default::default()
+                },
+            ),
+        ]);
+
+        // border-nope-width and outline-width's `auto`
+        assert_eq!(report_invalid_initials(&data.index()), 2);
+    }
+}
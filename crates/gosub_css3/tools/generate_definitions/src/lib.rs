@@ -0,0 +1,40 @@
+//! The definitions generator as a library: `generator::generate` runs the
+//! whole download-and-merge pipeline and returns the assembled `types::Data`,
+//! which `export` renders into the output files. The `generate_definitions`
+//! binary is a thin command-line wrapper around it.
+
+pub mod alias;
+mod archive;
+pub mod changelog;
+pub mod coverage;
+pub mod dependents;
+pub mod error;
+pub mod explain;
+pub mod export;
+mod fetch;
+pub mod filter;
+pub mod generator;
+mod global_keywords;
+mod initial_check;
+pub mod logger;
+pub mod lookup;
+pub mod manifest;
+mod mdn;
+mod media_features;
+mod obsolete;
+pub mod overrides;
+pub mod postprocess;
+mod prelude;
+mod registration;
+mod rust_export;
+mod schema;
+pub mod serve;
+mod shorthand_initial;
+pub mod spec_index;
+pub mod summary;
+mod syntax_check;
+#[cfg(test)]
+mod test_server;
+pub mod timing;
+pub mod types;
+pub mod webref;
@@ -0,0 +1,101 @@
+//! A minimal leveled logger for the `log` facade. Everything goes to stderr so
+//! stdout stays free for `--stdout` output. Debug and info records from
+//! dependencies (reqwest, rustls, ...) are dropped; their warnings and errors
+//! are kept. Warnings are also counted per module, for `--fail-on-warning`.
+
+use log::{Level, LevelFilter, Log, Metadata, Record};
+use parking_lot::Mutex;
+use std::collections::BTreeMap;
+
+struct StderrLogger;
+
+static LOGGER: StderrLogger = StderrLogger;
+
+/// Warnings emitted so far, keyed by category (see `category`).
+static WARNINGS: Mutex<BTreeMap<String, usize>> = Mutex::new(BTreeMap::new());
+
+/// The category of a record: the module that logged it (`webref`, `mdn`,
+/// ...), `main` for the crate root, or the dependency's crate name.
+fn category(record: &Record) -> String {
+    let path = record.module_path().unwrap_or(record.target());
+    match path.strip_prefix(env!("CARGO_CRATE_NAME")) {
+        Some("") => "main".to_string(),
+        Some(module) => module.trim_start_matches("::").to_string(),
+        None => path.split("::").next().unwrap_or(path).to_string(),
+    }
+}
+
+impl Log for StderrLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= log::max_level()
+            && (metadata.level() <= Level::Warn || metadata.target().starts_with(env!("CARGO_CRATE_NAME")))
+    }
+
+    fn log(&self, record: &Record) {
+        if !self.enabled(record.metadata()) {
+            return;
+        }
+        match record.level() {
+            Level::Info => eprintln!("{}", record.args()),
+            Level::Error => eprintln!("error: {}", record.args()),
+            Level::Warn => {
+                *WARNINGS.lock().entry(category(record)).or_default() += 1;
+                eprintln!("warning: {}", record.args());
+            }
+            Level::Debug | Level::Trace => eprintln!("debug: {}", record.args()),
+        }
+    }
+
+    fn flush(&self) {}
+}
+
+/// Installs the logger. `quiet` caps the level at warnings and errors.
+pub fn init(level: LevelFilter, quiet: bool) -> Result<(), log::SetLoggerError> {
+    log::set_logger(&LOGGER)?;
+    log::set_max_level(if quiet { level.min(LevelFilter::Warn) } else { level });
+    Ok(())
+}
+
+/// The number of warnings logged so far per category.
+pub fn warning_counts() -> BTreeMap<String, usize> {
+    WARNINGS.lock().clone()
+}
+
+/// Formats warning counts as `3 warning(s): mdn 1, webref 2`, or None when
+/// there were none.
+pub fn warning_summary(counts: &BTreeMap<String, usize>) -> Option<String> {
+    let total: usize = counts.values().sum();
+    let categories: Vec<String> = counts.iter().map(|(category, n)| format!("{category} {n}")).collect();
+    (total > 0).then(|| format!("{total} warning(s): {}", categories.join(", ")))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn record_from(module_path: &'static str) -> String {
+        category(
+            &Record::builder()
+                .level(Level::Warn)
+                .module_path_static(Some(module_path))
+                .build(),
+        )
+    }
+
+    #[test]
+    fn categories_are_modules() {
+        assert_eq!(record_from(env!("CARGO_CRATE_NAME")), "main");
+        assert_eq!(record_from(concat!(env!("CARGO_CRATE_NAME"), "::webref")), "webref");
+        assert_eq!(record_from("reqwest::connect"), "reqwest");
+    }
+
+    #[test]
+    fn summary_lists_counts_per_category() {
+        assert_eq!(warning_summary(&BTreeMap::new()), None);
+        let counts = BTreeMap::from([("webref".to_string(), 2), ("mdn".to_string(), 1)]);
+        assert_eq!(
+            warning_summary(&counts).as_deref(),
+            Some("3 warning(s): mdn 1, webref 2")
+        );
+    }
+}
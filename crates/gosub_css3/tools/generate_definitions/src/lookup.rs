@@ -0,0 +1,152 @@
+//! Name lookups into the generated `Data`, for code that consumes it as a
+//! library. [`Data::index`] builds the name maps once; the index borrows the
+//! data, so it cannot go stale while it is in use. Property lookups can
+//! follow `propAliases`, so a legacy name finds the property it stands for.
+//!
+//! The generator's own passes that look names up (the shorthand initials,
+//! the initial value check, the output filters, the aliases, the overrides)
+//! use it too, instead of each building their own maps or scanning the lists.
+//! A pass that changes entries needs `&mut Data`, which ends any index
+//! borrowing it: it looks up the positions of the entries first, drops the
+//! index, and then changes them by position.
+
+use crate::types::{AtRule, Data, Property, Value};
+use std::collections::HashMap;
+
+/// Properties, values, at-rules, and property aliases of one `Data`, by name.
+/// Entries are kept as their position in the lists of `data`. The maps are
+/// only looked up, never walked, so hash maps do: they are quicker to build.
+#[derive(Debug)]
+pub struct Index<'a> {
+    data: &'a Data,
+    properties: HashMap<&'a str, usize>,
+    values: HashMap<&'a str, usize>,
+    atrules: HashMap<&'a str, usize>,
+    aliases: HashMap<&'a str, &'a str>,
+}
+
+impl Data {
+    /// Indexes the definitions by name. Build it once and keep it for
+    /// repeated lookups.
+    pub fn index(&self) -> Index<'_> {
+        Index {
+            data: self,
+            properties: positions(self.properties.iter().map(|p| p.name.as_str())),
+            values: positions(self.values.iter().map(|v| v.name.as_str())),
+            atrules: positions(self.atrules.iter().map(|a| a.name.as_str())),
+            aliases: self
+                .prop_aliases
+                .iter()
+                .map(|a| (a.name.as_str(), a.property.as_str()))
+                .collect(),
+        }
+    }
+}
+
+/// Each name's position. A name listed twice is found at its first position,
+/// like a scan from the front would.
+fn positions<'a>(names: impl Iterator<Item = &'a str>) -> HashMap<&'a str, usize> {
+    let mut positions = HashMap::with_capacity(names.size_hint().0);
+    for (position, name) in names.enumerate() {
+        positions.entry(name).or_insert(position);
+    }
+    positions
+}
+
+impl<'a> Index<'a> {
+    /// The indexed data
+    pub fn data(&self) -> &'a Data {
+        self.data
+    }
+
+    /// The property named exactly `name`; aliases are not followed.
+    pub fn property(&self, name: &str) -> Option<&'a Property> {
+        Some(&self.data.properties[self.property_position(name)?])
+    }
+
+    /// The value type named `name`, angle brackets included (`<length>`).
+    pub fn value(&self, name: &str) -> Option<&'a Value> {
+        Some(&self.data.values[self.value_position(name)?])
+    }
+
+    /// The at-rule named `name`, `@` included (`@page`).
+    pub fn at_rule(&self, name: &str) -> Option<&'a AtRule> {
+        Some(&self.data.atrules[self.at_rule_position(name)?])
+    }
+
+    /// Where the property named exactly `name` is in `properties`.
+    pub fn property_position(&self, name: &str) -> Option<usize> {
+        self.properties.get(name).copied()
+    }
+
+    /// Where the value type named `name` is in `values`.
+    pub fn value_position(&self, name: &str) -> Option<usize> {
+        self.values.get(name).copied()
+    }
+
+    /// Where the at-rule named `name` is in `atrules`.
+    pub fn at_rule_position(&self, name: &str) -> Option<usize> {
+        self.atrules.get(name).copied()
+    }
+
+    /// The property `name` stands for: the property itself, or the one a
+    /// legacy alias resolves to (`word-wrap` gives `overflow-wrap`).
+    pub fn resolve_property(&self, name: &str) -> Option<&'a Property> {
+        self.property(name)
+            .or_else(|| self.aliases.get(name).and_then(|target| self.property(target)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::types::{Data, PropAlias, Property, Value, ValueKind};
+
+    fn property(name: &str) -> Property {
+        Property {
+            name: name.to_string(),
+            syntax: "normal | break-word | anywhere".to_string(),
+            inherited: true,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn lookups_are_direct_or_through_aliases() {
+        let data = Data {
+            properties: vec![property("overflow-wrap")],
+            values: vec![Value {
+                name: "<length>".to_string(),
+                syntax: "<number>px".to_string(),
+                kind: ValueKind::Type,
+                ..Default::default()
+            }],
+            prop_aliases: vec![
+                PropAlias {
+                    name: "word-wrap".to_string(),
+                    property: "overflow-wrap".to_string(),
+                },
+                PropAlias {
+                    name: "-old-wrap".to_string(),
+                    property: "gone".to_string(),
+                },
+            ],
+            ..Default::default()
+        };
+        let index = data.index();
+
+        assert_eq!(index.property("overflow-wrap").unwrap().name, "overflow-wrap");
+        assert!(index.property("word-wrap").is_none());
+        assert_eq!(index.resolve_property("word-wrap").unwrap().name, "overflow-wrap");
+        assert_eq!(index.resolve_property("overflow-wrap").unwrap().name, "overflow-wrap");
+        assert!(index.resolve_property("-old-wrap").is_none());
+        assert!(index.resolve_property("margin").is_none());
+
+        assert_eq!(index.value("<length>").unwrap().syntax, "<number>px");
+        assert!(index.value("length").is_none());
+        assert!(index.at_rule("@page").is_none());
+
+        assert_eq!(index.property_position("overflow-wrap"), Some(0));
+        assert_eq!(index.value_position("<length>"), Some(0));
+        assert!(index.property_position("word-wrap").is_none());
+    }
+}
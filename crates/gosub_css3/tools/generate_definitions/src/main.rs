@@ -1,337 +1,546 @@
 //! Generates the CSS definition JSON files embedded in gosub_css3
 //! (`resources/definitions/`) by merging webref's spec grammars with MDN's
 //! property metadata. See README.md for the full data-flow description.
-
-mod mdn;
-mod types;
-mod webref;
-
-use anyhow::Result;
-use regex::Regex;
-use std::collections::BTreeSet;
+//!
+//! This is the command-line wrapper; the pipeline itself is in the library
+//! (`generator::generate`). A failure exits with the code of its typed error
+//! (`error::Error::exit_code`), or 1.
+
+use anyhow::{bail, Context, Result};
+use clap::{Parser, Subcommand};
+use generate_definitions::alias::MissingTarget;
+use generate_definitions::dependents::Dependents;
+use generate_definitions::error::Error;
+use generate_definitions::export::{ExportOptions, MinifiedSize, OutputFormat, SplitBy};
+use generate_definitions::generator::{self, Options};
+use generate_definitions::manifest::{self, Manifest, MinCount};
+use generate_definitions::spec_index::Maturity;
+use generate_definitions::summary::Summary;
+use generate_definitions::webref::ConflictStrategy;
+use generate_definitions::{alias, changelog, export, filter, logger, overrides, postprocess, serve, webref};
+use log::{error, info, warn, LevelFilter};
 use std::fs;
-use std::path::Path;
-use types::{AtRule, AtRuleDescriptor, Data, Property, Value};
+use std::path::PathBuf;
+use std::process::ExitCode;
+use std::time::{Duration, Instant};
+
+#[derive(Parser)]
+#[command(
+    name = "generate_definitions",
+    about = "Generates the CSS definition JSON files embedded in gosub_css3"
+)]
+struct Args {
+    #[command(subcommand)]
+    command: Option<Command>,
+
+    /// Most verbose log level to print
+    #[arg(long, value_name = "LEVEL", value_enum, default_value_t = LogLevel::Info)]
+    log_level: LogLevel,
+
+    /// Only print warnings and errors
+    #[arg(long, short)]
+    quiet: bool,
+
+    /// Also write the per-phase timings (or, for `coverage`, the two lists,
+    /// and for `dependents`, the properties by value) as a JSON report to
+    /// this file
+    #[arg(long, value_name = "FILE")]
+    report: Option<PathBuf>,
+
+    /// Only export these properties (comma-separated names or `*` globs) plus
+    /// the values they transitively reference. Downloading is unaffected.
+    #[arg(long, value_name = "LIST")]
+    properties_filter: Option<String>,
+
+    /// Print how this property was collected (every spec that declared it,
+    /// the merges, MDN data, patches, and overrides) and its final
+    /// definition, instead of writing the output
+    #[arg(long, value_name = "PROPERTY")]
+    explain: Option<String>,
+
+    /// Drop value types that no property, at-rule, or selector grammar
+    /// references, directly or through other values
+    #[arg(long)]
+    prune_values: bool,
+
+    /// Also write the definitions as Rust static tables (definitions.rs)
+    #[arg(long, conflicts_with = "stdout")]
+    emit_rust: bool,
+
+    /// Also write a JSON Schema for definitions.json (definitions.schema.json)
+    #[arg(long, conflicts_with = "stdout")]
+    emit_schema: bool,
+
+    /// Also write definitions.json without indentation (definitions.min.json),
+    /// for embedding in release builds
+    #[arg(long, conflicts_with = "stdout")]
+    minify: bool,
+
+    /// Directory the output files are written to
+    #[arg(
+        long,
+        value_name = "DIR",
+        env = "GENERATE_DEFINITIONS_OUTPUT_DIR",
+        default_value = export::RESOURCE_PATH
+    )]
+    output_dir: PathBuf,
+
+    /// Format of the per-category files (definitions.json is always JSON)
+    #[arg(long, value_name = "FORMAT", value_enum, default_value_t = OutputFormat::Json)]
+    output_format: OutputFormat,
+
+    /// How the definitions are split across files besides definitions.json:
+    /// by kind of entry, or by the spec that contributed them
+    #[arg(long, value_name = "SPLIT", value_enum, default_value_t = SplitBy::Kind)]
+    split_by: SplitBy,
+
+    /// Write the combined definitions.json to stdout instead of any files
+    #[arg(long)]
+    stdout: bool,
+
+    /// Exit with an error when any spec file failed to download or parse,
+    /// or specs map a legacy alias to different properties
+    #[arg(long)]
+    strict: bool,
+
+    /// Fail when fewer entries of a kind are collected than this
+    /// (comma-separated `KIND=N`; kinds are properties, values, atrules, and
+    /// selectors)
+    #[arg(long, value_name = "KIND=N", value_delimiter = ',', value_parser = manifest::parse_min_count)]
+    min_counts: Vec<MinCount>,
+
+    /// Fail when any kind's count drops by more than this percentage against
+    /// the last run's manifest.json
+    #[arg(long, value_name = "PERCENT", value_parser = parse_percent)]
+    property_count_budget: Option<f64>,
+
+    /// Check that every property's initial value matches its own syntax
+    /// (always on with --strict, where a mismatch fails the run)
+    #[arg(long)]
+    validate_initial: bool,
+
+    /// Exit with an error when any warning was logged (after writing output)
+    #[arg(long)]
+    fail_on_warning: bool,
+
+    /// When the run completes, write a one-line JSON summary (counts,
+    /// duration, warnings by category, webref revision) to this file; e.g.
+    /// `/dev/fd/3` for a file descriptor
+    #[arg(long, value_name = "FILE")]
+    summary_file: Option<PathBuf>,
+
+    /// Never touch the network; build entirely from the local cache
+    #[arg(long)]
+    offline: bool,
+
+    /// Report stale cache entries and changed output files without
+    /// downloading spec files or writing the cache or output
+    #[arg(long, conflicts_with = "stdout")]
+    dry_run: bool,
+
+    /// Leave output files whose content did not change untouched, so their
+    /// mtime only moves when they change
+    #[arg(long, conflicts_with = "stdout")]
+    only_changed_output: bool,
+
+    /// GitHub repository to list the spec extracts from
+    #[arg(long, value_name = "OWNER/REPO", default_value = webref::REPO)]
+    webref_repo: String,
+
+    /// Branch, tag, or commit SHA of the webref repository; a tag or SHA pins
+    /// the generation. The commit it resolves to is recorded in manifest.json.
+    #[arg(long, visible_alias = "webref-ref", value_name = "REF", default_value = webref::BRANCH)]
+    webref_branch: String,
+
+    /// Directories inside the webref repository holding the CSS extracts
+    /// (comma-separated; merged in order, the first definition winning)
+    #[arg(long, value_name = "PATH", value_delimiter = ',', default_value = webref::LOCATION)]
+    webref_location: Vec<String>,
+
+    /// Read the extracts from this local webref checkout instead of GitHub.
+    /// Files are read as they are: no SHA checks, cache, or reuse.
+    #[arg(
+        long,
+        value_name = "DIR",
+        conflicts_with_all = ["webref_repo", "webref_branch", "max_age"]
+    )]
+    webref_dir: Option<PathBuf>,
+
+    /// Read the extracts from this tar (optionally gzipped) or zip snapshot
+    /// of webref, as GitHub serves them for a ref, instead of GitHub. It is
+    /// unpacked into the cache and read like `--webref-dir`.
+    #[arg(
+        long,
+        value_name = "FILE",
+        conflicts_with_all = ["webref_repo", "webref_branch", "max_age", "webref_dir"]
+    )]
+    webref_archive: Option<PathBuf>,
+
+    /// Directory for the cached downloads and decoded extracts
+    #[arg(
+        long,
+        value_name = "DIR",
+        env = "GENERATE_DEFINITIONS_CACHE_DIR",
+        default_value = webref::CACHE_DIR
+    )]
+    cache_dir: PathBuf,
+
+    /// Reuse the cached webref listing without asking GitHub while it is
+    /// younger than this (`90s`, `30m`, `24h`, `7d`; `0` always revalidates)
+    #[arg(long, value_name = "DURATION", default_value = "24h", value_parser = parse_duration)]
+    spec_index_ttl: Duration,
+
+    /// Download cached spec files older than this again (by file mtime), even
+    /// when their SHA still matches the listing; off by default
+    #[arg(long, value_name = "DURATION", value_parser = parse_duration, conflicts_with = "offline")]
+    max_age: Option<Duration>,
+
+    /// Only collect definitions from specs at least this mature, by their
+    /// latest /TR release in webref's spec index
+    #[arg(long, value_name = "LEVEL", value_enum, default_value_t = Maturity::Ed)]
+    maturity: Maturity,
+
+    /// How to merge a property, value, or at-rule grammar that specs give
+    /// differently
+    #[arg(long, value_name = "STRATEGY", value_enum, default_value_t = ConflictStrategy::Union)]
+    conflict_strategy: ConflictStrategy,
+
+    /// Decode every spec file again instead of reusing the parsed extracts
+    /// of files whose SHA the last run already decoded
+    #[arg(long)]
+    no_decode_cache: bool,
+
+    /// Number of spec decode workers (default: one per CPU). Decoded specs
+    /// are merged as they finish, so this also bounds how many are held in
+    /// memory at once
+    #[arg(long, value_name = "N", value_parser = clap::builder::RangedU64ValueParser::<usize>::new().range(1..))]
+    threads: Option<usize>,
+
+    /// Only collect the first N spec files (by name), for a quick run while
+    /// working on the decode or merge. The output is partial
+    #[arg(long, value_name = "N", value_parser = clap::builder::RangedU64ValueParser::<usize>::new().range(1..))]
+    limit_specs: Option<usize>,
+
+    /// Corrections applied to the merged data before export (default: the
+    /// checked-in resources/overrides.json)
+    #[arg(long, value_name = "FILE")]
+    overrides: Option<PathBuf>,
+
+    /// Also export the properties listed in the tool's
+    /// resources/obsolete.json, flagged `obsolete`, so old content still parses
+    #[arg(long)]
+    include_obsolete: bool,
+
+    /// What becomes of a legacy alias whose property is not collected:
+    /// the property is added with the alias's syntax, the alias is kept as a
+    /// property of its own, or it is dropped. It is never exported as an
+    /// alias of a missing property
+    #[arg(long, value_name = "ACTION", value_enum, default_value_t = MissingTarget::Synthesize)]
+    missing_alias_target: MissingTarget,
+
+    /// Build from webref alone, without fetching MDN: webref's properties
+    /// with their spec initial values, and no computed values
+    #[arg(long)]
+    no_mdn: bool,
+
+    /// Also export each property's MDN reference page (mdnUrl), for tooling
+    /// that links to documentation
+    #[arg(long, conflicts_with = "no_mdn")]
+    with_docs: bool,
+
+    /// Skip a post-processing step over the merged data (see the possible
+    /// values). Repeatable
+    #[arg(
+        long,
+        value_name = "NAME",
+        value_delimiter = ',',
+        value_parser = clap::builder::PossibleValuesParser::new(postprocess::NAMES)
+    )]
+    disable_processor: Vec<String>,
+}
 
-const RESOURCE_PATH: &str = ".output/definitions";
-const MULTI_FILE_PREFIX: &str = "definitions_";
+#[derive(Subcommand)]
+enum Command {
+    /// Print the alias chain of a legacy property name and the syntax of the
+    /// property it resolves to, instead of writing any output
+    ResolveAlias {
+        /// The alias, e.g. `word-wrap`
+        property: String,
+    },
+    /// List the properties only webref or only MDN defines, instead of
+    /// writing any output
+    Coverage,
+    /// List, for each value type, the properties whose grammar references
+    /// it, directly or through other values and properties, instead of
+    /// writing any output
+    Dependents {
+        /// Only list this value, e.g. `<color>`
+        value: Option<String>,
+    },
+    /// Serve the generated definitions over HTTP (`/properties/{name}`,
+    /// `/values/{name}`, `/atrules/{name}`, `/search?q=`) instead of writing
+    /// any output; `--properties-filter` applies
+    Serve {
+        /// The address to listen on
+        #[arg(long, default_value = "127.0.0.1:8080")]
+        addr: String,
+    },
+    /// Compare two definitions.json files and print what changed from the
+    /// old to the new one; nothing is downloaded or written
+    Diff {
+        /// The definitions.json of the earlier run
+        old: PathBuf,
+        /// The definitions.json of the later run
+        new: PathBuf,
+    },
+}
 
-/// Removes a value-definition-syntax comma multiplier (`#`, optionally bounded
-/// as `#{min,max}`) from the very end of a grammar, turning a comma-separated
-/// list grammar into its single-value form.
-fn strip_trailing_comma_multiplier(re: &Regex, syntax: &str) -> String {
-    re.replace_all(syntax.trim_end_matches(' '), "").into_owned()
+#[derive(Clone, Copy, clap::ValueEnum)]
+enum LogLevel {
+    Error,
+    Warn,
+    Info,
+    Debug,
 }
 
-/// Overrides for upstream PROPERTY grammars where both sources are wrong or
-/// incomplete for real-world CSS.
-const PROPERTY_SYNTAX_PATCHES: [(&str, &str); 2] = [
-    // webref only carries the modern space-separated basic-shape <rect()>, but
-    // the dominant real-world clip syntax is the legacy comma-separated CSS2
-    // rect() (MDN's <shape>). Accept both.
-    ("clip", "<shape> | <rect()> | auto"),
-    // webref types background-clip as <visual-box># which misses `text` (and
-    // `border-area`) from css-backgrounds-4; gradient text via
-    // `background-clip: text` is widely deployed. MDN's <bg-clip> carries the
-    // full alternation.
-    ("background-clip", "<bg-clip>#"),
-];
-
-/// Value types that grammars reference but neither source defines: webref
-/// lists them with an EMPTY syntax (which the generator skips) and MDN
-/// references them from <shape> without defining them. Definitions per
-/// CSS2.1 §11.1.2.
-const MISSING_VALUE_PATCHES: [(&str, &str); 4] = [
-    ("<top>", "<length> | auto"),
-    ("<right>", "<length> | auto"),
-    ("<bottom>", "<length> | auto"),
-    ("<left>", "<length> | auto"),
-];
-
-/// Pins value definitions that multiple specs define differently, so the
-/// choice is explicit instead of an artifact of decode order (first spec
-/// wins).
-const VALUE_SYNTAX_PATCHES: [(&str, &str); 1] = [
-    // Defined by css-masking-1 (legacy `rect( <top>, <right>, <bottom>,
-    // <left> )`, only for `clip`) and css-shapes-1 (the modern basic-shape
-    // used by clip-path etc.). Pin the modern form; `clip` reaches the legacy
-    // form through <shape> instead.
-    (
-        "rect()",
-        "rect( [ <length-percentage> | auto ]{4} [ round <'border-radius'> ]? )",
-    ),
-];
-
-/// Adds the css-sizing-4 bare `fit-content` keyword alongside the functional
-/// form in PROPERTY grammars (width, height, min/max-*, ...). webref still
-/// carries only `fit-content(<length-percentage>)` while MDN lists both; since
-/// webref grammar is preferred, the keyword would otherwise be lost. Value
-/// definitions are left alone: a bare fit-content is not valid in e.g. grid
-/// track sizing.
-fn add_bare_fit_content(syntax: &str) -> String {
-    match syntax.find("fit-content(") {
-        Some(pos) if !syntax.contains("fit-content |") => {
-            format!("{}fit-content | {}", &syntax[..pos], &syntax[pos..])
+impl From<LogLevel> for LevelFilter {
+    fn from(level: LogLevel) -> Self {
+        match level {
+            LogLevel::Error => LevelFilter::Error,
+            LogLevel::Warn => LevelFilter::Warn,
+            LogLevel::Info => LevelFilter::Info,
+            LogLevel::Debug => LevelFilter::Debug,
         }
-        _ => syntax.to_string(),
     }
 }
 
-fn main() -> Result<()> {
-    // A value-definition-syntax comma multiplier at the very end of a grammar.
-    let trailing_comma_multiplier = Regex::new(r"#(\{[0-9]+(,[0-9]*)?\})?\s*$")?;
-
-    // The "optional comma-list, then a mandatory comma, then a final term"
-    // shorthand that MDN and webref both use to flatten a repeated layer group
-    // onto one line (e.g. `background = <bg-layer>#? , <final-bg-layer>`).
-    // It is rewritten into the spec's actual grammar, where the separating
-    // comma lives inside the repeat: `[ <X> , ]* <Y>`. The linearized form
-    // makes the comma mandatory, so a single final term (`background: red`)
-    // fails to match; keeping the comma inside the repeat matches both one
-    // and many layers.
-    let comma_list_idiom = Regex::new(r"(<[^>]+>)#\? , ")?;
-
-    let client = reqwest::blocking::Client::builder()
-        .user_agent("gosub-generate-definitions")
-        .build()?;
-
-    let webref_data = webref::get_webref_data(&client)?;
-    let mdn_data = mdn::get_mdn_data(&client)?;
-
-    let mut data = Data::default();
-
-    eprintln!(
-        "Webref data: {} properties, {} values, {} at-rules, {} selectors",
-        webref_data.properties.len(),
-        webref_data.values.len(),
-        webref_data.at_rules.len(),
-        webref_data.selectors.len(),
-    );
+fn parse_percent(s: &str) -> Result<f64, String> {
+    match s.parse::<f64>() {
+        Ok(p) if (0.0..=100.0).contains(&p) => Ok(p),
+        _ => Err(format!("expected a percentage between 0 and 100, got {s:?}")),
+    }
+}
 
-    // Index webref properties by name so we can source authoritative grammar
-    // (syntax) from the W3C specs. webref is standards-scoped and does not
-    // cover vendor-prefixed or legacy properties.
-    let webref_by_name: std::collections::BTreeMap<&str, &webref::WebRefProperty> =
-        webref_data.properties.iter().map(|p| (p.name.as_str(), p)).collect();
-
-    // MDN is the authoritative property SET: it tracks the full shipping
-    // surface including vendor-prefixed and legacy properties that webref
-    // omits. For each property we prefer webref's spec grammar for the syntax,
-    // falling back to MDN's syntax when webref has no entry for it.
-    for (name, mdn_prop) in &mdn_data {
-        let mut syntax = mdn_prop.syntax.clone();
-        if let Some(webref_prop) = webref_by_name.get(name.as_str()) {
-            if !webref_prop.syntax.is_empty() {
-                syntax = webref_prop.syntax.clone();
-            }
-        }
+/// Parses a duration given as a whole number with an `s`, `m`, `h`, or `d`
+/// suffix; a bare number is seconds.
+fn parse_duration(s: &str) -> Result<Duration, String> {
+    let (number, unit) = match s.find(|c: char| !c.is_ascii_digit()) {
+        Some(pos) => s.split_at(pos),
+        None => (s, "s"),
+    };
+    let number: u64 = number.parse().map_err(|_| format!("invalid duration {s:?}"))?;
+    let seconds = match unit {
+        "s" => number,
+        "m" => number * 60,
+        "h" => number * 60 * 60,
+        "d" => number * 24 * 60 * 60,
+        _ => return Err(format!("invalid duration unit {unit:?} (expected s, m, h, or d)")),
+    };
+    Ok(Duration::from_secs(seconds))
+}
 
-        if let Some((_, patched)) = PROPERTY_SYNTAX_PATCHES.iter().find(|(n, _)| n == name) {
-            syntax = (*patched).to_string();
+fn main() -> ExitCode {
+    match run() {
+        Ok(()) => ExitCode::SUCCESS,
+        Err(e) => {
+            eprintln!("Error: {e:?}");
+            ExitCode::from(Error::find(&e).map_or(1, Error::exit_code))
         }
+    }
+}
 
-        let syntax = comma_list_idiom.replace_all(&syntax, "[ ${1} , ]* ").into_owned();
-        let syntax = add_bare_fit_content(&syntax);
+fn run() -> Result<()> {
+    let started = Instant::now();
+    let args = Args::parse();
+    logger::init(args.log_level.into(), args.quiet)?;
 
-        let computed = if mdn_prop.computed.array.is_empty() {
-            if !mdn_prop.computed.string.is_empty() {
-                vec![mdn_prop.computed.string.clone()]
-            } else {
-                Vec::new()
-            }
-        } else {
-            mdn_prop.computed.array.clone()
-        };
-
-        data.properties.push(Property {
-            name: name.clone(),
-            syntax,
-            computed,
-            initial: mdn_prop.initial.clone(),
-            inherited: mdn_prop.inherited,
-        });
+    if let Some(Command::Diff { old, new }) = &args.command {
+        let old = changelog::Definitions::load(old)?;
+        let new = changelog::Definitions::load(new)?;
+        print!("{}", changelog::Changelog::compare(&old, &new).render());
+        return Ok(());
     }
 
-    for value in &webref_data.values {
-        data.values.push(Value {
-            name: value.name.clone(),
-            syntax: value.syntax.clone(),
-        });
+    if args.no_mdn && matches!(args.command, Some(Command::Coverage)) {
+        bail!("coverage compares webref with MDN and can't run with --no-mdn");
     }
-
-    // Value definitions are named "<name>" in the output; track them by that form.
-    let mut defined_values: BTreeSet<String> = data.values.iter().map(|v| v.name.clone()).collect();
-
-    // Backfill 1: MDN's syntaxes.json is a value-type dictionary webref does
-    // not fully cover (e.g. outline-radius, single-animation-*). Add every
-    // entry webref did not already define, so grammar references to them
-    // resolve.
-    for (name, syntax) in mdn::get_mdn_syntaxes(&client)? {
-        let key = format!("<{name}>");
-        if syntax.is_empty() || defined_values.contains(&key) {
-            continue;
-        }
-        data.values.push(Value {
-            name: key.clone(),
-            syntax,
-        });
-        defined_values.insert(key);
+    if args.split_by == SplitBy::Spec && args.output_format != OutputFormat::Json {
+        bail!("--split-by spec writes JSON documents and can't be combined with --output-format ndjson");
     }
 
-    // Backfill 2: webref decomposes some shorthands into sub-properties it
-    // then references as value types (e.g. box-shadow -> <spread-shadow>,
-    // which uses <'box-shadow-blur'>). Those sub-properties live in webref but
-    // not in MDN's property set, so they are absent from data.properties. Emit
-    // any webref property that some grammar references but that is otherwise
-    // undefined, as a value-type definition sourced from its webref grammar.
-    let mdn_prop_set: BTreeSet<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
-
-    let mut corpus = String::new();
-    for prop in &data.properties {
-        corpus.push_str(&prop.syntax);
-        corpus.push('\n');
-    }
-    for value in &data.values {
-        corpus.push_str(&value.syntax);
-        corpus.push('\n');
+    let options = Options {
+        offline: args.offline,
+        dry_run: args.dry_run,
+        strict: args.strict,
+        validate_initial: args.validate_initial,
+        webref: webref::WebRefLocation {
+            repo: args.webref_repo.clone(),
+            branch: args.webref_branch.clone(),
+            locations: args.webref_location.clone(),
+            checkout: args.webref_dir.clone(),
+            api_url: webref::API_URL.to_string(),
+            raw_url: webref::RAW_URL.to_string(),
+        },
+        webref_archive: args.webref_archive.clone(),
+        cache_dir: args.cache_dir.clone(),
+        spec_index_ttl: args.spec_index_ttl,
+        max_age: args.max_age,
+        maturity: args.maturity,
+        conflict_strategy: args.conflict_strategy,
+        decode_cache: !args.no_decode_cache,
+        threads: args.threads,
+        limit_specs: args.limit_specs,
+        explain: args.explain.clone(),
+        include_obsolete: args.include_obsolete,
+        missing_alias_target: args.missing_alias_target,
+        mdn: !args.no_mdn,
+        overrides: overrides::resolve_path(args.overrides.as_deref()),
+        with_docs: args.with_docs,
+        prune_values: args.prune_values,
+        disabled_processors: args.disable_processor.clone(),
+        arrange_processors: None,
+    };
+    let generator::Generated {
+        mut data,
+        aliases,
+        coverage,
+        mut timings,
+        trace,
+        webref_commit,
+    } = generator::generate(&options)?;
+
+    if let Some(trace) = trace {
+        print!("{}", trace.render(&data));
+        return Ok(());
     }
 
-    for wp in &webref_data.properties {
-        let key = format!("<{}>", wp.name);
-        if wp.syntax.is_empty() || mdn_prop_set.contains(wp.name.as_str()) || defined_values.contains(&key) {
-            continue;
+    match &args.command {
+        Some(Command::ResolveAlias { property }) => {
+            print!("{}", alias::resolve(&aliases, &data, property)?);
+            return Ok(());
+        }
+        Some(Command::Coverage) => {
+            print!("{}", coverage.render());
+            if let Some(path) = &args.report {
+                fs::write(path, coverage.to_json()? + "\n")
+                    .with_context(|| format!("writing report {}", path.display()))?;
+            }
+            return Ok(());
         }
-        // Only capture it when a grammar actually references it as a value
-        // type, either as <name> or as the property-reference form <'name'>.
-        if corpus.contains(&key) || corpus.contains(&format!("<'{}'>", wp.name)) {
-            // A standalone property may be comma-separated (a trailing `#`),
-            // but when it is embedded as a value type in another grammar it
-            // stands for a single value (e.g. one shadow's <box-shadow-color>
-            // inside <spread-shadow>). Keeping the `#` makes that inner list
-            // greedily consume the separator comma of the outer list. Drop the
-            // trailing comma multiplier.
-            data.values.push(Value {
-                name: key.clone(),
-                syntax: strip_trailing_comma_multiplier(&trailing_comma_multiplier, &wp.syntax),
-            });
-            defined_values.insert(key);
+        Some(Command::Dependents { value }) => {
+            let mut dependents = Dependents::compute(&data)?;
+            if let Some(value) = value {
+                dependents = dependents
+                    .only(value)
+                    .with_context(|| format!("no value named {value}"))?;
+            }
+            print!("{}", dependents.render());
+            if let Some(path) = &args.report {
+                fs::write(path, dependents.to_json()? + "\n")
+                    .with_context(|| format!("writing report {}", path.display()))?;
+            }
+            return Ok(());
         }
+        Some(Command::Serve { .. } | Command::Diff { .. }) | None => {}
     }
 
-    // Backfill 3: value types no source defines (see MISSING_VALUE_PATCHES).
-    for (name, syntax) in MISSING_VALUE_PATCHES {
-        if defined_values.contains(name) {
-            continue;
+    // Counted before any filtering, so the guardrails and the next run's
+    // baseline see everything that was collected.
+    let local = options.webref.checkout.is_some() || options.webref_archive.is_some();
+    let revision = (!local).then(|| manifest::WebRefRevision {
+        repo: options.webref.repo.clone(),
+        reference: options.webref.branch.clone(),
+        commit: webref_commit,
+    });
+    let manifest = Manifest {
+        partial: args.limit_specs.is_some(),
+        ..Manifest::new(&data, revision)
+    };
+    // A partial run's counts are no baseline to compare against.
+    let baseline = Manifest::load(&args.output_dir.join(manifest::MANIFEST_FILE)).filter(|m| !m.partial);
+    let failures = manifest::check_counts(
+        &manifest.counts,
+        &args.min_counts,
+        baseline.as_ref().map(|m| &m.counts),
+        args.property_count_budget,
+    );
+    if !failures.is_empty() {
+        for failure in &failures {
+            error!("{failure}");
         }
-        data.values.push(Value {
-            name: name.to_string(),
-            syntax: syntax.to_string(),
-        });
-        defined_values.insert(name.to_string());
+        bail!("{} count guardrail(s) failed", failures.len());
     }
 
-    // Pin value definitions that specs duplicate with conflicting grammars.
-    for value in &mut data.values {
-        if let Some((_, patched)) = VALUE_SYNTAX_PATCHES.iter().find(|(n, _)| *n == value.name) {
-            value.syntax = (*patched).to_string();
+    if let Some(list) = &args.properties_filter {
+        let matched = filter::apply(&mut data, &filter::NameFilter::parse(list))?;
+        if matched == 0 {
+            warn!("--properties-filter {list:?} matched no properties");
         }
+        info!(
+            "Filtered data: {} properties, {} values, {} at-rules",
+            data.properties.len(),
+            data.values.len(),
+            data.atrules.len(),
+        );
     }
 
-    for at_rule in &webref_data.at_rules {
-        let mut descriptors = Vec::with_capacity(at_rule.descriptors.len());
-
-        for descriptor in &at_rule.descriptors {
-            let mut initial = descriptor.initial.clone();
-            // Remove "n/a" or "N/A" initial values. This is a faithful port of
-            // the Go tool's check, operator-precedence bug included: it also
-            // clears any initial whose first byte is 'n' (e.g. "normal",
-            // "none") or whose third byte is 'A'.
-            let b = initial.as_bytes();
-            if b.len() >= 3 && (b[0] == b'n' || (b[0] == b'N' && b[1] == b'/' && b[2] == b'a') || b[2] == b'A') {
-                initial = String::new();
-            }
+    if let Some(Command::Serve { addr }) = &args.command {
+        return serve::serve(&data, addr);
+    }
 
-            descriptors.push(AtRuleDescriptor {
-                name: descriptor.name.clone(),
-                syntax: descriptor.syntax.clone(),
-                initial,
-            });
+    let mut minified = None;
+    timings.time("export", || -> Result<()> {
+        if args.stdout {
+            return export::write_stdout(&data);
         }
+        let files = export::render_outputs(
+            &data,
+            &manifest,
+            &args.output_dir,
+            &ExportOptions {
+                format: args.output_format,
+                split_by: args.split_by,
+                minify: args.minify,
+                emit_rust: args.emit_rust,
+                emit_schema: args.emit_schema,
+            },
+        )?;
+        minified = MinifiedSize::of(&files);
+        export::write_outputs(&files, args.dry_run, args.only_changed_output)
+    })?;
+
+    if let Some(size) = minified {
+        info!("{}", size.summary());
+        timings.record_minified(size);
+    }
 
-        data.atrules.push(AtRule {
-            name: at_rule.name.clone(),
-            descriptors,
-            values: at_rule.values.clone(),
-        });
+    info!("Timings: {}", timings.summary());
+    if let Some(path) = &args.report {
+        fs::write(path, timings.to_json()? + "\n").with_context(|| format!("writing report {}", path.display()))?;
     }
 
-    data.selectors = webref_data.selectors.clone();
+    if let Some(limit) = args.limit_specs {
+        warn!("Only {limit} spec file(s) were collected (--limit-specs); the output is partial");
+    }
 
-    eprintln!(
-        "Collected data: {} properties, {} values, {} at-rules, {} selectors",
-        data.properties.len(),
-        data.values.len(),
-        data.atrules.len(),
-        data.selectors.len(),
-    );
+    let warnings = logger::warning_counts();
+    if let Some(path) = &args.summary_file {
+        let summary = Summary::new(
+            manifest.counts,
+            manifest::Counts::of(&data),
+            started.elapsed(),
+            &warnings,
+            manifest.webref.as_ref(),
+        );
+        fs::write(path, summary.to_json()? + "\n").with_context(|| format!("writing summary {}", path.display()))?;
+    }
 
-    // Sort elements, so that the output is deterministic and we have less
-    // issues with version control
-    data.properties.sort_by(|a, b| a.name.cmp(&b.name));
-    data.values.sort_by(|a, b| a.name.cmp(&b.name));
-    data.atrules.sort_by(|a, b| a.name.cmp(&b.name));
-    // webref does not emit at-rule descriptors/values in a stable order, so
-    // sort the nested collections too; otherwise every regeneration produces
-    // spurious churn.
-    for at_rule in &mut data.atrules {
-        at_rule.descriptors.sort_by(|a, b| a.name.cmp(&b.name));
-        if let Some(values) = &mut at_rule.values {
-            // Merging specs can leave duplicate names (e.g. @media has two
-            // "all" entries); tie-break on value and nested-list size so the
-            // order does not depend on which spec file was processed first.
-            values.sort_by(|a, b| {
-                a.name
-                    .cmp(&b.name)
-                    .then_with(|| a.value.cmp(&b.value))
-                    .then_with(|| a.values.as_ref().map(Vec::len).cmp(&b.values.as_ref().map(Vec::len)))
-            });
-            for value in values {
-                if let Some(entries) = &mut value.values {
-                    entries.sort_by(|a, b| a.name.cmp(&b.name).then_with(|| a.value.cmp(&b.value)));
-                }
-            }
+    if let Some(summary) = logger::warning_summary(&warnings) {
+        if args.fail_on_warning {
+            bail!("{summary} (--fail-on-warning)");
         }
+        info!("{summary}");
     }
-    data.selectors.sort_by(|a, b| a.name.cmp(&b.name));
-
-    export_multi_file(&data)?;
-    export_single_file(&data)?;
-
-    Ok(())
-}
-
-fn export_single_file(data: &Data) -> Result<()> {
-    export_data(data, &Path::new(RESOURCE_PATH).join("definitions.json"))
-}
-
-fn export_multi_file(data: &Data) -> Result<()> {
-    let dir = Path::new(RESOURCE_PATH);
-    fs::create_dir_all(dir)?;
-
-    export_data(
-        &data.properties,
-        &dir.join(format!("{MULTI_FILE_PREFIX}properties.json")),
-    )?;
-    export_data(&data.values, &dir.join(format!("{MULTI_FILE_PREFIX}values.json")))?;
-    export_data(&data.atrules, &dir.join(format!("{MULTI_FILE_PREFIX}at-rules.json")))?;
-    export_data(&data.selectors, &dir.join(format!("{MULTI_FILE_PREFIX}selectors.json")))?;
-
-    Ok(())
-}
 
-fn export_data<T: serde::Serialize>(data: &T, path: &Path) -> Result<()> {
-    let mut out = serde_json::to_vec_pretty(data)?;
-    out.push(b'\n');
-    fs::write(path, out)?;
     Ok(())
 }
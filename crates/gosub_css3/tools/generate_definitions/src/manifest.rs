@@ -0,0 +1,197 @@
+//! `manifest.json`, written next to the outputs: a summary of the run that
+//! produced them, read back by the next run. Its entry counts are the
+//! baseline the count guardrails compare against, so a broken filter or an
+//! upstream outage that silently drops half the properties fails the run
+//! instead of reaching the engine.
+
+use crate::types::Data;
+use log::warn;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::Path;
+
+pub const MANIFEST_FILE: &str = "manifest.json";
+
+/// How many entries of each kind were collected, before `--properties-filter`
+/// or `--prune-values`.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Counts {
+    pub properties: usize,
+    pub values: usize,
+    pub atrules: usize,
+    pub selectors: usize,
+}
+
+impl Counts {
+    pub fn of(data: &Data) -> Self {
+        Counts {
+            properties: data.properties.len(),
+            values: data.values.len(),
+            atrules: data.atrules.len(),
+            selectors: data.selectors.len(),
+        }
+    }
+
+    /// The count of `kind` (`properties`, `values`, `atrules`, `selectors`).
+    fn get(&self, kind: &str) -> Option<usize> {
+        match kind {
+            "properties" => Some(self.properties),
+            "values" => Some(self.values),
+            "atrules" => Some(self.atrules),
+            "selectors" => Some(self.selectors),
+            _ => None,
+        }
+    }
+
+    fn entries(&self) -> [(&'static str, usize); 4] {
+        [
+            ("properties", self.properties),
+            ("values", self.values),
+            ("atrules", self.atrules),
+            ("selectors", self.selectors),
+        ]
+    }
+}
+
+/// The webref revision the extracts were read from. With `commit`, another
+/// run pinned to it (`--webref-ref <commit>`) reads the same extracts.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct WebRefRevision {
+    pub repo: String,
+    #[serde(rename = "ref")]
+    pub reference: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub commit: Option<String>,
+}
+
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
+pub struct Manifest {
+    pub counts: Counts,
+    /// None when the extracts came from a local checkout or archive
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub webref: Option<WebRefRevision>,
+    /// Written by a `--limit-specs` run, whose counts are no baseline
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub partial: bool,
+}
+
+impl Manifest {
+    pub fn new(data: &Data, webref: Option<WebRefRevision>) -> Self {
+        Manifest {
+            counts: Counts::of(data),
+            webref,
+            partial: false,
+        }
+    }
+
+    /// Reads the manifest of the last run, or None when there is none. An
+    /// unreadable one is reported and treated as missing.
+    pub fn load(path: &Path) -> Option<Self> {
+        let body = fs::read(path).ok()?;
+        serde_json::from_slice(&body)
+            .inspect_err(|e| warn!("Ignoring unreadable manifest {}: {e}", path.display()))
+            .ok()
+    }
+}
+
+/// A minimum count for one kind, as given on the command line
+/// (`properties=500`).
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MinCount {
+    pub kind: String,
+    pub min: usize,
+}
+
+/// Parses a `--min-counts` entry.
+pub fn parse_min_count(s: &str) -> Result<MinCount, String> {
+    let (kind, min) = s.split_once('=').ok_or_else(|| format!("expected KIND=N, got {s:?}"))?;
+    if Counts::default().get(kind).is_none() {
+        return Err(format!(
+            "unknown kind {kind:?} (expected properties, values, atrules, or selectors)"
+        ));
+    }
+    let min = min.parse().map_err(|_| format!("invalid count {min:?}"))?;
+    Ok(MinCount {
+        kind: kind.to_string(),
+        min,
+    })
+}
+
+/// Checks `counts` against the minimums, and against `baseline` (the last
+/// run's counts) when `max_drop_percent` is given. Returns one message per
+/// count that fails.
+pub fn check_counts(
+    counts: &Counts,
+    minimums: &[MinCount],
+    baseline: Option<&Counts>,
+    max_drop_percent: Option<f64>,
+) -> Vec<String> {
+    let mut failures = Vec::new();
+    for MinCount { kind, min } in minimums {
+        let count = counts.get(kind).unwrap_or_default();
+        if count < *min {
+            failures.push(format!("{count} {kind} collected, below the minimum of {min}"));
+        }
+    }
+    if let (Some(baseline), Some(max_drop)) = (baseline, max_drop_percent) {
+        for ((kind, count), (_, before)) in counts.entries().into_iter().zip(baseline.entries()) {
+            if before == 0 || count >= before {
+                continue;
+            }
+            let drop = (before - count) as f64 * 100.0 / before as f64;
+            if drop > max_drop {
+                failures.push(format!(
+                    "{count} {kind} collected, {drop:.1}% fewer than the {before} of the last run (budget {max_drop}%)"
+                ));
+            }
+        }
+    }
+    failures
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn counts(properties: usize, values: usize) -> Counts {
+        Counts {
+            properties,
+            values,
+            atrules: 40,
+            selectors: 80,
+        }
+    }
+
+    #[test]
+    fn counts_are_checked_against_minimums_and_the_baseline() {
+        let minimums = [parse_min_count("properties=500").unwrap()];
+        assert!(check_counts(&counts(600, 300), &minimums, None, None).is_empty());
+        assert_eq!(
+            check_counts(&counts(300, 300), &minimums, None, None),
+            ["300 properties collected, below the minimum of 500"]
+        );
+
+        let baseline = counts(600, 300);
+        assert!(check_counts(&counts(570, 300), &[], Some(&baseline), Some(10.0)).is_empty());
+        assert_eq!(
+            check_counts(&counts(600, 150), &[], Some(&baseline), Some(10.0)),
+            ["150 values collected, 50.0% fewer than the 300 of the last run (budget 10%)"]
+        );
+        // Without a budget the baseline is not compared.
+        assert!(check_counts(&counts(0, 0), &[], Some(&baseline), None).is_empty());
+    }
+
+    #[test]
+    fn min_counts_are_parsed() {
+        assert_eq!(
+            parse_min_count("selectors=10"),
+            Ok(MinCount {
+                kind: "selectors".to_string(),
+                min: 10
+            })
+        );
+        assert!(parse_min_count("props=10").is_err());
+        assert!(parse_min_count("values").is_err());
+        assert!(parse_min_count("values=many").is_err());
+    }
+}
@@ -2,14 +2,36 @@
 //! properties (including vendor-prefixed and legacy ones webref omits) and its
 //! value-type grammar dictionary.
 
-use crate::types::StringMaybeArray;
-use anyhow::{Context, Result};
+use crate::error::ErrorContext;
+use crate::fetch::{retry_once, Fetcher};
+use crate::types::{Source, StringMaybeArray};
+use anyhow::{anyhow, Context, Result};
 use serde::Deserialize;
 use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
 
 const MDN_PROPERTIES: &str = "https://raw.githubusercontent.com/mdn/data/main/css/properties.json";
 const MDN_SYNTAXES: &str = "https://raw.githubusercontent.com/mdn/data/main/css/syntaxes.json";
 
+/// Provenance recorded on properties whose grammar falls back to MDN.
+pub fn properties_source() -> Source {
+    Source {
+        shortname: "mdn-properties".to_string(),
+        title: "MDN css/properties.json".to_string(),
+        url: MDN_PROPERTIES.to_string(),
+    }
+}
+
+/// Provenance recorded on value types backfilled from MDN's dictionary.
+pub fn syntaxes_source() -> Source {
+    Source {
+        shortname: "mdn-syntaxes".to_string(),
+        title: "MDN css/syntaxes.json".to_string(),
+        url: MDN_SYNTAXES.to_string(),
+    }
+}
+
 #[derive(Debug, Deserialize)]
 pub struct MdnItem {
     #[serde(default)]
@@ -18,8 +40,50 @@ pub struct MdnItem {
     pub initial: StringMaybeArray,
     #[serde(default)]
     pub computed: StringMaybeArray,
+    /// None when MDN leaves the field out
     #[serde(default)]
-    pub inherited: bool,
+    pub inherited: Option<bool>,
+    /// How the property interpolates (`"lpc"`, `"discrete"`, ...), or for
+    /// shorthands the list of longhands whose animation types apply.
+    #[serde(default = "default_animation_type", rename = "animationType")]
+    pub animation_type: StringMaybeArray,
+    /// What percentages resolve against (`"referToWidthOfContainingBlock"`,
+    /// ...), or `"no"` when they are not accepted.
+    #[serde(default = "default_percentages")]
+    pub percentages: StringMaybeArray,
+    /// The property's MDN reference page
+    #[serde(default)]
+    pub mdn_url: String,
+}
+
+impl MdnItem {
+    /// The longhands a shorthand expands to. MDN marks shorthands by listing
+    /// their longhands in array form in `initial` (and `computed`, ...), where
+    /// a longhand has a single string.
+    pub fn longhands(&self) -> Vec<String> {
+        if self.initial.is_array() {
+            self.initial.to_list()
+        } else {
+            Vec::new()
+        }
+    }
+}
+
+/// MDN's vocabulary for "not animatable", used when an entry omits the field.
+pub fn default_animation_type() -> StringMaybeArray {
+    StringMaybeArray {
+        string: "notAnimatable".to_string(),
+        ..Default::default()
+    }
+}
+
+/// MDN's vocabulary for "percentages not accepted", used when an entry omits
+/// the field.
+pub fn default_percentages() -> StringMaybeArray {
+    StringMaybeArray {
+        string: "no".to_string(),
+        ..Default::default()
+    }
 }
 
 #[derive(Debug, Deserialize)]
@@ -28,19 +92,122 @@ struct MdnSyntax {
     syntax: String,
 }
 
-pub fn get_mdn_data(client: &reqwest::blocking::Client) -> Result<BTreeMap<String, MdnItem>> {
-    let resp = client.get(MDN_PROPERTIES).send()?.error_for_status()?;
-    let body = resp.bytes()?;
-    serde_json::from_slice(&body).context("parsing MDN properties.json")
+pub fn get_mdn_data(fetcher: &Fetcher, cache_dir: &Path) -> Result<BTreeMap<String, MdnItem>> {
+    parse_properties(&fetch_cached(fetcher, cache_dir, MDN_PROPERTIES, "properties.json")?)
+}
+
+pub fn parse_properties(body: &[u8]) -> Result<BTreeMap<String, MdnItem>> {
+    serde_json::from_slice(body).decode_context("MDN properties.json")
 }
 
 /// Returns MDN's value-type dictionary (css/syntaxes.json) as a map of type
 /// name (without angle brackets) to its grammar. webref does not fully cover
 /// these value types, so they are used to backfill value definitions.
-pub fn get_mdn_syntaxes(client: &reqwest::blocking::Client) -> Result<BTreeMap<String, String>> {
-    let resp = client.get(MDN_SYNTAXES).send()?.error_for_status()?;
-    let body = resp.bytes()?;
-    let raw: BTreeMap<String, MdnSyntax> = serde_json::from_slice(&body).context("parsing MDN syntaxes.json")?;
+pub fn get_mdn_syntaxes(fetcher: &Fetcher, cache_dir: &Path) -> Result<BTreeMap<String, String>> {
+    parse_syntaxes(&fetch_cached(fetcher, cache_dir, MDN_SYNTAXES, "syntaxes.json")?)
+}
+
+pub fn parse_syntaxes(body: &[u8]) -> Result<BTreeMap<String, String>> {
+    let raw: BTreeMap<String, MdnSyntax> = serde_json::from_slice(body).decode_context("MDN syntaxes.json")?;
 
     Ok(raw.into_iter().map(|(name, item)| (name, item.syntax)).collect())
 }
+
+/// Downloads an MDN file and keeps a copy under `cache_dir`; offline, the
+/// cached copy is returned instead. A failed download, or a response that
+/// is not a JSON object (an error page), is tried once more. When that fails
+/// too, the run fails, pointing at `--no-mdn`; nothing is cached.
+fn fetch_cached(fetcher: &Fetcher, cache_dir: &Path, url: &str, file_name: &str) -> Result<Vec<u8>> {
+    let cache_path = cache_dir.join("mdn").join(file_name);
+
+    if fetcher.offline() {
+        return fs::read(&cache_path)
+            .context("offline mode needs a cached MDN file; run once online first")
+            .cache_context(&cache_path);
+    }
+
+    let download = || -> Result<Vec<u8>> {
+        let body = fetcher
+            .get(url)?
+            .send()
+            .and_then(|resp| resp.error_for_status())
+            .and_then(|resp| resp.bytes())
+            .download_context(url)?
+            .to_vec();
+        if !is_json_object(&body) {
+            let start = String::from_utf8_lossy(&body[..body.len().min(40)]).into_owned();
+            return Err(anyhow!("expected a JSON object, got {start:?}")).download_context(url);
+        }
+        Ok(body)
+    };
+    let body = retry_once(&format!("Fetching MDN {file_name}"), download)
+        .context("MDN data is unavailable; pass --no-mdn to build from webref alone")?;
+    fetcher.write_cache(&cache_path, &body)?;
+
+    Ok(body)
+}
+
+/// Whether `body` starts like a JSON object, as both MDN files do. Checked
+/// before the body is cached, so an error page never replaces good data.
+fn is_json_object(body: &[u8]) -> bool {
+    body.iter().find(|b| !b.is_ascii_whitespace()) == Some(&b'{')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::error::Error;
+    use crate::test_server::{Response, TestServer};
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    #[test]
+    fn longhands_come_from_array_form_initial() {
+        let items: BTreeMap<String, MdnItem> = serde_json::from_str(
+            r#"{
+                "margin": {"initial": ["margin-bottom", "margin-left", "margin-right", "margin-top"]},
+                "margin-top": {"initial": "0", "animationType": "length", "percentages": "referToWidthOfContainingBlock"},
+                "speak": {"initial": "auto"}
+            }"#,
+        )
+        .unwrap();
+
+        assert_eq!(items["margin"].longhands().len(), 4);
+        assert!(items["margin-top"].longhands().is_empty());
+        assert_eq!(items["margin-top"].animation_type.string, "length");
+        assert_eq!(items["speak"].animation_type.string, "notAnimatable");
+        assert_eq!(items["speak"].percentages.string, "no");
+    }
+
+    #[test]
+    fn a_failed_fetch_is_retried_once() {
+        let cache = tempfile::tempdir().unwrap();
+        let hits = AtomicUsize::new(0);
+        let server = TestServer::start(move |_| match hits.fetch_add(1, Ordering::SeqCst) {
+            0 => Response::status(500),
+            _ => Response::ok(r#"{"color": {"initial": "canvastext"}}"#),
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let url = format!("{}/properties.json", server.base_url);
+
+        let body = fetch_cached(&fetcher, cache.path(), &url, "properties.json").unwrap();
+
+        assert_eq!(server.requests().len(), 2);
+        assert!(parse_properties(&body).unwrap().contains_key("color"));
+        assert_eq!(fs::read(cache.path().join("mdn/properties.json")).unwrap(), body);
+    }
+
+    #[test]
+    fn a_response_that_is_not_a_json_object_fails_and_is_not_cached() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|_| Response::ok("<html>rate limited</html>"));
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let url = format!("{}/syntaxes.json", server.base_url);
+
+        let err = fetch_cached(&fetcher, cache.path(), &url, "syntaxes.json").unwrap_err();
+
+        assert_eq!(server.requests().len(), 2);
+        assert!(matches!(Error::find(&err), Some(Error::Download { .. })));
+        assert!(format!("{err:#}").contains("--no-mdn"), "{err:#}");
+        assert!(!cache.path().join("mdn/syntaxes.json").exists());
+    }
+}
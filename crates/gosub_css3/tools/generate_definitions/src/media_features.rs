@@ -0,0 +1,115 @@
+//! Media features (`width`, `prefers-reduced-motion`, ...) are the
+//! descriptors of the `@media` at-rule. How a query may use one depends on
+//! its type: a range feature takes a numeric value and can be compared
+//! (`width >= 600px`, `min-width: 600px`), a discrete one only matches one of
+//! its values. Besides the plain descriptor list, `@media` is exported with a
+//! `mediaFeatures` list that records each feature's type and value grammar.
+
+use crate::types::{AtRule, MediaFeature, MediaFeatureType};
+use log::warn;
+use std::collections::BTreeMap;
+
+pub const AT_RULE: &str = "@media";
+
+/// Value types that make a feature a range feature when its spec does not
+/// say which type it is.
+const RANGE_TYPES: [&str; 5] = ["<length>", "<number>", "<integer>", "<ratio>", "<resolution>"];
+
+/// Builds the media features from the `@media` descriptors. `declared` holds
+/// the type the specs give a feature (`range` or `discrete`), by name; a
+/// feature without one is classified by its grammar. The features are sorted
+/// by name, like the descriptors they come from.
+pub fn media_features(at_rule: &AtRule, declared: &BTreeMap<&str, &str>) -> Vec<MediaFeature> {
+    let mut features: Vec<MediaFeature> = at_rule
+        .descriptors
+        .iter()
+        .map(|descriptor| {
+            let feature_type = match declared.get(descriptor.name.as_str()).copied() {
+                Some("range") => MediaFeatureType::Range,
+                Some("discrete") => MediaFeatureType::Discrete,
+                Some(other) => {
+                    warn!(
+                        "Media feature {} has unknown type {other:?}, classifying it by its grammar",
+                        descriptor.name
+                    );
+                    classify(&descriptor.syntax)
+                }
+                None => classify(&descriptor.syntax),
+            };
+            MediaFeature {
+                name: descriptor.name.clone(),
+                feature_type,
+                syntax: descriptor.syntax.clone(),
+            }
+        })
+        .collect();
+    features.sort_by(|a, b| a.name.cmp(&b.name));
+    features
+}
+
+/// A feature is a range feature when its grammar takes a numeric value type;
+/// keywords and `<mq-boolean>` make it discrete.
+fn classify(syntax: &str) -> MediaFeatureType {
+    if RANGE_TYPES.iter().any(|t| syntax.contains(t)) {
+        MediaFeatureType::Range
+    } else {
+        MediaFeatureType::Discrete
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::AtRuleDescriptor;
+
+    fn media(descriptors: &[(&str, &str)]) -> AtRule {
+        AtRule {
+            name: AT_RULE.to_string(),
+            descriptors: descriptors
+                .iter()
+                .map(|(name, syntax)| AtRuleDescriptor {
+                    name: name.to_string(),
+                    syntax: syntax.to_string(),
+                    initial: String::new(),
+                    sources: Vec::new(),
+                })
+                .collect(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn features_are_classified_by_declared_type_or_grammar() {
+        let at_rule = media(&[
+            ("width", "<length>"),
+            ("aspect-ratio", "<ratio>"),
+            ("color", "<integer>"),
+            ("grid", "<mq-boolean>"),
+            ("prefers-reduced-motion", "no-preference | reduce"),
+            ("scan", "interlace | progressive"),
+        ]);
+        // A declared type wins over the grammar.
+        let declared = BTreeMap::from([("width", "range"), ("color", "discrete"), ("scan", "bogus")]);
+
+        let features = media_features(&at_rule, &declared);
+        let classified: Vec<(&str, MediaFeatureType, &str)> = features
+            .iter()
+            .map(|f| (f.name.as_str(), f.feature_type, f.syntax.as_str()))
+            .collect();
+        assert_eq!(
+            classified,
+            [
+                ("aspect-ratio", MediaFeatureType::Range, "<ratio>"),
+                ("color", MediaFeatureType::Discrete, "<integer>"),
+                ("grid", MediaFeatureType::Discrete, "<mq-boolean>"),
+                (
+                    "prefers-reduced-motion",
+                    MediaFeatureType::Discrete,
+                    "no-preference | reduce"
+                ),
+                ("scan", MediaFeatureType::Discrete, "interlace | progressive"),
+                ("width", MediaFeatureType::Range, "<length>"),
+            ]
+        );
+    }
+}
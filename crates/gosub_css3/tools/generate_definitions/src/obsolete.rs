@@ -0,0 +1,126 @@
+//! `--include-obsolete`: properties no source defines any more, listed in
+//! `resources/obsolete.json` next to this tool's Cargo.toml, so the engine can
+//! still parse (and ignore) them in old content.
+//!
+//! ```json
+//! { "properties": { "kerning": { "syntax": "auto | <length>" } } }
+//! ```
+//!
+//! Each entry is exported as a property flagged `obsolete`, with the listed
+//! syntax or, without one, `<declaration-value>` (anything at all).
+
+use crate::types::{Data, Property, Source};
+use anyhow::{Context, Result};
+use log::warn;
+use serde::Deserialize;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::Path;
+
+pub const OBSOLETE_PATH: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/resources/obsolete.json");
+
+/// How the list is named in `sources`: relative to this tool, so the output
+/// does not depend on where it was built.
+const OBSOLETE_URL: &str = "resources/obsolete.json";
+
+/// The grammar of an obsolete property listed without one.
+const ANY_VALUE: &str = "<declaration-value>";
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Obsolete {
+    #[serde(default)]
+    properties: BTreeMap<String, ObsoleteProperty>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ObsoleteProperty {
+    syntax: Option<String>,
+}
+
+impl Obsolete {
+    /// Reads the obsolete list. It is only read when asked for with
+    /// `--include-obsolete`, so a missing file is an error.
+    pub fn load(path: &Path) -> Result<Self> {
+        let body = fs::read(path).with_context(|| format!("reading {}", path.display()))?;
+        serde_json::from_slice(&body).with_context(|| format!("parsing {}", path.display()))
+    }
+
+    /// Adds every listed property to `data`, sourced from the list. One that
+    /// `data` or webref (`webref_names`) defines again is skipped with a
+    /// warning, so it can be dropped from the list. Returns how many were
+    /// added.
+    pub fn apply(&self, data: &mut Data, webref_names: &BTreeSet<&str>, path: &Path) -> usize {
+        let source = Source {
+            shortname: "obsolete".to_string(),
+            title: "generate_definitions obsolete properties".to_string(),
+            url: OBSOLETE_URL.to_string(),
+        };
+        let mut added = 0;
+
+        for (name, o) in &self.properties {
+            if webref_names.contains(name.as_str()) || data.properties.iter().any(|p| &p.name == name) {
+                warn!(
+                    "Obsolete property {name} is defined upstream again; remove it from {}",
+                    path.display()
+                );
+                continue;
+            }
+            data.properties.push(Property {
+                name: name.clone(),
+                syntax: o.syntax.clone().unwrap_or_else(|| ANY_VALUE.to_string()),
+                obsolete: true,
+                sources: vec![source.clone()],
+                ..Default::default()
+            });
+            added += 1;
+        }
+
+        added
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn listed_properties_are_added_unless_defined_again() {
+        let obsolete: Obsolete = serde_json::from_str(
+            r#"{"properties": {"kerning": {"syntax": "auto | <length>"}, "box-flex-group": {}, "zoom": {}}}"#,
+        )
+        .unwrap();
+        let mut data = Data::default();
+        let webref_names = BTreeSet::from(["zoom"]);
+
+        assert_eq!(obsolete.apply(&mut data, &webref_names, Path::new("obsolete.json")), 2);
+        let exported: Vec<(&str, &str, bool)> = data
+            .properties
+            .iter()
+            .map(|p| (p.name.as_str(), p.syntax.as_str(), p.obsolete))
+            .collect();
+        assert_eq!(
+            exported,
+            [
+                ("box-flex-group", "<declaration-value>", true),
+                ("kerning", "auto | <length>", true)
+            ]
+        );
+
+        let json = serde_json::to_value(&data.properties[1]).unwrap();
+        assert_eq!(json["obsolete"], true);
+        assert_eq!(json["sources"][0]["url"], "resources/obsolete.json");
+    }
+
+    #[test]
+    fn checked_in_list_parses() {
+        Obsolete::load(Path::new(OBSOLETE_PATH)).unwrap();
+    }
+
+    #[test]
+    fn missing_list_is_an_error() {
+        let dir = tempfile::tempdir().unwrap();
+        assert!(Obsolete::load(&dir.path().join("obsolete.json")).is_err());
+    }
+}
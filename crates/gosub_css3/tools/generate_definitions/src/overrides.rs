@@ -0,0 +1,289 @@
+//! Checked-in corrections (`resources/overrides.json` next to this tool's
+//! Cargo.toml) for upstream entries
+//! that are wrong or incomplete for the engine. Applied after merging, so an
+//! override always has the last word.
+//!
+//! ```json
+//! {
+//!   "properties": { "clip": { "syntax": "<shape> | auto" } },
+//!   "values": { "<top>": { "syntax": "<length> | auto" } },
+//!   "atrules": { "@page": { "descriptors": { "size": { "initial": "auto" } } } }
+//! }
+//! ```
+//!
+//! An entry patches only the fields it lists. With `"replace": true` the
+//! fields it does not list are reset to empty instead.
+//!
+//! A file given with `--overrides` must exist. The checked-in file is looked
+//! up in the source tree the tool was built from; when the tool runs without
+//! it, that is logged and no overrides are applied.
+
+use crate::types::{add_source, Data, Source, StringMaybeArray};
+use anyhow::{Context, Result};
+use log::warn;
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+pub const OVERRIDES_PATH: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/resources/overrides.json");
+
+/// How the checked-in overrides are named in `sources`: relative to this
+/// tool, so the output does not depend on where it was built.
+const OVERRIDES_URL: &str = "resources/overrides.json";
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Overrides {
+    #[serde(default)]
+    properties: BTreeMap<String, PropertyOverride>,
+    #[serde(default)]
+    values: BTreeMap<String, ValueOverride>,
+    #[serde(default)]
+    atrules: BTreeMap<String, AtRuleOverride>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct PropertyOverride {
+    #[serde(default)]
+    replace: bool,
+    syntax: Option<String>,
+    initial: Option<StringMaybeArray>,
+    computed: Option<Vec<String>>,
+    inherited: Option<bool>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ValueOverride {
+    syntax: String,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct AtRuleOverride {
+    #[serde(default)]
+    descriptors: BTreeMap<String, DescriptorOverride>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct DescriptorOverride {
+    #[serde(default)]
+    replace: bool,
+    syntax: Option<String>,
+    initial: Option<String>,
+}
+
+/// Sets `field` to the override when given, or resets it when replacing.
+fn patch<T: Default + Clone>(field: &mut T, value: &Option<T>, replace: bool) {
+    match value {
+        Some(value) => *field = value.clone(),
+        None if replace => *field = T::default(),
+        None => {}
+    }
+}
+
+/// The source an override adds. The checked-in file is named by
+/// [`OVERRIDES_URL`]; one given with `--overrides` as it was given.
+fn source(path: &Path) -> Source {
+    let url = if path == Path::new(OVERRIDES_PATH) {
+        OVERRIDES_URL.to_string()
+    } else {
+        path.display().to_string()
+    };
+    Source {
+        shortname: "overrides".to_string(),
+        title: "generate_definitions overrides".to_string(),
+        url,
+    }
+}
+
+/// The overrides file to apply: `given` (`--overrides`), or else the
+/// checked-in file when it is there.
+pub fn resolve_path(given: Option<&Path>) -> Option<PathBuf> {
+    if let Some(path) = given {
+        return Some(path.to_path_buf());
+    }
+    let checked_in = Path::new(OVERRIDES_PATH);
+    if checked_in.exists() {
+        Some(checked_in.to_path_buf())
+    } else {
+        warn!("{OVERRIDES_PATH} not found, applying no overrides (pass --overrides <file>)");
+        None
+    }
+}
+
+impl Overrides {
+    /// Reads the overrides file, which has to exist.
+    pub fn load(path: &Path) -> Result<Self> {
+        let body = fs::read(path).with_context(|| format!("reading {}", path.display()))?;
+        serde_json::from_slice(&body).with_context(|| format!("parsing {}", path.display()))
+    }
+
+    /// Applies every override to `data`, adding `path` to the sources of each
+    /// patched entry. Overrides naming an entry that does not exist are
+    /// logged and skipped; returns how many there were.
+    pub fn apply(&self, data: &mut Data, path: &Path) -> usize {
+        let source = source(path);
+        let mut unmatched = 0;
+
+        // Every override is matched up front, so the index is dropped before
+        // anything changes.
+        let (properties, values, atrules) = {
+            let index = data.index();
+            let mut matched = |kind: &str, name: &str, position: Option<usize>| {
+                if position.is_none() {
+                    warn!("Override for unknown {kind} {name}");
+                    unmatched += 1;
+                }
+                position
+            };
+            let properties: Vec<(usize, &PropertyOverride)> = self
+                .properties
+                .iter()
+                .filter_map(|(name, o)| Some((matched("property", name, index.property_position(name))?, o)))
+                .collect();
+            let values: Vec<(usize, &ValueOverride)> = self
+                .values
+                .iter()
+                .filter_map(|(name, o)| Some((matched("value", name, index.value_position(name))?, o)))
+                .collect();
+            let atrules: Vec<(usize, &String, &AtRuleOverride)> = self
+                .atrules
+                .iter()
+                .filter_map(|(name, o)| Some((matched("at-rule", name, index.at_rule_position(name))?, name, o)))
+                .collect();
+            (properties, values, atrules)
+        };
+
+        for (position, o) in properties {
+            let property = &mut data.properties[position];
+            patch(&mut property.syntax, &o.syntax, o.replace);
+            patch(&mut property.initial, &o.initial, o.replace);
+            patch(&mut property.computed, &o.computed, o.replace);
+            patch(&mut property.inherited, &o.inherited, o.replace);
+            add_source(&mut property.sources, &source);
+        }
+
+        for (position, o) in values {
+            let value = &mut data.values[position];
+            value.syntax = o.syntax.clone();
+            add_source(&mut value.sources, &source);
+        }
+
+        for (position, name, o) in atrules {
+            let at_rule = &mut data.atrules[position];
+            for (descriptor_name, d) in &o.descriptors {
+                let Some(descriptor) = at_rule.descriptors.iter_mut().find(|x| &x.name == descriptor_name) else {
+                    warn!("Override for unknown descriptor {descriptor_name} of {name}");
+                    unmatched += 1;
+                    continue;
+                };
+                patch(&mut descriptor.syntax, &d.syntax, d.replace);
+                patch(&mut descriptor.initial, &d.initial, d.replace);
+                add_source(&mut descriptor.sources, &source);
+            }
+            add_source(&mut at_rule.sources, &source);
+        }
+
+        unmatched
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{AtRule, AtRuleDescriptor, Property, Value, ValueKind};
+
+    fn data() -> Data {
+        Data {
+            properties: vec![Property {
+                name: "clip".to_string(),
+                syntax: "<rect()> | auto".to_string(),
+                computed: vec!["asSpecified".to_string()],
+                initial: StringMaybeArray {
+                    string: "auto".to_string(),
+                    ..Default::default()
+                },
+                ..Default::default()
+            }],
+            values: vec![Value {
+                name: "<top>".to_string(),
+                kind: ValueKind::Type,
+                ..Default::default()
+            }],
+            atrules: vec![AtRule {
+                name: "@page".to_string(),
+                descriptors: vec![AtRuleDescriptor {
+                    name: "size".to_string(),
+                    syntax: "<length>{1,2}".to_string(),
+                    initial: "auto".to_string(),
+                    sources: Vec::new(),
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn patches_only_listed_fields() {
+        let overrides: Overrides = serde_json::from_str(
+            r#"{
+                "properties": {"clip": {"syntax": "<shape> | <rect()> | auto", "inherited": true}},
+                "values": {"<top>": {"syntax": "<length> | auto"}},
+                "atrules": {"@page": {"descriptors": {"size": {"syntax": "<length>{1,2} | auto"}}}}
+            }"#,
+        )
+        .unwrap();
+        let mut data = data();
+
+        assert_eq!(overrides.apply(&mut data, Path::new(OVERRIDES_PATH)), 0);
+
+        let clip = &data.properties[0];
+        assert_eq!(clip.syntax, "<shape> | <rect()> | auto");
+        assert!(clip.inherited);
+        assert_eq!(clip.computed, ["asSpecified"]);
+        assert_eq!(clip.initial.string, "auto");
+        assert_eq!(clip.sources[0].shortname, "overrides");
+        assert_eq!(clip.sources[0].url, "resources/overrides.json");
+        assert_eq!(data.values[0].syntax, "<length> | auto");
+        assert_eq!(data.atrules[0].descriptors[0].syntax, "<length>{1,2} | auto");
+        assert_eq!(data.atrules[0].descriptors[0].initial, "auto");
+    }
+
+    #[test]
+    fn replace_resets_unlisted_fields() {
+        let overrides: Overrides =
+            serde_json::from_str(r#"{"properties": {"clip": {"replace": true, "syntax": "auto", "initial": ["a"]}}}"#)
+                .unwrap();
+        let mut data = data();
+
+        overrides.apply(&mut data, Path::new(OVERRIDES_PATH));
+
+        let clip = &data.properties[0];
+        assert_eq!(clip.syntax, "auto");
+        assert!(clip.initial.is_array());
+        assert!(clip.computed.is_empty());
+    }
+
+    #[test]
+    fn unknown_targets_are_counted() {
+        let overrides: Overrides = serde_json::from_str(
+            r#"{"properties": {"nope": {}}, "atrules": {"@page": {"descriptors": {"bleed": {}}}}}"#,
+        )
+        .unwrap();
+        assert_eq!(overrides.apply(&mut data(), Path::new(OVERRIDES_PATH)), 2);
+        assert!(serde_json::from_str::<Overrides>(r#"{"properties": {"clip": {"sytnax": "x"}}}"#).is_err());
+    }
+
+    #[test]
+    fn missing_file_is_an_error() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("overrides.json");
+        assert!(Overrides::load(&path).is_err());
+        assert_eq!(resolve_path(Some(&path)), Some(path));
+    }
+}
@@ -0,0 +1,354 @@
+//! Transforms that run over the merged data after collection, before it is
+//! sorted, checked, and exported. Each is a [`PostProcessor`]; the built-in
+//! ones run in the order of [`NAMES`], and `--disable-processor <name>` turns
+//! one off. A library caller can add processors of its own or reorder them
+//! with an [`Arrange`] hook (`Options::arrange_processors`). A new fixup is a
+//! new processor here rather than another step in the merge.
+
+use crate::alias::{self, MissingTarget, PropertyAliasTable};
+use crate::explain::{self, Trace};
+use crate::filter;
+use crate::global_keywords;
+use crate::media_features;
+use crate::obsolete::Obsolete;
+use crate::overrides::Overrides;
+use crate::registration;
+use crate::shorthand_initial;
+use crate::types::Data;
+use anyhow::Result;
+use log::{info, warn};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Every built-in processor, in the order they run.
+pub const NAMES: [&str; 8] = [
+    "obsolete",
+    "global-keywords",
+    "alias-syntaxes",
+    "overrides",
+    "shorthand-initials",
+    "registration",
+    "media-features",
+    "prune-values",
+];
+
+/// One transform of the merged data.
+pub trait PostProcessor {
+    /// The name `--disable-processor` takes
+    fn name(&self) -> &'static str;
+
+    /// How `--explain` words a change this processor made
+    fn describe(&self) -> String {
+        format!("changed by the {} post-processor", self.name())
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()>;
+}
+
+/// The processors of a run, in the order they run.
+pub type Processors = Vec<Box<dyn PostProcessor>>;
+
+/// Rearranges the processors of a run: called with the built-in ones, in the
+/// order they would run, it can add its own, move them, or drop some.
+#[derive(Clone)]
+pub struct Arrange(Arc<dyn Fn(&mut Processors) + Send + Sync>);
+
+impl Arrange {
+    pub fn new(arrange: impl Fn(&mut Processors) + Send + Sync + 'static) -> Self {
+        Arrange(Arc::new(arrange))
+    }
+
+    pub fn apply(&self, processors: &mut Processors) {
+        (self.0)(processors)
+    }
+}
+
+impl fmt::Debug for Arrange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Arrange(..)")
+    }
+}
+
+/// `obsolete`: adds the properties of the obsolete list
+/// (`--include-obsolete`). Properties webref defines (`webref_names`) are
+/// left out.
+pub struct ObsoleteProperties {
+    pub path: PathBuf,
+    pub webref_names: BTreeSet<String>,
+}
+
+impl PostProcessor for ObsoleteProperties {
+    fn name(&self) -> &'static str {
+        "obsolete"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let webref_names: BTreeSet<&str> = self.webref_names.iter().map(String::as_str).collect();
+        let added = Obsolete::load(&self.path)?.apply(data, &webref_names, &self.path);
+        info!("{added} obsolete property definition(s) added");
+        Ok(())
+    }
+}
+
+/// `global-keywords`: makes sure the CSS-wide keywords are values.
+pub struct GlobalKeywords;
+
+impl PostProcessor for GlobalKeywords {
+    fn name(&self) -> &'static str {
+        "global-keywords"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let added = global_keywords::ensure(data);
+        info!("{added} CSS-wide keyword value(s) added");
+        Ok(())
+    }
+}
+
+/// `alias-syntaxes`: lets a legacy alias and its property borrow each other's
+/// syntax when one of them has none, and handles aliases of properties that
+/// are not collected.
+pub struct AliasSyntaxes {
+    pub aliases: PropertyAliasTable,
+    pub missing: MissingTarget,
+}
+
+impl PostProcessor for AliasSyntaxes {
+    fn name(&self) -> &'static str {
+        "alias-syntaxes"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let shared = alias::share_syntaxes(&self.aliases, data, self.missing);
+        info!("{shared} property syntax(es) borrowed across a legacy alias");
+        Ok(())
+    }
+}
+
+/// `overrides`: applies the overrides file.
+pub struct ApplyOverrides {
+    pub path: PathBuf,
+}
+
+impl PostProcessor for ApplyOverrides {
+    fn name(&self) -> &'static str {
+        "overrides"
+    }
+
+    fn describe(&self) -> String {
+        format!("overridden by {}", self.path.display())
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let unmatched = Overrides::load(&self.path)?.apply(data, &self.path);
+        if unmatched > 0 {
+            warn!("{unmatched} override(s) in {} matched nothing", self.path.display());
+        }
+        Ok(())
+    }
+}
+
+/// `shorthand-initials`: composes the initial of shorthands that have none
+/// from their longhands' initials.
+pub struct ShorthandInitials;
+
+impl PostProcessor for ShorthandInitials {
+    fn name(&self) -> &'static str {
+        "shorthand-initials"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let derived = shorthand_initial::derive_initials(data);
+        info!("{derived} shorthand initial value(s) derived from their longhands");
+        Ok(())
+    }
+}
+
+/// `registration`: gives `@property` its `registration` object.
+pub struct PropertyRegistration;
+
+impl PostProcessor for PropertyRegistration {
+    fn name(&self) -> &'static str {
+        "registration"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        if let Some(at_rule) = data.atrules.iter_mut().find(|a| a.name == registration::AT_RULE) {
+            match registration::property_registration(at_rule) {
+                Ok(r) => at_rule.registration = Some(r),
+                Err(e) => warn!("Not exporting the @property registration: {e}"),
+            }
+        }
+        Ok(())
+    }
+}
+
+/// `media-features`: gives `@media` its `mediaFeatures` list. `declared`
+/// holds the feature types the specs give, by feature name.
+pub struct MediaFeatures {
+    pub declared: BTreeMap<String, String>,
+}
+
+impl PostProcessor for MediaFeatures {
+    fn name(&self) -> &'static str {
+        "media-features"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        if let Some(at_rule) = data.atrules.iter_mut().find(|a| a.name == media_features::AT_RULE) {
+            let declared: BTreeMap<&str, &str> = self.declared.iter().map(|(k, v)| (k.as_str(), v.as_str())).collect();
+            at_rule.media_features = Some(media_features::media_features(at_rule, &declared));
+        }
+        Ok(())
+    }
+}
+
+/// `prune-values` (`--prune-values`): drops the value types no grammar
+/// references. Runs last, after the processors that add values.
+pub struct PruneValues;
+
+impl PostProcessor for PruneValues {
+    fn name(&self) -> &'static str {
+        "prune-values"
+    }
+
+    fn process(&self, data: &mut Data) -> Result<()> {
+        let pruned = filter::prune_values(data)?;
+        info!("Pruned {pruned} unreferenced value(s), {} left", data.values.len());
+        Ok(())
+    }
+}
+
+/// Runs `processors` in order over `data`, skipping the `disabled` ones.
+/// Each field of the explained property a processor changes is recorded in
+/// `trace`.
+pub fn run(
+    processors: &[Box<dyn PostProcessor>],
+    disabled: &[String],
+    data: &mut Data,
+    trace: &mut Option<Trace>,
+) -> Result<()> {
+    let explained_name = trace.as_ref().map(|t| t.property().to_string());
+    let explained = |data: &Data| {
+        let name = explained_name.as_deref()?;
+        let property = data.index().property(name)?;
+        serde_json::to_value(property).ok()
+    };
+
+    for processor in processors {
+        let name = processor.name();
+        if disabled.iter().any(|d| d == name) {
+            info!("Post-processor {name} is disabled");
+            continue;
+        }
+        let before = explained(data);
+        processor.process(data)?;
+        let (Some(property), Some(after)) = (&explained_name, explained(data)) else {
+            continue;
+        };
+        for (field, value) in after.as_object().into_iter().flatten() {
+            if before.as_ref().and_then(|b| b.get(field)) != Some(value) {
+                explain::record(trace, property, || {
+                    format!("{}: {field} is now {value}", processor.describe())
+                });
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{AtRule, Property};
+
+    fn media() -> Data {
+        Data {
+            atrules: vec![AtRule {
+                name: "@media".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn disabled_processors_do_not_run() {
+        let processors: Vec<Box<dyn PostProcessor>> = vec![
+            Box::new(PropertyRegistration),
+            Box::new(MediaFeatures {
+                declared: BTreeMap::new(),
+            }),
+        ];
+
+        let mut data = media();
+        run(&processors, &[], &mut data, &mut None).unwrap();
+        assert!(data.atrules[0].media_features.is_some());
+
+        let mut data = media();
+        let disabled = ["media-features".to_string()];
+        run(&processors, &disabled, &mut data, &mut None).unwrap();
+        assert!(data.atrules[0].media_features.is_none());
+    }
+
+    struct Inherit;
+
+    impl PostProcessor for Inherit {
+        fn name(&self) -> &'static str {
+            "inherit"
+        }
+
+        fn process(&self, data: &mut Data) -> Result<()> {
+            data.properties.iter_mut().for_each(|p| p.inherited = true);
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn changes_to_the_explained_property_are_recorded() {
+        let mut data = Data {
+            properties: vec![Property {
+                name: "color".to_string(),
+                syntax: "<color>".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let processors: Vec<Box<dyn PostProcessor>> = vec![Box::new(Inherit), Box::new(PropertyRegistration)];
+        let mut trace = Some(Trace::new("color"));
+
+        run(&processors, &[], &mut data, &mut trace).unwrap();
+
+        assert_eq!(
+            trace.unwrap().render(&Data::default()),
+            "Property color\n  1. changed by the inherit post-processor: inherited is now true\n\
+             Result: not exported as a property\n"
+        );
+    }
+
+    #[test]
+    fn names_match_the_processors() {
+        let processors: [&dyn PostProcessor; 8] = [
+            &ObsoleteProperties {
+                path: PathBuf::new(),
+                webref_names: BTreeSet::new(),
+            },
+            &GlobalKeywords,
+            &AliasSyntaxes {
+                aliases: PropertyAliasTable::default(),
+                missing: MissingTarget::Synthesize,
+            },
+            &ApplyOverrides { path: PathBuf::new() },
+            &ShorthandInitials,
+            &PropertyRegistration,
+            &MediaFeatures {
+                declared: BTreeMap::new(),
+            },
+            &PruneValues,
+        ];
+        let names: Vec<&str> = processors.iter().map(|p| p.name()).collect();
+        assert_eq!(names, NAMES);
+    }
+}
@@ -0,0 +1,176 @@
+//! The prelude of an at-rule is the part between its name and its block or
+//! closing `;`: `(min-width: 600px)` in `@media (min-width: 600px) { ... }`.
+//! Webref only gives the grammar of the whole at-rule (`@media
+//! <media-query-list> { <rule-list> }`), so the prelude grammar is cut out of
+//! it, along with the forms the at-rule is written in: a statement ending in
+//! `;` (`@import`), a block (`@media`), or both (`@layer a, b;` and
+//! `@layer a { ... }`). The descriptors, which go in the block, are not
+//! affected.
+
+use crate::syntax_check::alternatives;
+use crate::types::AtRuleForms;
+
+/// Returns the prelude grammar of the at-rule `name` from its webref
+/// grammar. Empty when the at-rule takes no prelude (`@font-face { ... }`) or
+/// `syntax` does not start with `name`. When the grammar lists several forms
+/// with different preludes, they become alternatives, optional when one of
+/// the forms takes none.
+pub fn extract(name: &str, syntax: &str) -> String {
+    let mut preludes: Vec<&str> = Vec::new();
+    let mut optional = false;
+    for (prelude, _) in forms_of(name, syntax) {
+        if prelude.is_empty() {
+            optional = true;
+        } else if !preludes.contains(&prelude) {
+            preludes.push(prelude);
+        }
+    }
+
+    match preludes.as_slice() {
+        [] => String::new(),
+        [prelude] if !optional => prelude.to_string(),
+        _ if !optional => preludes.join(" | "),
+        _ => format!("[ {} ]?", preludes.join(" | ")),
+    }
+}
+
+/// The forms the at-rule `name` is written in, by its webref grammar; None
+/// when the grammar shows neither a block nor a closing `;`.
+pub fn forms(name: &str, syntax: &str) -> Option<AtRuleForms> {
+    let forms: Vec<AtRuleForms> = forms_of(name, syntax)
+        .into_iter()
+        .filter_map(|(_, form)| form)
+        .collect();
+    let statement = forms.contains(&AtRuleForms::Statement);
+    let block = forms.contains(&AtRuleForms::Block);
+    match (statement, block) {
+        (true, true) => Some(AtRuleForms::Both),
+        (true, false) => Some(AtRuleForms::Statement),
+        (false, true) => Some(AtRuleForms::Block),
+        (false, false) => None,
+    }
+}
+
+/// The prelude and form of each alternative of the at-rule grammar
+/// `syntax`. The grammar is only split at its top-level `|` when every
+/// alternative is a whole at-rule (`@layer a; | @layer a { ... }`), so a `|`
+/// inside a prelude stays part of it.
+fn forms_of<'a>(name: &str, syntax: &'a str) -> Vec<(&'a str, Option<AtRuleForms>)> {
+    let mut forms = alternatives(syntax);
+    if !forms.iter().all(|form| form.starts_with(name)) {
+        forms = vec![syntax.trim()];
+    }
+    forms.into_iter().filter_map(|form| split(name, form)).collect()
+}
+
+/// Splits one at-rule grammar into its prelude and its form.
+fn split<'a>(name: &str, syntax: &'a str) -> Option<(&'a str, Option<AtRuleForms>)> {
+    let rest = syntax.trim().strip_prefix(name)?;
+    if rest.starts_with(|c: char| !c.is_whitespace() && c != '{' && c != ';') {
+        // `@page-margin` is not `@page`
+        return None;
+    }
+
+    if let Some(start) = block_start(rest) {
+        return Some((rest[..start].trim(), Some(AtRuleForms::Block)));
+    }
+    match rest.strip_suffix(';') {
+        Some(prelude) => Some((prelude.trim(), Some(AtRuleForms::Statement))),
+        None => Some((rest.trim(), None)),
+    }
+}
+
+/// The offset of the `{` opening the block that `syntax` ends with, if it
+/// ends with one. Braces in between, such as `{1,4}` multipliers in the
+/// prelude, are skipped over as long as they are balanced.
+fn block_start(syntax: &str) -> Option<usize> {
+    let syntax = syntax.trim_end();
+    if !syntax.ends_with('}') {
+        return None;
+    }
+    let mut open = Vec::new();
+    let mut quoted = false;
+    for (i, c) in syntax.char_indices() {
+        match c {
+            '\'' => quoted = !quoted,
+            '{' if !quoted => open.push(i),
+            '}' if !quoted => {
+                let start = open.pop()?;
+                if i == syntax.len() - 1 {
+                    return Some(start);
+                }
+            }
+            _ => {}
+        }
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn the_prelude_is_cut_from_the_at_rule_grammar() {
+        for (name, syntax, prelude) in [
+            (
+                "@media",
+                "@media <media-query-list> {\n  <rule-list>\n}",
+                "<media-query-list>",
+            ),
+            (
+                "@supports",
+                "@supports <supports-condition> { <rule-list> }",
+                "<supports-condition>",
+            ),
+            ("@font-face", "@font-face { <declaration-list> }", ""),
+            (
+                "@import",
+                "@import [ <url> | <string> ] [ layer | layer( <layer-name> ) ]? <import-conditions> ;",
+                "[ <url> | <string> ] [ layer | layer( <layer-name> ) ]? <import-conditions>",
+            ),
+            ("@layer", "@layer <layer-name>#;", "<layer-name>#"),
+            ("@test", "@test <length>{1,2} '{' { <rule-list> }", "<length>{1,2} '{'"),
+            ("@test", "@test a | b { <rule-list> }", "a | b"),
+            ("@page", "@page-margin { <declaration-list> }", ""),
+            ("@media", "", ""),
+            (
+                "@layer",
+                "@layer <layer-name>? { <rule-list> } | @layer <layer-name>#;",
+                "<layer-name>? | <layer-name>#",
+            ),
+            ("@test", "@test { <rule-list> } | @test <x>;", "[ <x> ]?"),
+        ] {
+            assert_eq!(extract(name, syntax), prelude, "{syntax}");
+        }
+    }
+
+    #[test]
+    fn forms_follow_the_end_of_each_alternative() {
+        for (name, syntax, expected) in [
+            (
+                "@layer",
+                "@layer <layer-name>? {\n  <rule-list>\n} | @layer <layer-name>#;",
+                Some(AtRuleForms::Both),
+            ),
+            (
+                "@import",
+                "@import [ <url> | <string> ] [ layer | layer( <layer-name> ) ]? <import-conditions> ;",
+                Some(AtRuleForms::Statement),
+            ),
+            (
+                "@layer",
+                "@layer <layer-name>? { <rule-list> }",
+                Some(AtRuleForms::Block),
+            ),
+            (
+                "@media",
+                "@media <media-query-list> { <rule-list> }",
+                Some(AtRuleForms::Block),
+            ),
+            ("@media", "", None),
+        ] {
+            assert_eq!(forms(name, syntax), expected, "{syntax}");
+        }
+    }
+}
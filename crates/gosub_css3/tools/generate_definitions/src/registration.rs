@@ -0,0 +1,116 @@
+//! The `@property` at-rule registers a custom property through three
+//! descriptors: `syntax`, `inherits`, and `initial-value`. Besides the plain
+//! descriptor list, the at-rule is exported with a `registration` object
+//! holding those three grammars by name, so the engine does not have to look
+//! them up among the descriptors.
+
+use crate::syntax_check::alternatives;
+use crate::types::{AtRule, PropertyRegistration};
+
+pub const AT_RULE: &str = "@property";
+
+/// Grammars the `syntax` descriptor may have: its value is a string holding a
+/// registered-property syntax (`"<length> | auto"`, `"*"`), which the engine
+/// parses itself.
+const SYNTAX_GRAMMARS: [&str; 2] = ["<string>", "<syntax>"];
+
+/// Builds the registration from the `@property` descriptors. Fails when one of
+/// them is missing or its grammar is not one a registration can be read from.
+pub fn property_registration(at_rule: &AtRule) -> Result<PropertyRegistration, String> {
+    let grammar = |name: &str| {
+        at_rule
+            .descriptors
+            .iter()
+            .find(|d| d.name == name)
+            .map(|d| d.syntax.clone())
+            .ok_or_else(|| format!("{} has no {name} descriptor", at_rule.name))
+    };
+    let syntax = grammar("syntax")?;
+    let inherits = grammar("inherits")?;
+    let initial_value = grammar("initial-value")?;
+
+    if !alternatives(&syntax).iter().all(|a| SYNTAX_GRAMMARS.contains(a)) {
+        return Err(format!(
+            "syntax descriptor grammar {syntax:?} is not a registered-property syntax string ({})",
+            SYNTAX_GRAMMARS.join(" or ")
+        ));
+    }
+    let mut keywords = alternatives(&inherits);
+    keywords.sort_unstable();
+    if keywords != ["false", "true"] {
+        return Err(format!(
+            "inherits descriptor grammar {inherits:?} is not `true | false`"
+        ));
+    }
+
+    Ok(PropertyRegistration {
+        syntax,
+        inherits,
+        initial_value,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::AtRuleDescriptor;
+
+    fn at_rule(descriptors: &[(&str, &str)]) -> AtRule {
+        AtRule {
+            name: AT_RULE.to_string(),
+            descriptors: descriptors
+                .iter()
+                .map(|(name, syntax)| AtRuleDescriptor {
+                    name: name.to_string(),
+                    syntax: syntax.to_string(),
+                    initial: String::new(),
+                    sources: Vec::new(),
+                })
+                .collect(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn registration_comes_from_the_three_descriptors() {
+        let registration = property_registration(&at_rule(&[
+            ("syntax", "<string>"),
+            ("inherits", "true | false"),
+            ("initial-value", "<declaration-value>?"),
+        ]))
+        .unwrap();
+        assert_eq!(registration.syntax, "<string>");
+        assert_eq!(registration.inherits, "true | false");
+        assert_eq!(registration.initial_value, "<declaration-value>?");
+    }
+
+    #[test]
+    fn unusable_descriptor_grammars_are_rejected() {
+        let missing = property_registration(&at_rule(&[("syntax", "<string>"), ("inherits", "true | false")]));
+        assert_eq!(missing.unwrap_err(), "@property has no initial-value descriptor");
+
+        let syntax = property_registration(&at_rule(&[
+            ("syntax", "<custom-ident>"),
+            ("inherits", "true | false"),
+            ("initial-value", "<declaration-value>?"),
+        ]));
+        assert!(syntax
+            .unwrap_err()
+            .starts_with("syntax descriptor grammar \"<custom-ident>\""));
+
+        let inherits = property_registration(&at_rule(&[
+            ("syntax", "<string> | <syntax>"),
+            ("inherits", "<boolean>"),
+            ("initial-value", "<declaration-value>?"),
+        ]));
+        assert!(inherits.unwrap_err().starts_with("inherits descriptor grammar"));
+
+        // Only top-level alternatives count: a bracketed `|` does not split.
+        let bracketed = property_registration(&at_rule(&[
+            ("syntax", "[ <string> | <syntax> ]+"),
+            ("inherits", "true | false"),
+            ("initial-value", "<declaration-value>?"),
+        ]));
+        assert!(bracketed.unwrap_err().starts_with("syntax descriptor grammar"));
+    }
+}
@@ -0,0 +1,456 @@
+//! `--emit-rust`: renders the generated data as a Rust source file of static
+//! tables, so the definitions can be embedded at compile time instead of
+//! parsing JSON at startup. The engine compiles grammars at runtime
+//! (`CssSyntax::new(..).compile()`), so syntaxes are emitted as the same raw
+//! strings the JSON carries. The file declares its own table types (the
+//! engine's definition types hold compiled grammars, which cannot be
+//! `static`) and carries everything `definitions.json` does but the
+//! `sources`.
+
+use crate::types::{AtRule, Data, Property, Selector, StringMaybeArray};
+use std::fmt::{self, Write};
+
+/// Type definitions emitted at the top of the generated file.
+const PRELUDE: &str = r#"// @generated by generate_definitions --emit-rust. Do not edit by hand.
+
+/// A field MDN gives either as a single string or as a list.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum StringOrList {
+    Single(&'static str),
+    List(&'static [&'static str]),
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct PropertyDef {
+    pub name: &'static str,
+    pub syntax: &'static str,
+    pub computed: &'static [&'static str],
+    pub initial: StringOrList,
+    pub initial_derived: bool,
+    pub inherited: bool,
+    pub animation_type: StringOrList,
+    pub percentages: StringOrList,
+    pub longhands: &'static [&'static str],
+    pub obsolete: bool,
+    pub mdn_url: &'static str,
+}
+
+/// What a value definition names.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ValueKind {
+    Type,
+    Function,
+    Keyword,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct ValueDef {
+    pub name: &'static str,
+    pub syntax: &'static str,
+    pub kind: ValueKind,
+    pub children: &'static [&'static str],
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct AtRuleDescriptorDef {
+    pub name: &'static str,
+    pub syntax: &'static str,
+    pub initial: &'static str,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct AtRuleValueEntryDef {
+    pub name: &'static str,
+    pub value: &'static str,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct AtRuleValueDef {
+    pub name: &'static str,
+    pub value: &'static str,
+    pub values: Option<&'static [AtRuleValueEntryDef]>,
+}
+
+/// How an at-rule is written.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AtRuleForms {
+    Statement,
+    Block,
+    Both,
+}
+
+/// The `@property` descriptors that register a custom property.
+#[derive(Debug, Clone, Copy)]
+pub struct PropertyRegistrationDef {
+    pub syntax: &'static str,
+    pub inherits: &'static str,
+    pub initial_value: &'static str,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MediaFeatureType {
+    Range,
+    Discrete,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct MediaFeatureDef {
+    pub name: &'static str,
+    pub feature_type: MediaFeatureType,
+    pub syntax: &'static str,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct AtRuleDef {
+    pub name: &'static str,
+    pub prelude: &'static str,
+    pub forms: Option<AtRuleForms>,
+    pub descriptors: &'static [AtRuleDescriptorDef],
+    pub values: Option<&'static [AtRuleValueDef]>,
+    pub registration: Option<PropertyRegistrationDef>,
+    pub media_features: Option<&'static [MediaFeatureDef]>,
+}
+
+/// What kind of selector an entry is.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SelectorKind {
+    PseudoClass,
+    PseudoElement,
+    Combinator,
+    Functional,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct SelectorDef {
+    pub name: &'static str,
+    pub kind: Option<SelectorKind>,
+    pub arguments: &'static str,
+}
+"#;
+
+/// Renders `data` as Rust source. Entries keep the order of `data`, which the
+/// generator sorts before export, so the output is deterministic.
+pub fn render(data: &Data) -> Result<String, fmt::Error> {
+    let mut out = String::from(PRELUDE);
+
+    out.push_str("\npub static PROPERTIES: &[PropertyDef] = &[\n");
+    for property in &data.properties {
+        render_property(&mut out, property)?;
+    }
+    out.push_str("];\n");
+
+    out.push_str("\npub static VALUES: &[ValueDef] = &[\n");
+    for value in &data.values {
+        writeln!(
+            out,
+            "    ValueDef {{ name: {:?}, syntax: {:?}, kind: ValueKind::{:?}, children: {} }},",
+            value.name,
+            value.syntax,
+            value.kind,
+            str_slice(&value.children)
+        )?;
+    }
+    out.push_str("];\n");
+
+    out.push_str("\npub static AT_RULES: &[AtRuleDef] = &[\n");
+    for at_rule in &data.atrules {
+        render_at_rule(&mut out, at_rule)?;
+    }
+    out.push_str("];\n");
+
+    out.push_str("\npub static SELECTORS: &[SelectorDef] = &[\n");
+    for selector in &data.selectors {
+        render_selector(&mut out, selector)?;
+    }
+    out.push_str("];\n");
+
+    out.push_str("\n/// (alias, property) pairs\npub static PROP_ALIASES: &[(&str, &str)] = &[\n");
+    for alias in &data.prop_aliases {
+        writeln!(out, "    ({:?}, {:?}),", alias.name, alias.property)?;
+    }
+    out.push_str("];\n");
+
+    out.push_str("\n/// (property, aliases) pairs\npub static REVERSE_ALIASES: &[(&str, &[&str])] = &[\n");
+    for reverse in &data.reverse_aliases {
+        writeln!(out, "    ({:?}, {}),", reverse.property, str_slice(&reverse.aliases))?;
+    }
+    out.push_str("];\n");
+
+    Ok(out)
+}
+
+fn render_property(out: &mut String, property: &Property) -> fmt::Result {
+    writeln!(out, "    PropertyDef {{")?;
+    writeln!(out, "        name: {:?},", property.name)?;
+    writeln!(out, "        syntax: {:?},", property.syntax)?;
+    writeln!(out, "        computed: {},", str_slice(&property.computed))?;
+    writeln!(out, "        initial: {},", string_or_list(&property.initial))?;
+    writeln!(out, "        initial_derived: {},", property.initial_derived)?;
+    writeln!(out, "        inherited: {},", property.inherited)?;
+    writeln!(
+        out,
+        "        animation_type: {},",
+        string_or_list(&property.animation_type)
+    )?;
+    writeln!(out, "        percentages: {},", string_or_list(&property.percentages))?;
+    writeln!(out, "        longhands: {},", str_slice(&property.longhands))?;
+    writeln!(out, "        obsolete: {},", property.obsolete)?;
+    writeln!(out, "        mdn_url: {:?},", property.mdn_url)?;
+    writeln!(out, "    }},")
+}
+
+fn render_at_rule(out: &mut String, at_rule: &AtRule) -> fmt::Result {
+    writeln!(out, "    AtRuleDef {{")?;
+    writeln!(out, "        name: {:?},", at_rule.name)?;
+    writeln!(out, "        prelude: {:?},", at_rule.prelude)?;
+    match at_rule.forms {
+        None => writeln!(out, "        forms: None,")?,
+        Some(forms) => writeln!(out, "        forms: Some(AtRuleForms::{forms:?}),")?,
+    }
+    writeln!(out, "        descriptors: &[")?;
+    for descriptor in &at_rule.descriptors {
+        writeln!(
+            out,
+            "            AtRuleDescriptorDef {{ name: {:?}, syntax: {:?}, initial: {:?} }},",
+            descriptor.name, descriptor.syntax, descriptor.initial
+        )?;
+    }
+    writeln!(out, "        ],")?;
+    match &at_rule.values {
+        None => writeln!(out, "        values: None,")?,
+        Some(values) => {
+            writeln!(out, "        values: Some(&[")?;
+            for value in values {
+                let entries = match &value.values {
+                    None => "None".to_string(),
+                    Some(entries) => {
+                        let entries: Vec<String> = entries
+                            .iter()
+                            .map(|e| format!("AtRuleValueEntryDef {{ name: {:?}, value: {:?} }}", e.name, e.value))
+                            .collect();
+                        format!("Some(&[{}])", entries.join(", "))
+                    }
+                };
+                writeln!(
+                    out,
+                    "            AtRuleValueDef {{ name: {:?}, value: {:?}, values: {entries} }},",
+                    value.name, value.value
+                )?;
+            }
+            writeln!(out, "        ]),")?;
+        }
+    }
+    match &at_rule.registration {
+        None => writeln!(out, "        registration: None,")?,
+        Some(registration) => writeln!(
+            out,
+            "        registration: Some(PropertyRegistrationDef {{ syntax: {:?}, inherits: {:?}, initial_value: {:?} }}),",
+            registration.syntax, registration.inherits, registration.initial_value
+        )?,
+    }
+    match &at_rule.media_features {
+        None => writeln!(out, "        media_features: None,")?,
+        Some(features) => {
+            writeln!(out, "        media_features: Some(&[")?;
+            for feature in features {
+                writeln!(
+                    out,
+                    "            MediaFeatureDef {{ name: {:?}, feature_type: MediaFeatureType::{:?}, syntax: {:?} }},",
+                    feature.name, feature.feature_type, feature.syntax
+                )?;
+            }
+            writeln!(out, "        ]),")?;
+        }
+    }
+    writeln!(out, "    }},")
+}
+
+fn render_selector(out: &mut String, selector: &Selector) -> fmt::Result {
+    let kind = match selector.kind {
+        None => "None".to_string(),
+        Some(kind) => format!("Some(SelectorKind::{kind:?})"),
+    };
+    writeln!(
+        out,
+        "    SelectorDef {{ name: {:?}, kind: {kind}, arguments: {:?} }},",
+        selector.name, selector.arguments
+    )
+}
+
+fn str_slice(items: &[String]) -> String {
+    let items: Vec<String> = items.iter().map(|i| format!("{i:?}")).collect();
+    format!("&[{}]", items.join(", "))
+}
+
+fn string_or_list(value: &StringMaybeArray) -> String {
+    if value.is_array() {
+        format!("StringOrList::List({})", str_slice(&value.array))
+    } else {
+        format!("StringOrList::Single({:?})", value.string)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{
+        AtRuleDescriptor, AtRuleForms, AtRuleValue, AtRuleValueEntry, MediaFeature, MediaFeatureType, PropAlias,
+        Property, PropertyRegistration, ReverseAlias, SelectorKind, Value, ValueKind,
+    };
+    use std::fs;
+
+    /// `render(&data())`, checked in so the compile test below can include it.
+    const RENDERED: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/testdata/rust/definitions.rs");
+
+    /// The checked-in output, compiled as part of the tests.
+    #[allow(dead_code)]
+    mod rendered {
+        include!(concat!(env!("CARGO_MANIFEST_DIR"), "/testdata/rust/definitions.rs"));
+    }
+
+    fn data() -> Data {
+        Data {
+            properties: vec![Property {
+                name: "quotes".to_string(),
+                syntax: "auto | none | [ <string> <string> ]+".to_string(),
+                computed: vec!["asSpecified".to_string()],
+                initial: StringMaybeArray {
+                    string: "dependsOnUserAgent".to_string(),
+                    ..Default::default()
+                },
+                inherited: true,
+                animation_type: StringMaybeArray {
+                    string: "discrete".to_string(),
+                    ..Default::default()
+                },
+                percentages: StringMaybeArray {
+                    array: vec!["a".to_string()],
+                    is_array: true,
+                    ..Default::default()
+                },
+                ..Default::default()
+            }],
+            values: vec![Value {
+                name: "<string>".to_string(),
+                syntax: "\"quoted\" \\ text".to_string(),
+                kind: ValueKind::Type,
+                ..Default::default()
+            }],
+            atrules: vec![
+                AtRule {
+                    name: "@media".to_string(),
+                    prelude: "<media-query-list>".to_string(),
+                    forms: Some(AtRuleForms::Block),
+                    media_features: Some(vec![MediaFeature {
+                        name: "width".to_string(),
+                        feature_type: MediaFeatureType::Range,
+                        syntax: "<length>".to_string(),
+                    }]),
+                    ..Default::default()
+                },
+                AtRule {
+                    name: "@page".to_string(),
+                    prelude: "<page-selector-list>?".to_string(),
+                    descriptors: vec![AtRuleDescriptor {
+                        name: "size".to_string(),
+                        syntax: "<length>{1,2} | auto".to_string(),
+                        initial: "auto".to_string(),
+                        sources: Vec::new(),
+                    }],
+                    values: Some(vec![AtRuleValue {
+                        name: "size".to_string(),
+                        value: String::new(),
+                        values: Some(vec![AtRuleValueEntry {
+                            name: "A4".to_string(),
+                            value: "210mm 297mm".to_string(),
+                        }]),
+                    }]),
+                    ..Default::default()
+                },
+                AtRule {
+                    name: "@property".to_string(),
+                    prelude: "<custom-property-name>".to_string(),
+                    forms: Some(AtRuleForms::Block),
+                    registration: Some(PropertyRegistration {
+                        syntax: "<string>".to_string(),
+                        inherits: "true | false".to_string(),
+                        initial_value: "<declaration-value>?".to_string(),
+                    }),
+                    ..Default::default()
+                },
+            ],
+            selectors: vec![
+                Selector {
+                    name: ":hover".to_string(),
+                    kind: Some(SelectorKind::PseudoClass),
+                    arguments: String::new(),
+                },
+                Selector {
+                    name: ":nth-child()".to_string(),
+                    kind: Some(SelectorKind::Functional),
+                    arguments: "<an+b> [ of <complex-real-selector-list> ]?".to_string(),
+                },
+            ],
+            prop_aliases: vec![PropAlias {
+                name: "word-wrap".to_string(),
+                property: "overflow-wrap".to_string(),
+            }],
+            reverse_aliases: vec![ReverseAlias {
+                property: "overflow-wrap".to_string(),
+                aliases: vec!["word-wrap".to_string()],
+            }],
+        }
+    }
+
+    #[test]
+    fn renders_escaped_static_tables() {
+        let out = render(&data()).unwrap();
+        assert!(out.starts_with("// @generated"));
+        assert!(out.contains(r#"        name: "quotes","#));
+        assert!(out.contains(r#"        computed: &["asSpecified"],"#));
+        assert!(out.contains(r#"        initial: StringOrList::Single("dependsOnUserAgent"),"#));
+        assert!(out.contains(r#"        percentages: StringOrList::List(&["a"]),"#));
+        assert!(out.contains(
+            r#"ValueDef { name: "<string>", syntax: "\"quoted\" \\ text", kind: ValueKind::Type, children: &[] },"#
+        ));
+        assert!(out
+            .contains(r#"    SelectorDef { name: ":hover", kind: Some(SelectorKind::PseudoClass), arguments: "" },"#));
+        assert!(out.contains(r#"    ("word-wrap", "overflow-wrap"),"#));
+        assert!(out.contains(r#"    ("overflow-wrap", &["word-wrap"]),"#));
+    }
+
+    /// The checked-in rendering is current and, being included above,
+    /// compiles. After an intended change, regenerate it with
+    /// `UPDATE_GOLDEN=1 cargo test -p generate_definitions` and review the diff.
+    #[test]
+    fn rendered_tables_compile() {
+        let actual = render(&data()).unwrap();
+        if std::env::var_os("UPDATE_GOLDEN").is_some() {
+            fs::write(RENDERED, &actual).unwrap();
+            return;
+        }
+        assert!(
+            actual == fs::read_to_string(RENDERED).unwrap_or_default(),
+            "rendered Rust differs from {RENDERED}; if the change is intended, rerun with UPDATE_GOLDEN=1"
+        );
+
+        assert_eq!(
+            rendered::PROPERTIES[0].initial,
+            rendered::StringOrList::Single("dependsOnUserAgent")
+        );
+        assert_eq!(rendered::VALUES[0].syntax, "\"quoted\" \\ text");
+        let media = &rendered::AT_RULES[0];
+        assert_eq!(media.forms, Some(rendered::AtRuleForms::Block));
+        let features = media.media_features.unwrap();
+        assert_eq!(features[0].feature_type, rendered::MediaFeatureType::Range);
+        assert_eq!(
+            rendered::AT_RULES[1].values.unwrap()[0].values.unwrap()[0].value,
+            "210mm 297mm"
+        );
+        assert_eq!(rendered::AT_RULES[2].registration.unwrap().inherits, "true | false");
+        let nth_child = &rendered::SELECTORS[1];
+        assert_eq!(nth_child.kind, Some(rendered::SelectorKind::Functional));
+        assert_eq!(nth_child.arguments, "<an+b> [ of <complex-real-selector-list> ]?");
+        assert_eq!(rendered::REVERSE_ALIASES[0].1, ["word-wrap"]);
+    }
+}
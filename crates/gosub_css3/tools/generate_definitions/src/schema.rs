@@ -0,0 +1,167 @@
+//! `--emit-schema`: a JSON Schema (draft 2020-12) for `definitions.json`,
+//! derived from the types it is serialized from, so a field added to them is
+//! in the schema too. Every object is closed (`additionalProperties: false`).
+
+use crate::export::Document;
+use schemars::generate::SchemaSettings;
+use schemars::transform::{transform_subschemas, Transform};
+use schemars::Schema;
+
+/// Closes every object schema, so documents with fields the types do not
+/// have are rejected.
+#[derive(Debug, Clone)]
+struct DenyUnknownFields;
+
+impl Transform for DenyUnknownFields {
+    fn transform(&mut self, schema: &mut Schema) {
+        if schema.get("properties").is_some() {
+            schema.insert("additionalProperties".to_string(), false.into());
+        }
+        transform_subschemas(self, schema);
+    }
+}
+
+/// Returns the schema of the combined `definitions.json` document.
+pub fn definitions_schema() -> Schema {
+    SchemaSettings::draft2020_12()
+        .for_serialize()
+        .with_transform(DenyUnknownFields)
+        .into_generator()
+        .into_root_schema_for::<Document<'static>>()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::export;
+    use crate::types::{
+        AtRule, AtRuleDescriptor, AtRuleForms, AtRuleValue, AtRuleValueEntry, Data, MediaFeature, MediaFeatureType,
+        PropAlias, Property, PropertyRegistration, ReverseAlias, Selector, SelectorKind, Source, StringMaybeArray,
+        Value as CssValue, ValueKind, SCHEMA_VERSION,
+    };
+    use serde_json::{json, Value};
+
+    /// The validation errors of `instance` against the schema.
+    fn errors(instance: &Value) -> Vec<String> {
+        let schema = serde_json::to_value(definitions_schema()).unwrap();
+        let validator = jsonschema::validator_for(&schema).unwrap();
+        validator.iter_errors(instance).map(|e| e.to_string()).collect()
+    }
+
+    fn populated_data() -> Data {
+        let source = Source {
+            shortname: "css-box-4".to_string(),
+            title: "CSS Box Model Module Level 4".to_string(),
+            url: "https://drafts.csswg.org/css-box-4/".to_string(),
+        };
+        Data {
+            properties: vec![Property {
+                name: "margin".to_string(),
+                syntax: "<'margin-top'>{1,4}".to_string(),
+                computed: vec!["margin-top".to_string()],
+                initial: StringMaybeArray {
+                    array: vec!["margin-top".to_string()],
+                    is_array: true,
+                    ..Default::default()
+                },
+                initial_derived: true,
+                animation_type: StringMaybeArray {
+                    string: "length".to_string(),
+                    ..Default::default()
+                },
+                percentages: StringMaybeArray {
+                    string: "referToWidthOfContainingBlock".to_string(),
+                    ..Default::default()
+                },
+                longhands: vec!["margin-top".to_string()],
+                mdn_url: "https://developer.mozilla.org/docs/Web/CSS/margin".to_string(),
+                sources: vec![source.clone()],
+                ..Default::default()
+            }],
+            values: vec![CssValue {
+                name: "<margin-width>".to_string(),
+                syntax: "<length-percentage> | auto".to_string(),
+                kind: ValueKind::Type,
+                children: vec!["<length-percentage>".to_string()],
+                sources: vec![source.clone()],
+            }],
+            atrules: vec![
+                AtRule {
+                    name: "@page".to_string(),
+                    prelude: "<page-selector-list>?".to_string(),
+                    forms: Some(AtRuleForms::Block),
+                    descriptors: vec![AtRuleDescriptor {
+                        name: "size".to_string(),
+                        syntax: "<length>{1,2}".to_string(),
+                        initial: "auto".to_string(),
+                        sources: vec![source.clone()],
+                    }],
+                    values: Some(vec![AtRuleValue {
+                        name: ":first".to_string(),
+                        value: ":first".to_string(),
+                        values: Some(vec![AtRuleValueEntry {
+                            name: "a".to_string(),
+                            value: "b".to_string(),
+                        }]),
+                    }]),
+                    sources: vec![source],
+                    ..Default::default()
+                },
+                AtRule {
+                    name: "@property".to_string(),
+                    registration: Some(PropertyRegistration {
+                        syntax: "<string>".to_string(),
+                        inherits: "true | false".to_string(),
+                        initial_value: "<declaration-value>?".to_string(),
+                    }),
+                    ..Default::default()
+                },
+                AtRule {
+                    name: "@media".to_string(),
+                    media_features: Some(vec![MediaFeature {
+                        name: "width".to_string(),
+                        feature_type: MediaFeatureType::Range,
+                        syntax: "<length>".to_string(),
+                    }]),
+                    ..Default::default()
+                },
+            ],
+            selectors: vec![Selector {
+                name: ":nth-child()".to_string(),
+                kind: Some(SelectorKind::Functional),
+                arguments: "<an+b>".to_string(),
+            }],
+            prop_aliases: vec![PropAlias {
+                name: "word-wrap".to_string(),
+                property: "overflow-wrap".to_string(),
+            }],
+            reverse_aliases: vec![ReverseAlias {
+                property: "overflow-wrap".to_string(),
+                aliases: vec!["word-wrap".to_string()],
+            }],
+        }
+    }
+
+    #[test]
+    fn generated_document_matches_schema() {
+        let document: Value = serde_json::from_slice(&export::definitions_json(&populated_data()).unwrap()).unwrap();
+        assert_eq!(errors(&document), Vec::<String>::new());
+    }
+
+    #[test]
+    fn schema_rejects_unknown_and_mistyped_fields() {
+        let document: Value = serde_json::from_slice(&export::definitions_json(&populated_data()).unwrap()).unwrap();
+
+        let mut unknown = document.clone();
+        unknown["properties"][0]["status"] = json!("standard");
+        assert!(!errors(&unknown).is_empty());
+
+        let mut mistyped = document.clone();
+        mistyped["properties"][0]["initial"] = json!(0);
+        assert!(!errors(&mistyped).is_empty());
+
+        let mut outdated = document;
+        outdated["schemaVersion"] = json!(SCHEMA_VERSION - 1);
+        assert!(!errors(&outdated).is_empty());
+    }
+}
@@ -0,0 +1,226 @@
+//! The `serve` subcommand: answers lookups into the generated data over HTTP,
+//! so it can be browsed or queried by engine integration tests without
+//! regenerating. A development aid, not a production server: requests are
+//! handled one at a time and every response closes the connection.
+//!
+//! - `GET /properties/{name}`: one property; a legacy alias gives the
+//!   property it resolves to
+//! - `GET /values/{name}`: one value, by the name as given or else as a type
+//!   (`/values/calc()`, `/values/length` for `<length>`)
+//! - `GET /atrules/{name}`: one at-rule; the `@` is optional
+//! - `GET /search?q=`: every property, value, and at-rule whose name contains
+//!   the query, as `{"kind", "name"}` entries
+
+use crate::lookup::Index;
+use crate::types::Data;
+use anyhow::{Context, Result};
+use cow_utils::CowUtils;
+use log::{debug, info, warn};
+use serde::Serialize;
+use serde_json::json;
+use std::io::{BufRead, BufReader, Write};
+use std::net::{TcpListener, TcpStream};
+
+#[derive(Debug, Serialize)]
+struct SearchResult<'a> {
+    kind: &'static str,
+    name: &'a str,
+}
+
+/// Serves `data` on `addr` until the process is stopped.
+pub fn serve(data: &Data, addr: &str) -> Result<()> {
+    let listener = TcpListener::bind(addr).with_context(|| format!("binding {addr}"))?;
+    info!("Serving definitions on http://{}", listener.local_addr()?);
+    let index = data.index();
+    for stream in listener.incoming() {
+        let result = stream
+            .map_err(anyhow::Error::from)
+            .and_then(|stream| handle(&index, stream));
+        if let Err(e) = result {
+            warn!("Request failed: {e:#}");
+        }
+    }
+    Ok(())
+}
+
+fn handle(index: &Index, mut stream: TcpStream) -> Result<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line)?;
+    // The headers are not needed; read past them so the client is not cut off
+    // mid-request.
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 || line.trim().is_empty() {
+            break;
+        }
+    }
+
+    let mut parts = request_line.split_whitespace();
+    let (status, body) = match (parts.next(), parts.next()) {
+        (Some("GET"), Some(target)) => route(index, target),
+        _ => (405, json!({ "error": "only GET is supported" })),
+    };
+    debug!("{} -> {status}", request_line.trim());
+
+    let body = serde_json::to_vec_pretty(&body)?;
+    let reason = match status {
+        200 => "OK",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        _ => "Internal Server Error",
+    };
+    write!(
+        stream,
+        "HTTP/1.1 {status} {reason}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        body.len()
+    )?;
+    stream.write_all(&body)?;
+    Ok(())
+}
+
+/// Answers one request target (path and query) with a status and JSON body.
+fn route(index: &Index, target: &str) -> (u16, serde_json::Value) {
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    let segments: Vec<String> = path.split('/').filter(|s| !s.is_empty()).map(percent_decode).collect();
+
+    let found = match segments.as_slice() {
+        [kind, name] if kind == "properties" => index.resolve_property(name).map(serde_json::to_value),
+        [kind, name] if kind == "values" => index
+            .value(name)
+            .or_else(|| index.value(&format!("<{name}>")))
+            .map(serde_json::to_value),
+        [kind, name] if kind == "atrules" => {
+            let with_at = format!("@{}", name.trim_start_matches('@'));
+            index.at_rule(&with_at).map(serde_json::to_value)
+        }
+        [kind] if kind == "search" => {
+            let q = query
+                .split('&')
+                .find_map(|param| param.strip_prefix("q="))
+                .map(|q| percent_decode(&q.cow_replace('+', " ")))
+                .unwrap_or_default();
+            Some(serde_json::to_value(search(index.data(), &q)))
+        }
+        _ => None,
+    };
+
+    match found {
+        Some(Ok(value)) => (200, value),
+        Some(Err(e)) => (500, json!({ "error": e.to_string() })),
+        None => (404, json!({ "error": format!("nothing at {path}") })),
+    }
+}
+
+fn search<'a>(data: &'a Data, q: &str) -> Vec<SearchResult<'a>> {
+    let properties = data.properties.iter().map(|p| ("property", p.name.as_str()));
+    let values = data.values.iter().map(|v| ("value", v.name.as_str()));
+    let atrules = data.atrules.iter().map(|a| ("at-rule", a.name.as_str()));
+    properties
+        .chain(values)
+        .chain(atrules)
+        .filter(|(_, name)| name.contains(q))
+        .map(|(kind, name)| SearchResult { kind, name })
+        .collect()
+}
+
+/// Decodes `%XX` escapes. Invalid escapes are kept as they are. A `+` stays
+/// a `+`: only in query strings does it stand for a space.
+fn percent_decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let escaped = (bytes[i] == b'%')
+            .then(|| s.get(i + 1..i + 3))
+            .flatten()
+            .and_then(|hex| u8::from_str_radix(hex, 16).ok());
+        match escaped {
+            Some(byte) => {
+                out.push(byte);
+                i += 3;
+            }
+            None => {
+                out.push(bytes[i]);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::{AtRule, PropAlias, Property, Value, ValueKind};
+
+    fn data() -> Data {
+        let property = |name: &str| Property {
+            name: name.to_string(),
+            syntax: "<length-percentage> | auto".to_string(),
+            ..Default::default()
+        };
+        let value = |name: &str, kind| Value {
+            name: name.to_string(),
+            kind,
+            ..Default::default()
+        };
+        Data {
+            properties: vec![property("margin"), property("margin-top")],
+            values: vec![
+                value("<margin-width>", ValueKind::Type),
+                value("<an+b>", ValueKind::Type),
+                value("calc()", ValueKind::Function),
+            ],
+            atrules: vec![AtRule {
+                name: "@page".to_string(),
+                ..Default::default()
+            }],
+            prop_aliases: vec![PropAlias {
+                name: "-old-margin".to_string(),
+                property: "margin".to_string(),
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn entries_are_looked_up_by_name() {
+        let data = data();
+        let index = data.index();
+
+        let (status, body) = route(&index, "/properties/margin-top");
+        assert_eq!(status, 200);
+        assert_eq!(body["name"], "margin-top");
+
+        assert_eq!(route(&index, "/values/margin-width").1["name"], "<margin-width>");
+        assert_eq!(route(&index, "/values/%3Cmargin-width%3E").1["name"], "<margin-width>");
+        assert_eq!(route(&index, "/values/calc()").1["name"], "calc()");
+        assert_eq!(route(&index, "/values/an+b").1["name"], "<an+b>");
+        assert_eq!(route(&index, "/atrules/page").1["name"], "@page");
+        assert_eq!(route(&index, "/atrules/@page").1["name"], "@page");
+
+        assert_eq!(route(&index, "/properties/-old-margin").1["name"], "margin");
+        assert_eq!(route(&index, "/properties/padding").0, 404);
+        assert_eq!(route(&index, "/").0, 404);
+    }
+
+    #[test]
+    fn search_matches_names_of_every_kind() {
+        let (status, body) = route(&data().index(), "/search?q=margin");
+        assert_eq!(status, 200);
+        assert_eq!(
+            body,
+            json!([
+                { "kind": "property", "name": "margin" },
+                { "kind": "property", "name": "margin-top" },
+                { "kind": "value", "name": "<margin-width>" }
+            ])
+        );
+        assert_eq!(
+            route(&data().index(), "/search?q=an%2Bb").1,
+            json!([{ "kind": "value", "name": "<an+b>" }])
+        );
+        assert_eq!(route(&data().index(), "/search?q=nothing").1, json!([]));
+    }
+}
@@ -0,0 +1,264 @@
+//! A shorthand's initial value is the initial values of its longhands, in
+//! the order it lists them. When the sources give a shorthand no initial of
+//! its own, it is composed from the longhands' and flagged `initialDerived`.
+//! An initial in array form only lists the longhands (MDN's way of marking a
+//! shorthand), so it counts as none.
+//!
+//! Longhands whose initial is prose rather than a value are left out, a
+//! longhand the shorthand's grammar writes after a `/` gets one, and a
+//! composed value the grammar does not accept is dropped.
+
+use crate::initial_check::{is_descriptive, Check, Matcher};
+use crate::lookup::Index;
+use crate::syntax_check::{parse_grammar, Node};
+use crate::types::{Data, Property, StringMaybeArray};
+use log::{debug, warn};
+use std::collections::{BTreeMap, BTreeSet};
+
+/// Composes the missing shorthand initials, and warns about shorthands whose
+/// own initial differs from the composed one. Returns how many were
+/// composed.
+pub fn derive_initials(data: &mut Data) -> usize {
+    let index = data.index();
+    let matcher = Matcher::new(&index);
+    let derived: BTreeMap<String, String> = data
+        .properties
+        .iter()
+        .filter(|p| !p.longhands.is_empty())
+        .filter_map(|p| {
+            let initial = compose(&matcher, &index, p, &mut BTreeSet::from([p.name.as_str()]))?;
+            if matcher.check(&p.syntax, &initial) == Check::Invalid {
+                debug!(
+                    "Not deriving the initial of {}: `{initial}` does not match its syntax",
+                    p.name
+                );
+                return None;
+            }
+            Some((p.name.clone(), initial))
+        })
+        .collect();
+
+    let mut count = 0;
+    for property in &mut data.properties {
+        let Some(initial) = derived.get(&property.name) else {
+            continue;
+        };
+        let explicit = if property.initial.is_array() {
+            ""
+        } else {
+            property.initial.string.as_str()
+        };
+        if explicit.is_empty() {
+            property.initial = StringMaybeArray {
+                string: initial.clone(),
+                ..Default::default()
+            };
+            property.initial_derived = true;
+            count += 1;
+        } else if !explicit.split_whitespace().eq(initial.split_whitespace()) {
+            warn!(
+                "Shorthand {} has initial value `{explicit}`, but its longhands give `{initial}`",
+                property.name
+            );
+        }
+    }
+    count
+}
+
+/// The initial values of the longhands of `shorthand`, joined in order, with
+/// a `/` before those its grammar writes after one. A longhand that is a
+/// shorthand itself contributes its own composed value; one whose initial is
+/// not a value its own grammar accepts (prose) is left out. None when any of
+/// them is unknown or has no initial at all, or none is left. `seen` holds
+/// the shorthands being composed, to stop at a cycle.
+fn compose<'a>(
+    matcher: &Matcher<'a>,
+    index: &Index<'a>,
+    shorthand: &'a Property,
+    seen: &mut BTreeSet<&'a str>,
+) -> Option<String> {
+    let mut after_slash = BTreeSet::new();
+    if let Ok(grammar) = parse_grammar(&shorthand.syntax) {
+        collect_after_slash(&grammar, &mut after_slash);
+    }
+
+    let mut composed = String::new();
+    for longhand in &shorthand.longhands {
+        let property = index.property(longhand)?;
+        let initial = &property.initial;
+        let part = if !initial.is_array() && !initial.string.trim().is_empty() {
+            let value = initial.string.trim();
+            if is_descriptive(value) || matcher.check(&property.syntax, value) == Check::Invalid {
+                debug!(
+                    "Leaving {longhand} out of the initial of {}: `{value}` is not a value",
+                    shorthand.name
+                );
+                continue;
+            }
+            value.to_string()
+        } else if !property.longhands.is_empty() && seen.insert(longhand.as_str()) {
+            let nested = compose(matcher, index, property, seen);
+            seen.remove(longhand.as_str());
+            nested?
+        } else {
+            return None;
+        };
+        if !composed.is_empty() {
+            composed.push_str(if after_slash.contains(longhand) { " / " } else { " " });
+        }
+        composed.push_str(&part);
+    }
+    (!composed.is_empty()).then_some(composed)
+}
+
+/// Collects the properties `node` writes right after a `/`, as `<'line-height'>`
+/// in `<'font-size'> [ / <'line-height'> ]?`.
+fn collect_after_slash(node: &Node, found: &mut BTreeSet<String>) {
+    match node {
+        Node::Seq(items) => {
+            for pair in items.windows(2) {
+                if matches!(&pair[0], Node::Literal(literal) if literal == "/") {
+                    found.extend(first_property(&pair[1]).map(str::to_string));
+                }
+            }
+            items.iter().for_each(|item| collect_after_slash(item, found));
+        }
+        Node::AllOf(items) | Node::AnyOf(items) | Node::OneOf(items) => {
+            items.iter().for_each(|item| collect_after_slash(item, found));
+        }
+        Node::Function(_, inner) | Node::Block(inner) | Node::Repeat { node: inner, .. } => {
+            collect_after_slash(inner, found);
+        }
+        Node::Keyword(_) | Node::Literal(_) | Node::Type(_) | Node::Property(_) => {}
+    }
+}
+
+/// The property `node` starts with, if it starts with one.
+fn first_property(node: &Node) -> Option<&str> {
+    match node {
+        Node::Property(name) => Some(name),
+        Node::Seq(items) => items.first().and_then(first_property),
+        Node::Repeat { node, .. } => first_property(node),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::Property;
+
+    fn property(name: &str, initial: &str, longhands: &[&str]) -> Property {
+        Property {
+            name: name.to_string(),
+            initial: StringMaybeArray {
+                string: initial.to_string(),
+                ..Default::default()
+            },
+            longhands: longhands.iter().map(|l| l.to_string()).collect(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn empty_shorthand_initials_are_composed_from_their_longhands() {
+        let mut data = Data {
+            properties: vec![
+                property("border", "", &["border-width", "border-style", "border-color"]),
+                property("border-color", "currentcolor", &[]),
+                property("border-style", "none", &[]),
+                property("border-width", "", &["border-top-width", "border-bottom-width"]),
+                property("border-top-width", "medium", &[]),
+                property("border-bottom-width", "medium", &[]),
+                property("gap", "normal", &["row-gap", "column-gap"]),
+                property("row-gap", "normal", &[]),
+                property("column-gap", "normal", &[]),
+                property("inset", "", &["top", "missing"]),
+                property("top", "auto", &[]),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(derive_initials(&mut data), 2);
+
+        let initial = |name: &str| {
+            let p = data.properties.iter().find(|p| p.name == name).unwrap();
+            (p.initial.string.as_str(), p.initial_derived)
+        };
+        assert_eq!(initial("border"), ("medium medium none currentcolor", true));
+        assert_eq!(initial("border-width"), ("medium medium", true));
+        // An explicit initial is kept, even when it differs.
+        assert_eq!(initial("gap"), ("normal", false));
+        // Not composed when a longhand is unknown.
+        assert_eq!(initial("inset"), ("", false));
+    }
+
+    #[test]
+    fn array_form_initials_count_as_none() {
+        let listing = |longhands: &[&str]| StringMaybeArray {
+            array: longhands.iter().map(|l| l.to_string()).collect(),
+            is_array: true,
+            ..Default::default()
+        };
+        let mut background = property("background", "", &["background-clip", "background-color"]);
+        background.initial = listing(&["background-clip", "background-color"]);
+        let mut margin = property("margin", "", &["margin-top", "margin-bottom"]);
+        margin.initial = listing(&["margin-top", "margin-bottom"]);
+        let mut data = Data {
+            properties: vec![
+                background,
+                property("background-clip", "border-box", &[]),
+                property("background-color", "transparent", &[]),
+                margin,
+                property("margin-top", "0", &[]),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(derive_initials(&mut data), 1);
+
+        let background = &data.properties[0];
+        assert_eq!(background.initial.string, "border-box transparent");
+        assert!(!background.initial.is_array());
+        assert!(background.initial_derived);
+        // The listing is kept when a longhand is unknown.
+        let margin = &data.properties[3];
+        assert!(margin.initial.is_array());
+        assert!(!margin.initial_derived);
+    }
+
+    #[test]
+    fn composed_initials_follow_the_shorthand_grammar() {
+        let with_syntax = |name: &str, syntax: &str, initial: &str, longhands: &[&str]| Property {
+            syntax: syntax.to_string(),
+            ..property(name, initial, longhands)
+        };
+        let mut data = Data {
+            properties: vec![
+                with_syntax(
+                    "font",
+                    "<'font-size'> [ / <'line-height'> ]? <'font-family'>?",
+                    "",
+                    &["font-size", "line-height", "font-family"],
+                ),
+                with_syntax("font-size", "medium | large", "medium", &[]),
+                with_syntax("line-height", "normal | tight", "normal", &[]),
+                with_syntax("font-family", "serif | sans-serif", "dependsOnUserAgent", &[]),
+                with_syntax("place-items", "<'align-items'>", "", &["align-items", "justify-items"]),
+                with_syntax("align-items", "normal | start", "normal", &[]),
+                with_syntax("justify-items", "legacy | start", "legacy", &[]),
+            ],
+            ..Default::default()
+        };
+
+        assert_eq!(derive_initials(&mut data), 1);
+
+        // The prose initial of font-family is left out, and line-height
+        // follows a `/`.
+        assert_eq!(data.properties[0].initial.string, "medium / normal");
+        assert!(data.properties[0].initial_derived);
+        // `normal legacy` is not something place-items' grammar accepts.
+        assert_eq!(data.properties[4].initial.string, "");
+        assert!(!data.properties[4].initial_derived);
+    }
+}
@@ -0,0 +1,188 @@
+//! webref's spec index (`ed/index.json`), which records the maturity of every
+//! spec: its latest published release on /TR, if any. Used by `--maturity` to
+//! leave out spec extracts that are less mature than asked for.
+
+use crate::error::ErrorContext;
+use crate::fetch::Fetcher;
+use crate::webref::WebRefLocation;
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::Path;
+
+/// Which specs to collect definitions from, by maturity.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum Maturity {
+    /// Only specs published as a W3C Recommendation
+    Stable,
+    /// Specs that reached Candidate Recommendation or later
+    #[value(name = "cr+")]
+    CandidateRecommendation,
+    /// Every spec, including editor's drafts never published on /TR
+    #[default]
+    Ed,
+}
+
+impl Maturity {
+    /// Whether a spec whose latest release has `status` (None when it was
+    /// never published) is mature enough.
+    fn admits(self, status: Option<&str>) -> bool {
+        match self {
+            Maturity::Ed => true,
+            Maturity::CandidateRecommendation => status.is_some_and(|s| {
+                s.starts_with("Candidate Recommendation") || s == "Proposed Recommendation" || s == "Recommendation"
+            }),
+            Maturity::Stable => status == Some("Recommendation"),
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct SpecIndex {
+    results: Vec<IndexEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+struct IndexEntry {
+    /// The spec's CSS extract relative to the index, e.g. `css/css-align.json`
+    #[serde(default)]
+    css: Option<String>,
+    #[serde(default)]
+    release: Option<Release>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Release {
+    #[serde(default)]
+    status: String,
+}
+
+/// Returns the extract file names (`css-align.json`) of the specs that pass
+/// `maturity`, or None when every spec does and the index is not needed. The
+/// index is cached under `cache_dir`.
+pub fn admitted_files(
+    fetcher: &Fetcher,
+    location: &WebRefLocation,
+    cache_dir: &Path,
+    maturity: Maturity,
+) -> Result<Option<BTreeSet<String>>> {
+    if maturity == Maturity::Ed {
+        return Ok(None);
+    }
+    let body = fetch_index(fetcher, location, cache_dir)?;
+    parse_admitted(&body, maturity).map(Some)
+}
+
+fn parse_admitted(body: &[u8], maturity: Maturity) -> Result<BTreeSet<String>> {
+    let index: SpecIndex = serde_json::from_slice(body).decode_context("webref spec index")?;
+    Ok(index
+        .results
+        .into_iter()
+        .filter(|entry| maturity.admits(entry.release.as_ref().map(|r| r.status.as_str())))
+        .filter_map(|entry| {
+            let css = entry.css?;
+            Some(css.rsplit('/').next().unwrap_or(&css).to_string())
+        })
+        .collect())
+}
+
+/// The spec index's path in the repository. Every location shares it; it
+/// sits next to the first one.
+pub fn index_path(locations: &[String]) -> String {
+    let first = locations.first().map_or("", String::as_str);
+    match first.rsplit_once('/') {
+        Some((parent, _)) => format!("{parent}/index.json"),
+        None => "index.json".to_string(),
+    }
+}
+
+/// Downloads the spec index next to the extracts' directory (`ed/index.json`
+/// for `ed/css`) and caches it; offline, the cached copy is used. A local
+/// checkout has its own copy, read directly.
+fn fetch_index(fetcher: &Fetcher, location: &WebRefLocation, cache_dir: &Path) -> Result<Vec<u8>> {
+    let cache_path = cache_dir.join("index.json");
+    let index_path = index_path(&location.locations);
+
+    if let Some(checkout) = &location.checkout {
+        let path = checkout.join(&index_path);
+        return fs::read(&path).with_context(|| format!("reading {}", path.display()));
+    }
+
+    if fetcher.offline() {
+        return fs::read(&cache_path)
+            .context("offline mode needs a cached webref spec index; run once online first")
+            .cache_context(&cache_path);
+    }
+
+    let url = format!(
+        "{}/{}/{}/{index_path}",
+        location.raw_url, location.repo, location.branch
+    );
+    let body = fetcher
+        .get(&url)?
+        .send()
+        .and_then(|resp| resp.error_for_status())
+        .and_then(|resp| resp.bytes())
+        .download_context(&url)?
+        .to_vec();
+    fetcher.write_cache(&cache_path, &body)?;
+
+    Ok(body)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const INDEX: &str = r#"{"results": [
+        {"shortname": "css-color-3", "css": "css/css-color-3.json", "release": {"status": "Recommendation"}},
+        {"shortname": "css-grid-1", "css": "css/css-grid.json", "release": {"status": "Candidate Recommendation Snapshot"}},
+        {"shortname": "css-align-3", "css": "css/css-align.json", "release": {"status": "Working Draft"}},
+        {"shortname": "css-anchor-position-1", "css": "css/css-anchor-position.json"},
+        {"shortname": "dom", "release": {"status": "Recommendation"}}
+    ]}"#;
+
+    fn admitted(maturity: Maturity) -> Vec<String> {
+        parse_admitted(INDEX.as_bytes(), maturity)
+            .unwrap()
+            .into_iter()
+            .collect()
+    }
+
+    #[test]
+    fn specs_are_admitted_by_release_status() {
+        assert_eq!(admitted(Maturity::Stable), ["css-color-3.json"]);
+        assert_eq!(
+            admitted(Maturity::CandidateRecommendation),
+            ["css-color-3.json", "css-grid.json"]
+        );
+        assert_eq!(
+            admitted(Maturity::Ed),
+            [
+                "css-align.json",
+                "css-anchor-position.json",
+                "css-color-3.json",
+                "css-grid.json"
+            ]
+        );
+    }
+
+    #[test]
+    fn every_spec_passes_without_fetching_the_index() {
+        let fetcher = Fetcher::new(true, false).unwrap();
+        let location = WebRefLocation {
+            repo: "w3c/webref".to_string(),
+            branch: "curated".to_string(),
+            locations: vec!["ed/css".to_string()],
+            checkout: None,
+            api_url: crate::webref::API_URL.to_string(),
+            raw_url: crate::webref::RAW_URL.to_string(),
+        };
+        assert!(
+            admitted_files(&fetcher, &location, Path::new(crate::webref::CACHE_DIR), Maturity::Ed)
+                .unwrap()
+                .is_none()
+        );
+    }
+}
@@ -0,0 +1,88 @@
+//! `--summary-file`: one JSON object describing a finished run, for scripts
+//! that wrap the generator. Unlike the log and the `--report` timings, its
+//! shape is stable: fields are only ever added, and `version` is bumped if
+//! one has to change.
+
+use crate::manifest::{Counts, WebRefRevision};
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::time::Duration;
+
+/// Version of the summary's shape, written as its `version` field.
+pub const SUMMARY_VERSION: u32 = 1;
+
+#[derive(Debug, Serialize)]
+pub struct Summary<'a> {
+    version: u32,
+    /// Entries collected, before `--properties-filter` and `--prune-values`
+    collected: Counts,
+    /// Entries written to the outputs
+    exported: Counts,
+    duration_seconds: f64,
+    warnings: usize,
+    /// Warning counts by category (the module that logged them)
+    warnings_by_category: &'a BTreeMap<String, usize>,
+    /// None when the extracts came from a local checkout or archive
+    webref: Option<&'a WebRefRevision>,
+}
+
+impl<'a> Summary<'a> {
+    pub fn new(
+        collected: Counts,
+        exported: Counts,
+        duration: Duration,
+        warnings: &'a BTreeMap<String, usize>,
+        webref: Option<&'a WebRefRevision>,
+    ) -> Self {
+        Summary {
+            version: SUMMARY_VERSION,
+            collected,
+            exported,
+            duration_seconds: duration.as_secs_f64(),
+            warnings: warnings.values().sum(),
+            warnings_by_category: warnings,
+            webref,
+        }
+    }
+
+    /// The summary as a single line of JSON.
+    pub fn to_json(&self) -> serde_json::Result<String> {
+        serde_json::to_string(self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn summary_is_one_line_of_json() {
+        let counts = Counts {
+            properties: 600,
+            values: 300,
+            atrules: 40,
+            selectors: 80,
+        };
+        let warnings = BTreeMap::from([("webref".to_string(), 2), ("mdn".to_string(), 1)]);
+        let webref = WebRefRevision {
+            repo: "w3c/webref".to_string(),
+            reference: "curated".to_string(),
+            commit: Some("0123abcd".to_string()),
+        };
+        let exported = Counts { values: 120, ..counts };
+        let json = Summary::new(counts, exported, Duration::from_millis(2500), &warnings, Some(&webref))
+            .to_json()
+            .unwrap();
+
+        assert!(!json.contains('\n'));
+        let summary: serde_json::Value = serde_json::from_str(&json).unwrap();
+        assert_eq!(summary["version"], SUMMARY_VERSION);
+        assert_eq!(summary["collected"]["values"], 300);
+        assert_eq!(summary["exported"]["values"], 120);
+        assert_eq!(summary["duration_seconds"], 2.5);
+        assert_eq!(summary["warnings"], 3);
+        assert_eq!(summary["warnings_by_category"]["webref"], 2);
+        assert_eq!(summary["webref"]["ref"], "curated");
+        assert_eq!(summary["webref"]["commit"], "0123abcd");
+    }
+}
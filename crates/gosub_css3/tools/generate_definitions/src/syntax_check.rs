@@ -0,0 +1,473 @@
+//! The parser for CSS value definition syntax, and the check built on it:
+//! balanced `[ ]`, `( )` and `{ }`, multipliers (`* + ? # !` and `{n,m}`)
+//! attached to a term, and combinators (`|`, `||`, `&&`) with a term on both
+//! sides. The check does not know which types exist; it only catches grammars
+//! the engine's parser would choke on, so upstream data errors surface during
+//! generation. `initial_check` matches values against the parsed grammars.
+
+use crate::types::Data;
+use anyhow::{bail, Result};
+use log::warn;
+
+/// A parsed value definition syntax grammar.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Node {
+    /// An identifier to match literally (case-insensitively)
+    Keyword(String),
+    /// Literal punctuation: `,`, `/`, or a quoted `'['`
+    Literal(String),
+    /// `<name>`, with any `[min,max]` range dropped
+    Type(String),
+    /// `<'name'>`
+    Property(String),
+    /// `name( ... )`
+    Function(String, Box<Node>),
+    /// A literal `( ... )` or `{ ... }` block
+    Block(Box<Node>),
+    /// Juxtaposition: all, in order
+    Seq(Vec<Node>),
+    /// `&&`: all, in any order
+    AllOf(Vec<Node>),
+    /// `||`: one or more, in any order
+    AnyOf(Vec<Node>),
+    /// `|`: exactly one
+    OneOf(Vec<Node>),
+    Repeat {
+        node: Box<Node>,
+        min: usize,
+        max: Option<usize>,
+        /// `#`: repetitions are separated by commas
+        comma: bool,
+    },
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    Keyword(String),
+    Literal(String),
+    Type(String),
+    Property(String),
+    Function(String),
+    /// `[`
+    Open,
+    /// `]`
+    Close,
+    /// A bare `(`, opening a literal block
+    OpenParen,
+    CloseParen,
+    /// A `{` that is not a `{n,m}` multiplier, opening a literal block
+    OpenBrace,
+    CloseBrace,
+    Multiplier {
+        min: usize,
+        max: Option<usize>,
+        comma: bool,
+    },
+    Bar,
+    DoubleBar,
+    DoubleAmp,
+}
+
+fn is_word_char(c: char) -> bool {
+    !c.is_whitespace() && !"'<>[](){}*+?#!|&,/".contains(c)
+}
+
+/// Parses the inside of a `{n}`, `{n,}` or `{n,m}` multiplier.
+fn parse_bounds(inner: &str) -> Result<(usize, Option<usize>)> {
+    let inner: String = inner.chars().filter(|c| !c.is_whitespace()).collect();
+    Ok(match inner.split_once(',') {
+        Some((min, "" | "∞")) => (min.parse()?, None),
+        Some((min, max)) => (min.parse()?, Some(max.parse()?)),
+        None => {
+            let n = inner.parse()?;
+            (n, Some(n))
+        }
+    })
+}
+
+fn tokenize(syntax: &str) -> Result<Vec<Token>> {
+    let chars: Vec<char> = syntax.chars().collect();
+    let mut tokens = Vec::new();
+    let mut i = 0;
+
+    // The text up to (not including) the next `close`, starting after `i`.
+    let until = |i: usize, close: char| -> Result<String> {
+        match chars[i + 1..].iter().position(|&c| c == close) {
+            Some(end) => Ok(chars[i + 1..i + 1 + end].iter().collect()),
+            None => bail!("unterminated {}", chars[i]),
+        }
+    };
+
+    while i < chars.len() {
+        let c = chars[i];
+        match c {
+            _ if c.is_whitespace() => i += 1,
+            '\'' => {
+                let literal = until(i, '\'')?;
+                i += literal.chars().count() + 2;
+                tokens.push(Token::Literal(literal));
+            }
+            '<' if chars
+                .get(i + 1)
+                .is_some_and(|n| n.is_alphanumeric() || *n == '\'' || *n == '-') =>
+            {
+                let inner = until(i, '>')?;
+                i += inner.chars().count() + 2;
+                tokens.push(match inner.strip_prefix('\'').and_then(|p| p.strip_suffix('\'')) {
+                    Some(property) => Token::Property(property.to_string()),
+                    None => {
+                        let name = inner.split(|c: char| c.is_whitespace() || c == '[').next();
+                        Token::Type(name.unwrap_or_default().to_string())
+                    }
+                });
+            }
+            '[' | ']' | '(' | ')' | '}' => {
+                tokens.push(match c {
+                    '[' => Token::Open,
+                    ']' => Token::Close,
+                    '(' => Token::OpenParen,
+                    ')' => Token::CloseParen,
+                    _ => Token::CloseBrace,
+                });
+                i += 1;
+            }
+            '{' => match until(i, '}')
+                .ok()
+                .and_then(|inner| Some((parse_bounds(&inner).ok()?, inner)))
+            {
+                Some(((min, max), inner)) => {
+                    i += inner.chars().count() + 2;
+                    tokens.push(Token::Multiplier { min, max, comma: false });
+                }
+                None => {
+                    tokens.push(Token::OpenBrace);
+                    i += 1;
+                }
+            },
+            '*' | '+' | '?' | '!' => {
+                // `!` (at least one value of the group) matches what the group
+                // matches once.
+                let (min, max) = match c {
+                    '*' => (0, None),
+                    '+' => (1, None),
+                    '?' => (0, Some(1)),
+                    _ => (1, Some(1)),
+                };
+                tokens.push(Token::Multiplier { min, max, comma: false });
+                i += 1;
+            }
+            '#' => {
+                i += 1;
+                let (min, max) = match chars.get(i) {
+                    Some('{') => {
+                        let inner = until(i, '}')?;
+                        i += inner.chars().count() + 2;
+                        parse_bounds(&inner)?
+                    }
+                    _ => (1, None),
+                };
+                tokens.push(Token::Multiplier { min, max, comma: true });
+            }
+            '|' if chars.get(i + 1) == Some(&'|') => {
+                tokens.push(Token::DoubleBar);
+                i += 2;
+            }
+            '|' => {
+                tokens.push(Token::Bar);
+                i += 1;
+            }
+            '&' if chars.get(i + 1) == Some(&'&') => {
+                tokens.push(Token::DoubleAmp);
+                i += 2;
+            }
+            '&' => bail!("single '&' is not a combinator"),
+            _ if is_word_char(c) => {
+                // A keyword or number. A keyword directly followed by `(`
+                // opens a function.
+                let start = i;
+                while i < chars.len() && is_word_char(chars[i]) {
+                    i += 1;
+                }
+                let word: String = chars[start..i].iter().collect();
+                if chars.get(i) == Some(&'(') {
+                    tokens.push(Token::Function(word));
+                    i += 1;
+                } else {
+                    tokens.push(Token::Keyword(word));
+                }
+            }
+            _ => {
+                // Literal punctuation: `,`, `/`, or a bare `<` or `>`.
+                tokens.push(Token::Literal(c.to_string()));
+                i += 1;
+            }
+        }
+    }
+
+    Ok(tokens)
+}
+
+/// A recursive descent parser over grammar tokens. Precedence, tightest
+/// first: multipliers, juxtaposition, `&&`, `||`, `|`.
+struct Parser {
+    tokens: Vec<Token>,
+    pos: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos)
+    }
+
+    /// Parses `next ( separator next )*` into `group`, or just the single
+    /// operand when there is no separator. A combinator needs a term on both
+    /// sides.
+    fn separated(
+        &mut self,
+        separator: &Token,
+        next: fn(&mut Self) -> Result<Node>,
+        group: fn(Vec<Node>) -> Node,
+    ) -> Result<Node> {
+        let mut nodes = vec![next(self)?];
+        while self.peek() == Some(separator) {
+            self.pos += 1;
+            nodes.push(next(self)?);
+        }
+        if nodes.len() > 1 && nodes.iter().any(|n| matches!(n, Node::Seq(terms) if terms.is_empty())) {
+            bail!("{separator:?} without a term on both sides");
+        }
+        Ok(match nodes.len() {
+            1 => nodes.remove(0),
+            _ => group(nodes),
+        })
+    }
+
+    fn one_of(&mut self) -> Result<Node> {
+        self.separated(&Token::Bar, Self::any_of, Node::OneOf)
+    }
+
+    fn any_of(&mut self) -> Result<Node> {
+        self.separated(&Token::DoubleBar, Self::all_of, Node::AnyOf)
+    }
+
+    fn all_of(&mut self) -> Result<Node> {
+        self.separated(&Token::DoubleAmp, Self::seq, Node::AllOf)
+    }
+
+    fn seq(&mut self) -> Result<Node> {
+        let mut nodes = Vec::new();
+        while let Some(token) = self.peek() {
+            if matches!(
+                token,
+                Token::Bar | Token::DoubleBar | Token::DoubleAmp | Token::Close | Token::CloseParen | Token::CloseBrace
+            ) {
+                break;
+            }
+            nodes.push(self.term()?);
+        }
+        Ok(match nodes.len() {
+            1 => nodes.remove(0),
+            _ => Node::Seq(nodes),
+        })
+    }
+
+    fn term(&mut self) -> Result<Node> {
+        let Some(token) = self.tokens.get(self.pos).cloned() else {
+            bail!("unexpected end of grammar");
+        };
+        self.pos += 1;
+
+        let mut node = match token {
+            Token::Keyword(k) => Node::Keyword(k),
+            Token::Literal(l) => Node::Literal(l),
+            Token::Type(t) => Node::Type(t),
+            Token::Property(p) => Node::Property(p),
+            Token::Open => {
+                let inner = self.one_of()?;
+                self.expect(&Token::Close)?;
+                inner
+            }
+            Token::Function(name) => {
+                let inner = self.one_of()?;
+                self.expect(&Token::CloseParen)?;
+                Node::Function(name, Box::new(inner))
+            }
+            Token::OpenParen => {
+                let inner = self.one_of()?;
+                self.expect(&Token::CloseParen)?;
+                Node::Block(Box::new(inner))
+            }
+            Token::OpenBrace => {
+                let inner = self.one_of()?;
+                self.expect(&Token::CloseBrace)?;
+                Node::Block(Box::new(inner))
+            }
+            Token::Multiplier { .. } => bail!("multiplier without a preceding term"),
+            other => bail!("unexpected {other:?}"),
+        };
+
+        while let Some(Token::Multiplier { min, max, comma }) = self.peek().cloned() {
+            self.pos += 1;
+            node = Node::Repeat {
+                node: Box::new(node),
+                min,
+                max,
+                comma,
+            };
+        }
+        Ok(node)
+    }
+
+    fn expect(&mut self, token: &Token) -> Result<()> {
+        if self.peek() != Some(token) {
+            bail!("expected {token:?}");
+        }
+        self.pos += 1;
+        Ok(())
+    }
+}
+
+/// Parses `syntax` into its grammar. An empty syntax is an empty sequence.
+pub fn parse_grammar(syntax: &str) -> Result<Node> {
+    let mut parser = Parser {
+        tokens: tokenize(syntax)?,
+        pos: 0,
+    };
+    let node = parser.one_of()?;
+    if let Some(token) = parser.peek() {
+        bail!("unbalanced {token:?}");
+    }
+    Ok(node)
+}
+
+/// Checks that `syntax` is well-formed value definition syntax.
+pub fn validate_syntax(syntax: &str) -> Result<()> {
+    parse_grammar(syntax).map(|_| ())
+}
+
+/// The top-level `|` alternatives of a grammar, trimmed: `a | [ b | c ]`
+/// gives `a` and `[ b | c ]`. A `||` combinator does not split.
+pub fn alternatives(syntax: &str) -> Vec<&str> {
+    let bytes = syntax.as_bytes();
+    let mut alternatives = Vec::new();
+    let mut depth = 0usize;
+    let mut quoted = false;
+    let mut start = 0;
+    for (i, &b) in bytes.iter().enumerate() {
+        match b {
+            b'\'' => quoted = !quoted,
+            b'[' | b'(' | b'{' if !quoted => depth += 1,
+            b']' | b')' | b'}' if !quoted => depth = depth.saturating_sub(1),
+            b'|' if !quoted && depth == 0 => {
+                let doubled = bytes.get(i + 1) == Some(&b'|') || (i > 0 && bytes[i - 1] == b'|');
+                if !doubled {
+                    alternatives.push(syntax[start..i].trim());
+                    start = i + 1;
+                }
+            }
+            _ => {}
+        }
+    }
+    alternatives.push(syntax[start..].trim());
+    alternatives
+}
+
+/// Validates every property, value, at-rule prelude, and at-rule descriptor
+/// grammar in `data` and logs the malformed ones. Returns how many were found.
+pub fn report_malformed(data: &Data) -> usize {
+    let grammars = data
+        .properties
+        .iter()
+        .map(|p| ("property", p.name.clone(), &p.syntax))
+        .chain(data.values.iter().map(|v| ("value", v.name.clone(), &v.syntax)))
+        .chain(data.atrules.iter().map(|a| ("prelude", a.name.clone(), &a.prelude)))
+        .chain(data.atrules.iter().flat_map(|a| {
+            a.descriptors
+                .iter()
+                .map(move |d| ("descriptor", format!("{} {}", a.name, d.name), &d.syntax))
+        }));
+
+    let mut malformed = 0;
+    for (kind, name, syntax) in grammars {
+        if let Err(e) = validate_syntax(syntax) {
+            warn!("Malformed syntax for {kind} {name}: {e}: {syntax}");
+            malformed += 1;
+        }
+    }
+    malformed
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn accepts_well_formed_grammars() {
+        for syntax in [
+            "",
+            "auto | <length [0,∞]>",
+            "[ <bg-layer> , ]* <final-bg-layer>",
+            "<'margin-top'>{1,4}",
+            "<length>{2,} && <color>? || inset",
+            "rect( [ <length-percentage> | auto ]{4} [ round <'border-radius'> ]? )",
+            "[ <ident> ]# | '[' <custom-ident>* ']'",
+            "<keyframe-selector># { <declaration-list> }",
+            "fit-content( <length-percentage> )#?",
+            "[ a b ]!",
+        ] {
+            assert!(validate_syntax(syntax).is_ok(), "{syntax}");
+        }
+    }
+
+    #[test]
+    fn grammars_parse_by_precedence() {
+        let keyword = |k: &str| Node::Keyword(k.to_string());
+        assert_eq!(
+            parse_grammar("a b | c && d || e").unwrap(),
+            Node::OneOf(vec![
+                Node::Seq(vec![keyword("a"), keyword("b")]),
+                Node::AnyOf(vec![Node::AllOf(vec![keyword("c"), keyword("d")]), keyword("e")]),
+            ])
+        );
+        assert_eq!(
+            parse_grammar("<length [0,∞]>#{1,4} { x }").unwrap(),
+            Node::Seq(vec![
+                Node::Repeat {
+                    node: Box::new(Node::Type("length".to_string())),
+                    min: 1,
+                    max: Some(4),
+                    comma: true,
+                },
+                Node::Block(Box::new(keyword("x"))),
+            ])
+        );
+    }
+
+    #[test]
+    fn alternatives_split_at_the_top_level_only() {
+        assert_eq!(
+            alternatives("a | [ b | c ] || d | f( x | y ) | '|'"),
+            ["a", "[ b | c ] || d", "f( x | y )", "'|'"]
+        );
+        assert_eq!(alternatives("auto"), ["auto"]);
+    }
+
+    #[test]
+    fn rejects_malformed_grammars() {
+        for syntax in [
+            "[ a | b",
+            "a | b ]",
+            "calc( <x> ]",
+            "| a",
+            "a |",
+            "[ a || ]",
+            "* a",
+            "[ | a ]",
+            "a & b",
+            "'unterminated",
+            "<length",
+        ] {
+            assert!(validate_syntax(syntax).is_err(), "{syntax}");
+        }
+    }
+}
@@ -0,0 +1,118 @@
+//! A minimal HTTP/1.1 server for tests. Every request is answered by a handler
+//! closure and reported back to the test, so tests can assert both on what the
+//! generator fetched and on what it did not fetch.
+
+use std::io::{BufRead, BufReader, Write};
+use std::net::TcpListener;
+use std::sync::mpsc::{channel, Receiver};
+use std::thread;
+
+#[derive(Debug, Clone)]
+pub struct Request {
+    /// Path including the query string, e.g. `/repos/w3c/webref/contents/ed/css?ref=curated`
+    pub path: String,
+    /// Header names are lowercased.
+    pub headers: Vec<(String, String)>,
+}
+
+impl Request {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers.iter().find(|(n, _)| n == name).map(|(_, v)| v.as_str())
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct Response {
+    pub status: u16,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Response {
+    pub fn ok(body: impl Into<Vec<u8>>) -> Self {
+        Response {
+            status: 200,
+            headers: Vec::new(),
+            body: body.into(),
+        }
+    }
+
+    pub fn status(status: u16) -> Self {
+        Response {
+            status,
+            headers: Vec::new(),
+            body: Vec::new(),
+        }
+    }
+
+    pub fn with_header(mut self, name: &str, value: &str) -> Self {
+        self.headers.push((name.to_string(), value.to_string()));
+        self
+    }
+}
+
+pub struct TestServer {
+    pub base_url: String,
+    requests: Receiver<Request>,
+}
+
+impl TestServer {
+    /// Starts serving on an ephemeral localhost port. The server thread lives
+    /// until the test process exits.
+    pub fn start(handler: impl Fn(&Request) -> Response + Send + 'static) -> Self {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let base_url = format!("http://{}", listener.local_addr().unwrap());
+        let (tx, rx) = channel();
+
+        thread::spawn(move || {
+            for stream in listener.incoming() {
+                let Ok(mut stream) = stream else { continue };
+                let Ok(reader_stream) = stream.try_clone() else {
+                    continue;
+                };
+                let mut reader = BufReader::new(reader_stream);
+
+                let mut request_line = String::new();
+                if reader.read_line(&mut request_line).is_err() {
+                    continue;
+                }
+                let path = request_line.split_whitespace().nth(1).unwrap_or("/").to_string();
+
+                let mut headers = Vec::new();
+                loop {
+                    let mut line = String::new();
+                    if reader.read_line(&mut line).is_err() || line.trim().is_empty() {
+                        break;
+                    }
+                    if let Some((name, value)) = line.split_once(':') {
+                        let mut name = name.trim().to_string();
+                        name.make_ascii_lowercase();
+                        headers.push((name, value.trim().to_string()));
+                    }
+                }
+
+                let request = Request { path, headers };
+                let response = handler(&request);
+                let _ = tx.send(request);
+
+                let mut out = format!("HTTP/1.1 {} X\r\n", response.status);
+                for (name, value) in &response.headers {
+                    out.push_str(&format!("{name}: {value}\r\n"));
+                }
+                out.push_str(&format!(
+                    "Content-Length: {}\r\nConnection: close\r\n\r\n",
+                    response.body.len()
+                ));
+                let _ = stream.write_all(out.as_bytes());
+                let _ = stream.write_all(&response.body);
+            }
+        });
+
+        TestServer { base_url, requests: rx }
+    }
+
+    /// The requests served since the last call.
+    pub fn requests(&self) -> Vec<Request> {
+        self.requests.try_iter().collect()
+    }
+}
@@ -0,0 +1,138 @@
+//! Wall-clock timing of the generator's phases (download, decode, MDN fetch,
+//! merge, export), logged at the end of a run and optionally written out as a
+//! JSON report together with the process's peak memory use and, with
+//! `--minify`, how much the minified output saves.
+
+use crate::export::MinifiedSize;
+use serde::Serialize;
+use std::fs;
+use std::time::{Duration, Instant};
+
+#[derive(Debug, Serialize)]
+struct Phase {
+    name: String,
+    seconds: f64,
+}
+
+/// Accumulated duration per phase, in the order each phase was first seen.
+#[derive(Debug, Default)]
+pub struct Timings {
+    phases: Vec<(String, Duration)>,
+    minified: Option<MinifiedSize>,
+}
+
+#[derive(Debug, Serialize)]
+struct Report<'a> {
+    phases: &'a [Phase],
+    total_seconds: f64,
+    /// Left out where the platform does not report it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    peak_resident_bytes: Option<u64>,
+    /// Only with `--minify`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    minified: Option<MinifiedSize>,
+}
+
+impl Timings {
+    /// Adds `duration` to `phase`. A phase recorded several times (e.g. the
+    /// per-file download and decode steps) accumulates.
+    pub fn record(&mut self, phase: &str, duration: Duration) {
+        match self.phases.iter_mut().find(|(name, _)| name == phase) {
+            Some((_, total)) => *total += duration,
+            None => self.phases.push((phase.to_string(), duration)),
+        }
+    }
+
+    /// Runs `f` and records its wall-clock duration under `phase`.
+    pub fn time<T>(&mut self, phase: &str, f: impl FnOnce() -> T) -> T {
+        let start = Instant::now();
+        let result = f();
+        self.record(phase, start.elapsed());
+        result
+    }
+
+    /// Records the sizes of the pretty and minified definitions, for the report.
+    pub fn record_minified(&mut self, size: MinifiedSize) {
+        self.minified = Some(size);
+    }
+
+    pub fn total(&self) -> Duration {
+        self.phases.iter().map(|(_, d)| *d).sum()
+    }
+
+    /// One-line human readable summary: `download: 12.3s, decode: 0.4s, ...`.
+    pub fn summary(&self) -> String {
+        self.phases
+            .iter()
+            .map(|(name, d)| format!("{name}: {:.1}s", d.as_secs_f64()))
+            .collect::<Vec<_>>()
+            .join(", ")
+    }
+
+    /// The timings as a pretty-printed JSON report.
+    pub fn to_json(&self) -> serde_json::Result<String> {
+        let phases: Vec<Phase> = self
+            .phases
+            .iter()
+            .map(|(name, d)| Phase {
+                name: name.clone(),
+                seconds: d.as_secs_f64(),
+            })
+            .collect();
+
+        serde_json::to_string_pretty(&Report {
+            phases: &phases,
+            total_seconds: self.total().as_secs_f64(),
+            peak_resident_bytes: peak_resident_bytes(),
+            minified: self.minified,
+        })
+    }
+}
+
+/// The peak resident set size of this process so far. Only available on
+/// Linux, where it is read from `/proc/self/status`.
+pub fn peak_resident_bytes() -> Option<u64> {
+    parse_vm_hwm(&fs::read_to_string("/proc/self/status").ok()?)
+}
+
+/// Reads the `VmHWM:   1234 kB` line of a `/proc/<pid>/status` file.
+fn parse_vm_hwm(status: &str) -> Option<u64> {
+    let line = status.lines().find_map(|line| line.strip_prefix("VmHWM:"))?;
+    let kib: u64 = line.trim().strip_suffix("kB")?.trim().parse().ok()?;
+    Some(kib * 1024)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn timings_accumulate_per_phase_in_first_seen_order() {
+        let mut timings = Timings::default();
+        timings.record("download", Duration::from_millis(1500));
+        timings.record("decode", Duration::from_millis(200));
+        timings.record("download", Duration::from_millis(500));
+
+        assert_eq!(timings.summary(), "download: 2.0s, decode: 0.2s");
+        assert_eq!(timings.total(), Duration::from_millis(2200));
+
+        let report: serde_json::Value = serde_json::from_str(&timings.to_json().unwrap()).unwrap();
+        assert_eq!(report["phases"][0]["name"], "download");
+        assert_eq!(report["phases"][1]["seconds"], 0.2);
+        assert!(report.get("minified").is_none());
+
+        timings.record_minified(MinifiedSize {
+            pretty_bytes: 300,
+            minified_bytes: 100,
+        });
+        let report: serde_json::Value = serde_json::from_str(&timings.to_json().unwrap()).unwrap();
+        assert_eq!(report["minified"]["minified_bytes"], 100);
+    }
+
+    #[test]
+    fn peak_resident_set_is_read_from_proc_status() {
+        let status = "Name:\tgenerate_defini\nVmPeak:\t  204800 kB\nVmHWM:\t   51200 kB\nVmRSS:\t   40960 kB\n";
+        assert_eq!(parse_vm_hwm(status), Some(51200 * 1024));
+        assert_eq!(parse_vm_hwm("Name:\tgenerate_defini\n"), None);
+    }
+}
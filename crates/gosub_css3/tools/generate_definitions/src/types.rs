@@ -1,19 +1,84 @@
+use schemars::{json_schema, JsonSchema, Schema, SchemaGenerator};
 use serde::de::{SeqAccess, Visitor};
 use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::borrow::Cow;
 use std::fmt;
 
 /// A JSON field that may hold either a string or an array of strings (MDN uses
-/// both for `initial` and `computed`). Serializes as the array when non-empty,
-/// otherwise as the string - matching the Go tool's `StringMaybeArray`.
+/// both for `initial` and `computed`). `is_array` records which shape was
+/// deserialized, so an intentionally empty array round-trips as `[]` instead
+/// of collapsing into `""`.
 #[derive(Debug, Default, Clone)]
 pub struct StringMaybeArray {
     pub string: String,
     pub array: Vec<String>,
+    pub is_array: bool,
 }
 
+impl StringMaybeArray {
+    /// Returns true when the value is in array form. A non-empty `array` counts
+    /// even if `is_array` was never set, so hand-built values serialize the way
+    /// they did before the flag existed.
+    pub fn is_array(&self) -> bool {
+        self.is_array || !self.array.is_empty()
+    }
+
+    /// The value in the same shape, with whitespace trimmed from the string
+    /// or from every array entry, and empty array entries dropped.
+    pub fn normalized(&self) -> StringMaybeArray {
+        if self.is_array() {
+            StringMaybeArray {
+                string: String::new(),
+                array: self.to_list(),
+                is_array: true,
+            }
+        } else {
+            StringMaybeArray {
+                string: self.string.trim().to_string(),
+                array: Vec::new(),
+                is_array: false,
+            }
+        }
+    }
+
+    /// The value as a list: the array entries, or the string as a single
+    /// entry. Entries are trimmed and empty ones dropped, so an empty string
+    /// gives an empty list rather than `[""]`.
+    pub fn to_list(&self) -> Vec<String> {
+        let entries: Vec<&str> = if self.is_array() {
+            self.array.iter().map(String::as_str).collect()
+        } else {
+            vec![self.string.as_str()]
+        };
+        entries
+            .into_iter()
+            .map(str::trim)
+            .filter(|e| !e.is_empty())
+            .map(str::to_string)
+            .collect()
+    }
+}
+
+/// Two values are equal when they have the same shape and the same content:
+/// `""` and `[]` are different, as are `"a"` and `["a"]`.
+impl PartialEq for StringMaybeArray {
+    fn eq(&self, other: &Self) -> bool {
+        if self.is_array() != other.is_array() {
+            return false;
+        }
+        if self.is_array() {
+            self.array == other.array
+        } else {
+            self.string == other.string
+        }
+    }
+}
+
+impl Eq for StringMaybeArray {}
+
 impl Serialize for StringMaybeArray {
     fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
-        if !self.array.is_empty() {
+        if self.is_array() {
             self.array.serialize(serializer)
         } else {
             self.string.serialize(serializer)
@@ -36,6 +101,7 @@ impl<'de> Deserialize<'de> for StringMaybeArray {
                 Ok(StringMaybeArray {
                     string: v.to_string(),
                     array: Vec::new(),
+                    is_array: false,
                 })
             }
 
@@ -47,6 +113,7 @@ impl<'de> Deserialize<'de> for StringMaybeArray {
                 Ok(StringMaybeArray {
                     string: String::new(),
                     array,
+                    is_array: true,
                 })
             }
         }
@@ -55,28 +122,130 @@ impl<'de> Deserialize<'de> for StringMaybeArray {
     }
 }
 
+/// Either shape, as serialized above.
+impl JsonSchema for StringMaybeArray {
+    fn schema_name() -> Cow<'static, str> {
+        "StringMaybeArray".into()
+    }
+
+    fn json_schema(_: &mut SchemaGenerator) -> Schema {
+        json_schema!({
+            "oneOf": [
+                { "type": "string" },
+                { "type": "array", "items": { "type": "string" } }
+            ]
+        })
+    }
+}
+
+/// Version of the `definitions.json` document shape, written as its
+/// `schemaVersion` field. Bump it whenever that shape changes. Documents
+/// without the field predate `propAliases`; version 3 added descriptor
+/// `sources`, version 4 the `@property` `registration`, version 5
+/// `reverseAliases`, version 6 the property `obsolete` flag, version 7 value
+/// `children`, version 8 the `@media` `mediaFeatures`, version 9 the property
+/// `initialDerived` flag, version 10 the value `kind`, version 11 the property
+/// `mdnUrl`, version 12 the at-rule `prelude`, version 13 the at-rule `forms`.
+pub const SCHEMA_VERSION: u32 = 13;
+
 /// The complete generated dataset (`definitions.json`).
-#[derive(Debug, Default, Serialize)]
+#[derive(Debug, Default, Serialize, JsonSchema)]
 pub struct Data {
     pub properties: Vec<Property>,
     pub values: Vec<Value>,
     pub atrules: Vec<AtRule>,
     pub selectors: Vec<Selector>,
+    #[serde(rename = "propAliases")]
+    pub prop_aliases: Vec<PropAlias>,
+    #[serde(rename = "reverseAliases")]
+    pub reverse_aliases: Vec<ReverseAlias>,
+}
+
+/// The spec (or dataset) a definition was collected from. Definitions merged
+/// from several specs carry one entry per spec.
+#[derive(Debug, Default, Clone, PartialEq, Eq, PartialOrd, Ord, Serialize, JsonSchema)]
+pub struct Source {
+    pub shortname: String,
+    pub title: String,
+    pub url: String,
+}
+
+/// Appends `source` to `sources` unless it is already listed.
+pub fn add_source(sources: &mut Vec<Source>, source: &Source) {
+    if !sources.contains(source) {
+        sources.push(source.clone());
+    }
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Default, Clone, Serialize, JsonSchema)]
 pub struct Property {
     pub name: String,
     pub syntax: String,
     pub computed: Vec<String>,
     pub initial: StringMaybeArray,
+    /// `initial` was composed from the longhands' initial values, as the
+    /// shorthand had none of its own. Only exported when set.
+    #[serde(rename = "initialDerived", skip_serializing_if = "std::ops::Not::not")]
+    pub initial_derived: bool,
     pub inherited: bool,
+    #[serde(rename = "animationType")]
+    pub animation_type: StringMaybeArray,
+    pub percentages: StringMaybeArray,
+    /// For shorthands, the longhand properties it expands to.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub longhands: Vec<String>,
+    /// No source defines it any more; listed in `resources/obsolete.json` so
+    /// old content still parses. Only exported when set.
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub obsolete: bool,
+    /// The property's MDN reference page. Only exported with `--with-docs`,
+    /// and only when MDN has one.
+    #[serde(rename = "mdnUrl", skip_serializing_if = "String::is_empty")]
+    pub mdn_url: String,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub sources: Vec<Source>,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Default, Serialize, JsonSchema)]
 pub struct Value {
     pub name: String,
     pub syntax: String,
+    pub kind: ValueKind,
+    /// Names of the values nested under this one in webref, such as the
+    /// argument types of a function. Each is also a value of its own.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub children: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub sources: Vec<Source>,
+}
+
+/// What a value definition names, from webref's `type`.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, Serialize, JsonSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum ValueKind {
+    /// A value type (`<length>`), referenced by its `<name>` in grammars
+    #[default]
+    Type,
+    /// A functional notation (`calc()`); its syntax is the whole call,
+    /// arguments included
+    Function,
+    /// A keyword (`auto`)
+    Keyword,
+}
+
+impl ValueKind {
+    /// The kind webref's `type` gives. Values without one (MDN's syntaxes,
+    /// the patches) get the kind their name's shape implies.
+    pub fn classify(webref_type: &str, name: &str) -> ValueKind {
+        match webref_type {
+            "type" => ValueKind::Type,
+            "function" => ValueKind::Function,
+            "value" => ValueKind::Keyword,
+            _ if name.starts_with('<') => ValueKind::Type,
+            _ if name.ends_with("()") => ValueKind::Function,
+            _ => ValueKind::Keyword,
+        }
+    }
 }
 
 // The `values` fields below serialize under the key "Values" and as `null`
@@ -84,15 +253,74 @@ pub struct Value {
 // consumer (gosub_css3) reads the Go field name, and Go marshals nil slices
 // as null. `Option<Vec<..>>` keeps the absent-vs-empty distinction intact.
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Default, Serialize, JsonSchema)]
 pub struct AtRule {
     pub name: String,
+    /// The grammar between the name and the block or `;`
+    /// (`<media-query-list>` for `@media`), if the at-rule takes one
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub prelude: String,
+    /// How the at-rule is written, when its grammar shows it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub forms: Option<AtRuleForms>,
     pub descriptors: Vec<AtRuleDescriptor>,
     #[serde(rename = "Values")]
     pub values: Option<Vec<AtRuleValue>>,
+    /// Only on `@property`: its registration descriptors by name.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub registration: Option<PropertyRegistration>,
+    /// Only on `@media`: its descriptors as media features.
+    #[serde(rename = "mediaFeatures", skip_serializing_if = "Option::is_none")]
+    pub media_features: Option<Vec<MediaFeature>>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub sources: Vec<Source>,
+}
+
+/// Whether an at-rule is a statement, has a block, or may be written either
+/// way.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, JsonSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum AtRuleForms {
+    /// Ends with `;` (`@import url(a.css);`)
+    Statement,
+    /// Ends with a `{ }` block (`@media print { ... }`)
+    Block,
+    /// Either (`@layer a, b;` and `@layer a { ... }`)
+    Both,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// The grammars of the `@property` descriptors that register a custom
+/// property.
+#[derive(Debug, Serialize, JsonSchema)]
+pub struct PropertyRegistration {
+    /// A string holding a registered-property syntax (`"<length> | auto"`)
+    pub syntax: String,
+    pub inherits: String,
+    #[serde(rename = "initialValue")]
+    pub initial_value: String,
+}
+
+/// A `@media` descriptor with the type that decides how a query may use it.
+#[derive(Debug, Serialize, JsonSchema)]
+pub struct MediaFeature {
+    pub name: String,
+    #[serde(rename = "type")]
+    pub feature_type: MediaFeatureType,
+    /// The grammar of the feature's value
+    pub syntax: String,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, JsonSchema)]
+#[serde(rename_all = "lowercase")]
+pub enum MediaFeatureType {
+    /// Takes a numeric value and can be compared (`width >= 600px`) or
+    /// prefixed (`min-width`)
+    Range,
+    /// Matches one of its values (`prefers-reduced-motion: reduce`)
+    Discrete,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 pub struct AtRuleValue {
     #[serde(default)]
     pub name: String,
@@ -103,7 +331,7 @@ pub struct AtRuleValue {
     pub values: Option<Vec<AtRuleValueEntry>>,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Serialize, Deserialize, JsonSchema)]
 pub struct AtRuleValueEntry {
     #[serde(default)]
     pub name: String,
@@ -111,14 +339,146 @@ pub struct AtRuleValueEntry {
     pub value: String,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Serialize, JsonSchema)]
 pub struct AtRuleDescriptor {
     pub name: String,
     pub syntax: String,
     pub initial: String,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub sources: Vec<Source>,
+}
+
+/// A legacy property name and the property it resolves to.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, JsonSchema)]
+pub struct PropAlias {
+    pub name: String,
+    pub property: String,
+}
+
+/// A property and the legacy names that resolve to it (`transform` ←
+/// `-webkit-transform`): `propAliases` the other way round.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, JsonSchema)]
+pub struct ReverseAlias {
+    pub property: String,
+    pub aliases: Vec<String>,
+}
+
+/// What kind of selector an entry is, derived from its name.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, JsonSchema)]
+#[serde(rename_all = "kebab-case")]
+pub enum SelectorKind {
+    /// `:hover`
+    PseudoClass,
+    /// `::before`, including functional ones such as `::part()`
+    PseudoElement,
+    /// `>`, `+`, `~`, `||`, or the descendant combinator (a space)
+    Combinator,
+    /// A pseudo-class taking arguments, such as `:nth-child()`
+    Functional,
+}
+
+impl SelectorKind {
+    /// Classifies a selector by its webref name. Returns None for simple
+    /// selectors (`*`, `.class`, `[attr]`, `&`, …).
+    pub fn classify(name: &str) -> Option<Self> {
+        if name.starts_with("::") {
+            Some(SelectorKind::PseudoElement)
+        } else if name.starts_with(':') && name.ends_with("()") {
+            Some(SelectorKind::Functional)
+        } else if name.starts_with(':') {
+            Some(SelectorKind::PseudoClass)
+        } else if matches!(name.trim(), "" | ">" | "+" | "~" | "||") {
+            Some(SelectorKind::Combinator)
+        } else {
+            None
+        }
+    }
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+// `kind` and `arguments` are omitted when absent, so consumers reading only
+// `name` see the same entries as before.
+#[derive(Debug, Clone, Serialize, JsonSchema)]
 pub struct Selector {
     pub name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub kind: Option<SelectorKind>,
+    /// The argument grammar of a functional selector (`<an+b> [ of <complex-real-selector-list> ]?`)
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub arguments: String,
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn round_trip(json: &str) -> String {
+        let value: StringMaybeArray = serde_json::from_str(json).unwrap();
+        serde_json::to_string(&value).unwrap()
+    }
+
+    #[test]
+    fn value_kind_comes_from_the_webref_type_or_the_name() {
+        assert_eq!(ValueKind::classify("type", "<length>"), ValueKind::Type);
+        assert_eq!(ValueKind::classify("function", "calc()"), ValueKind::Function);
+        assert_eq!(ValueKind::classify("value", "auto"), ValueKind::Keyword);
+        // The webref type wins over the name's shape.
+        assert_eq!(ValueKind::classify("type", "rect()"), ValueKind::Type);
+
+        assert_eq!(ValueKind::classify("", "<outline-radius>"), ValueKind::Type);
+        assert_eq!(ValueKind::classify("", "fit-content()"), ValueKind::Function);
+        assert_eq!(ValueKind::classify("", "auto"), ValueKind::Keyword);
+        assert_eq!(serde_json::to_string(&ValueKind::Function).unwrap(), r#""function""#);
+    }
+
+    #[test]
+    fn string_maybe_array_round_trips_strings() {
+        assert_eq!(round_trip(r#""""#), r#""""#);
+        assert_eq!(round_trip(r#""auto""#), r#""auto""#);
+    }
+
+    #[test]
+    fn string_maybe_array_round_trips_arrays() {
+        assert_eq!(round_trip("[]"), "[]");
+        assert_eq!(round_trip(r#"["a"]"#), r#"["a"]"#);
+        assert_eq!(round_trip(r#"["a","b"]"#), r#"["a","b"]"#);
+    }
+
+    #[test]
+    fn string_maybe_array_equality_respects_shape() {
+        let empty_string: StringMaybeArray = serde_json::from_str(r#""""#).unwrap();
+        let empty_array: StringMaybeArray = serde_json::from_str("[]").unwrap();
+        let single_string: StringMaybeArray = serde_json::from_str(r#""a""#).unwrap();
+        let single_array: StringMaybeArray = serde_json::from_str(r#"["a"]"#).unwrap();
+
+        assert_ne!(empty_string, empty_array);
+        assert_ne!(single_string, single_array);
+        assert_eq!(empty_array, serde_json::from_str("[]").unwrap());
+        assert_eq!(single_array, serde_json::from_str(r#"["a"]"#).unwrap());
+        assert_eq!(empty_string, StringMaybeArray::default());
+    }
+
+    /// The normalized value as JSON, and the value as a list.
+    fn normalize(json: &str) -> (String, Vec<String>) {
+        let value: StringMaybeArray = serde_json::from_str(json).unwrap();
+        (serde_json::to_string(&value.normalized()).unwrap(), value.to_list())
+    }
+
+    #[test]
+    fn string_maybe_array_normalizes_empty_single_and_array() {
+        let none: Vec<String> = Vec::new();
+        assert_eq!(normalize(r#""""#), (r#""""#.to_string(), none.clone()));
+        assert_eq!(normalize(r#"" ""#), (r#""""#.to_string(), none.clone()));
+        assert_eq!(normalize("[]"), ("[]".to_string(), none));
+        assert_eq!(
+            normalize(r#"" asSpecified ""#),
+            (r#""asSpecified""#.to_string(), vec!["asSpecified".to_string()])
+        );
+        assert_eq!(
+            normalize(r#"["margin-top ", "", " margin-left"]"#),
+            (
+                r#"["margin-top","margin-left"]"#.to_string(),
+                vec!["margin-top".to_string(), "margin-left".to_string()]
+            )
+        );
+    }
 }
@@ -2,31 +2,100 @@
 //! grammars, value types, at-rules, and selectors from the W3C editor's-draft
 //! specs (curated branch).
 
-use crate::types::{AtRuleValue, Selector};
-use anyhow::{Context, Result};
-use serde::Deserialize;
+use crate::error::ErrorContext;
+use crate::explain::{self, Trace};
+use crate::fetch::{retry_once, Fetcher};
+use crate::spec_index::{self, Maturity};
+use crate::syntax_check::alternatives;
+use crate::timing::Timings;
+use crate::types::{add_source, AtRuleValue, Selector, SelectorKind, Source};
+use anyhow::{anyhow, bail, Context, Result};
+use base64::engine::general_purpose::STANDARD;
+use base64::Engine;
+use cow_utils::CowUtils;
+use log::{debug, info, warn};
+use parking_lot::Mutex;
+use reqwest::blocking::Response;
+use reqwest::header::{ACCEPT, CONTENT_TYPE, ETAG, IF_NONE_MATCH, LINK};
+use reqwest::StatusCode;
+use serde::de::IgnoredAny;
+use serde::{Deserialize, Serialize};
 use sha1::{Digest, Sha1};
-use std::collections::BTreeMap;
-use std::fs;
-use std::path::Path;
+use std::borrow::Cow;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write as _;
+use std::fs::{self, File};
+use std::io::{self, Read};
+use std::path::{Path, PathBuf};
+use std::sync::mpsc;
+use std::thread;
+use std::time::{Duration, Instant};
 
-const REPO: &str = "w3c/webref";
-const LOCATION: &str = "ed/css";
-const BRANCH: &str = "curated";
+pub const REPO: &str = "w3c/webref";
+pub const LOCATION: &str = "ed/css";
+pub const BRANCH: &str = "curated";
+/// Where the GitHub API is served from
+pub const API_URL: &str = "https://api.github.com";
+/// Where GitHub serves raw repository files from
+pub const RAW_URL: &str = "https://raw.githubusercontent.com";
+/// Default cache directory, relative to where the tool runs
 pub const CACHE_DIR: &str = ".css_cache";
 
-#[derive(Debug, Deserialize)]
+/// Which GitHub repository, branch, and directories the spec extracts are
+/// listed from (webref's curated CSS extracts unless overridden by flags).
+#[derive(Debug, Clone)]
+pub struct WebRefLocation {
+    pub repo: String,
+    /// A branch, tag, or commit SHA; a tag or SHA pins the whole generation
+    pub branch: String,
+    /// The directories holding extracts, merged in this order
+    pub locations: Vec<String>,
+    /// A local clone of the repository to read instead of GitHub; `repo` and
+    /// `branch` are then unused
+    pub checkout: Option<PathBuf>,
+    /// The GitHub API base URL ([`API_URL`]); tests point it at a local server
+    pub api_url: String,
+    /// The base URL raw files are read from ([`RAW_URL`])
+    pub raw_url: String,
+}
+
+/// How `get_webref_data` fetches, decodes, and merges the spec extracts.
+#[derive(Debug, Clone, Default)]
+pub struct WebRefSettings {
+    /// How long a cached listing is reused without revalidating
+    pub listing_ttl: Duration,
+    /// Download cached spec files older than this again, even when their SHA
+    /// matches the listing
+    pub max_age: Option<Duration>,
+    /// Only collect specs at least this mature
+    pub maturity: Maturity,
+    /// How differing syntaxes for the same entry are merged
+    pub conflict_strategy: ConflictStrategy,
+    /// Reuse the parsed extracts of spec files whose SHA the last run decoded
+    pub decode_cache: bool,
+    /// Number of decode workers; None for one per CPU
+    pub threads: Option<usize>,
+    /// Only collect this many spec files
+    pub limit: Option<usize>,
+    /// Trace how this property is merged
+    pub explain: Option<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
 pub struct DirectoryListItem {
     pub name: String,
     pub path: String,
     pub sha: String,
     #[serde(default)]
     pub download_url: Option<String>,
+    /// The git blobs API URL of this exact file version
+    #[serde(default)]
+    pub git_url: Option<String>,
     #[serde(rename = "type")]
     pub item_type: String,
 }
 
-#[derive(Debug, Default, Clone, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 pub struct WebRefValue {
     #[serde(default)]
     pub name: String,
@@ -37,9 +106,16 @@ pub struct WebRefValue {
     /// Additional accompanied values
     #[serde(default)]
     pub values: Vec<WebRefValue>,
+    /// Specs this value was collected from (not part of webref's JSON)
+    #[serde(skip)]
+    pub sources: Vec<Source>,
+    /// Names of the values nested in `values` by any spec (not part of
+    /// webref's JSON); the nested values are collected as entries of their own
+    #[serde(skip)]
+    pub children: Vec<String>,
 }
 
-#[derive(Debug, Default, Clone, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 pub struct WebRefProperty {
     #[serde(default)]
     pub name: String,
@@ -47,12 +123,25 @@ pub struct WebRefProperty {
     pub syntax: String,
     #[serde(default, rename = "newValues")]
     pub new_syntax: String,
+    /// For legacy names (`word-wrap`), the property this one is an alias of
+    #[serde(default, rename = "legacyAliasOf", skip_serializing_if = "String::is_empty")]
+    pub legacy_alias_of: String,
+    /// The spec's initial value, as written in its property table. MDN's is
+    /// used unless `--no-mdn` is given.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub initial: String,
+    /// `yes` or `no`, as written in the spec's property table
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub inherited: String,
     /// Additional accompanied values for this property
     #[serde(default)]
     pub values: Vec<WebRefValue>,
+    /// Specs this property was collected from (not part of webref's JSON)
+    #[serde(skip)]
+    pub sources: Vec<Source>,
 }
 
-#[derive(Debug, Default, Clone, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 pub struct WebRefAtRule {
     #[serde(default)]
     pub name: String,
@@ -62,9 +151,12 @@ pub struct WebRefAtRule {
     pub syntax: String,
     #[serde(default)]
     pub values: Option<Vec<AtRuleValue>>,
+    /// Specs this at-rule was collected from (not part of webref's JSON)
+    #[serde(skip)]
+    pub sources: Vec<Source>,
 }
 
-#[derive(Debug, Default, Clone, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 pub struct WebRefAtRuleDescriptor {
     #[serde(default)]
     pub name: String,
@@ -72,11 +164,37 @@ pub struct WebRefAtRuleDescriptor {
     pub syntax: String,
     #[serde(default)]
     pub initial: String,
+    /// For media features, `range` or `discrete`
+    #[serde(default, rename = "type", skip_serializing_if = "String::is_empty")]
+    pub descriptor_type: String,
+    /// Specs this descriptor was collected from (not part of webref's JSON)
+    #[serde(skip)]
+    pub sources: Vec<Source>,
+}
+
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
+pub struct WebRefSelector {
+    #[serde(default)]
+    pub name: String,
+    /// The argument grammar of functional selectors
+    #[serde(default, rename = "value")]
+    pub syntax: String,
+}
+
+/// The `spec` header of a webref extract file.
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
+struct WebRefSpec {
+    #[serde(default)]
+    title: String,
+    #[serde(default)]
+    url: String,
 }
 
 /// One webref spec extract file (e.g. `css-backgrounds.json`).
-#[derive(Debug, Default, Deserialize)]
+#[derive(Debug, Default, Clone, Serialize, Deserialize)]
 struct WebRefFileData {
+    #[serde(default)]
+    spec: WebRefSpec,
     #[serde(default)]
     properties: Vec<WebRefProperty>,
     #[serde(default)]
@@ -84,7 +202,22 @@ struct WebRefFileData {
     #[serde(default)]
     atrules: Vec<WebRefAtRule>,
     #[serde(default)]
-    selectors: Vec<Selector>,
+    selectors: Vec<WebRefSelector>,
+}
+
+/// How a grammar is merged when a spec gives a property, value, or at-rule
+/// another syntax than the one already collected for it.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum ConflictStrategy {
+    /// Accept either grammar: `old | new`
+    #[default]
+    Union,
+    /// Keep the syntax of the first spec, in listing order
+    FirstWins,
+    /// Take the syntax of the last spec, in listing order
+    LastWins,
+    /// Keep the first syntax, but fail the run listing every conflict
+    Error,
 }
 
 #[derive(Debug, Default)]
@@ -93,6 +226,18 @@ pub struct WebRefData {
     pub values: Vec<WebRefValue>,
     pub at_rules: Vec<WebRefAtRule>,
     pub selectors: Vec<Selector>,
+    /// Spec files that were skipped because they failed to download or parse
+    pub failed_files: Vec<String>,
+    /// Legacy aliases that specs map to different properties, one message
+    /// each; the first spec's mapping is kept
+    pub alias_conflicts: Vec<String>,
+    /// With [`ConflictStrategy::Error`], the entries specs give different
+    /// syntaxes, one message each
+    pub syntax_conflicts: Vec<String>,
+    /// How the `--explain` property was collected, when one is explained
+    pub trace: Option<Trace>,
+    /// The commit the listed ref pointed at, when it could be resolved
+    pub commit: Option<String>,
 }
 
 #[derive(Debug, Default)]
@@ -101,78 +246,1103 @@ struct ParseData {
     values: BTreeMap<String, WebRefValue>,
     at_rules: BTreeMap<String, WebRefAtRule>,
     selectors: BTreeMap<String, Selector>,
+    failed_files: Vec<String>,
+    alias_conflicts: Vec<String>,
+    conflict_strategy: ConflictStrategy,
+    syntax_conflicts: Vec<String>,
+    trace: Option<Trace>,
 }
 
-pub fn get_webref_data(client: &reqwest::blocking::Client) -> Result<WebRefData> {
-    let files = get_webref_files(client)?;
+impl ParseData {
+    /// Decodes one spec file into the collected data and returns the parsed
+    /// extract. A file that fails to parse is logged, recorded in
+    /// `failed_files`, and otherwise ignored.
+    #[cfg(test)]
+    fn add_file(&mut self, file_name: &str, content: &[u8]) -> Option<WebRefFileData> {
+        self.add_parsed(file_name, serde_json::from_slice(content))
+    }
+
+    /// Merges a parsed spec file and returns its extract for the decoded
+    /// cache, or records the file as failed when it did not parse.
+    fn add_parsed(&mut self, file_name: &str, parsed: serde_json::Result<WebRefFileData>) -> Option<WebRefFileData> {
+        match parsed {
+            Ok(file_data) => {
+                self.add_file_data(file_name, file_data.clone());
+                Some(file_data)
+            }
+            Err(e) => {
+                warn!("Skipping {file_name}: parsing failed: {e:#}");
+                self.failed_files.push(file_name.to_string());
+                None
+            }
+        }
+    }
+
+    fn add_file_data(&mut self, file_name: &str, file_data: WebRefFileData) {
+        decode_file_content(file_name.trim_end_matches(".json"), file_data, self);
+    }
 
+    /// Merges `new`, the syntax `shortname` gives the `kind` `name`, into
+    /// `current`, the syntax collected so far. An empty side is no conflict.
+    fn merge_syntax(&mut self, kind: &str, name: &str, shortname: &str, current: &mut String, new: &str) {
+        if new.is_empty() || current == new {
+            return;
+        }
+        if current.is_empty() {
+            *current = new.to_string();
+            return;
+        }
+
+        debug!("Different syntax for duplicated {kind} {name}\nOld: {current}\nNew: {new}");
+        match self.conflict_strategy {
+            ConflictStrategy::Union => {
+                let listed = alternatives(current);
+                let added: Vec<&str> = alternatives(new)
+                    .into_iter()
+                    .filter(|alternative| !listed.contains(alternative))
+                    .collect();
+                if !added.is_empty() {
+                    *current = format!("{current} | {}", added.join(" | "));
+                }
+            }
+            ConflictStrategy::FirstWins => {}
+            ConflictStrategy::LastWins => *current = new.to_string(),
+            ConflictStrategy::Error => self.syntax_conflicts.push(format!(
+                "{kind} {name}: {shortname} gives `{new}`, but it already is `{current}`"
+            )),
+        }
+    }
+
+    fn into_webref_data(self) -> WebRefData {
+        WebRefData {
+            properties: self.properties.into_values().collect(),
+            values: self.values.into_values().collect(),
+            at_rules: self.at_rules.into_values().collect(),
+            selectors: self.selectors.into_values().collect(),
+            failed_files: self.failed_files,
+            alias_conflicts: self.alias_conflicts,
+            syntax_conflicts: self.syntax_conflicts,
+            trace: self.trace,
+            commit: None,
+        }
+    }
+}
+
+/// Decodes spec files given as (file name, content), in order, the way
+/// `get_webref_data` does after downloading them.
+#[cfg(test)]
+pub fn decode_files(files: &[(String, Vec<u8>)]) -> WebRefData {
     let mut pd = ParseData::default();
+    for (file_name, content) in files {
+        pd.add_file(file_name, content);
+    }
+    pd.into_webref_data()
+}
 
-    for file in &files {
-        if file.item_type != "file" || !file.name.ends_with(".json") {
-            continue;
+/// Bump whenever the webref input types change shape, so the decoded cache
+/// falls back to a full decode instead of reading stale cached extracts.
+const DECODED_CACHE_VERSION: u32 = 3;
+
+/// Every spec file's parsed extract from the last run, keyed by the git blob
+/// SHA of the file it was parsed from. Loading the cache decodes the extracts
+/// straight into their structs, so a reused extract is not parsed again.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct DecodedCache {
+    version: u32,
+    files: BTreeMap<String, WebRefFileData>,
+}
+
+impl DecodedCache {
+    /// Loads the cache of the last run, or None when it is missing or was
+    /// written by a different version.
+    fn load(path: &Path) -> Option<Self> {
+        let body = fs::read(path).ok()?;
+        let cache: DecodedCache = serde_json::from_slice(&body).ok()?;
+        if cache.version != DECODED_CACHE_VERSION {
+            info!("Decoded spec cache is from another version, doing a full rebuild");
+            return None;
         }
+        Some(cache)
+    }
+}
 
-        let shortname = file.name.trim_end_matches(".json");
-        // Spec extracts come in an unversioned form plus per-level snapshots
-        // (css-backgrounds.json, css-backgrounds-4.json, ...); only the
-        // unversioned one carries the full, current definitions.
-        if shortname.chars().last().is_some_and(|c| c.is_ascii_digit()) {
-            eprintln!("Skipping versioned spec {shortname}");
-            continue;
+/// Downloads (or reads from the cache under `cache_dir`) and decodes every
+/// unversioned spec extract, as `settings` says. With `decode_cache`, spec
+/// files whose upstream SHA was decoded by the last run are merged from that
+/// parsed extract without reading or parsing the spec file again. Merging
+/// always starts from scratch, in listing order, so the result is the same as
+/// a full rebuild. Cached spec files older than `max_age` are downloaded again
+/// even when their SHA still matches the listing. Specs less mature than
+/// `maturity` are skipped. Syntaxes specs give the same entry differently are
+/// merged by `conflict_strategy`. `threads` decode workers run alongside the
+/// fetching (by default one per CPU), and their results are merged as they
+/// arrive. The merge of the property `explain`, if any, is traced. With
+/// `limit`, only that many spec files are collected (see [`limit_specs`]), and
+/// the cache records are left untouched.
+pub fn get_webref_data(
+    fetcher: &Fetcher,
+    location: &WebRefLocation,
+    cache_dir: &Path,
+    settings: &WebRefSettings,
+    timings: &mut Timings,
+) -> Result<WebRefData> {
+    // Resolve the ref first and read everything at that commit, so the commit
+    // recorded in the manifest is the one the data came from, even when the
+    // ref moves on during the run or a cached listing is reused.
+    let commit = match location.checkout {
+        Some(_) => None,
+        None => timings.time("download", || {
+            resolve_commit(fetcher, location, cache_dir, settings.listing_ttl)
+        }),
+    };
+    let pinned = commit.as_ref().map(|sha| WebRefLocation {
+        branch: sha.clone(),
+        ..location.clone()
+    });
+    let location = pinned.as_ref().unwrap_or(location);
+
+    let files = timings.time("download", || {
+        get_webref_files(fetcher, location, cache_dir, settings.listing_ttl)
+    })?;
+    let admitted = timings.time("download", || {
+        spec_index::admitted_files(fetcher, location, cache_dir, settings.maturity)
+    })?;
+
+    let decoded_path = cache_dir.join("decoded.json");
+    // Loading the cache is where reused extracts are decoded.
+    let mut previous = if settings.decode_cache {
+        timings
+            .time("decode", || DecodedCache::load(&decoded_path))
+            .unwrap_or_else(|| {
+                info!("No usable decoded spec cache, doing a full rebuild");
+                DecodedCache::default()
+            })
+    } else {
+        DecodedCache::default()
+    };
+    let mut decoded = DecodedCache {
+        version: DECODED_CACHE_VERSION,
+        files: BTreeMap::new(),
+    };
+
+    let mut specs = spec_files(&files, admitted.as_ref());
+    if let Some(limit) = settings.limit {
+        let total = specs.len();
+        specs = limit_specs(specs, limit);
+        warn!(
+            "--limit-specs: collecting {} of {total} spec files, the output is partial",
+            specs.len()
+        );
+    }
+
+    // A local checkout is read as it is: no SHAs, so no cache and no reuse.
+    let plan = match &location.checkout {
+        Some(checkout) => FetchPlan {
+            checkout: Some(checkout.clone()),
+            ..Default::default()
+        },
+        None => {
+            let mut plan = timings.time("download", || {
+                cache_plan(&specs, &previous, settings.max_age, cache_dir)
+            });
+            // A limited run's record only lists its own files; saving it
+            // would make the next full run hash the others again.
+            plan.completed.read_only = settings.limit.is_some();
+            plan.completed.save(fetcher, cache_dir);
+            plan
+        }
+    };
+    let reused = plan.reused.len();
+    let to_check = specs.len() - reused;
+
+    let workers = settings
+        .threads
+        .unwrap_or_else(|| thread::available_parallelism().map_or(1, |n| n.get()));
+    let mut pd = ParseData {
+        conflict_strategy: settings.conflict_strategy,
+        trace: settings.explain.as_deref().map(Trace::new),
+        ..Default::default()
+    };
+    let mut merging = Duration::ZERO;
+    let start = Instant::now();
+    let fetched = fetch_and_parse(fetcher, &specs, &plan, cache_dir, workers, |index, fetched| {
+        let merge_start = Instant::now();
+        let file = specs[index];
+        match fetched {
+            Fetched::Reused => {
+                // Files with the same content share one entry.
+                let cached = previous
+                    .files
+                    .remove(&file.sha)
+                    .or_else(|| decoded.files.get(&file.sha).cloned());
+                match cached {
+                    Some(data) => {
+                        pd.add_file_data(&file.name, data.clone());
+                        decoded.files.insert(file.sha.clone(), data);
+                    }
+                    None => {
+                        warn!("Skipping {}: its cached extract is missing", file.name);
+                        pd.failed_files.push(file.name.clone());
+                    }
+                }
+            }
+            Fetched::Failed => pd.failed_files.push(file.name.clone()),
+            Fetched::Decoded(result) => match result.transpose() {
+                None => debug!("Skipping {}: not a spec extract", file.name),
+                Some(result) => {
+                    if let Some(data) = pd.add_parsed(&file.name, result) {
+                        decoded.files.insert(file.sha.clone(), data);
+                    }
+                }
+            },
         }
+        merging += merge_start.elapsed();
+    });
+    // Fetching and merging overlap; the merger's share is the decode phase.
+    timings.record("download", start.elapsed().saturating_sub(merging));
+    timings.record("decode", merging);
+    fetched?;
 
-        let content = download_file_content(client, file).with_context(|| format!("downloading {}", file.path))?;
-        decode_file_content(&content, &mut pd).with_context(|| format!("parsing {}", file.name))?;
+    if settings.decode_cache {
+        info!("Re-decoded {to_check} of {} spec files", specs.len());
+    }
+    if location.checkout.is_none() && settings.limit.is_none() {
+        fetcher.write_cache(&decoded_path, &serde_json::to_vec(&decoded)?)?;
     }
 
     Ok(WebRefData {
-        properties: pd.properties.into_values().collect(),
-        values: pd.values.into_values().collect(),
-        at_rules: pd.at_rules.into_values().collect(),
-        selectors: pd.selectors.into_values().collect(),
+        commit,
+        ..pd.into_webref_data()
     })
 }
 
-fn get_webref_files(client: &reqwest::blocking::Client) -> Result<Vec<DirectoryListItem>> {
-    let url = format!("https://api.github.com/repos/{REPO}/contents/{LOCATION}?ref={BRANCH}");
-    let resp = client.get(&url).send()?.error_for_status()?;
-    let body = resp.bytes()?;
-    serde_json::from_slice(&body).context("parsing webref directory listing")
+/// `--limit-specs`: the first `limit` spec files by name, for a quick run
+/// while working on the decode or merge. They keep their listing order, so
+/// they merge as they would in a full run.
+fn limit_specs(specs: Vec<&DirectoryListItem>, limit: usize) -> Vec<&DirectoryListItem> {
+    let mut names: Vec<&str> = specs.iter().map(|f| f.name.as_str()).collect();
+    names.sort_unstable();
+    let kept: BTreeSet<&str> = names.into_iter().take(limit).collect();
+    specs
+        .iter()
+        .copied()
+        .filter(|f| kept.contains(f.name.as_str()))
+        .collect()
 }
 
-/// Returns the file's content, from the local cache when it still matches the
-/// upstream git blob SHA, downloading and re-caching it otherwise.
-fn download_file_content(client: &reqwest::blocking::Client, file: &DirectoryListItem) -> Result<Vec<u8>> {
-    let cache_path = Path::new(CACHE_DIR).join("specs").join(&file.name);
-    if let Some(parent) = cache_path.parent() {
-        fs::create_dir_all(parent)?;
+/// JSON files in the listing that are not spec extracts, such as indexes.
+const NON_SPEC_FILES: [&str; 2] = ["index.json", "package.json"];
+
+/// Picks the spec extracts to collect from a directory listing: unversioned
+/// `.json` files not on the `NON_SPEC_FILES` list, each download URL and file
+/// name once, and only those `admitted` (by `--maturity`) when that is given.
+fn spec_files<'a>(files: &'a [DirectoryListItem], admitted: Option<&BTreeSet<String>>) -> Vec<&'a DirectoryListItem> {
+    let mut seen = BTreeSet::new();
+    let mut names = BTreeMap::new();
+    files
+        .iter()
+        .filter(|file| file.item_type == "file" && file.name.ends_with(".json"))
+        .filter(|file| {
+            let listed = NON_SPEC_FILES.contains(&file.name.as_str());
+            if listed {
+                debug!("Skipping {}: not a spec extract", file.name);
+            }
+            !listed
+        })
+        .filter(|file| {
+            let shortname = file.name.trim_end_matches(".json");
+            // Spec extracts come in an unversioned form plus per-level
+            // snapshots (css-backgrounds.json, css-backgrounds-4.json, ...);
+            // only the unversioned one carries the full, current definitions.
+            let versioned = shortname.chars().last().is_some_and(|c| c.is_ascii_digit());
+            if versioned {
+                debug!("Skipping versioned spec {shortname}");
+            }
+            !versioned
+        })
+        .filter(|file| {
+            // Overlapping listing pages can name the same file twice.
+            let first = seen.insert(file.download_url.as_deref().unwrap_or(&file.path));
+            if !first {
+                debug!("Skipping {}: listed more than once", file.path);
+            }
+            first
+        })
+        .filter(|file| {
+            // Spec files are cached by name, so of two locations holding the
+            // same file name only the first is used.
+            match names.get(file.name.as_str()) {
+                Some(kept) => {
+                    warn!("Skipping {}: {kept} has the same file name", file.path);
+                    false
+                }
+                None => {
+                    names.insert(file.name.as_str(), file.path.as_str());
+                    true
+                }
+            }
+        })
+        .filter(|file| {
+            let mature = admitted.is_none_or(|a| a.contains(&file.name));
+            if !mature {
+                debug!("Skipping {}: less mature than --maturity", file.name);
+            }
+            mature
+        })
+        .collect()
+}
+
+/// The top-level keys that make a JSON file a spec extract; their contents
+/// are skipped unparsed.
+#[derive(Deserialize)]
+struct ExtractKeys {
+    properties: Option<IgnoredAny>,
+    values: Option<IgnoredAny>,
+    atrules: Option<IgnoredAny>,
+    selectors: Option<IgnoredAny>,
+}
+
+/// Parses a spec extract, or returns None when the JSON has none of the
+/// extract keys (`properties`, `values`, `atrules`, `selectors`), so metadata
+/// files do not turn into empty entries.
+fn parse_extract(content: &[u8]) -> serde_json::Result<Option<WebRefFileData>> {
+    // An extract is an object; a serde struct would also accept an array.
+    if content.iter().find(|b| !b.is_ascii_whitespace()) == Some(&b'[') {
+        return Ok(None);
+    }
+    let keys: ExtractKeys = serde_json::from_slice(content)?;
+    if keys.properties.is_none() && keys.values.is_none() && keys.atrules.is_none() && keys.selectors.is_none() {
+        return Ok(None);
+    }
+    serde_json::from_slice(content).map(Some)
+}
+
+/// Decides which spec files can be reused from the last run (`previous`) or
+/// read from the cache, and which cache entries are older than `max_age`.
+fn cache_plan(
+    specs: &[&DirectoryListItem],
+    previous: &DecodedCache,
+    max_age: Option<Duration>,
+    cache_dir: &Path,
+) -> FetchPlan {
+    let expired = expired_cache_entries(specs, cache_dir, max_age);
+    if !expired.is_empty() {
+        info!("{} cached spec file(s) are older than --max-age", expired.len());
+    }
+
+    // Spec files whose parsed extract is reused never need their cache read;
+    // the rest have their cache checked against the listing up front.
+    let reused: BTreeSet<String> = specs
+        .iter()
+        .filter(|file| !expired.contains(&file.name) && previous.files.contains_key(&file.sha))
+        .map(|file| file.name.clone())
+        .collect();
+    let unexpired: Vec<&DirectoryListItem> = specs
+        .iter()
+        .copied()
+        .filter(|f| !reused.contains(&f.name) && !expired.contains(&f.name))
+        .collect();
+
+    // Files an earlier run (even an interrupted one) completed are trusted
+    // without hashing while the listing still names the same blob. Entries
+    // for changed, expired, or unlisted files are dropped.
+    let listed: BTreeMap<&str, &str> = specs.iter().map(|f| (f.name.as_str(), f.sha.as_str())).collect();
+    let mut completed = Completed::load(cache_dir);
+    completed.retain(|name, sha| listed.get(name.as_str()) == Some(&sha.as_str()) && !expired.contains(name));
+    let (confirmed, unconfirmed): (Vec<&DirectoryListItem>, Vec<&DirectoryListItem>) =
+        unexpired.into_iter().partition(|f| completed.contains_key(&f.name));
+    let mut fresh = fresh_cache_entries(&unconfirmed, cache_dir);
+    completed.extend(
+        unconfirmed
+            .iter()
+            .filter(|f| fresh.contains(&f.name))
+            .map(|f| (f.name.clone(), f.sha.clone())),
+    );
+    fresh.extend(confirmed.iter().map(|f| f.name.clone()));
+    info!(
+        "{} cached spec file(s) confirmed by an earlier run, {} hashed",
+        confirmed.len(),
+        unconfirmed.len()
+    );
+    info!(
+        "{} of {} spec files stale",
+        specs.len() - reused.len() - fresh.len(),
+        specs.len()
+    );
+
+    FetchPlan {
+        reused,
+        fresh,
+        expired,
+        completed: Completed {
+            files: Mutex::new(completed),
+            read_only: false,
+        },
+        checkout: None,
+    }
+}
+
+/// Lists every location in order. The first location's listing is cached at
+/// the cache root; further ones under `listings/<location>/`. With a local
+/// checkout the directories are listed from disk instead.
+fn get_webref_files(
+    fetcher: &Fetcher,
+    location: &WebRefLocation,
+    cache_dir: &Path,
+    listing_ttl: Duration,
+) -> Result<Vec<DirectoryListItem>> {
+    if let Some(checkout) = &location.checkout {
+        return location
+            .locations
+            .iter()
+            .map(|dir| local_listing(checkout, dir))
+            .collect::<Result<Vec<_>>>()
+            .map(|listings| listings.into_iter().flatten().collect());
     }
 
-    if let Ok(content) = fs::read(&cache_path) {
-        if compute_git_blob_sha1(&content) == file.sha {
+    let mut files = Vec::new();
+    for (index, dir) in location.locations.iter().enumerate() {
+        let url = format!(
+            "{}/repos/{}/contents/{dir}?ref={}",
+            location.api_url, location.repo, location.branch
+        );
+        let listing_dir = match index {
+            0 => cache_dir.to_path_buf(),
+            _ => cache_dir.join("listings").join(dir),
+        };
+        files.extend(get_listing(fetcher, &url, &listing_dir, listing_ttl).with_context(|| format!("listing {dir}"))?);
+    }
+    Ok(files)
+}
+
+/// Resolves the webref ref to the commit it points at, which the extracts
+/// are then read at and the manifest records. A full commit SHA is taken as
+/// it is; otherwise GitHub is asked, and the answer cached. Like the listing,
+/// an answer younger than `ttl` is reused without a request, so within the
+/// TTL the listing URL (`?ref=<sha>`) stays the same and is not revalidated
+/// either. Failing to resolve it only costs the manifest entry (the ref is
+/// then read as it is), so it is logged and None returned.
+fn resolve_commit(fetcher: &Fetcher, location: &WebRefLocation, cache_dir: &Path, ttl: Duration) -> Option<String> {
+    if is_commit_sha(&location.branch) {
+        return Some(location.branch.clone());
+    }
+    let url = format!(
+        "{}/repos/{}/commits/{}",
+        location.api_url, location.repo, location.branch
+    );
+    fetch_commit(fetcher, &url, &cache_dir.join("commit.json"), ttl)
+        .inspect_err(|e| warn!("Cannot resolve webref ref {}: {e:#}", location.branch))
+        .ok()
+}
+
+fn is_commit_sha(reference: &str) -> bool {
+    reference.len() == 40 && reference.bytes().all(|b| b.is_ascii_hexdigit())
+}
+
+/// The commit the ref at `url` was last resolved to.
+#[derive(Debug, Serialize, Deserialize)]
+struct CachedCommit {
+    url: String,
+    sha: String,
+}
+
+fn fetch_commit(fetcher: &Fetcher, url: &str, cache_path: &Path, ttl: Duration) -> Result<String> {
+    let age = fs::metadata(cache_path)
+        .and_then(|m| m.modified())
+        .ok()
+        .and_then(|modified| modified.elapsed().ok());
+    if age.is_some_and(|age| age < ttl) {
+        let cached = fs::read(cache_path)
+            .ok()
+            .and_then(|body| serde_json::from_slice::<CachedCommit>(&body).ok());
+        if let Some(cached) = cached.filter(|cached| cached.url == url) {
+            debug!("Resolved commit is younger than {}s, using cached copy", ttl.as_secs());
+            return Ok(cached.sha);
+        }
+    }
+
+    if fetcher.offline() {
+        let body = fs::read(cache_path).cache_context(cache_path)?;
+        let cached: CachedCommit = serde_json::from_slice(&body).decode_context("cached webref commit")?;
+        if cached.url != url {
+            bail!("the cached commit is for another ref");
+        }
+        return Ok(cached.sha);
+    }
+
+    // This media type makes GitHub answer with the bare SHA.
+    let sha = fetcher
+        .get(url)?
+        .header(ACCEPT, "application/vnd.github.sha")
+        .send()
+        .and_then(|resp| resp.error_for_status())
+        .and_then(|resp| resp.text())
+        .download_context(url)?
+        .trim()
+        .to_string();
+    if !is_commit_sha(&sha) {
+        bail!("GitHub returned {sha:?} instead of a commit SHA");
+    }
+    let cached = CachedCommit {
+        url: url.to_string(),
+        sha: sha.clone(),
+    };
+    fetcher.write_cache(cache_path, &serde_json::to_vec(&cached)?)?;
+    Ok(sha)
+}
+
+/// Lists `dir` inside a local checkout the way the GitHub contents API would,
+/// sorted by name. Entries have no SHA: local files are always read as they
+/// are.
+fn local_listing(checkout: &Path, dir: &str) -> Result<Vec<DirectoryListItem>> {
+    let path = checkout.join(dir);
+    let mut items = Vec::new();
+    for entry in fs::read_dir(&path).with_context(|| format!("listing {}", path.display()))? {
+        let entry = entry.with_context(|| format!("listing {}", path.display()))?;
+        let name = entry.file_name().to_string_lossy().into_owned();
+        let is_dir = entry.file_type().is_ok_and(|t| t.is_dir());
+        items.push(DirectoryListItem {
+            path: format!("{dir}/{name}"),
+            name,
+            sha: String::new(),
+            download_url: None,
+            git_url: None,
+            item_type: if is_dir { "dir" } else { "file" }.to_string(),
+        });
+    }
+    items.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(items)
+}
+
+/// Fetches a GitHub contents listing, following `Link: rel="next"` pages.
+/// The previous result is kept in the cache together with the first page's
+/// ETag and revalidated with `If-None-Match`, so an unchanged listing costs a
+/// `304 Not Modified` instead of the full download. A listing younger than
+/// `ttl` is not revalidated at all; offline, the cached listing is used as is.
+fn get_listing(fetcher: &Fetcher, url: &str, cache_dir: &Path, ttl: Duration) -> Result<Vec<DirectoryListItem>> {
+    let listing_path = cache_dir.join("listing.json");
+    let etag_path = cache_dir.join("listing.etag");
+    let url_path = cache_dir.join("listing.url");
+
+    // The TTL only applies to a listing of the same URL, so switching
+    // --webref-repo/branch/location always fetches the new listing.
+    let age = fs::metadata(&listing_path)
+        .and_then(|m| m.modified())
+        .ok()
+        .and_then(|modified| modified.elapsed().ok());
+    let same_url = fs::read_to_string(&url_path).is_ok_and(|cached| cached == url);
+    if same_url && age.is_some_and(|age| age < ttl) {
+        debug!(
+            "Directory listing is younger than {}s, using cached copy",
+            ttl.as_secs()
+        );
+        let body = fs::read(&listing_path).cache_context(&listing_path)?;
+        return serde_json::from_slice(&body).decode_context("cached webref directory listing");
+    }
+
+    if fetcher.offline() {
+        let body = fs::read(&listing_path)
+            .context("offline mode needs a cached webref listing; run once online first")
+            .cache_context(&listing_path)?;
+        return serde_json::from_slice(&body).decode_context("cached webref directory listing");
+    }
+
+    let mut request = fetcher.get(url)?;
+    if listing_path.exists() {
+        if let Ok(etag) = fs::read_to_string(&etag_path) {
+            request = request.header(IF_NONE_MATCH, etag.trim());
+        }
+    }
+
+    let resp = request.send().download_context(url)?;
+    if resp.status() == StatusCode::NOT_MODIFIED {
+        debug!("Directory listing not modified, using cached copy");
+        let body = fs::read(&listing_path).cache_context(&listing_path)?;
+        // Rewriting the listing restarts its TTL.
+        fetcher.write_cache(&listing_path, &body)?;
+        return serde_json::from_slice(&body).decode_context("cached webref directory listing");
+    }
+
+    let mut resp = resp.error_for_status().download_context(url)?;
+    let etag = resp
+        .headers()
+        .get(ETAG)
+        .and_then(|v| v.to_str().ok())
+        .map(str::to_string);
+
+    let mut items: Vec<DirectoryListItem> = Vec::new();
+    loop {
+        let next = resp
+            .headers()
+            .get(LINK)
+            .and_then(|v| v.to_str().ok())
+            .and_then(next_link);
+        let body = resp.bytes().download_context(url)?;
+        let page: Vec<DirectoryListItem> = serde_json::from_slice(&body).decode_context("webref directory listing")?;
+        items.extend(page);
+
+        let Some(next) = next else { break };
+        debug!("Fetching next directory listing page {next}");
+        resp = fetcher
+            .get(&next)?
+            .send()
+            .and_then(|resp| resp.error_for_status())
+            .download_context(&next)?;
+    }
+
+    fetcher.write_cache(&listing_path, &serde_json::to_vec(&items)?)?;
+    fetcher.write_cache(&url_path, url.as_bytes())?;
+    match etag {
+        Some(etag) => fetcher.write_cache(&etag_path, etag.as_bytes())?,
+        None if !fetcher.dry_run() => {
+            let _ = fs::remove_file(&etag_path);
+        }
+        None => {}
+    }
+
+    Ok(items)
+}
+
+/// Returns the `rel="next"` target of an RFC 8288 `Link` header.
+fn next_link(header: &str) -> Option<String> {
+    header.split(',').find_map(|link| {
+        let (target, params) = link.split_once(';')?;
+        let is_next = params
+            .split(';')
+            .any(|p| matches!(p.trim(), "rel=\"next\"" | "rel=next"));
+        is_next.then(|| target.trim().trim_start_matches('<').trim_end_matches('>').to_string())
+    })
+}
+
+/// Returns the names of the files whose cached copy still matches the
+/// listing's git blob SHA. Hashing streams each file and is spread over all
+/// cores, so an unchanged cache is cheap to confirm.
+fn fresh_cache_entries(files: &[&DirectoryListItem], cache_dir: &Path) -> BTreeSet<String> {
+    let workers = thread::available_parallelism().map_or(1, |n| n.get());
+    let chunk_size = files.len().div_ceil(workers).max(1);
+
+    thread::scope(|scope| {
+        let handles: Vec<_> = files
+            .chunks(chunk_size)
+            .map(|chunk| {
+                scope.spawn(move || {
+                    chunk
+                        .iter()
+                        .filter(|file| {
+                            compute_git_blob_sha1_file(&cache_dir.join("specs").join(&file.name))
+                                .is_ok_and(|sha| sha == file.sha)
+                        })
+                        .map(|file| file.name.clone())
+                        .collect::<Vec<_>>()
+                })
+            })
+            .collect();
+        handles
+            .into_iter()
+            .filter_map(|handle| handle.join().ok())
+            .flatten()
+            .collect()
+    })
+}
+
+/// Returns the names of the files whose cache entry was written longer than
+/// `max_age` ago (by file mtime). Without a `max_age` nothing expires.
+fn expired_cache_entries(
+    files: &[&DirectoryListItem],
+    cache_dir: &Path,
+    max_age: Option<Duration>,
+) -> BTreeSet<String> {
+    let Some(max_age) = max_age else {
+        return BTreeSet::new();
+    };
+    files
+        .iter()
+        .filter(|file| {
+            fs::metadata(cache_dir.join("specs").join(&file.name))
+                .and_then(|m| m.modified())
+                .ok()
+                .and_then(|modified| modified.elapsed().ok())
+                .is_some_and(|age| age > max_age)
+        })
+        .map(|file| file.name.clone())
+        .collect()
+}
+
+/// Which spec files can skip part of the fetch, by file name.
+#[derive(Debug, Default)]
+struct FetchPlan {
+    /// Merged from the last run's parsed extract; not read at all
+    reused: BTreeSet<String>,
+    /// Read from the cache without checking upstream
+    fresh: BTreeSet<String>,
+    /// Downloaded again whatever their SHA
+    expired: BTreeSet<String>,
+    /// Cache entries known to match the listing, extended as files download
+    completed: Completed,
+    /// A local checkout every file is read from instead
+    checkout: Option<PathBuf>,
+}
+
+/// The cache file that records which spec files are complete.
+const COMPLETED_FILE: &str = "completed.json";
+
+/// The spec files whose cache entry is complete and matches the listing, as
+/// file name -> blob SHA. A downloaded file is added once it is on disk with
+/// the listed SHA, and the record is saved right away, so a run interrupted
+/// halfway through a fresh cache build resumes without hashing the files it
+/// already finished.
+#[derive(Debug, Default)]
+struct Completed {
+    files: Mutex<BTreeMap<String, String>>,
+    /// Never saved (`--limit-specs`)
+    read_only: bool,
+}
+
+impl Completed {
+    /// The saved record; empty when there is none or it is unreadable.
+    fn load(cache_dir: &Path) -> BTreeMap<String, String> {
+        fs::read(cache_dir.join(COMPLETED_FILE))
+            .ok()
+            .and_then(|body| serde_json::from_slice(&body).ok())
+            .unwrap_or_default()
+    }
+
+    /// Records `file` as complete and saves the record.
+    fn record(&self, fetcher: &Fetcher, cache_dir: &Path, file: &DirectoryListItem) {
+        let mut files = self.files.lock();
+        if files.get(&file.name) == Some(&file.sha) {
+            return;
+        }
+        files.insert(file.name.clone(), file.sha.clone());
+        self.write(fetcher, cache_dir, &files);
+    }
+
+    fn save(&self, fetcher: &Fetcher, cache_dir: &Path) {
+        self.write(fetcher, cache_dir, &self.files.lock());
+    }
+
+    /// A record that fails to save only costs the next run some hashing, so
+    /// the failure is logged rather than returned.
+    fn write(&self, fetcher: &Fetcher, cache_dir: &Path, files: &BTreeMap<String, String>) {
+        if fetcher.dry_run() || self.read_only {
+            return;
+        }
+        let path = cache_dir.join(COMPLETED_FILE);
+        let written = serde_json::to_vec(files)
+            .map_err(anyhow::Error::from)
+            .and_then(|body| fetcher.write_cache(&path, &body));
+        if let Err(e) = written {
+            warn!("Not saving {}: {e:#}", path.display());
+        }
+    }
+}
+
+/// What became of one spec file, handed to the merger.
+#[derive(Debug)]
+enum Fetched {
+    /// Its parsed extract from the last run is to be reused
+    Reused,
+    /// It could not be fetched; the failure was reported already
+    Failed,
+    /// Its content was decoded; None when it is not a spec extract
+    Decoded(serde_json::Result<Option<WebRefFileData>>),
+}
+
+/// Reads every spec file not `reused` from the cache (when `fresh`) or
+/// downloads it (always when `expired`), and hands the raw content to
+/// `workers` decode threads, so parsing overlaps fetching. The results are
+/// passed to `merge` with their index in `specs`, in listing order, as they
+/// arrive. Both channels are bounded by `workers` and merged files are
+/// dropped, so only a few times `workers` decoded files are held at once
+/// rather than the whole spec set.
+fn fetch_and_parse(
+    fetcher: &Fetcher,
+    specs: &[&DirectoryListItem],
+    plan: &FetchPlan,
+    cache_dir: &Path,
+    workers: usize,
+    mut merge: impl FnMut(usize, Fetched),
+) -> Result<()> {
+    let workers = workers.max(1);
+    let (raw_tx, raw_rx) = mpsc::sync_channel::<(usize, Vec<u8>)>(workers);
+    let (fetched_tx, fetched_rx) = mpsc::sync_channel::<(usize, Fetched)>(workers);
+    let raw_rx = Mutex::new(raw_rx);
+
+    thread::scope(|scope| {
+        for _ in 0..workers {
+            let fetched_tx = fetched_tx.clone();
+            let raw_rx = &raw_rx;
+            scope.spawn(move || {
+                loop {
+                    // The lock is only held while waiting for the next file,
+                    // not while parsing it.
+                    let next = raw_rx.lock().recv();
+                    let Ok((index, content)) = next else {
+                        break;
+                    };
+                    let _ = fetched_tx.send((index, Fetched::Decoded(parse_extract(&content))));
+                }
+            });
+        }
+
+        let producer = scope.spawn(move || -> Result<()> {
+            for (index, file) in specs.iter().enumerate() {
+                if plan.reused.contains(&file.name) {
+                    let _ = fetched_tx.send((index, Fetched::Reused));
+                    continue;
+                }
+                // A single unreachable spec file only costs that spec's
+                // definitions; skip it rather than aborting the whole run.
+                // Offline, a missing cache entry means the cache is
+                // incomplete: fail clearly.
+                let content = match read_spec_file_retrying(fetcher, file, plan, cache_dir) {
+                    Ok(content) => content,
+                    Err(e) if fetcher.offline() && plan.checkout.is_none() => return Err(e),
+                    Err(e) => {
+                        warn!("Skipping {}: {e:#}", file.path);
+                        let _ = fetched_tx.send((index, Fetched::Failed));
+                        continue;
+                    }
+                };
+                raw_tx.send((index, content)).context("decode workers stopped")?;
+            }
+            Ok(())
+        });
+
+        // Merge in listing order, whatever order the decode workers finish
+        // in, so conflicting definitions are merged in a fixed order. Results
+        // that arrive early wait for the ones before them.
+        let mut waiting = BTreeMap::new();
+        let mut next = 0;
+        for (index, fetched) in fetched_rx {
+            waiting.insert(index, fetched);
+            while let Some(fetched) = waiting.remove(&next) {
+                merge(next, fetched);
+                next += 1;
+            }
+        }
+
+        producer.join().map_err(|_| anyhow!("spec fetcher thread panicked"))?
+    })
+}
+
+/// Like `read_spec_file`, but a failed download is tried once more (see
+/// [`retry_once`]). Reads that cannot go better the second time (a local
+/// checkout, offline, a dry run) are not retried.
+fn read_spec_file_retrying(
+    fetcher: &Fetcher,
+    file: &DirectoryListItem,
+    plan: &FetchPlan,
+    cache_dir: &Path,
+) -> Result<Vec<u8>> {
+    let read = || read_spec_file(fetcher, file, plan, cache_dir);
+    if plan.checkout.is_some() || fetcher.offline() || fetcher.dry_run() {
+        return read();
+    }
+    retry_once(&format!("Reading {}", file.path), read)
+}
+
+/// Returns one spec file's content: from the local checkout if there is one,
+/// else from the cache when `plan` has it fresh, else downloaded.
+fn read_spec_file(fetcher: &Fetcher, file: &DirectoryListItem, plan: &FetchPlan, cache_dir: &Path) -> Result<Vec<u8>> {
+    if let Some(checkout) = &plan.checkout {
+        let path = checkout.join(&file.path);
+        return fs::read(&path).with_context(|| format!("reading {}", path.display()));
+    }
+    if plan.fresh.contains(&file.name) {
+        if let Ok(content) = fs::read(cache_dir.join("specs").join(&file.name)) {
             return Ok(content);
         }
     }
+    download_file_content(
+        fetcher,
+        file,
+        cache_dir,
+        plan.expired.contains(&file.name),
+        &plan.completed,
+    )
+    .context("download failed")
+}
+
+/// Returns the file's content, from the local cache when it still matches the
+/// upstream git blob SHA, downloading and re-caching it otherwise. An
+/// `expired` cache entry is downloaded again regardless of its SHA. A
+/// download is only cached once its whole body has the listed SHA; either way
+/// a verified file is recorded in `completed`.
+fn download_file_content(
+    fetcher: &Fetcher,
+    file: &DirectoryListItem,
+    cache_dir: &Path,
+    expired: bool,
+    completed: &Completed,
+) -> Result<Vec<u8>> {
+    let cache_path = cache_dir.join("specs").join(&file.name);
+
+    let cached = fs::read(&cache_path).ok();
+    if let Some(content) = &cached {
+        if !expired && compute_git_blob_sha1(content) == file.sha {
+            completed.record(fetcher, cache_dir, file);
+            return Ok(content.clone());
+        }
+    }
+
+    // A dry run only reports the download and carries on with whatever is
+    // cached, so the rest of the plan can still be computed.
+    if fetcher.dry_run() {
+        info!("Would download {}", file.path);
+        return cached.context("not cached yet; skipped in dry run");
+    }
+
+    if fetcher.offline() {
+        return Err(anyhow!(
+            "offline mode needs an up-to-date cache entry; run once online first"
+        ))
+        .cache_context(&cache_path);
+    }
+
+    if expired {
+        info!("Cache file is older than --max-age, downloading {}", file.path);
+    } else {
+        info!("Cache file is outdated, downloading {}", file.path);
+    }
+    let body = match download_raw(fetcher, file) {
+        Ok(body) => body,
+        // The raw download_url can briefly point at a ref that has moved on
+        // while the listing still names the old blob; the blob itself stays
+        // reachable by its SHA.
+        Err(e) => {
+            let Some(git_url) = &file.git_url else {
+                return Err(e);
+            };
+            warn!(
+                "Downloading {} failed ({e:#}), falling back to blob {}",
+                file.path, file.sha
+            );
+            download_blob(fetcher, git_url)?
+        }
+    };
+    // Content other than the listed blob means the listing (or the pinned
+    // ref) is behind the file it points at. It is used for this run but not
+    // cached, since the next run would not trust it anyway.
+    if compute_git_blob_sha1(&body) != file.sha {
+        warn!(
+            "{} changed upstream but the listing still names blob {}; the listing may be stale",
+            file.path, file.sha
+        );
+        return Ok(body);
+    }
+    fetcher.write_cache(&cache_path, &body)?;
+    completed.record(fetcher, cache_dir, file);
+
+    Ok(body)
+}
 
-    eprintln!("Cache file is outdated, downloading {}", file.path);
+fn download_raw(fetcher: &Fetcher, file: &DirectoryListItem) -> Result<Vec<u8>> {
     let url = file
         .download_url
         .as_deref()
         .context("listing entry has no download_url")?;
-    let resp = client.get(url).send()?.error_for_status()?;
-    let body = resp.bytes()?.to_vec();
-    fs::write(&cache_path, &body).with_context(|| format!("writing cache file {}", cache_path.display()))?;
+    fetcher
+        .get(url)?
+        .send()
+        .map_err(anyhow::Error::from)
+        .and_then(json_body)
+        .download_context(url)
+}
 
+/// Returns the body of a response that must be a JSON document. GitHub can
+/// answer with an HTML error page, and a connection can drop mid-body; both
+/// are rejected here, before anything is written to the cache, instead of
+/// being cached as a spec file that fails to decode on every later run.
+fn json_body(resp: Response) -> Result<Vec<u8>> {
+    if resp.status() != StatusCode::OK {
+        bail!("unexpected status {}", resp.status());
+    }
+    let content_type = resp.headers().get(CONTENT_TYPE).and_then(|v| v.to_str().ok());
+    if let Some(content_type) = content_type {
+        let media_type = content_type.split(';').next().unwrap_or_default().trim();
+        // raw.githubusercontent.com serves every file as text/plain.
+        let is_json = ["application/json", "text/plain"]
+            .iter()
+            .any(|t| media_type.eq_ignore_ascii_case(t))
+            || media_type.ends_with("+json");
+        if !is_json {
+            bail!("unexpected content type {content_type:?}");
+        }
+    }
+    let body = resp.bytes()?.to_vec();
+    ensure_json(&body)?;
     Ok(body)
 }
 
+fn ensure_json(body: &[u8]) -> Result<()> {
+    serde_json::from_slice::<IgnoredAny>(body).context("response is not a complete JSON document")?;
+    Ok(())
+}
+
+/// A response of the GitHub git blobs API.
+#[derive(Debug, Deserialize)]
+struct GitBlob {
+    content: String,
+    encoding: String,
+}
+
+/// Fetches a file through the git blobs API, which serves it by SHA as
+/// (line-wrapped) base64.
+fn download_blob(fetcher: &Fetcher, git_url: &str) -> Result<Vec<u8>> {
+    let body = fetcher
+        .get(git_url)?
+        .send()
+        .map_err(anyhow::Error::from)
+        .and_then(json_body)
+        .download_context(git_url)?;
+    decode_blob(&body).decode_context(git_url)
+}
+
+/// Returns the file content carried by a git blobs API response.
+fn decode_blob(body: &[u8]) -> Result<Vec<u8>> {
+    let blob: GitBlob = serde_json::from_slice(body).context("parsing git blob response")?;
+    if blob.encoding != "base64" {
+        bail!("unexpected git blob encoding {:?}", blob.encoding);
+    }
+    let encoded: String = blob.content.split_whitespace().collect();
+    let content = STANDARD.decode(encoded).context("decoding git blob content")?;
+    ensure_json(&content)?;
+    Ok(content)
+}
+
 /// Git blob SHA-1 (`sha1("blob <len>\0<content>")`), used to validate the
 /// cache against the GitHub directory listing.
 fn compute_git_blob_sha1(content: &[u8]) -> String {
-    let mut hasher = Sha1::new();
-    hasher.update(format!("blob {}\0", content.len()).as_bytes());
+    let mut hasher = blob_hasher(content.len() as u64);
     hasher.update(content);
+    hex_digest(hasher)
+}
+
+/// Like `compute_git_blob_sha1`, but streams the file through the hasher
+/// instead of loading it whole; the size for the header comes from its
+/// metadata.
+fn compute_git_blob_sha1_file(path: &Path) -> io::Result<String> {
+    let mut file = File::open(path)?;
+    let mut hasher = blob_hasher(file.metadata()?.len());
+    let mut buf = [0; 64 * 1024];
+    loop {
+        let n = file.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+    }
+    Ok(hex_digest(hasher))
+}
+
+fn blob_hasher(len: u64) -> Sha1 {
+    let mut hasher = Sha1::new();
+    hasher.update(format!("blob {len}\0").as_bytes());
+    hasher
+}
+
+fn hex_digest(hasher: Sha1) -> String {
     let mut out = String::with_capacity(40);
     for byte in hasher.finalize() {
         out.push_str(&format!("{byte:02x}"));
@@ -180,25 +1350,44 @@ fn compute_git_blob_sha1(content: &[u8]) -> String {
     out
 }
 
-fn decode_file_content(content: &[u8], pd: &mut ParseData) -> Result<()> {
-    let file_data: WebRefFileData = serde_json::from_slice(content)?;
-
-    for property in file_data.properties {
-        for v in &property.values {
-            process_value(&v.name, &v.value_type, &v.syntax, pd);
-            process_extra_values(&v.values, pd);
+fn decode_file_content(shortname: &str, mut file_data: WebRefFileData, pd: &mut ParseData) {
+    for property in &mut file_data.properties {
+        canonicalize(shortname, "property", &mut property.name, canonical_name);
+        if !property.legacy_alias_of.is_empty() {
+            canonicalize(shortname, "property", &mut property.legacy_alias_of, canonical_name);
         }
+        canonicalize_values(shortname, &mut property.values);
+    }
+    canonicalize_values(shortname, &mut file_data.values);
+
+    let source = Source {
+        shortname: shortname.to_string(),
+        title: file_data.spec.title,
+        url: file_data.spec.url,
+    };
+
+    for mut property in file_data.properties {
+        process_extra_values(&property.values, &source, pd);
+        explain::record(&mut pd.trace, &property.name, || {
+            let mut step = format!("{shortname}: syntax `{}`", property.syntax);
+            if !property.new_syntax.is_empty() {
+                let _ = write!(step, ", newValues `{}`", property.new_syntax);
+            }
+            if !property.values.is_empty() {
+                let names: Vec<&str> = property.values.iter().map(|v| v.name.as_str()).collect();
+                let _ = write!(step, ", defines values {}", names.join(", "));
+            }
+            if !property.legacy_alias_of.is_empty() {
+                let _ = write!(step, ", legacy alias of {}", property.legacy_alias_of);
+            }
+            step
+        });
 
         if let Some(existing) = pd.properties.get(&property.name) {
             let mut p = existing.clone();
+            add_source(&mut p.sources, &source);
 
-            if p.syntax.is_empty() {
-                p.syntax = property.syntax.clone();
-            } else if p.syntax != property.syntax && !property.syntax.is_empty() {
-                eprintln!("Different syntax for duplicated property {}", property.name);
-                eprintln!("Old: {}", p.syntax);
-                eprintln!("New: {}", property.syntax);
-            }
+            pd.merge_syntax("property", &property.name, shortname, &mut p.syntax, &property.syntax);
 
             // `newValues` entries (a spec extending another spec's property)
             // are folded into the base grammar as extra alternatives.
@@ -217,53 +1406,177 @@ fn decode_file_content(content: &[u8], pd: &mut ParseData) -> Result<()> {
                 }
             }
 
+            if p.legacy_alias_of.is_empty() {
+                p.legacy_alias_of = property.legacy_alias_of.clone();
+            } else if !property.legacy_alias_of.is_empty() && p.legacy_alias_of != property.legacy_alias_of {
+                pd.alias_conflicts.push(format!(
+                    "{} is a legacy alias of {}, but {shortname} makes it one of {}",
+                    p.name, p.legacy_alias_of, property.legacy_alias_of
+                ));
+            }
+
+            explain::record(&mut pd.trace, &p.name, || {
+                if p.syntax.is_empty() {
+                    format!(
+                        "{shortname} merged: no syntax yet, pending newValues `{}`",
+                        p.new_syntax
+                    )
+                } else {
+                    format!("{shortname} merged: syntax is now `{}`", p.syntax)
+                }
+            });
             pd.properties.insert(p.name.clone(), p);
             continue;
         }
 
+        property.sources = vec![source.clone()];
         pd.properties.insert(property.name.clone(), property);
     }
 
-    process_extra_values(&file_data.values, pd);
+    process_extra_values(&file_data.values, &source, pd);
 
-    for at_rule in file_data.atrules {
+    for mut at_rule in file_data.atrules {
+        for descriptor in &mut at_rule.descriptors {
+            descriptor.sources = vec![source.clone()];
+        }
+        if let Some(values) = &mut at_rule.values {
+            drop_unusable_values(&at_rule.name, &source.shortname, values);
+        }
         if let Some(existing) = pd.at_rules.get(&at_rule.name) {
             let mut a = existing.clone();
+            add_source(&mut a.sources, &source);
 
-            if a.syntax.is_empty() {
-                a.syntax = at_rule.syntax.clone();
-            }
-
-            if !a.syntax.is_empty() && !at_rule.syntax.is_empty() && a.syntax != at_rule.syntax {
-                eprintln!("Different syntax for duplicated at-rule {}", at_rule.name);
-                eprintln!("Old: {}", a.syntax);
-                eprintln!("New: {}", at_rule.syntax);
-            }
+            pd.merge_syntax("at-rule", &at_rule.name, shortname, &mut a.syntax, &at_rule.syntax);
 
             if let Some(values) = at_rule.values {
                 if !values.is_empty() {
                     a.values.get_or_insert_with(Vec::new).extend(values);
                 }
             }
-            a.descriptors.extend(at_rule.descriptors);
+            merge_descriptors(pd, &at_rule.name, shortname, &mut a.descriptors, at_rule.descriptors);
 
             pd.at_rules.insert(a.name.clone(), a);
             continue;
         }
 
+        at_rule.sources = vec![source.clone()];
         pd.at_rules.insert(at_rule.name.clone(), at_rule);
     }
 
+    // Selectors are keyed by name, so one declared by several specs (`:hover`
+    // is in both selectors-4 and selectors-5) is exported once. The first
+    // spec's argument grammar wins; a differing one is reported.
     for selector in file_data.selectors {
-        pd.selectors.insert(selector.name.clone(), selector);
+        let entry = pd.selectors.entry(selector.name.clone()).or_insert_with(|| Selector {
+            kind: SelectorKind::classify(&selector.name),
+            name: selector.name,
+            arguments: String::new(),
+        });
+        if entry.arguments.is_empty() {
+            entry.arguments = selector.syntax;
+        } else if !selector.syntax.is_empty() && entry.arguments != selector.syntax {
+            warn!(
+                "Different arguments for duplicated selector {} in {}\nKept: {}\nIgnored: {}",
+                entry.name, source.shortname, entry.arguments, selector.syntax
+            );
+        }
     }
+}
 
-    Ok(())
+/// Drops the `values` entries of an at-rule that give the engine nothing to
+/// use: no grammar (or only `!important`) and no nested values. An entry
+/// whose name is a plain keyword (`portrait`) stands for itself and is kept.
+/// Each drop is logged.
+fn drop_unusable_values(at_rule: &str, shortname: &str, values: &mut Vec<AtRuleValue>) {
+    values.retain(|v| {
+        let value = v.value.trim();
+        let usable = !(value.is_empty() || value == "!important")
+            || v.values.as_ref().is_some_and(|nested| !nested.is_empty())
+            || is_keyword(&v.name);
+        if !usable {
+            info!(
+                "Dropping value {:?} of at-rule {at_rule} in {shortname}: it has no usable value",
+                v.name
+            );
+        }
+        usable
+    });
+}
+
+fn is_keyword(name: &str) -> bool {
+    name.starts_with(|c: char| c.is_ascii_alphabetic() || c == '-')
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+}
+
+/// Merges another spec's descriptors for `at_rule` into `existing`, one
+/// entry per descriptor name. Like duplicated properties, an empty syntax or
+/// initial value is filled in from the other spec, and two different syntaxes
+/// are merged by the conflict strategy (see [`ParseData::merge_syntax`]).
+/// Every spec declaring a descriptor is added to its sources.
+fn merge_descriptors(
+    pd: &mut ParseData,
+    at_rule: &str,
+    shortname: &str,
+    existing: &mut Vec<WebRefAtRuleDescriptor>,
+    descriptors: Vec<WebRefAtRuleDescriptor>,
+) {
+    for descriptor in descriptors {
+        let Some(d) = existing.iter_mut().find(|d| d.name == descriptor.name) else {
+            existing.push(descriptor);
+            continue;
+        };
+        for source in &descriptor.sources {
+            add_source(&mut d.sources, source);
+        }
+
+        let name = format!("{} of {at_rule}", descriptor.name);
+        pd.merge_syntax("descriptor", &name, shortname, &mut d.syntax, &descriptor.syntax);
+
+        if d.initial.is_empty() {
+            d.initial = descriptor.initial;
+        }
+        if d.descriptor_type.is_empty() {
+            d.descriptor_type = descriptor.descriptor_type;
+        }
+    }
+}
+
+/// The form property names are matched in: trimmed and lowercased, as CSS
+/// property names are ASCII case-insensitive (` Color` is `color`).
+pub fn canonical_name(name: &str) -> Cow<'_, str> {
+    name.trim().cow_to_ascii_lowercase()
+}
+
+/// The form value names are matched in: only trimmed. Grammars reference
+/// camelCase functions such as `translateX()` by their spelled-out name, so
+/// lowercasing them would leave those references unresolved.
+fn canonical_value_name(name: &str) -> Cow<'_, str> {
+    Cow::Borrowed(name.trim())
+}
+
+/// Replaces `name` with its `canonical` form, warning when that changed it so
+/// the bad upstream name gets reported.
+fn canonicalize(shortname: &str, kind: &str, name: &mut String, canonical: fn(&str) -> Cow<'_, str>) {
+    let canonical = canonical(name);
+    if canonical != name.as_str() {
+        let canonical = canonical.into_owned();
+        warn!("{shortname}: {kind} name {name:?} canonicalized to {canonical:?}");
+        *name = canonical;
+    }
+}
+
+/// Canonicalizes the names of `values` and everything nested in them.
+fn canonicalize_values(shortname: &str, values: &mut [WebRefValue]) {
+    for value in values {
+        canonicalize(shortname, "value", &mut value.name, canonical_value_name);
+        canonicalize_values(shortname, &mut value.values);
+    }
 }
 
 /// Process a single value (from either root values or property values) and add
-/// it to the ParseData if possible.
-fn process_value(name: &str, value_type: &str, syntax: &str, pd: &mut ParseData) {
+/// it to the ParseData if possible. Names are expected in canonical form (see
+/// [`canonical_value_name`]).
+fn process_value(name: &str, value_type: &str, syntax: &str, source: &Source, pd: &mut ParseData) {
     if name == syntax {
         return;
     }
@@ -277,39 +1590,38 @@ fn process_value(name: &str, value_type: &str, syntax: &str, pd: &mut ParseData)
         if v.syntax.is_empty() {
             v.syntax = syntax.clone();
         }
+        if v.value_type.is_empty() {
+            v.value_type = value_type.to_string();
+        }
 
         // Skip built-in values (<integer> has syntax "<integer>", which
         // results in a loop when resolving)
         if v.syntax == v.name {
-            eprintln!("name == syntax, skipping as this is an built-in value: {name}");
+            debug!("name == syntax, skipping as this is an built-in value: {name}");
             return;
         }
 
-        // Not all values have the same syntax. It can change. We ignore this
-        // and keep the first one we saw.
-        if !v.syntax.is_empty() && !syntax.is_empty() && v.syntax != syntax {
-            eprintln!("Different syntax for duplicated value {name}");
-            eprintln!("Old: {}", v.syntax);
-            eprintln!("New: {syntax}");
-        }
+        // Not all values have the same syntax. It can change between specs.
+        pd.merge_syntax("value", name, &source.shortname, &mut v.syntax, &syntax);
 
+        add_source(&mut v.sources, source);
         pd.values.insert(name.to_string(), v);
         return;
     }
 
     if value_type == "value" {
-        eprintln!("value type. Skipping: {name}");
+        debug!("value type. Skipping: {name}");
         return;
     }
 
     // Skip <integer> = syntax("<integer>")
     if syntax == name {
-        eprintln!("value==name. Skipping: {name}");
+        debug!("value==name. Skipping: {name}");
         return;
     }
 
     if syntax.is_empty() {
-        eprintln!("empty value/syntax: {name}");
+        debug!("empty value/syntax: {name}");
         return;
     }
 
@@ -318,16 +1630,31 @@ fn process_value(name: &str, value_type: &str, syntax: &str, pd: &mut ParseData)
         WebRefValue {
             name: name.to_string(),
             syntax,
-            value_type: String::new(),
+            value_type: value_type.to_string(),
             values: Vec::new(),
+            sources: vec![source.clone()],
+            children: Vec::new(),
         },
     );
 }
 
-fn process_extra_values(values: &[WebRefValue], pd: &mut ParseData) {
+/// Processes `values` and everything nested in them. A nested value becomes
+/// an entry of its own, and its name is recorded in its parent's `children`
+/// (e.g. a function and the value types of its arguments).
+fn process_extra_values(values: &[WebRefValue], source: &Source, pd: &mut ParseData) {
     for value in values {
-        process_value(&value.name, &value.value_type, &value.syntax, pd);
-        process_extra_values(&value.values, pd);
+        process_value(&value.name, &value.value_type, &value.syntax, source, pd);
+        process_extra_values(&value.values, source, pd);
+
+        // A parent skipped by process_value (a plain keyword, a built-in)
+        // has no entry to record its children on.
+        if let Some(parent) = pd.values.get_mut(&value.name) {
+            for child in &value.values {
+                if child.name != value.name && !parent.children.contains(&child.name) {
+                    parent.children.push(child.name.clone());
+                }
+            }
+        }
     }
 }
 
@@ -387,3 +1714,1100 @@ fn quote_parentheses(input: &str) -> String {
 
     result
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::alias::PropertyAliasTable;
+    use crate::error::Error;
+    use crate::test_server::{Response, TestServer};
+    use flate2::write::GzEncoder;
+    use flate2::Compression;
+    use std::io::Write;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    const LISTING: &str = r#"[{"name": "css-a.json", "path": "ed/css/css-a.json", "sha": "abc", "type": "file"}]"#;
+
+    /// A listed spec file under `ed/css` with no download URLs.
+    fn listing_item(name: &str, sha: &str) -> DirectoryListItem {
+        DirectoryListItem {
+            name: name.to_string(),
+            path: format!("ed/css/{name}"),
+            sha: sha.to_string(),
+            download_url: None,
+            git_url: None,
+            item_type: "file".to_string(),
+        }
+    }
+
+    #[test]
+    fn listing_is_revalidated_with_its_etag() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|req| match req.header("if-none-match") {
+            Some("\"v1\"") => Response::status(304),
+            _ => Response::ok(LISTING).with_header("ETag", "\"v1\""),
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let url = format!("{}/contents", server.base_url);
+
+        let first = get_listing(&fetcher, &url, cache.path(), Duration::ZERO).unwrap();
+        let second = get_listing(&fetcher, &url, cache.path(), Duration::ZERO).unwrap();
+
+        assert_eq!(first.len(), 1);
+        assert_eq!(second[0].name, "css-a.json");
+        let requests = server.requests();
+        assert_eq!(requests.len(), 2);
+        assert_eq!(requests[0].path, "/contents");
+        assert_eq!(requests[0].header("if-none-match"), None);
+        assert_eq!(requests[1].header("if-none-match"), Some("\"v1\""));
+    }
+
+    #[test]
+    fn ref_is_resolved_to_a_commit_and_cached() {
+        const SHA: &str = "0123456789abcdef0123456789abcdef01234567";
+        let cache = tempfile::tempdir().unwrap();
+        let path = cache.path().join("commit.json");
+        let server = TestServer::start(|req| match req.header("accept") {
+            Some("application/vnd.github.sha") => Response::ok(SHA),
+            _ => Response::ok("{}"),
+        });
+        let url = format!("{}/commits/curated", server.base_url);
+
+        let online = Fetcher::new(false, false).unwrap();
+        assert_eq!(fetch_commit(&online, &url, &path, Duration::ZERO).unwrap(), SHA);
+        assert_eq!(server.requests().len(), 1);
+
+        // Within the TTL the cached answer is used without a request.
+        let ttl = Duration::from_secs(3600);
+        assert_eq!(fetch_commit(&online, &url, &path, ttl).unwrap(), SHA);
+        assert!(server.requests().is_empty());
+        assert_eq!(fetch_commit(&online, &url, &path, Duration::ZERO).unwrap(), SHA);
+        assert_eq!(server.requests().len(), 1);
+
+        let offline = Fetcher::new(true, false).unwrap();
+        assert_eq!(fetch_commit(&offline, &url, &path, Duration::ZERO).unwrap(), SHA);
+        let main = format!("{}/commits/main", server.base_url);
+        assert!(fetch_commit(&offline, &main, &path, ttl).is_err());
+
+        assert!(is_commit_sha(SHA));
+        assert!(!is_commit_sha("curated"));
+    }
+
+    #[test]
+    fn listing_within_ttl_is_not_revalidated() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|_| Response::ok(LISTING).with_header("ETag", "\"v1\""));
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let url = format!("{}/contents", server.base_url);
+        let day = Duration::from_secs(24 * 60 * 60);
+
+        get_listing(&fetcher, &url, cache.path(), day).unwrap();
+        let cached = get_listing(&fetcher, &url, cache.path(), day).unwrap();
+        assert_eq!(cached[0].name, "css-a.json");
+        assert_eq!(server.requests().len(), 1);
+
+        get_listing(&fetcher, &url, cache.path(), Duration::ZERO).unwrap();
+        assert_eq!(server.requests().len(), 1);
+
+        let other = format!("{}/other", server.base_url);
+        get_listing(&fetcher, &other, cache.path(), day).unwrap();
+        assert_eq!(server.requests().len(), 1);
+    }
+
+    #[test]
+    fn listing_follows_next_links() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|req| {
+            let host = req.header("host").unwrap_or_default();
+            if req.path.ends_with("page=2") {
+                return Response::ok(
+                    r#"[{"name": "css-b.json", "path": "ed/css/css-b.json", "sha": "def", "type": "file"}]"#,
+                );
+            }
+            Response::ok(LISTING).with_header(
+                "Link",
+                &format!(r#"<http://{host}/contents?page=2>; rel="next", <http://{host}/contents?page=2>; rel="last""#),
+            )
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let items = get_listing(
+            &fetcher,
+            &format!("{}/contents", server.base_url),
+            cache.path(),
+            Duration::ZERO,
+        )
+        .unwrap();
+
+        let names: Vec<&str> = items.iter().map(|i| i.name.as_str()).collect();
+        assert_eq!(names, ["css-a.json", "css-b.json"]);
+        assert_eq!(server.requests().len(), 2);
+    }
+
+    #[test]
+    fn offline_listing_comes_from_cache_only() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|_| Response::ok(LISTING));
+        let url = format!("{}/contents", server.base_url);
+        let offline = Fetcher::new(true, false).unwrap();
+
+        let err = get_listing(&offline, &url, cache.path(), Duration::ZERO).unwrap_err();
+        assert!(matches!(Error::find(&err), Some(Error::Cache { .. })));
+
+        get_listing(&Fetcher::new(false, false).unwrap(), &url, cache.path(), Duration::ZERO).unwrap();
+        server.requests();
+
+        let items = get_listing(&offline, &url, cache.path(), Duration::ZERO).unwrap();
+        assert_eq!(items[0].name, "css-a.json");
+        assert!(server.requests().is_empty());
+    }
+
+    #[test]
+    fn spec_file_is_only_downloaded_when_the_cache_is_stale() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|_| Response::ok(r#"{"properties": []}"#));
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let cached = br#"{"values": []}"#;
+        fs::create_dir_all(cache.path().join("specs")).unwrap();
+        fs::write(cache.path().join("specs/css-a.json"), cached).unwrap();
+
+        let mut file = DirectoryListItem {
+            download_url: Some(format!("{}/css-a.json", server.base_url)),
+            ..listing_item("css-a.json", &compute_git_blob_sha1(cached))
+        };
+
+        let content = download_file_content(&fetcher, &file, cache.path(), false, &Completed::default()).unwrap();
+        assert_eq!(content, cached);
+        assert!(server.requests().is_empty());
+
+        file.sha = compute_git_blob_sha1(br#"{"properties": []}"#);
+        let content = download_file_content(&fetcher, &file, cache.path(), false, &Completed::default()).unwrap();
+        assert_eq!(content, br#"{"properties": []}"#);
+        assert_eq!(server.requests().len(), 1);
+        assert_eq!(fs::read(cache.path().join("specs/css-a.json")).unwrap(), content);
+    }
+
+    #[test]
+    fn gzip_responses_are_cached_decompressed() {
+        let content = br#"{"properties": [{"name": "margin", "value": "<length>"}]}"#;
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|req| {
+            let mut gz = GzEncoder::new(Vec::new(), Compression::default());
+            gz.write_all(content).unwrap();
+            match req.header("accept-encoding") {
+                Some(encodings) if encodings.contains("gzip") => {
+                    Response::ok(gz.finish().unwrap()).with_header("Content-Encoding", "gzip")
+                }
+                _ => Response::ok(content.to_vec()),
+            }
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let file = DirectoryListItem {
+            download_url: Some(format!("{}/css-a.json", server.base_url)),
+            ..listing_item("css-a.json", &compute_git_blob_sha1(content))
+        };
+        let downloaded = download_file_content(&fetcher, &file, cache.path(), false, &Completed::default()).unwrap();
+        assert_eq!(downloaded, content);
+        assert_eq!(fs::read(cache.path().join("specs/css-a.json")).unwrap(), content);
+        assert!(server.requests()[0]
+            .header("accept-encoding")
+            .is_some_and(|e| e.contains("gzip")));
+    }
+
+    #[test]
+    fn expired_cache_entry_is_downloaded_again() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|_| Response::ok(r#"{"values": []}"#));
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let cached = br#"{"values": []}"#;
+        let path = cache.path().join("specs/css-a.json");
+        fs::create_dir_all(cache.path().join("specs")).unwrap();
+        fs::write(&path, cached).unwrap();
+        let two_hours_ago = std::time::SystemTime::now() - Duration::from_secs(2 * 60 * 60);
+        File::options()
+            .write(true)
+            .open(&path)
+            .unwrap()
+            .set_modified(two_hours_ago)
+            .unwrap();
+
+        let file = DirectoryListItem {
+            download_url: Some(format!("{}/css-a.json", server.base_url)),
+            ..listing_item("css-a.json", &compute_git_blob_sha1(cached))
+        };
+        let files = [&file];
+
+        assert!(expired_cache_entries(&files, cache.path(), None).is_empty());
+        assert!(expired_cache_entries(&files, cache.path(), Some(Duration::from_secs(3 * 60 * 60))).is_empty());
+        let expired = expired_cache_entries(&files, cache.path(), Some(Duration::from_secs(60 * 60)));
+        assert_eq!(expired.into_iter().collect::<Vec<_>>(), ["css-a.json"]);
+
+        // Downloaded even though the cached copy has the listed SHA.
+        let content = download_file_content(&fetcher, &file, cache.path(), true, &Completed::default()).unwrap();
+        assert_eq!(content, cached);
+        assert_eq!(server.requests().len(), 1);
+        assert_eq!(fs::read(&path).unwrap(), content);
+        assert!(expired_cache_entries(&files, cache.path(), Some(Duration::from_secs(60 * 60))).is_empty());
+    }
+
+    #[test]
+    fn failed_download_falls_back_to_the_git_blob() {
+        let cache = tempfile::tempdir().unwrap();
+        let sha = compute_git_blob_sha1(br#"{"values": []}"#);
+        let server = TestServer::start(|req| match req.path.as_str() {
+            // `{"values": []}` wrapped the way GitHub wraps blob content
+            path if path.starts_with("/blobs/") => {
+                Response::ok(r#"{"content": "eyJ2YWx1\nZXMiOiBbXX0=\n", "encoding": "base64"}"#)
+            }
+            _ => Response::status(404),
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let file = DirectoryListItem {
+            download_url: Some(format!("{}/raw/css-a.json", server.base_url)),
+            git_url: Some(format!("{}/blobs/{sha}", server.base_url)),
+            ..listing_item("css-a.json", &sha)
+        };
+
+        let content = download_file_content(&fetcher, &file, cache.path(), false, &Completed::default()).unwrap();
+
+        assert_eq!(content, br#"{"values": []}"#);
+        let paths: Vec<String> = server.requests().into_iter().map(|r| r.path).collect();
+        assert_eq!(paths, ["/raw/css-a.json".to_string(), format!("/blobs/{sha}")]);
+        assert_eq!(fs::read(cache.path().join("specs/css-a.json")).unwrap(), content);
+    }
+
+    #[test]
+    fn invalid_downloads_are_not_cached() {
+        let cache = tempfile::tempdir().unwrap();
+        let server = TestServer::start(|req| match req.path.as_str() {
+            "/error-page.json" => Response::ok("<html><body>Whoa there!</body></html>")
+                .with_header("Content-Type", "text/html; charset=utf-8"),
+            "/truncated.json" => {
+                Response::ok(r#"{"properties": [{"name": "#).with_header("Content-Type", "text/plain; charset=utf-8")
+            }
+            _ => Response::status(404),
+        });
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let stale = br#"{"values": []}"#;
+        fs::create_dir_all(cache.path().join("specs")).unwrap();
+        fs::write(cache.path().join("specs/error-page.json"), stale).unwrap();
+
+        for name in ["error-page.json", "truncated.json"] {
+            let file = DirectoryListItem {
+                download_url: Some(format!("{}/{name}", server.base_url)),
+                ..listing_item(name, "0000000000000000000000000000000000000000")
+            };
+            let err = download_file_content(&fetcher, &file, cache.path(), false, &Completed::default()).unwrap_err();
+            assert!(
+                matches!(Error::find(&err), Some(Error::Download { url, .. }) if url.ends_with(name)),
+                "{name}"
+            );
+        }
+
+        assert_eq!(fs::read(cache.path().join("specs/error-page.json")).unwrap(), stale);
+        assert!(!cache.path().join("specs/truncated.json").exists());
+    }
+
+    #[test]
+    fn parallel_decoding_merges_in_listing_order() {
+        let cache = tempfile::tempdir().unwrap();
+        fs::create_dir_all(cache.path().join("specs")).unwrap();
+
+        let mut files = Vec::new();
+        let mut add = |name: String, content: String| {
+            fs::write(cache.path().join("specs").join(&name), &content).unwrap();
+            files.push(listing_item(&name, &compute_git_blob_sha1(content.as_bytes())));
+        };
+        // Every spec redefines <shared>; each adds its alternative in listing
+        // order.
+        for i in 0..16 {
+            add(
+                format!("css-{i:02}.json"),
+                format!(
+                    r#"{{"spec": {{"title": "Spec {i}", "url": ""}},
+                        "properties": [{{"name": "p{i}", "value": "auto"}}],
+                        "values": [{{"name": "<shared>", "type": "type", "value": "v{i} | auto"}}]}}"#
+                ),
+            );
+        }
+        add("css-broken.json".to_string(), r#"{"properties": ["#.to_string());
+
+        let refs: Vec<&DirectoryListItem> = files.iter().collect();
+        let plan = FetchPlan {
+            fresh: files.iter().map(|f| f.name.clone()).collect(),
+            ..Default::default()
+        };
+        // Offline, so the test fails instead of fetching if the cache is not used.
+        let fetcher = Fetcher::new(true, false).unwrap();
+
+        for workers in [1, 4] {
+            let mut pd = ParseData::default();
+            let mut merged = Vec::new();
+            fetch_and_parse(&fetcher, &refs, &plan, cache.path(), workers, |index, fetched| {
+                merged.push(index);
+                if let Fetched::Decoded(result) = fetched {
+                    if let Some(result) = result.transpose() {
+                        pd.add_parsed(&refs[index].name, result);
+                    }
+                }
+            })
+            .unwrap();
+            let data = pd.into_webref_data();
+
+            assert_eq!(merged, (0..refs.len()).collect::<Vec<_>>());
+            assert_eq!(data.properties.len(), 16);
+            let shared = data.values.iter().find(|v| v.name == "<shared>").unwrap();
+            // Merged in listing order, each spec's grammar adds its alternative.
+            let expected: Vec<String> = (1..16).map(|i| format!("v{i}")).collect();
+            assert_eq!(shared.syntax, format!("v0 | auto | {}", expected.join(" | ")));
+            assert_eq!(data.failed_files, ["css-broken.json"]);
+        }
+    }
+
+    #[test]
+    fn webref_data_is_collected_from_a_mocked_github() {
+        const COMMIT: &str = "0123456789abcdef0123456789abcdef01234567";
+        const INDEX: &str = r#"{"results": [
+            {"css": "css/css-a.json", "release": {"status": "Recommendation"}},
+            {"css": "css/css-b.json", "release": {"status": "Recommendation"}},
+            {"css": "css/css-draft.json", "release": {"status": "Working Draft"}}
+        ]}"#;
+        const CSS_A: &str = r#"{"properties": [{"name": "a", "value": "auto"}]}"#;
+        const CSS_DRAFT: &str = r#"{"properties": [{"name": "draft", "value": "auto"}]}"#;
+        let cache = tempfile::tempdir().unwrap();
+        let css_b = Arc::new(Mutex::new(
+            r#"{"properties": [{"name": "b", "value": "auto"}]}"#.to_string(),
+        ));
+        let served = Arc::clone(&css_b);
+        let server = TestServer::start(move |req| {
+            let host = req.header("host").unwrap_or_default();
+            let item = |name: &str, content: &str| {
+                format!(
+                    r#"{{"name": "{name}", "path": "ed/css/{name}", "sha": "{}", "type": "file",
+                        "download_url": "http://{host}/files/{name}"}}"#,
+                    compute_git_blob_sha1(content.as_bytes())
+                )
+            };
+            let b = served.lock().clone();
+            match req.path.as_str() {
+                "/repos/w3c/webref/contents/ed/css?ref=0123456789abcdef0123456789abcdef01234567" => Response::ok(
+                    format!("[{}, {}]", item("css-a.json", CSS_A), item("css-draft.json", CSS_DRAFT)),
+                )
+                .with_header(
+                    "Link",
+                    &format!(r#"<http://{host}/repos/w3c/webref/contents/ed/css?ref={COMMIT}&page=2>; rel="next""#),
+                ),
+                "/repos/w3c/webref/contents/ed/css?ref=0123456789abcdef0123456789abcdef01234567&page=2" => {
+                    Response::ok(format!("[{}]", item("css-b.json", &b)))
+                }
+                "/repos/w3c/webref/commits/curated" => Response::ok(COMMIT),
+                "/raw/w3c/webref/0123456789abcdef0123456789abcdef01234567/ed/index.json" => Response::ok(INDEX),
+                "/files/css-a.json" => Response::ok(CSS_A),
+                "/files/css-b.json" => Response::ok(b),
+                "/files/css-draft.json" => Response::ok(CSS_DRAFT),
+                _ => Response::status(404),
+            }
+        });
+        let location = WebRefLocation {
+            repo: REPO.to_string(),
+            branch: BRANCH.to_string(),
+            locations: vec![LOCATION.to_string()],
+            checkout: None,
+            api_url: server.base_url.clone(),
+            raw_url: format!("{}/raw", server.base_url),
+        };
+        let fetcher = Fetcher::new(false, false).unwrap();
+        let run = || {
+            let settings = WebRefSettings {
+                maturity: Maturity::Stable,
+                decode_cache: true,
+                threads: Some(2),
+                ..Default::default()
+            };
+            let data = get_webref_data(&fetcher, &location, cache.path(), &settings, &mut Timings::default()).unwrap();
+            let requests: Vec<String> = server.requests().into_iter().map(|r| r.path).collect();
+            let downloads: Vec<String> = requests.iter().filter(|p| p.starts_with("/files/")).cloned().collect();
+            let names: Vec<String> = data.properties.iter().map(|p| p.name.clone()).collect();
+            (data, names, downloads, requests)
+        };
+
+        // The commit first, then both listing pages, the spec index, and both
+        // admitted files, all at that commit; the working draft is never
+        // downloaded.
+        let (data, names, mut downloads, requests) = run();
+        downloads.sort();
+        assert_eq!(names, ["a", "b"]);
+        assert_eq!(downloads, ["/files/css-a.json", "/files/css-b.json"]);
+        assert_eq!(requests.len(), 6);
+        assert_eq!(requests[0], "/repos/w3c/webref/commits/curated");
+        assert_eq!(data.commit.as_deref(), Some(COMMIT));
+        assert!(data.failed_files.is_empty());
+
+        // The listed SHAs match the cache, so nothing is downloaded again.
+        let (_, names, downloads, _) = run();
+        assert_eq!(names, ["a", "b"]);
+        assert!(downloads.is_empty());
+
+        // Only the file whose SHA changed upstream is.
+        *css_b.lock() = r#"{"properties": [{"name": "b2", "value": "auto"}]}"#.to_string();
+        let (_, names, downloads, _) = run();
+        assert_eq!(names, ["a", "b2"]);
+        assert_eq!(downloads, ["/files/css-b.json"]);
+    }
+
+    #[test]
+    fn failed_downloads_are_retried_once_then_skipped() {
+        let cache = tempfile::tempdir().unwrap();
+        let flaky_calls = AtomicUsize::new(0);
+        let server = TestServer::start(move |req| match req.path.as_str() {
+            "/css-down.json" => Response::status(503),
+            // Fails once, then recovers
+            "/css-flaky.json" if flaky_calls.fetch_add(1, Ordering::SeqCst) == 0 => Response::status(502),
+            path => Response::ok(format!(
+                r#"{{"properties": [{{"name": "{}", "value": "auto"}}]}}"#,
+                &path[1..path.len() - ".json".len()]
+            )),
+        });
+        let files: Vec<DirectoryListItem> = ["css-a.json", "css-down.json", "css-flaky.json", "css-z.json"]
+            .iter()
+            .map(|name| DirectoryListItem {
+                download_url: Some(format!("{}/{name}", server.base_url)),
+                ..listing_item(name, "0000000000000000000000000000000000000000")
+            })
+            .collect();
+        let refs: Vec<&DirectoryListItem> = files.iter().collect();
+        let fetcher = Fetcher::new(false, false).unwrap();
+
+        let mut pd = ParseData::default();
+        fetch_and_parse(
+            &fetcher,
+            &refs,
+            &FetchPlan::default(),
+            cache.path(),
+            2,
+            |index, fetched| match fetched {
+                Fetched::Failed => pd.failed_files.push(refs[index].name.clone()),
+                Fetched::Decoded(result) => {
+                    if let Some(result) = result.transpose() {
+                        pd.add_parsed(&refs[index].name, result);
+                    }
+                }
+                Fetched::Reused => {}
+            },
+        )
+        .unwrap();
+        let data = pd.into_webref_data();
+
+        let names: Vec<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
+        assert_eq!(names, ["css-a", "css-flaky", "css-z"]);
+        assert_eq!(data.failed_files, ["css-down.json"]);
+        let down = server.requests().iter().filter(|r| r.path == "/css-down.json").count();
+        assert_eq!(down, 2);
+    }
+
+    #[test]
+    fn a_local_checkout_is_listed_and_read_from_disk() {
+        let checkout = tempfile::tempdir().unwrap();
+        let dir = checkout.path().join("ed/css");
+        fs::create_dir_all(dir.join("archive")).unwrap();
+        fs::write(
+            dir.join("css-b.json"),
+            r#"{"spec": {"title": "B", "url": ""}, "properties": [{"name": "b", "value": "auto"}]}"#,
+        )
+        .unwrap();
+        fs::write(
+            dir.join("css-a.json"),
+            r#"{"spec": {"title": "A", "url": ""}, "properties": [{"name": "a", "value": "auto"}]}"#,
+        )
+        .unwrap();
+        fs::write(dir.join("index.json"), "{}").unwrap();
+
+        let listing = local_listing(checkout.path(), "ed/css").unwrap();
+        let names: Vec<&str> = listing.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(names, ["archive", "css-a.json", "css-b.json", "index.json"]);
+        assert_eq!(listing[0].item_type, "dir");
+
+        let specs = spec_files(&listing, None);
+        let plan = FetchPlan {
+            checkout: Some(checkout.path().to_path_buf()),
+            ..Default::default()
+        };
+        // Offline with an empty cache: anything not read from the checkout fails.
+        let cache = tempfile::tempdir().unwrap();
+        let fetcher = Fetcher::new(true, false).unwrap();
+        let mut pd = ParseData::default();
+        fetch_and_parse(&fetcher, &specs, &plan, cache.path(), 2, |index, fetched| {
+            if let Fetched::Decoded(Ok(Some(data))) = fetched {
+                pd.add_file_data(&specs[index].name, data);
+            }
+        })
+        .unwrap();
+        let data = pd.into_webref_data();
+        let properties: Vec<&str> = data.properties.iter().map(|p| p.name.as_str()).collect();
+        assert_eq!(properties, ["a", "b"]);
+    }
+
+    #[test]
+    fn non_spec_files_in_the_listing_are_skipped() {
+        let item = |name: &str, item_type: &str| DirectoryListItem {
+            download_url: Some(format!("https://example.org/{name}")),
+            item_type: item_type.to_string(),
+            ..listing_item(name, "abc")
+        };
+        let files = [
+            item("css-a.json", "file"),
+            item("css-a-4.json", "file"),
+            item("index.json", "file"),
+            item("README.md", "file"),
+            item("archive", "dir"),
+            item("css-b.json", "file"),
+            item("css-a.json", "file"),
+            // The same file name in a second location
+            DirectoryListItem {
+                path: "ed/svg/css-b.json".to_string(),
+                download_url: Some("https://example.org/svg/css-b.json".to_string()),
+                ..item("css-b.json", "file")
+            },
+        ];
+        let paths: Vec<&str> = spec_files(&files, None).iter().map(|f| f.path.as_str()).collect();
+        assert_eq!(paths, ["ed/css/css-a.json", "ed/css/css-b.json"]);
+
+        let admitted = BTreeSet::from(["css-b.json".to_string()]);
+        let names: Vec<&str> = spec_files(&files, Some(&admitted))
+            .iter()
+            .map(|f| f.name.as_str())
+            .collect();
+        assert_eq!(names, ["css-b.json"]);
+
+        // Files that get past the listing are recognized by their keys.
+        assert!(parse_extract(br#"{"spec": {"title": "A"}, "selectors": []}"#)
+            .unwrap()
+            .is_some());
+        assert!(parse_extract(br#"{"results": [{"shortname": "css-a"}]}"#)
+            .unwrap()
+            .is_none());
+        assert!(parse_extract(br#" [{"name": "css-a.json"}]"#).unwrap().is_none());
+        assert!(parse_extract(br#"{"properties": ["#).is_err());
+    }
+
+    #[test]
+    fn fresh_cache_pass_keeps_only_matching_files() {
+        let cache = tempfile::tempdir().unwrap();
+        fs::create_dir_all(cache.path().join("specs")).unwrap();
+        fs::write(cache.path().join("specs/css-a.json"), b"{}").unwrap();
+        fs::write(cache.path().join("specs/css-b.json"), b"{}").unwrap();
+
+        let files = [
+            listing_item("css-a.json", &compute_git_blob_sha1(b"{}")),
+            listing_item("css-b.json", "outdated"),
+            listing_item("css-c.json", &compute_git_blob_sha1(b"{}")),
+        ];
+        let refs: Vec<&DirectoryListItem> = files.iter().collect();
+
+        let fresh = fresh_cache_entries(&refs, cache.path());
+        assert_eq!(fresh.into_iter().collect::<Vec<_>>(), ["css-a.json"]);
+    }
+
+    #[test]
+    fn streamed_blob_sha_matches_in_memory_and_git() {
+        let dir = tempfile::tempdir().unwrap();
+        // `git hash-object` of each content
+        for (content, expected) in [
+            (&b""[..], "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"),
+            (&b"hello\n"[..], "ce013625030ba8dba906f756967f9e9ca394464a"),
+        ] {
+            let path = dir.path().join("blob");
+            fs::write(&path, content).unwrap();
+            assert_eq!(compute_git_blob_sha1(content), expected);
+            assert_eq!(compute_git_blob_sha1_file(&path).unwrap(), expected);
+        }
+
+        // Larger than the read buffer
+        let large = vec![b'x'; 200 * 1024];
+        let path = dir.path().join("large");
+        fs::write(&path, &large).unwrap();
+        assert_eq!(
+            compute_git_blob_sha1_file(&path).unwrap(),
+            compute_git_blob_sha1(&large)
+        );
+    }
+
+    /// The cache is only trusted when these match GitHub's blob SHAs; a
+    /// mismatch would silently re-download every spec file on every run.
+    #[test]
+    fn blob_shas_match_git_for_edge_case_files() {
+        let dir = Path::new(concat!(env!("CARGO_MANIFEST_DIR"), "/testdata/blobs"));
+        // `git hash-object --no-filters` of each fixture
+        for (file, expected) in [
+            ("empty", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"),
+            ("nul.bin", "174a58cf3c3b2f9cdb083766d81789471bd8a1a5"),
+            ("binary.bin", "c86626638e0bc8cf47ca49bb1525b40e9737ee64"),
+            ("crlf.txt", "4ca505732f52895d071866b8887c57fc58a10e66"),
+            ("no-newline.json", "23626b8b70fb6a1606d3f2242983c8e813400dc8"),
+            ("utf8.json", "1ad76fdde31f5e87778cad9aba762a005a3861b1"),
+        ] {
+            let path = dir.join(file);
+            let content = fs::read(&path).unwrap();
+            assert_eq!(compute_git_blob_sha1(&content), expected, "{file}");
+            assert_eq!(compute_git_blob_sha1_file(&path).unwrap(), expected, "{file}");
+        }
+    }
+
+    #[test]
+    fn next_link_parsing() {
+        assert_eq!(
+            next_link(r#"<https://api/x?page=2>; rel="next", <https://api/x?page=5>; rel="last""#).as_deref(),
+            Some("https://api/x?page=2")
+        );
+        assert_eq!(next_link(r#"<https://api/x?page=1>; rel="prev""#), None);
+    }
+
+    #[test]
+    fn duplicate_at_rule_descriptors_are_merged_by_name() {
+        let mut pd = ParseData::default();
+        pd.add_file(
+            "css-fonts.json",
+            br#"{"atrules": [{"name": "@font-face", "descriptors": [
+                {"name": "src", "value": "<url> [ format( <string># ) ]?"},
+                {"name": "font-display", "value": "", "initial": "auto"}
+            ]}]}"#,
+        );
+        pd.add_file(
+            "css-fonts-extra.json",
+            br#"{"atrules": [{"name": "@font-face", "descriptors": [
+                {"name": "src", "value": "<font-src-list>"},
+                {"name": "font-display", "value": "auto | block | swap"},
+                {"name": "size-adjust", "value": "<percentage>", "initial": "100%"}
+            ]}]}"#,
+        );
+
+        let data = pd.into_webref_data();
+        let descriptors = &data.at_rules[0].descriptors;
+        let names: Vec<&str> = descriptors.iter().map(|d| d.name.as_str()).collect();
+        assert_eq!(names, ["src", "font-display", "size-adjust"]);
+        assert_eq!(
+            descriptors[0].syntax,
+            "<url> [ format( <string># ) ]? | <font-src-list>"
+        );
+        assert_eq!(descriptors[1].syntax, "auto | block | swap");
+        assert_eq!(descriptors[1].initial, "auto");
+
+        let sources = |d: &WebRefAtRuleDescriptor| d.sources.iter().map(|s| s.shortname.clone()).collect::<Vec<_>>();
+        assert_eq!(sources(&descriptors[0]), ["css-fonts", "css-fonts-extra"]);
+        assert_eq!(sources(&descriptors[2]), ["css-fonts-extra"]);
+    }
+
+    #[test]
+    fn at_rule_values_without_a_usable_value_are_dropped() {
+        let mut pd = ParseData::default();
+        pd.add_file(
+            "css-fonts.json",
+            br#"{"atrules": [{"name": "@font-feature-values", "values": [
+                {"name": "@stylistic", "value": "@stylistic { <declaration-list> }"},
+                {"name": "<feature-value-block>"},
+                {"name": "@swash", "value": " "},
+                {"name": "<font-display>", "value": "!important"},
+                {"name": "@annotation", "values": [{"name": "<feature-value-name>", "value": "<integer>+"}]},
+                {"name": "normal"}
+            ]}]}"#,
+        );
+
+        let data = pd.into_webref_data();
+        let names: Vec<&str> = data.at_rules[0]
+            .values
+            .iter()
+            .flatten()
+            .map(|v| v.name.as_str())
+            .collect();
+        assert_eq!(names, ["@stylistic", "@annotation", "normal"]);
+    }
+
+    #[test]
+    fn selectors_carry_kind_and_arguments() {
+        let mut pd = ParseData::default();
+        pd.add_file(
+            "selectors.json",
+            br#"{"selectors": [
+                {"name": ":hover"},
+                {"name": ":nth-child()", "value": "<an+b> [ of <complex-real-selector-list> ]?"},
+                {"name": "::before"},
+                {"name": ">"},
+                {"name": "[att]"}
+            ]}"#,
+        );
+
+        let data = pd.into_webref_data();
+        let selectors: Vec<(&str, Option<SelectorKind>, &str)> = data
+            .selectors
+            .iter()
+            .map(|s| (s.name.as_str(), s.kind, s.arguments.as_str()))
+            .collect();
+        assert_eq!(
+            selectors,
+            [
+                ("::before", Some(SelectorKind::PseudoElement), ""),
+                (":hover", Some(SelectorKind::PseudoClass), ""),
+                (
+                    ":nth-child()",
+                    Some(SelectorKind::Functional),
+                    "<an+b> [ of <complex-real-selector-list> ]?"
+                ),
+                (">", Some(SelectorKind::Combinator), ""),
+                ("[att]", None, ""),
+            ]
+        );
+    }
+
+    #[test]
+    fn selectors_from_several_specs_are_deduplicated() {
+        let mut pd = ParseData::default();
+        pd.add_file(
+            "selectors-4.json",
+            br#"{"spec": {"title": "Selectors 4", "url": ""}, "selectors": [
+                {"name": ":hover"},
+                {"name": ":nth-child()", "value": "<an+b> [ of <complex-real-selector-list> ]?"}
+            ]}"#,
+        );
+        pd.add_file(
+            "selectors-5.json",
+            br#"{"spec": {"title": "Selectors 5", "url": ""}, "selectors": [
+                {"name": ":hover"},
+                {"name": ":nth-child()", "value": "<an+b>"}
+            ]}"#,
+        );
+
+        let data = pd.into_webref_data();
+        let selectors: Vec<(&str, &str)> = data
+            .selectors
+            .iter()
+            .map(|s| (s.name.as_str(), s.arguments.as_str()))
+            .collect();
+        assert_eq!(
+            selectors,
+            [
+                (":hover", ""),
+                (":nth-child()", "<an+b> [ of <complex-real-selector-list> ]?"),
+            ]
+        );
+    }
+
+    #[test]
+    fn conflicting_legacy_aliases_are_reported() {
+        let text = br#"{"properties": [{"name": "word-wrap", "value": "", "legacyAliasOf": "overflow-wrap"}]}"#;
+        let other = br#"{"properties": [{"name": "word-wrap", "value": "", "legacyAliasOf": "word-break"},
+            {"name": "-webkit-box-flex", "value": "", "legacyAliasOf": "flex-grow"}]}"#;
+        let same = br#"{"properties": [{"name": "word-wrap", "value": "", "legacyAliasOf": "overflow-wrap"}]}"#;
+        let data = decode_files(&[
+            ("css-text.json".to_string(), text.to_vec()),
+            ("css-legacy.json".to_string(), other.to_vec()),
+            ("css-text-4.json".to_string(), same.to_vec()),
+        ]);
+
+        assert_eq!(
+            data.alias_conflicts,
+            ["word-wrap is a legacy alias of overflow-wrap, but css-legacy makes it one of word-break"]
+        );
+        let word_wrap = data.properties.iter().find(|p| p.name == "word-wrap").unwrap();
+        assert_eq!(word_wrap.legacy_alias_of, "overflow-wrap");
+    }
+
+    #[test]
+    fn conflicting_syntaxes_are_merged_by_the_chosen_strategy() {
+        let first = br#"{
+            "properties": [{"name": "float", "value": "left | right | none"}],
+            "values": [{"name": "<corner>", "type": "type", "value": "<length>"}],
+            "atrules": [{"name": "@page", "value": "@page { <declaration-list> }",
+                "descriptors": [{"name": "size", "value": "<length>{1,2} | auto"}]}]
+        }"#;
+        let second = br#"{
+            "properties": [{"name": "float", "value": "left | right | none | inline-start"}],
+            "values": [{"name": "<corner>", "type": "type", "value": "<length-percentage>"}],
+            "atrules": [{"name": "@page", "value": "@page <page-selector-list>? { <declaration-list> }",
+                "descriptors": [{"name": "size", "value": "<length>{1,2} | auto | <page-size>"}]}]
+        }"#;
+        let decode = |conflict_strategy| {
+            let mut pd = ParseData {
+                conflict_strategy,
+                ..Default::default()
+            };
+            pd.add_file("css-page-3.json", first);
+            pd.add_file("css-page-4.json", second);
+            // The same grammar again is no new conflict.
+            pd.add_file("css-page-5.json", second);
+            pd.into_webref_data()
+        };
+        let syntaxes = |data: &WebRefData| {
+            [
+                data.properties[0].syntax.clone(),
+                data.values[0].syntax.clone(),
+                data.at_rules[0].syntax.clone(),
+                data.at_rules[0].descriptors[0].syntax.clone(),
+            ]
+        };
+
+        let union = decode(ConflictStrategy::Union);
+        assert_eq!(
+            syntaxes(&union),
+            [
+                "left | right | none | inline-start",
+                "<length> | <length-percentage>",
+                "@page { <declaration-list> } | @page <page-selector-list>? { <declaration-list> }",
+                "<length>{1,2} | auto | <page-size>",
+            ]
+        );
+        assert!(union.syntax_conflicts.is_empty());
+
+        let first_wins = decode(ConflictStrategy::FirstWins);
+        assert_eq!(
+            syntaxes(&first_wins),
+            [
+                "left | right | none",
+                "<length>",
+                "@page { <declaration-list> }",
+                "<length>{1,2} | auto",
+            ]
+        );
+
+        let last_wins = decode(ConflictStrategy::LastWins);
+        assert_eq!(
+            syntaxes(&last_wins),
+            [
+                "left | right | none | inline-start",
+                "<length-percentage>",
+                "@page <page-selector-list>? { <declaration-list> }",
+                "<length>{1,2} | auto | <page-size>",
+            ]
+        );
+
+        let error = decode(ConflictStrategy::Error);
+        assert_eq!(syntaxes(&error), syntaxes(&first_wins));
+        assert_eq!(
+            error.syntax_conflicts,
+            [
+                "property float: css-page-4 gives `left | right | none | inline-start`, but it already is `left | right | none`",
+                "value <corner>: css-page-4 gives `<length-percentage>`, but it already is `<length>`",
+                "at-rule @page: css-page-4 gives `@page <page-selector-list>? { <declaration-list> }`, but it already is `@page { <declaration-list> }`",
+                "descriptor size of @page: css-page-4 gives `<length>{1,2} | auto | <page-size>`, but it already is `<length>{1,2} | auto`",
+                "property float: css-page-5 gives `left | right | none | inline-start`, but it already is `left | right | none`",
+                "value <corner>: css-page-5 gives `<length-percentage>`, but it already is `<length>`",
+                "at-rule @page: css-page-5 gives `@page <page-selector-list>? { <declaration-list> }`, but it already is `@page { <declaration-list> }`",
+                "descriptor size of @page: css-page-5 gives `<length>{1,2} | auto | <page-size>`, but it already is `<length>{1,2} | auto`",
+            ]
+        );
+    }
+
+    #[test]
+    fn dirty_names_are_canonicalized() {
+        let first = br#"{
+            "properties": [
+                {"name": " Color", "value": "<color>"},
+                {"name": "WORD-WRAP", "value": "", "legacyAliasOf": "Overflow-Wrap "},
+                {"name": "overflow-wrap", "value": "normal | break-word",
+                    "values": [{"name": "Break-Word", "type": "value", "value": "break-word"}]}
+            ],
+            "values": [
+                {"name": "<length-percentage> ", "type": "type", "value": "<length> | <percentage>"},
+                {"name": "translateX()", "type": "function", "value": "translateX( <length-percentage> )"}
+            ]
+        }"#;
+        let second = br#"{"properties": [{"name": "color", "value": ""}]}"#;
+        let data = decode_files(&[
+            ("css-color.json".to_string(), first.to_vec()),
+            ("css-color-5.json".to_string(), second.to_vec()),
+        ]);
+
+        let mut properties: Vec<(&str, usize)> = data
+            .properties
+            .iter()
+            .map(|p| (p.name.as_str(), p.sources.len()))
+            .collect();
+        properties.sort();
+        assert_eq!(properties, [("color", 2), ("overflow-wrap", 1), ("word-wrap", 1)]);
+        assert!(data.values.iter().any(|v| v.name == "<length-percentage>"));
+        assert!(data.values.iter().any(|v| v.name == "translateX()"));
+
+        let aliases = PropertyAliasTable::from_webref(&data.properties);
+        assert_eq!(aliases.get_alias("word-wrap"), Some("overflow-wrap"));
+        assert_eq!(aliases.get_alias(" Word-Wrap"), Some("overflow-wrap"));
+        assert_eq!(canonical_name("color"), Cow::Borrowed("color"));
+    }
+
+    #[test]
+    fn nested_values_are_recorded_as_children() {
+        let content = br#"{
+            "spec": {"title": "CSS Shapes", "url": "https://drafts.csswg.org/css-shapes-1/"},
+            "values": [{"name": "inset()", "type": "function",
+                "value": "inset( <length-percentage>{1,4} [ round <'border-radius'> ]? )",
+                "values": [
+                    {"name": "<shape-arg>", "type": "type", "value": "<length-percentage>",
+                        "values": [{"name": "<shape-unit>", "type": "type", "value": "px | em"}]},
+                    {"name": "round", "type": "value", "value": "round"}
+                ]}]
+        }"#;
+
+        let mut pd = ParseData::default();
+        pd.add_file("css-shapes.json", content);
+
+        assert_eq!(pd.values["inset()"].children, ["<shape-arg>", "round"]);
+        assert_eq!(pd.values["<shape-arg>"].children, ["<shape-unit>"]);
+        assert!(pd.values["<shape-unit>"].children.is_empty());
+        // A plain keyword is listed as a child but gets no entry of its own.
+        assert!(!pd.values.contains_key("round"));
+    }
+
+    #[test]
+    fn cached_extract_merges_like_the_spec_file() {
+        let content = br#"{
+            "spec": {"title": "CSS Box Model", "url": "https://drafts.csswg.org/css-box-4/"},
+            "properties": [{"name": "margin-top", "value": "<length-percentage> | auto",
+                "values": [{"name": "auto", "type": "value", "value": "auto"}]}],
+            "values": [{"name": "<margin-width>", "type": "type", "value": "<length-percentage> | auto"}],
+            "atrules": [{"name": "@page", "descriptors": [{"name": "size", "value": "<length>{1,2}"}],
+                "values": [{"name": ":first", "value": ":first"}]}],
+            "selectors": [{"name": ":nth-child()", "value": "<an+b>"}]
+        }"#;
+
+        let mut direct = ParseData::default();
+        let data = direct.add_file("css-box.json", content).unwrap();
+
+        let cache = DecodedCache {
+            version: DECODED_CACHE_VERSION,
+            files: BTreeMap::from([("abc".to_string(), data)]),
+        };
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("decoded.json");
+        fs::write(&path, serde_json::to_vec(&cache).unwrap()).unwrap();
+
+        let mut loaded = DecodedCache::load(&path).unwrap();
+        let mut incremental = ParseData::default();
+        incremental.add_file_data("css-box.json", loaded.files.remove("abc").unwrap());
+
+        assert_eq!(
+            format!("{:?}", incremental.into_webref_data()),
+            format!("{:?}", direct.into_webref_data())
+        );
+    }
+
+    #[test]
+    fn decoded_extracts_are_reused_by_sha() {
+        let previous = DecodedCache {
+            version: DECODED_CACHE_VERSION,
+            files: BTreeMap::from([("abc".to_string(), WebRefFileData::default())]),
+        };
+        // A renamed file keeps its SHA; a changed one does not.
+        let files = [
+            listing_item("css-renamed.json", "abc"),
+            listing_item("css-changed.json", "def"),
+        ];
+        let specs: Vec<&DirectoryListItem> = files.iter().collect();
+
+        let cache = tempfile::tempdir().unwrap();
+        let plan = cache_plan(&specs, &previous, None, cache.path());
+        assert_eq!(plan.reused, BTreeSet::from(["css-renamed.json".to_string()]));
+    }
+
+    #[test]
+    fn completed_files_are_trusted_until_their_sha_changes() {
+        let cache = tempfile::tempdir().unwrap();
+        let specs_dir = cache.path().join("specs");
+        fs::create_dir_all(&specs_dir).unwrap();
+        let mut files = [
+            listing_item("css-a.json", &compute_git_blob_sha1(b"{}")),
+            listing_item("css-b.json", &compute_git_blob_sha1(br#"{"values": []}"#)),
+            listing_item("css-c.json", &compute_git_blob_sha1(br#"{"selectors": []}"#)),
+        ];
+        // css-a was completed and is not hashed again (its cache file does
+        // not even match); css-b's record names an older blob, so it is
+        // hashed; css-c was never downloaded.
+        fs::write(specs_dir.join("css-a.json"), "not hashed").unwrap();
+        fs::write(specs_dir.join("css-b.json"), br#"{"values": []}"#).unwrap();
+        fs::write(
+            cache.path().join(COMPLETED_FILE),
+            format!(r#"{{"css-a.json": "{}", "css-b.json": "0000"}}"#, files[0].sha),
+        )
+        .unwrap();
+        let specs: Vec<&DirectoryListItem> = files.iter().collect();
+
+        let plan = cache_plan(&specs, &DecodedCache::default(), None, cache.path());
+        assert_eq!(
+            plan.fresh,
+            BTreeSet::from(["css-a.json".to_string(), "css-b.json".to_string()])
+        );
+
+        let server = TestServer::start(|_| Response::ok(r#"{"selectors": []}"#));
+        let completed = plan.completed;
+        files[2].download_url = Some(format!("{}/css-c.json", server.base_url));
+        let fetcher = Fetcher::new(false, false).unwrap();
+        download_file_content(&fetcher, &files[2], cache.path(), false, &completed).unwrap();
+
+        let saved = Completed::load(cache.path());
+        let names: Vec<&str> = saved.keys().map(String::as_str).collect();
+        assert_eq!(names, ["css-a.json", "css-b.json", "css-c.json"]);
+        assert_eq!(saved["css-b.json"], files[1].sha);
+        assert!(!specs_dir.join("css-c.json.part").exists());
+    }
+
+    #[test]
+    fn limited_runs_take_the_first_files_by_name_and_save_no_record() {
+        let files = [
+            listing_item("css-c.json", "ccc"),
+            listing_item("css-a.json", "aaa"),
+            listing_item("css-b.json", "bbb"),
+        ];
+        let specs: Vec<&DirectoryListItem> = files.iter().collect();
+
+        // The first two by name, in listing order.
+        let limited = limit_specs(specs, 2);
+        let names: Vec<&str> = limited.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(names, ["css-a.json", "css-b.json"]);
+
+        let cache = tempfile::tempdir().unwrap();
+        fs::write(cache.path().join(COMPLETED_FILE), r#"{"css-c.json": "0000"}"#).unwrap();
+        let completed = Completed {
+            read_only: true,
+            ..Default::default()
+        };
+        let fetcher = Fetcher::new(false, false).unwrap();
+        completed.record(&fetcher, cache.path(), &files[1]);
+        completed.save(&fetcher, cache.path());
+        assert_eq!(
+            Completed::load(cache.path()),
+            BTreeMap::from([("css-c.json".to_string(), "0000".to_string())])
+        );
+    }
+
+    #[test]
+    fn decoded_cache_of_another_version_is_ignored() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("decoded.json");
+        fs::write(&path, br#"{"version": 0, "files": {}}"#).unwrap();
+        assert!(DecodedCache::load(&path).is_none());
+    }
+
+    #[test]
+    fn corrupt_spec_file_is_skipped_and_recorded() {
+        let mut pd = ParseData::default();
+        pd.add_file(
+            "css-a.json",
+            br#"{"spec": {"title": "A", "url": "https://a"}, "properties": [{"name": "a-prop", "value": "auto"}]}"#,
+        );
+        pd.add_file("css-broken.json", br#"{"properties": [{"name": "#);
+        pd.add_file(
+            "css-b.json",
+            br#"{"values": [{"name": "<b-type>", "type": "type", "value": "none | <length>"}]}"#,
+        );
+
+        let data = pd.into_webref_data();
+        assert_eq!(data.failed_files, ["css-broken.json"]);
+        assert_eq!(data.properties.len(), 1);
+        assert_eq!(data.properties[0].name, "a-prop");
+        assert_eq!(data.properties[0].sources[0].url, "https://a");
+        assert_eq!(data.values.len(), 1);
+        assert_eq!(data.values[0].name, "<b-type>");
+    }
+}